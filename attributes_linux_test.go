@@ -0,0 +1,708 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func statx(t *testing.T, k *fakekernel.Kernel) fusekernel.Statx {
+	m, err := k.Do(fusekernel.OpStatx, 1, fakekernel.Bytes(&fusekernel.StatxIn{
+		SxMask: fusekernel.StatxBasicStats | fusekernel.StatxBtime,
+	}))
+	if err != nil {
+		t.Fatalf("Do(OpStatx): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("Statx: errno %v", errno)
+	}
+
+	var out fusekernel.StatxOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	return out.Stat
+}
+
+////////////////////////////////////////////////////////////////////////
+// setattrFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that remembers the last SetInodeAttributesOp.
+type setattrFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu   sync.Mutex
+	last fuseops.SetInodeAttributesOp // GUARDED_BY(mu)
+}
+
+func (fs *setattrFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.last = *op
+	op.Attributes = fuseops.InodeAttributes{Mode: 0644}
+	return nil
+}
+
+func (fs *setattrFS) lastOp() fuseops.SetInodeAttributesOp {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.last
+}
+
+func setattr(t *testing.T, k *fakekernel.Kernel, in *fusekernel.SetattrIn) {
+	t.Helper()
+
+	m, err := k.Do(fusekernel.OpSetattr, 2, fakekernel.Bytes(in))
+	if err != nil {
+		t.Fatalf("Do(OpSetattr): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("SetInodeAttributes: errno %v", errno)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// accessFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that lets only root write, and everyone else read and search.
+type accessFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *accessFS) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	if op.Mask&2 != 0 && op.OpContext.Uid != 0 {
+		return fuse.EACCES
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// immutableFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose files and directories open without asking the kernel
+// to cache anything, and in which nothing can be found.
+type immutableFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *immutableFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fuse.ENOENT
+}
+
+func (fs *immutableFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *immutableFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestOverrideOwnership(t *testing.T) {
+	uid, gid := uint32(1000), uint32(1001)
+	fs, k := mountAttrFS(t, &fuse.MountConfig{
+		OverrideUID:       &uid,
+		OverrideGID:       &gid,
+		OverrideCallerIDs: true,
+	})
+	defer k.Close()
+
+	out := getattr(t, k)
+	if out.Attr.Uid != uid || out.Attr.Gid != gid {
+		t.Errorf("Got owner %d:%d, want %d:%d", out.Attr.Uid, out.Attr.Gid, uid, gid)
+	}
+
+	opCtx := fs.lastOpContext()
+	if opCtx.Uid != uid || opCtx.Gid != gid {
+		t.Errorf("Got caller %d:%d, want %d:%d", opCtx.Uid, opCtx.Gid, uid, gid)
+	}
+}
+
+func TestCallerCredentials(t *testing.T) {
+	fs, k := mountAttrFS(t, nil)
+	defer k.Close()
+
+	getattr(t, k)
+
+	opCtx := fs.lastOpContext()
+	if opCtx.Uid != uint32(os.Getuid()) ||
+		opCtx.Gid != uint32(os.Getgid()) ||
+		opCtx.Pid != uint32(os.Getpid()) {
+		t.Errorf("Unexpected caller credentials: %+v", opCtx)
+	}
+}
+
+func TestNoOverrideOwnership(t *testing.T) {
+	fs, k := mountAttrFS(t, nil)
+	defer k.Close()
+
+	out := getattr(t, k)
+	if out.Attr.Uid != fs.attrs.Uid || out.Attr.Gid != fs.attrs.Gid {
+		t.Errorf(
+			"Got owner %d:%d, want %d:%d",
+			out.Attr.Uid, out.Attr.Gid,
+			fs.attrs.Uid, fs.attrs.Gid)
+	}
+}
+
+func TestTimestampResolution(t *testing.T) {
+	mtime := time.Date(2015, 3, 2, 17, 4, 5, 123456789, time.UTC)
+
+	testCases := []struct {
+		res      time.Duration
+		wantNsec uint32
+		wantGran uint32
+	}{
+		{0, 123456789, 1},
+		{time.Microsecond, 123456000, 1000},
+		{10 * time.Millisecond, 120000000, 10000000},
+		{time.Second, 0, 1000000000},
+		{2 * time.Second, 0, 1000000000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.res.String(), func(t *testing.T) {
+			fs := &attrFS{
+				attrs: fuseops.InodeAttributes{
+					Nlink: 1,
+					Mode:  0644,
+					Atime: mtime,
+					Mtime: mtime,
+					Ctime: mtime,
+				},
+			}
+
+			k := mountFS(t, fs, &fuse.MountConfig{TimestampResolution: tc.res})
+			defer k.Close()
+
+			if k.Init.TimeGran != tc.wantGran {
+				t.Errorf("Got time granularity %d, want %d", k.Init.TimeGran, tc.wantGran)
+			}
+
+			wantSec := uint64(mtime.Unix())
+			if tc.res == 2*time.Second {
+				// An odd number of seconds rounds down to an even one.
+				wantSec--
+			}
+
+			a := getattr(t, k).Attr
+			for _, ts := range []struct {
+				name string
+				sec  uint64
+				nsec uint32
+			}{
+				{"atime", a.Atime, a.AtimeNsec},
+				{"mtime", a.Mtime, a.MtimeNsec},
+				{"ctime", a.Ctime, a.CtimeNsec},
+			} {
+				if ts.sec != wantSec || ts.nsec != tc.wantNsec {
+					t.Errorf(
+						"Got %s %d.%09d, want %d.%09d",
+						ts.name, ts.sec, ts.nsec, wantSec, tc.wantNsec)
+				}
+			}
+		})
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	testCases := []struct {
+		size   uint64
+		blocks uint64
+		want   uint64
+	}{
+		{0, 0, 0},
+		{1, 0, 1},
+		{10000, 0, 20},
+		{10000, 3, 3},
+		{0, 8, 8},
+	}
+
+	for _, tc := range testCases {
+		fs := &attrFS{
+			attrs: fuseops.InodeAttributes{
+				Size:   tc.size,
+				Blocks: tc.blocks,
+				Nlink:  1,
+				Mode:   0644,
+			},
+		}
+
+		k := mountFS(t, fs, nil)
+
+		if got := getattr(t, k).Attr.Blocks; got != tc.want {
+			t.Errorf("Size %d, Blocks %d: got %d blocks, want %d", tc.size, tc.blocks, got, tc.want)
+		}
+
+		k.Close()
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	for _, blockSize := range []uint32{0, 4096, 1 << 20} {
+		fs := &attrFS{
+			attrs: fuseops.InodeAttributes{
+				BlockSize: blockSize,
+				Nlink:     1,
+				Mode:      0644,
+			},
+		}
+
+		k := mountFS(t, fs, nil)
+
+		if got := getattr(t, k).Attr.Blksize; got != blockSize {
+			t.Errorf("BlockSize %d: got blksize %d", blockSize, got)
+		}
+
+		if got := statx(t, k).Blksize; got != blockSize {
+			t.Errorf("BlockSize %d: got statx blksize %d", blockSize, got)
+		}
+
+		k.Close()
+	}
+}
+
+func TestStatx(t *testing.T) {
+	crtime := time.Date(2012, 8, 15, 22, 56, 12, 17, time.UTC)
+	mtime := crtime.Add(time.Hour)
+	fs := &attrFS{
+		attrs: fuseops.InodeAttributes{
+			Size:   1234,
+			Nlink:  2,
+			Mode:   0640 | os.ModeDevice,
+			Rdev:   0x12345,
+			Mtime:  mtime,
+			Crtime: crtime,
+			Uid:    17,
+			Gid:    19,
+		},
+	}
+
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	st := statx(t, k)
+
+	if st.Mask != fusekernel.StatxBasicStats|fusekernel.StatxBtime {
+		t.Errorf("Got mask 0x%x", st.Mask)
+	}
+
+	if st.Ino != 1 || st.Size != 1234 || st.Blocks != 3 || st.Nlink != 2 {
+		t.Errorf("Unexpected stat: %+v", st)
+	}
+
+	if st.Mode != syscall.S_IFBLK|0640 {
+		t.Errorf("Got mode 0%o", st.Mode)
+	}
+
+	if st.Uid != 17 || st.Gid != 19 {
+		t.Errorf("Got owner %d:%d", st.Uid, st.Gid)
+	}
+
+	if st.RdevMajor != 0x123 || st.RdevMinor != 0x45 {
+		t.Errorf("Got device %x:%x", st.RdevMajor, st.RdevMinor)
+	}
+
+	if st.Mtime.Sec != mtime.Unix() || st.Mtime.Nsec != 17 {
+		t.Errorf("Got mtime %+v", st.Mtime)
+	}
+
+	if st.Btime.Sec != crtime.Unix() || st.Btime.Nsec != 17 {
+		t.Errorf("Got btime %+v", st.Btime)
+	}
+
+	// Unset times.
+	if st.Atime.Sec != 0 || st.Atime.Nsec != 0 {
+		t.Errorf("Got atime %+v, want zero", st.Atime)
+	}
+}
+
+func TestStatxWithoutCrtime(t *testing.T) {
+	_, k := mountAttrFS(t, nil)
+	defer k.Close()
+
+	st := statx(t, k)
+	if st.Mask != fusekernel.StatxBasicStats {
+		t.Errorf("Got mask 0x%x, want 0x%x", st.Mask, fusekernel.StatxBasicStats)
+	}
+
+	if st.Btime.Sec != 0 || st.Btime.Nsec != 0 {
+		t.Errorf("Got btime %+v, want zero", st.Btime)
+	}
+}
+
+func TestDefaultCacheTimeouts(t *testing.T) {
+	cfg := &fuse.MountConfig{
+		DefaultEntryTimeout: time.Hour,
+		DefaultAttrTimeout:  time.Minute,
+	}
+
+	// Results that leave the expiration unset get the default.
+	fs, k := mountAttrFS(t, cfg)
+	defer k.Close()
+
+	if out := getattr(t, k); out.AttrValid != 60 || out.AttrValidNsec != 0 {
+		t.Errorf("Unset: got %v s + %v ns, want 60 s", out.AttrValid, out.AttrValidNsec)
+	}
+
+	// An expiration that has already passed turns caching off.
+	fs.setExpiration(time.Now())
+	if out := getattr(t, k); out.AttrValid != 0 || out.AttrValidNsec != 0 {
+		t.Errorf("Expired: got %v s + %v ns, want 0", out.AttrValid, out.AttrValidNsec)
+	}
+
+	// Entries work the same way, and without defaults nothing is cached.
+	for _, tc := range []struct {
+		cfg                 *fuse.MountConfig
+		wantEntry, wantAttr uint64
+	}{
+		{cfg, 3600, 60},
+		{&fuse.MountConfig{}, 0, 0},
+	} {
+		k := mountFS(t, &mknodFS{}, tc.cfg)
+
+		in := fusekernel.MknodIn{Mode: syscall.S_IFREG | 0644}
+		m, err := k.Do(fusekernel.OpMknod, 1, fakekernel.Bytes(&in), fakekernel.String("foo"))
+		if err != nil {
+			t.Fatalf("Do(OpMknod): %v", err)
+		}
+
+		var out fusekernel.EntryOut
+		if err := fakekernel.Decode(m.Data, &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		if out.EntryValid != tc.wantEntry || out.AttrValid != tc.wantAttr {
+			t.Errorf(
+				"Got entry %v s and attributes %v s, want %v s and %v s",
+				out.EntryValid,
+				out.AttrValid,
+				tc.wantEntry,
+				tc.wantAttr)
+		}
+
+		k.Close()
+	}
+}
+
+func TestNegativeDefaultCacheTimeout(t *testing.T) {
+	_, err := fakekernel.Mount(
+		fuseutil.NewFileSystemServer(&attrFS{}),
+		&fuse.MountConfig{DefaultAttrTimeout: -time.Second})
+	if err == nil {
+		t.Errorf("Mount succeeded with a negative timeout")
+	}
+}
+
+func TestImmutableData(t *testing.T) {
+	const year = 365 * 24 * 60 * 60
+	cfg := &fuse.MountConfig{
+		ImmutableData:       true,
+		DefaultEntryTimeout: time.Hour,
+	}
+
+	k := mountFS(t, &immutableFS{}, cfg)
+	defer k.Close()
+
+	if fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitCacheSymlinks == 0 {
+		t.Errorf("Symlink caching wasn't negotiated")
+	}
+
+	// Nonexistent names are cached for a year.
+	m, err := k.Do(fusekernel.OpLookup, 1, fakekernel.String("missing"))
+	if err != nil {
+		t.Fatalf("Do(OpLookup): %v", err)
+	}
+
+	var entry fusekernel.EntryOut
+	if err := fakekernel.Decode(m.Data, &entry); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if entry.Nodeid != 0 || entry.EntryValid < year-1 {
+		t.Errorf("Got inode %d for %d s, want a negative entry for a year", entry.Nodeid, entry.EntryValid)
+	}
+
+	// Files and directories keep their caches.
+	for _, opcode := range []uint32{fusekernel.OpOpen, fusekernel.OpOpendir} {
+		m, err := k.Do(opcode, 1, fakekernel.Bytes(&fusekernel.OpenIn{}))
+		if err != nil {
+			t.Fatalf("Do(%d): %v", opcode, err)
+		}
+
+		var out fusekernel.OpenOut
+		if err := fakekernel.Decode(m.Data, &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		want := fusekernel.OpenKeepCache
+		if opcode == fusekernel.OpOpendir {
+			want |= fusekernel.OpenCacheDir
+		}
+
+		if got := fusekernel.OpenResponseFlags(out.OpenFlags); got != want {
+			t.Errorf("Opcode %d: got flags %v, want %v", opcode, got, want)
+		}
+	}
+
+	// Attributes are cached for a year, while the timeout that was set
+	// explicitly is left alone.
+	_, k2 := mountAttrFS(t, cfg)
+	defer k2.Close()
+
+	if out := getattr(t, k2); out.AttrValid != year {
+		t.Errorf("Got attributes for %d s, want a year", out.AttrValid)
+	}
+
+	k3 := mountFS(t, &mknodFS{}, cfg)
+	defer k3.Close()
+
+	in := fusekernel.MknodIn{Mode: syscall.S_IFREG | 0644}
+	m, err = k3.Do(fusekernel.OpMknod, 1, fakekernel.Bytes(&in), fakekernel.String("foo"))
+	if err != nil {
+		t.Fatalf("Do(OpMknod): %v", err)
+	}
+
+	if err := fakekernel.Decode(m.Data, &entry); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if entry.EntryValid != 3600 || entry.AttrValid != year {
+		t.Errorf("Got entry for %d s and attributes for %d s", entry.EntryValid, entry.AttrValid)
+	}
+}
+
+func TestSetattrHandle(t *testing.T) {
+	fs := &setattrFS{}
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	// ftruncate(2)
+	var in fusekernel.SetattrIn
+	in.Valid = uint32(fusekernel.SetattrSize | fusekernel.SetattrHandle)
+	in.Fh = 17
+	in.Size = 5
+	setattr(t, k, &in)
+
+	op := fs.lastOp()
+	if op.Handle == nil || *op.Handle != 17 || op.Size == nil || *op.Size != 5 {
+		t.Errorf("ftruncate: got handle %v and size %v", op.Handle, op.Size)
+	}
+
+	// truncate(2), which has no handle.
+	in = fusekernel.SetattrIn{}
+	in.Valid = uint32(fusekernel.SetattrSize)
+	in.Fh = 17
+	in.Size = 3
+	setattr(t, k, &in)
+
+	op = fs.lastOp()
+	if op.Handle != nil || op.Size == nil || *op.Size != 3 {
+		t.Errorf("truncate: got handle %v and size %v", op.Handle, op.Size)
+	}
+}
+
+func TestSetattrValid(t *testing.T) {
+	fs := &setattrFS{}
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	// chmod(2) changes only the mode.
+	var in fusekernel.SetattrIn
+	in.Valid = uint32(fusekernel.SetattrMode)
+	in.Mode = syscall.S_IFREG | 0600
+	in.Mtime = 1234
+	setattr(t, k, &in)
+
+	op := fs.lastOp()
+	if op.Mode == nil || *op.Mode != 0600 {
+		t.Errorf("chmod: got mode %v", op.Mode)
+	}
+
+	if op.Mtime != nil || op.Atime != nil || op.Size != nil || op.Ctime != nil {
+		t.Errorf("chmod: got other attributes in %+v", op)
+	}
+
+	if !op.Valid.Mode() || op.Valid.Mtime() {
+		t.Errorf("chmod: got mask %v", op.Valid)
+	}
+
+	// touch(1) sets both times to now.
+	in = fusekernel.SetattrIn{}
+	in.Valid = uint32(fusekernel.SetattrAtime | fusekernel.SetattrAtimeNow |
+		fusekernel.SetattrMtime | fusekernel.SetattrMtimeNow)
+	in.Atime = 1234
+	in.Mtime = 1234
+	setattr(t, k, &in)
+
+	op = fs.lastOp()
+	if op.Atime == nil || op.Mtime == nil || op.Mode != nil {
+		t.Errorf("touch: got %+v", op)
+	}
+
+	if !op.Valid.AtimeNow() || !op.Valid.MtimeNow() {
+		t.Errorf("touch: got mask %v", op.Valid)
+	}
+
+	// With writeback caching the kernel may send the ctime.
+	in = fusekernel.SetattrIn{}
+	in.Valid = uint32(fusekernel.SetattrCtime)
+	in.Ctime = 1234
+	in.CtimeNsec = 5
+	setattr(t, k, &in)
+
+	op = fs.lastOp()
+	if op.Ctime == nil || !op.Ctime.Equal(time.Unix(1234, 5)) {
+		t.Errorf("ctime: got %v", op.Ctime)
+	}
+}
+
+func TestIgnoredModeWarning(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		var buf bytes.Buffer
+		_, k := mountAttrFS(t, &fuse.MountConfig{
+			DisableDefaultPermissions: disable,
+			ErrorLogger:               log.New(&buf, "", 0),
+		})
+
+		getattr(t, k)
+		getattr(t, k)
+
+		if err := k.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		// The warning is logged only without default_permissions, and only once.
+		want := 0
+		if disable {
+			want = 1
+		}
+
+		if got := strings.Count(buf.String(), "not enforced"); got != want {
+			t.Errorf(
+				"DisableDefaultPermissions: %v: got %d warnings, want %d. Log:\n%s",
+				disable,
+				got,
+				want,
+				buf.String())
+		}
+	}
+}
+
+func TestAccess(t *testing.T) {
+	k := mountFS(t, &accessFS{}, &fuse.MountConfig{DisableDefaultPermissions: true})
+	defer k.Close()
+
+	access := func(uid uint32, mask uint32) syscall.Errno {
+		h := k.Header(fusekernel.OpAccess, 2)
+		h.Uid = uid
+
+		if err := k.Send(h, fakekernel.Bytes(&fusekernel.AccessIn{Mask: mask})); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+
+		m, err := k.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+
+		return m.Errno()
+	}
+
+	testCases := []struct {
+		uid  uint32
+		mask uint32
+		want syscall.Errno
+	}{
+		{1000, 0, 0},
+		{1000, 4 | 1, 0},
+		{1000, 4 | 2, syscall.EACCES},
+		{0, 4 | 2, 0},
+	}
+
+	for _, tc := range testCases {
+		if got := access(tc.uid, tc.mask); got != tc.want {
+			t.Errorf("uid %d, mask %#o: got errno %v, want %v", tc.uid, tc.mask, got, tc.want)
+		}
+	}
+
+	// While the file system is read-only, so are write checks.
+	if err := k.MountedFileSystem().SetReadOnly(true); err != nil {
+		t.Fatalf("SetReadOnly: %v", err)
+	}
+
+	if got := access(0, 2); got != syscall.EROFS {
+		t.Errorf("W_OK while read-only: got errno %v, want EROFS", got)
+	}
+
+	if got := access(1000, 4); got != 0 {
+		t.Errorf("R_OK while read-only: got errno %v, want 0", got)
+	}
+}
+
+func TestAccessNotImplemented(t *testing.T) {
+	k := mountFS(t, &fuseutil.NotImplementedFileSystem{}, nil)
+	defer k.Close()
+
+	m, err := k.Do(fusekernel.OpAccess, 2, fakekernel.Bytes(&fusekernel.AccessIn{Mask: 4}))
+	if err != nil {
+		t.Fatalf("Do(OpAccess): %v", err)
+	}
+
+	// Which the kernel takes as success.
+	if got := m.Errno(); got != syscall.ENOSYS {
+		t.Errorf("Got errno %v, want ENOSYS", got)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import "github.com/jacobsa/fuse/internal/fusekernel"
+
+// Capabilities that may be reported by Connection.Capabilities. Each is set
+// only if both the kernel and this package support it, and the MountConfig
+// asked for it where there is a setting to do so.
+const (
+	CapAsyncRead         = uint64(fusekernel.InitAsyncRead)
+	CapPosixLocks        = uint64(fusekernel.InitPosixLocks)
+	CapBigWrites         = uint64(fusekernel.InitBigWrites)
+	CapDontMask          = uint64(fusekernel.InitDontMask)
+	CapFlockLocks        = uint64(fusekernel.InitFlockLocks)
+	CapReaddirplus       = uint64(fusekernel.InitDoReaddirplus)
+	CapWritebackCache    = uint64(fusekernel.InitWritebackCache)
+	CapNoOpenSupport     = uint64(fusekernel.InitNoOpenSupport)
+	CapParallelDirOps    = uint64(fusekernel.InitParallelDirOps)
+	CapPosixACL          = uint64(fusekernel.InitPosixACL)
+	CapHandleKillPriv    = uint64(fusekernel.InitHandleKillprivV2)
+	CapMaxPages          = uint64(fusekernel.InitMaxPages)
+	CapCacheSymlinks     = uint64(fusekernel.InitCacheSymlinks)
+	CapNoOpendirSupport  = uint64(fusekernel.InitNoOpendirSupport)
+	CapDirectIOAllowMmap = uint64(fusekernel.InitDirectIOAllowMmap)
+	CapPassthrough       = uint64(fusekernel.InitPassthrough)
+	CapExportSupport     = uint64(fusekernel.InitExportSupport)
+	CapAtomicTrunc       = uint64(fusekernel.InitAtomicTrunc)
+	CapSpliceWrite       = uint64(fusekernel.InitSpliceWrite)
+)
+
+// ProtocolVersion returns the version of the FUSE protocol negotiated with the
+// kernel: the older of the kernel's and the newest this package speaks. File
+// systems can use it to tell whether the kernel understands a request or
+// notification before sending it.
+func (c *Connection) ProtocolVersion() (major, minor uint32) {
+	return c.protocol.Major, c.protocol.Minor
+}
+
+// Capabilities returns the features negotiated with the kernel, as a set of
+// the Cap* bits.
+func (c *Connection) Capabilities() uint64 {
+	return c.capabilities
+}
+
+// NoAtime reports whether the file system was mounted with the noatime option,
+// through MountConfig.NoAtime or MountConfig.Options, in which case file
+// systems needn't record access times on reads. See MountConfig.NoAtime.
+func (c *Connection) NoAtime() bool {
+	_, ok := c.cfg.toMap()["noatime"]
+	return ok
+}
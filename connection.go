@@ -16,19 +16,23 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path"
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
 	"github.com/jacobsa/fuse/internal/freelist"
 	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
 )
 
 type contextKeyType uint64
@@ -51,7 +55,8 @@ var contextKey interface{} = contextKeyType(0)
 //
 //   - (http://goo.gl/JnhbdL) Don't read ahead at all if that field is zero.
 //
-// Reading a page at a time is a drag. Ask for a larger size.
+// Reading a page at a time is a drag. Ask for a larger size, unless
+// MountConfig.MaxReadahead says otherwise.
 const maxReadahead = 1 << 20
 
 // Connection represents a connection to the fuse kernel process. It is used to
@@ -66,6 +71,29 @@ type Connection struct {
 	dev      *os.File
 	protocol fusekernel.Protocol
 
+	// The user that mounted the file system.
+	owner uint32
+
+	// Whether FUSE passthrough was negotiated in Init.
+	passthrough bool
+
+	// Whether replies to reads from files are spliced to the device, as set up
+	// in Init. See splice.go.
+	splice bool
+
+	// The INIT flags in our reply to the kernel, set in Init. See
+	// capabilities.go.
+	capabilities uint64
+
+	// The largest write that the kernel may send, which request buffers must
+	// have room for, as negotiated in Init. Zero before then, meaning
+	// buffer.MaxWriteSize.
+	maxWrite int
+
+	// Used to warn only once about permission bits that the kernel won't
+	// enforce. See convertAttributes.
+	ignoredModeWarning sync.Once
+
 	mu sync.Mutex
 
 	// A map from fuse "unique" request ID (*not* the op ID for logging used
@@ -74,9 +102,74 @@ type Connection struct {
 	// GUARDED_BY(mu)
 	cancelFuncs map[uint64]func()
 
+	// Set once Drain has been called. While draining, ReadOp turns away new
+	// ops, and drained is closed as soon as no ops are in flight.
+	//
+	// GUARDED_BY(mu)
+	draining bool
+	drained  chan struct{}
+
+	// Set by MountConfig.ReadOnly and MountedFileSystem.SetReadOnly. While set,
+	// ReadOp turns away ops that would modify the file system with EROFS.
+	//
+	// GUARDED_BY(mu)
+	readOnly bool
+
+	// Tokens for the ops being handled, when MountConfig.MaxConcurrentOps is
+	// set. Taken by ReadOp and given back by Reply; serviced by interceptor.go.
+	opSlots chan struct{}
+
+	// Ops that ReadOp has read but holds back until there is a slot for them
+	// under MountConfig.MaxConcurrentOps, oldest first. Touched only by ReadOp;
+	// serviced by interceptor.go.
+	held []heldOp
+
+	// Messages read from the kernel by a goroutine of its own, once ReadOp may
+	// have to wait for something other than the kernel, and closed is closed
+	// when the connection is. Serviced by reader.go.
+	incoming chan readResult
+	closed   chan struct{}
+
+	// The goroutines handling ops, when MountConfig.WorkerPoolSize is set.
+	// Serviced by workers.go.
+	workers *workerPool
+
 	// Freelists, serviced by freelists.go.
-	inMessages  freelist.Freelist // GUARDED_BY(mu)
+	inMessages  sync.Pool
 	outMessages freelist.Freelist // GUARDED_BY(mu)
+
+	// Read buffers belonging to open file handles, when
+	// MountConfig.HandleReadBuffers is set. Serviced by freelists.go.
+	//
+	// GUARDED_BY(mu)
+	readBuffers map[fuseops.HandleID]*handleReadBuffers
+
+	// The sizes last reported for symlinks, when the kernel caches their
+	// targets. Serviced by symlinks.go.
+	//
+	// GUARDED_BY(mu)
+	symlinkSizes map[fuseops.InodeID]uint64
+
+	// The kernel's lookup count for each inode, with MountConfig.TrackLookupCounts.
+	// Serviced by lookup_counts.go.
+	//
+	// GUARDED_BY(mu)
+	lookupCounts map[fuseops.InodeID]uint64
+
+	// Notifications being sent in the background, which close waits for.
+	// Serviced by notify.go.
+	notifications sync.WaitGroup
+
+	// Forgets held back by MountConfig.CoalesceForgets. Serviced by forgets.go.
+	forgets forgetBatch
+
+	// Counters for Stats. Serviced by stats.go.
+	stats connStats
+
+	// Empty pipes for splicing replies. Serviced by splice.go.
+	//
+	// GUARDED_BY(mu)
+	splicePipes []*splicePipe
 }
 
 // State that is maintained for each in-flight op. This is stuffed into the
@@ -85,6 +178,40 @@ type opState struct {
 	inMsg  *buffer.InMessage
 	outMsg *buffer.OutMessage
 	op     interface{}
+
+	// For reads given a buffer by MountConfig.HandleReadBuffers, the buffer and
+	// the handle's buffers to give it back to.
+	readBuffer  []byte
+	readBuffers *handleReadBuffers
+
+	// When the op was read, for debug logging.
+	start time.Time
+
+	// Whether the op holds one of the slots allowed by
+	// MountConfig.MaxConcurrentOps.
+	holdsSlot bool
+
+	// The kernel's unique ID for the op. Kept apart from inMsg, which is reused
+	// once the op has been replied to.
+	fuseID uint64
+
+	// The op's deadline, if MountConfig.OpDeadline is set.
+	deadline *opDeadline
+}
+
+// RequestID returns the unique ID that the kernel gave the op whose context,
+// as returned by Connection.ReadOp, is ctx, or zero if ctx doesn't belong to an
+// op. It is the ID that interrupts refer to and that debug logging shows (as
+// "Op 0x..."), and the same as fuseops.OpContext.FuseID. It stays the same for
+// as long as ctx is around, even after the op has been replied to, but the
+// kernel may reuse it for a later op after that.
+func RequestID(ctx context.Context) uint64 {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return 0
+	}
+
+	return state.fuseID
 }
 
 // Create a connection wrapping the supplied file descriptor connected to the
@@ -101,7 +228,23 @@ func newConnection(
 		debugLogger: debugLogger,
 		errorLogger: errorLogger,
 		dev:         dev,
+		owner:       uint32(os.Getuid()),
 		cancelFuncs: make(map[uint64]func()),
+		readOnly:    cfg.ReadOnly,
+		closed:      make(chan struct{}),
+	}
+
+	if cfg.MaxConcurrentOps > 0 {
+		c.opSlots = make(chan struct{}, cfg.MaxConcurrentOps)
+	}
+
+	if cfg.WorkerPoolSize > 0 {
+		c.workers = newWorkerPool(cfg.WorkerPoolSize)
+	}
+
+	if cfg.TrackLookupCounts {
+		// The kernel holds a reference to the root from the start.
+		c.lookupCounts = map[fuseops.InodeID]uint64{fuseops.RootInodeID: 1}
 	}
 
 	// Initialize.
@@ -148,14 +291,50 @@ func (c *Connection) Init() error {
 		c.protocol = initOp.Kernel
 	}
 
+	// Let the user turn the kernel down.
+	if c.cfg.OnInit != nil {
+		err := c.cfg.OnInit(initOp.Kernel.Major, initOp.Kernel.Minor, uint64(initOp.Flags))
+		if err != nil {
+			c.Reply(ctx, syscall.EPROTO)
+			return fmt.Errorf("OnInit: %v", err)
+		}
+	}
+
 	cacheSymlinks := initOp.Flags&fusekernel.InitCacheSymlinks > 0
 	noOpenSupport := initOp.Flags&fusekernel.InitNoOpenSupport > 0
 	noOpendirSupport := initOp.Flags&fusekernel.InitNoOpendirSupport > 0
+	directIOAllowMmap := initOp.Flags&fusekernel.InitDirectIOAllowMmap > 0
+	posixLocks := initOp.Flags&fusekernel.InitPosixLocks > 0
+	flockLocks := initOp.Flags&fusekernel.InitFlockLocks > 0
+	passthrough := initOp.Flags&fusekernel.InitPassthrough > 0
+	dontMask := initOp.Flags&fusekernel.InitDontMask > 0
+	readdirplus := initOp.Flags&fusekernel.InitDoReaddirplus > 0
+	posixACL := initOp.Flags&fusekernel.InitPosixACL > 0
+	killPriv := initOp.Flags&fusekernel.InitHandleKillprivV2 > 0
+	export := initOp.Flags&fusekernel.InitExportSupport > 0
+	atomicTrunc := initOp.Flags&fusekernel.InitAtomicTrunc > 0
+	spliceWrite := initOp.Flags&fusekernel.InitSpliceWrite > 0
+	maxPages := initOp.Flags&fusekernel.InitMaxPages > 0
+
+	// Flags beyond the first 32 travel in the flags2 field, which the kernel
+	// reads only if we set InitExt (protocol 7.36 and later).
+	initExt := initOp.Flags&fusekernel.InitExt > 0 &&
+		!c.protocol.LT(fusekernel.Protocol{Major: 7, Minor: 36})
 
 	// Respond to the init op.
 	initOp.Library = c.protocol
-	initOp.MaxReadahead = maxReadahead
-	initOp.MaxWrite = buffer.MaxWriteSize
+	switch {
+	case c.cfg.MaxReadahead < 0:
+		initOp.MaxReadahead = 0
+
+	case c.cfg.MaxReadahead > 0:
+		initOp.MaxReadahead = uint32(c.cfg.MaxReadahead)
+
+	default:
+		initOp.MaxReadahead = maxReadahead
+	}
+
+	initOp.TimeGran = timeGran(c.cfg.TimestampResolution)
 
 	initOp.Flags = 0
 
@@ -166,9 +345,31 @@ func (c *Connection) Init() error {
 		initOp.Flags |= fusekernel.InitAsyncRead
 	}
 
-	// kernel 4.20 increases the max from 32 -> 256
-	initOp.Flags |= fusekernel.InitMaxPages
-	initOp.MaxPages = 256
+	// Linux 4.20 lets us raise the number of pages in a request from 32 (see
+	// MountConfig.MaxPages). Older versions ignore a larger MaxWrite, so don't
+	// make room for it.
+	pageSize := uint32(os.Getpagesize())
+	initOp.MaxWrite = buffer.MaxWriteSize
+	switch {
+	case maxPages && c.cfg.MaxPages > 0:
+		pages := c.cfg.MaxPages
+		if pages > math.MaxUint16 {
+			pages = math.MaxUint16
+		}
+
+		initOp.Flags |= fusekernel.InitMaxPages
+		initOp.MaxPages = uint16(pages)
+		initOp.MaxWrite = uint32(pages) * pageSize
+
+	case maxPages:
+		initOp.Flags |= fusekernel.InitMaxPages
+		initOp.MaxPages = 256
+
+	case runtime.GOOS == "linux" && initOp.MaxWrite > 32*pageSize:
+		initOp.MaxWrite = 32 * pageSize
+	}
+
+	c.maxWrite = int(initOp.MaxWrite)
 
 	// Enable writeback caching if the user hasn't asked us not to.
 	if !c.cfg.DisableWritebackCaching {
@@ -198,9 +399,88 @@ func (c *Connection) Init() error {
 		initOp.Flags |= fusekernel.InitParallelDirOps
 	}
 
+	// List directories with READDIRPLUS, if the kernel supports it.
+	if c.cfg.EnableReaddirplus && readdirplus {
+		initOp.Flags |= fusekernel.InitDoReaddirplus
+	}
+
+	// Leave applying the umask to the file system, if it asked to.
+	if c.cfg.DontMask && dontMask {
+		initOp.Flags |= fusekernel.InitDontMask
+	}
+
+	// Have the kernel enforce POSIX ACLs, which it reads and writes with the
+	// xattr ops.
+	if c.cfg.EnablePosixACL && posixACL {
+		initOp.Flags |= fusekernel.InitPosixACL
+	}
+
+	// Have the kernel ask the file system to clear setuid and setgid bits.
+	if c.cfg.HandleKillPriv && killPriv {
+		initOp.Flags |= fusekernel.InitHandleKillprivV2
+	}
+
+	// Let the kernel look up "." and "..", for NFS export.
+	if c.cfg.EnableExport && export {
+		initOp.Flags |= fusekernel.InitExportSupport
+	}
+
+	// Leave O_TRUNC to OpenFileOp, rather than truncating separately.
+	if c.cfg.EnableAtomicTrunc && atomicTrunc {
+		initOp.Flags |= fusekernel.InitAtomicTrunc
+	}
+
+	// Splice replies to reads from files, when we can (see splice.go).
+	if c.cfg.EnableSplice && spliceWrite {
+		initOp.Flags |= fusekernel.InitSpliceWrite
+		c.splice = canSplice(c.dev)
+	}
+
+	if c.cfg.EnablePosixLocks && posixLocks {
+		initOp.Flags |= fusekernel.InitPosixLocks
+	}
+
+	if c.cfg.EnableFlockLocks && flockLocks {
+		initOp.Flags |= fusekernel.InitFlockLocks
+	}
+
+	if initExt {
+		initOp.Flags |= fusekernel.InitExt
+
+		// Allow shared mmap of files opened with direct IO (Linux >= 6.6).
+		if c.cfg.EnableDirectIOAllowMmap && directIOAllowMmap {
+			initOp.Flags |= fusekernel.InitDirectIOAllowMmap
+		}
+
+		// Let the kernel route I/O on open files to backing files (Linux >=
+		// 6.9). A stack depth of one means that the backing files must not
+		// themselves be on a passthrough file system.
+		if c.cfg.EnablePassthrough && passthrough {
+			initOp.Flags |= fusekernel.InitPassthrough
+			initOp.MaxStackDepth = 1
+			c.passthrough = true
+		}
+	}
+
+	c.capabilities = uint64(initOp.Flags)
+
 	return c.Reply(ctx, nil)
 }
 
+// Return the timestamp granularity in nanoseconds to advertise to the kernel
+// for the given resolution. The kernel accepts at most one second.
+func timeGran(res time.Duration) uint32 {
+	switch {
+	case res <= 0:
+		return 1
+
+	case res > time.Second:
+		return uint32(time.Second)
+	}
+
+	return uint32(res)
+}
+
 // Log information for an operation with the given ID. calldepth is the depth
 // to use when recovering file:line information with runtime.Caller.
 func (c *Connection) debugLog(
@@ -235,6 +515,21 @@ func (c *Connection) debugLog(
 	c.debugLogger.Println(msg)
 }
 
+// Log the reply to an operation with the given ID, along with the time since
+// it was read from the kernel.
+func (c *Connection) debugLogReply(
+	fuseID uint64,
+	start time.Time,
+	op interface{},
+	opErr error) {
+	elapsed := time.Since(start)
+	if opErr == nil {
+		c.debugLog(fuseID, 1, "-> %s (%v)", describeResponse(op), elapsed)
+	} else {
+		c.debugLog(fuseID, 1, "-> Error: %q (%v)", opErr.Error(), elapsed)
+	}
+}
+
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) recordCancelFunc(
 	fuseID uint64,
@@ -305,6 +600,151 @@ func (c *Connection) finishOp(
 		cancel()
 		delete(c.cancelFuncs, fuseID)
 	}
+
+	c.checkDrained()
+}
+
+// Close c.drained if we're draining and the last op in flight has finished.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) checkDrained() {
+	if !c.draining || len(c.cancelFuncs) != 0 {
+		return
+	}
+
+	select {
+	case <-c.drained:
+	default:
+		close(c.drained)
+	}
+}
+
+// Drain begins a graceful shutdown of the connection. From now on, ReadOp
+// answers newly arriving ops itself with MountConfig.DrainRejectErrno rather
+// than returning them, while ops it has already returned are left to finish.
+// Drain blocks until none of those remain in flight, or until ctx is done, in
+// which case it returns ctx.Err(). Draining continues either way; there is no
+// going back.
+//
+// The file system stays mounted while draining, and clients see every system
+// call that reaches it fail with the configured errno (by default EAGAIN,
+// "resource temporarily unavailable"), which callers prepared for it may
+// retry, for example against a new mount. Forget ops and ops that release
+// handles are still returned by ReadOp, because the kernel ignores errors for
+// them and refusing them would leak state in the file system.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.draining {
+		c.draining = true
+		c.drained = make(chan struct{})
+		c.checkDrained()
+	}
+
+	drained := c.drained
+	c.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Report whether the supplied op, just read from the kernel, should be turned
+// away because we're draining.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) rejectWhileDraining(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp,
+		*fuseops.BatchForgetOp,
+		*fuseops.ReleaseFileHandleOp,
+		*fuseops.ReleaseDirHandleOp:
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) setReadOnly(ro bool) {
+	c.mu.Lock()
+	c.readOnly = ro
+	c.mu.Unlock()
+}
+
+// Report whether the supplied op, just read from the kernel, should be turned
+// away because it would modify a file system that has been made read-only.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) rejectWhileReadOnly(op interface{}) bool {
+	switch o := op.(type) {
+	case *fuseops.SetInodeAttributesOp,
+		*fuseops.MkDirOp,
+		*fuseops.MkNodeOp,
+		*fuseops.CreateFileOp,
+		*fuseops.CreateTmpfileOp,
+		*fuseops.CreateSymlinkOp,
+		*fuseops.CreateLinkOp,
+		*fuseops.RenameOp,
+		*fuseops.RmDirOp,
+		*fuseops.UnlinkOp,
+		*fuseops.WriteFileOp,
+		*fuseops.SetXattrOp,
+		*fuseops.RemoveXattrOp,
+		*fuseops.FallocateOp:
+
+	case *fuseops.OpenFileOp:
+		if o.OpenFlags.IsReadOnly() && o.OpenFlags&fusekernel.OpenTruncate == 0 {
+			return false
+		}
+
+	case *fuseops.AccessOp:
+		// Only W_OK asks about modifying.
+		if o.Mask&unix.W_OK == 0 {
+			return false
+		}
+
+	case *fuseops.IoctlOp:
+		// Ioctls that only pass data in (_IOW), such as FS_IOC_SETFLAGS for
+		// chattr(1), set something. Those that also pass data out (_IOWR) are
+		// usually queries, so they are let through along with the rest.
+		if len(o.Input) == 0 || o.OutputSize != 0 {
+			return false
+		}
+
+	default:
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readOnly
+}
+
+// The errno with which ops are turned away while draining.
+func (c *Connection) drainErrno() syscall.Errno {
+	if c.cfg.DrainRejectErrno != 0 {
+		return c.cfg.DrainRejectErrno
+	}
+
+	return syscall.EAGAIN
+}
+
+// The error with which to answer an op that we don't understand, as chosen by
+// MountConfig.OnUnknownOp.
+func (c *Connection) unknownOpErrno(op *unknownOp) syscall.Errno {
+	if errno := c.cfg.OnUnknownOp(op.OpCode); errno != 0 {
+		return errno
+	}
+
+	return syscall.ENOSYS
 }
 
 // LOCKS_EXCLUDED(c.mu)
@@ -340,10 +780,20 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 	// Allocate a message.
 	m := c.getInMessage()
 
-	// Loop past transient errors.
+	if err := readInMessage(m, c.dev); err != nil {
+		c.putInMessage(m)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Fill in m with the next message read from dev, looping past transient
+// errors. Only errors after which dev can't be read again are returned, with
+// io.EOF meaning that fuse has hung up.
+func readInMessage(m *buffer.InMessage, dev io.Reader) error {
 	for {
-		// Attempt a read.
-		err := m.Init(c.dev)
+		err := m.Init(dev)
 
 		// Special cases:
 		//
@@ -352,24 +802,67 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 		//  *  EINTR means we should try again. (This seems to happen often on
 		//     OS X, cf. http://golang.org/issue/11180)
 		//
-		if pe, ok := err.(*os.PathError); ok {
-			switch pe.Err {
+		//  *  ENOENT means that the request the kernel was about to hand over
+		//     was interrupted and withdrawn in the meantime.
+		//
+		//  *  EAGAIN means that there was no request after all, which can only
+		//     happen if the device is non-blocking. Wait for the next one rather
+		//     than spinning.
+		//
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			switch errno {
 			case syscall.ENODEV:
-				err = io.EOF
+				return io.EOF
+
+			case syscall.EINTR, syscall.ENOENT:
+				continue
+
+			case syscall.EAGAIN:
+				if err := waitReadable(dev); err != nil {
+					return err
+				}
 
-			case syscall.EINTR:
-				err = nil
 				continue
 			}
 		}
 
-		if err != nil {
-			c.putInMessage(m)
-			return nil, err
+		// We closed the device ourselves, as when a mount is abandoned.
+		if errors.Is(err, os.ErrClosed) {
+			return io.EOF
 		}
 
-		return m, nil
+		return err
+	}
+}
+
+// Block until dev, if it is a file, has something to read.
+func waitReadable(dev io.Reader) error {
+	f, ok := dev.(*os.File)
+	if !ok {
+		return nil
+	}
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var pollErr error
+	err = rc.Control(func(fd uintptr) {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		for {
+			_, pollErr = unix.Poll(fds, -1)
+			if pollErr != unix.EINTR {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
 	}
+
+	return pollErr
 }
 
 // Write the supplied message to the kernel.
@@ -402,17 +895,59 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 	// Keep going until we find a request we know how to convert.
 	for {
 		// Read the next message from the kernel.
-		inMsg, err := c.readMessage()
+		inMsg, err := c.nextMessage()
+		switch err {
+		case errSlotTaken:
+			// A slot has come free for the first held op.
+			h := c.popHeldOp()
+			if ctx, op, ok := c.handOut(h.inMsg, h.outMsg, h.op, h.start, true); ok {
+				return ctx, op, nil
+			}
+			continue
+
+		case errForgetsDue:
+			return c.flushForgets()
+		}
+
 		if err != nil {
+			if c.forgetsPending() {
+				c.forgets.nextErr = err
+				return c.flushForgets()
+			}
+
 			return nil, nil, err
 		}
 
-		// Convert the message to an op.
+		// Hand out coalesced forgets before whatever follows them, so that ops
+		// still reach the user in the order the kernel sent them.
+		if c.forgetsPending() && inMsg.Header().Opcode != fusekernel.OpForget {
+			c.forgets.next = inMsg
+			return c.flushForgets()
+		}
+
 		outMsg := c.getOutMessage()
+
+		var start time.Time
+		if c.debugLogger != nil {
+			start = time.Now()
+		}
+
+		// Turn away users that MountConfig.AllowRoot doesn't let in.
+		if c.deniesCaller(inMsg.Header()) {
+			c.rejectMessage(inMsg, outMsg, syscall.EACCES)
+			continue
+		}
+
+		// Present the caller as someone else, if asked to.
+		if c.cfg.OverrideCallerIDs {
+			c.overrideCaller(inMsg.Header())
+		}
+
+		// Convert the message to an op.
 		op, err = convertInMessage(&c.cfg, inMsg, outMsg, c.protocol)
 		if err != nil {
-			c.putOutMessage(outMsg)
-			return nil, nil, fmt.Errorf("convertInMessage: %v", err)
+			c.rejectMessage(inMsg, outMsg, syscall.EIO)
+			return nil, nil, &convertError{err}
 		}
 
 		// Choose an ID for this operation for the purposes of logging, and log it.
@@ -422,19 +957,197 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 
 		// Special case: handle interrupt requests inline.
 		if interruptOp, ok := op.(*interruptOp); ok {
-			c.handleInterrupt(interruptOp.FuseID)
+			if !c.interruptHeldOp(interruptOp.FuseID) {
+				c.handleInterrupt(interruptOp.FuseID)
+			}
 			continue
 		}
 
-		// Set up a context that remembers information about this op.
-		ctx := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
-		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op})
+		// Coalesce forgets, if asked to.
+		if forget, ok := op.(*fuseops.ForgetInodeOp); ok && c.cfg.CoalesceForgets {
+			if c.addForget(inMsg, outMsg, forget, start) {
+				return c.flushForgets()
+			}
+
+			continue
+		}
+
+		// Take a slot if MountConfig.MaxConcurrentOps is set, before the op is
+		// handed out. Until one is free, the op is held while reading goes on,
+		// so that interrupts and forgets still get through.
+		holdsSlot, ok := c.takeOpSlot(op)
+		if !ok {
+			if c.cfg.OpContext.Err() != nil {
+				c.rejectMessage(inMsg, outMsg, syscall.EINTR)
+				continue
+			}
+
+			c.held = append(c.held, heldOp{inMsg, outMsg, op, start})
+			continue
+		}
 
-		// Return the op to the user.
-		return ctx, op, nil
+		if ctx, op, ok := c.handOut(inMsg, outMsg, op, start, holdsSlot); ok {
+			return ctx, op, nil
+		}
 	}
 }
 
+// Set up the context for an op that ReadOp has read and is free to hand out,
+// reporting whether it should be returned to the user. If not, the op has
+// already been answered.
+func (c *Connection) handOut(
+	inMsg *buffer.InMessage,
+	outMsg *buffer.OutMessage,
+	op interface{},
+	start time.Time,
+	holdsSlot bool) (_ context.Context, _ interface{}, ok bool) {
+	// Set up a context that remembers information about this op.
+	state := opState{
+		inMsg:     inMsg,
+		outMsg:    outMsg,
+		op:        op,
+		start:     start,
+		holdsSlot: holdsSlot,
+		fuseID:    inMsg.Header().Unique,
+	}
+	ctx := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
+	c.countOpStarted(op)
+
+	// Hand vectored reads a buffer belonging to their handle, if asked to.
+	readOp, isRead := op.(*fuseops.ReadFileOp)
+	if isRead && c.handleReadBuffers() {
+		state.readBuffer, state.readBuffers = c.getReadBuffer(readOp.Handle, int(readOp.Size))
+		readOp.Buffer = state.readBuffer
+	}
+
+	ctx, state.deadline = c.startDeadline(ctx, inMsg.Header().Opcode, state.fuseID, op)
+	ctx = context.WithValue(ctx, contextKey, state)
+
+	// Special case: while draining, answer new ops ourselves.
+	if c.rejectWhileDraining(op) {
+		c.Reply(ctx, c.drainErrno())
+		return nil, nil, false
+	}
+
+	// Special case: while read-only, so are modifying ops.
+	if c.rejectWhileReadOnly(op) {
+		c.Reply(ctx, syscall.EROFS)
+		return nil, nil, false
+	}
+
+	// Special case: let the user answer ops we don't understand.
+	if unknown, isUnknown := op.(*unknownOp); isUnknown && c.cfg.OnUnknownOp != nil {
+		c.Reply(ctx, c.unknownOpErrno(unknown))
+		return nil, nil, false
+	}
+
+	return ctx, op, true
+}
+
+// Report whether the request with the supplied header must be refused because
+// of MountConfig.AllowRoot. Only Linux and FreeBSD need us to enforce this;
+// elsewhere the kernel does it. Like libfuse, we let through requests on handles that have
+// already been opened, along with those that can't be replied to.
+func (c *Connection) deniesCaller(h *fusekernel.InHeader) bool {
+	if !c.cfg.AllowRoot || (runtime.GOOS != "linux" && runtime.GOOS != "freebsd") {
+		return false
+	}
+
+	if h.Uid == 0 || h.Uid == c.owner {
+		return false
+	}
+
+	switch h.Opcode {
+	case fusekernel.OpInit,
+		fusekernel.OpRead,
+		fusekernel.OpWrite,
+		fusekernel.OpFsync,
+		fusekernel.OpRelease,
+		fusekernel.OpReaddir,
+		fusekernel.OpReaddirplus,
+		fusekernel.OpFsyncdir,
+		fusekernel.OpReleasedir,
+		fusekernel.OpForget,
+		fusekernel.OpBatchForget,
+		fusekernel.OpInterrupt:
+		return false
+	}
+
+	return true
+}
+
+// Rewrite the credentials in the supplied header according to
+// MountConfig.OverrideUID and MountConfig.OverrideGID.
+func (c *Connection) overrideCaller(h *fusekernel.InHeader) {
+	if c.cfg.OverrideUID != nil {
+		h.Uid = *c.cfg.OverrideUID
+	}
+
+	if c.cfg.OverrideGID != nil {
+		h.Gid = *c.cfg.OverrideGID
+	}
+}
+
+// Reply with the supplied error to a message without converting it to an op,
+// for example because convertInMessage couldn't make sense of it, then
+// release the message buffers.
+func (c *Connection) rejectMessage(
+	inMsg *buffer.InMessage,
+	outMsg *buffer.OutMessage,
+	errno syscall.Errno) {
+	defer func() {
+		c.putInMessage(inMsg)
+		c.putOutMessage(outMsg)
+	}()
+
+	switch inMsg.Header().Opcode {
+	case fusekernel.OpForget, fusekernel.OpBatchForget, fusekernel.OpInterrupt:
+		// No response expected.
+		return
+	}
+
+	outMsg.Reset()
+	h := outMsg.OutHeader()
+	h.Unique = inMsg.Header().Unique
+	h.Error = -int32(errno)
+	h.Len = uint32(outMsg.Len())
+
+	if err := c.writeMessage(outMsg.OutHeaderBytes()); err != nil {
+		if c.errorLogger != nil {
+			c.errorLogger.Printf("writeMessage: %v", err)
+		}
+	}
+}
+
+// convertError is returned by ReadOp for messages that convertInMessage
+// rejects.
+type convertError struct {
+	err error
+}
+
+func (e *convertError) Error() string {
+	return fmt.Sprintf("convertInMessage: %v", e.err)
+}
+
+func (e *convertError) Unwrap() error {
+	return e.err
+}
+
+// IsTransientReadError reports whether err, as returned by ReadOp, leaves the
+// connection usable, such that it is safe to go on calling ReadOp. This is
+// the case for messages from the kernel that could not be converted to an op,
+// for example because they are truncated or use an opcode in an unexpected
+// way. Such a message has already been consumed and answered with EIO.
+//
+// ReadOp never returns the errors that reading /dev/fuse fails with as a
+// matter of course (EINTR, EAGAIN and ENOENT), since it retries the read
+// itself. io.EOF, returned by ReadOp once the file system has been unmounted,
+// is not transient, and neither is any other error.
+func IsTransientReadError(err error) bool {
+	var ce *convertError
+	return errors.As(err, &ce)
+}
+
 // Skip errors that happen as a matter of course, since they spook users.
 func (c *Connection) shouldLogError(
 	op interface{},
@@ -449,21 +1162,22 @@ func (c *Connection) shouldLogError(
 		return false
 	}
 
+	errno := Errno(err)
 	switch op.(type) {
 	case *fuseops.LookUpInodeOp:
 		// It is totally normal for the kernel to ask to look up an inode by name
 		// and find the name doesn't exist. For example, this happens when linking
 		// a new file.
-		if err == syscall.ENOENT {
+		if errno == syscall.ENOENT {
 			return false
 		}
 	case *fuseops.GetXattrOp, *fuseops.ListXattrOp:
-		if err == syscall.ENOSYS || err == syscall.ENODATA || err == syscall.ERANGE {
+		if errno == syscall.ENOSYS || errno == ENOATTR || errno == syscall.ERANGE {
 			return false
 		}
 	case *unknownOp:
 		// Don't bother the user with methods we intentionally don't support.
-		if err == syscall.ENOSYS {
+		if errno == syscall.ENOSYS {
 			return false
 		}
 	}
@@ -502,31 +1216,79 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 		// Make sure we destroy the messages when we're done.
 		c.putInMessage(inMsg)
 		c.putOutMessage(outMsg)
+		if state.readBuffers != nil {
+			c.putReadBuffer(state.readBuffers, state.readBuffer)
+		}
+
+		if state.holdsSlot {
+			c.releaseOpSlot()
+		}
 	}()
 
+	// Forget the read buffers of a released handle.
+	if releaseOp, ok := op.(*fuseops.ReleaseFileHandleOp); ok && c.handleReadBuffers() {
+		c.releaseReadBuffers(releaseOp.Handle)
+	}
+
+	// If the op outlived MountConfig.OpDeadline, it has been answered already
+	// and its state cleaned up, so all that's left is to throw away this reply
+	// once that answer is out.
+	if !state.deadline.claim() {
+		<-state.deadline.expired
+		c.countOpFinished(op, false)
+		if c.debugLogger != nil {
+			c.debugLog(fuseID, 1, "-> (discarded after OpDeadline)")
+		}
+
+		return nil
+	}
+
+	state.deadline.stop()
+
 	// Clean up state for this op.
 	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
 
-	// Debug logging
+	// Forget the sizes of forgotten symlinks.
+	c.forgetSymlinkSizes(op)
+
+	// Keep the tally of lookup counts, if asked to.
+	c.countForgets(op)
+
+	// A create that made something other than a regular file, which the kernel
+	// won't take as the reply to a create, is answered with EEXIST instead.
+	createdNonRegular := createdNonRegular(op, opErr)
+	if createdNonRegular {
+		opErr = syscall.EEXIST
+	}
+
+	// Debug logging, once the reply has been written so that the time taken
+	// includes writing it.
 	if c.debugLogger != nil {
-		if opErr == nil {
-			c.debugLog(fuseID, 1, "-> %s", describeResponse(op))
-		} else {
-			c.debugLog(fuseID, 1, "-> Error: %q", opErr.Error())
-		}
+		defer c.debugLogReply(fuseID, state.start, op, opErr)
 	}
 
 	// Error logging
-	if c.shouldLogError(op, opErr) {
+	if !createdNonRegular && c.shouldLogError(op, opErr) {
 		c.errorLogger.Printf("%T error: %v", op, opErr)
 	}
 
 	// Send the reply to the kernel, if one is required.
-	noResponse := c.kernelResponse(outMsg, inMsg.Header().Unique, op, opErr)
+	noResponse := c.kernelResponse(outMsg, inMsg.Header(), op, opErr)
+
+	// The kernel may forget what the reply gives it as soon as it has the
+	// reply, so count it first.
+	succeeded := !noResponse && outMsg.OutHeader().Error == 0
+	if succeeded {
+		c.countLookups(op)
+	}
+
+	c.countOpFinished(op, succeeded)
 
 	if !noResponse {
 		var err error
-		if outMsg.Sglist != nil {
+		if o, ok := op.(*fuseops.ReadFileOp); ok && o.SpliceFile != nil && succeeded {
+			err = c.writeSpliced(outMsg, o)
+		} else if outMsg.Sglist != nil {
 			if fusekernel.IsPlatformFuseT {
 				// writev is not atomic on macos, restrict to fuse-t platform
 				writeLock.Lock()
@@ -544,6 +1306,14 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 			return fmt.Errorf(writeErrMsg)
 		}
 		outMsg.Sglist = nil
+
+		if o, ok := op.(*fuseops.ReadFileOp); ok && o.ShortRead && opErr == nil {
+			c.invalidateShortRead(o)
+		}
+
+		if createdNonRegular {
+			c.invalidateCreated(op.(*fuseops.CreateFileOp))
+		}
 	}
 
 	return nil
@@ -565,5 +1335,13 @@ func (c *Connection) close() error {
 	// Posix doesn't say that close can be called concurrently with read or
 	// write, but luckily we exclude the possibility of a race by requiring the
 	// user to respond to all ops first.
+	if c.workers != nil {
+		c.workers.close()
+	}
+
+	c.notifications.Wait()
+	c.reportLookupCounts()
+	close(c.closed)
+	c.closeSplicePipes()
 	return c.dev.Close()
 }
@@ -0,0 +1,1008 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Mount the supplied file system on a fake kernel, failing the test if that
+// doesn't work. The caller is responsible for closing the kernel.
+func mountFS(
+	tb testing.TB,
+	fs fuseutil.FileSystem,
+	cfg *fuse.MountConfig) *fakekernel.Kernel {
+	k, err := fakekernel.Mount(fuseutil.NewFileSystemServer(fs), cfg)
+	if err != nil {
+		tb.Fatalf("Mount: %v", err)
+	}
+
+	return k
+}
+
+////////////////////////////////////////////////////////////////////////
+// attrFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that reports fixed attributes for every inode, and remembers
+// the context of the last op it saw.
+type attrFS struct {
+	fuseutil.NotImplementedFileSystem
+	attrs fuseops.InodeAttributes
+
+	mu         sync.Mutex
+	lastCtx    fuseops.OpContext // GUARDED_BY(mu)
+	expiration time.Time         // GUARDED_BY(mu)
+}
+
+func (fs *attrFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	fs.lastCtx = op.OpContext
+	op.AttributesExpiration = fs.expiration
+	fs.mu.Unlock()
+
+	op.Attributes = fs.attrs
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attrFS) setExpiration(t time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.expiration = t
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attrFS) lastOpContext() fuseops.OpContext {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.lastCtx
+}
+
+func mountAttrFS(
+	t *testing.T,
+	cfg *fuse.MountConfig) (*attrFS, *fakekernel.Kernel) {
+	fs := &attrFS{
+		attrs: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0644,
+			Uid:   17,
+			Gid:   19,
+		},
+	}
+
+	return fs, mountFS(t, fs, cfg)
+}
+
+func getattr(t *testing.T, k *fakekernel.Kernel) fusekernel.AttrOut {
+	m, err := k.Do(fusekernel.OpGetattr, 1, fakekernel.Bytes(&fusekernel.GetattrIn{}))
+	if err != nil {
+		t.Fatalf("Do(OpGetattr): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("GetInodeAttributes: errno %v", errno)
+	}
+
+	var out fusekernel.AttrOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	return out
+}
+
+////////////////////////////////////////////////////////////////////////
+// blockingFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose StatFS method announces itself and then blocks until
+// released, or until its context is cancelled, in which case it fails with
+// EINTR.
+type blockingFS struct {
+	fuseutil.NotImplementedFileSystem
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingFS() *blockingFS {
+	return &blockingFS{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+}
+
+func (fs *blockingFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fs.started <- struct{}{}
+	select {
+	case <-fs.release:
+		return nil
+
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// writeFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose WriteFile method announces itself and then blocks until
+// released.
+type writeFS struct {
+	fuseutil.NotImplementedFileSystem
+	started chan struct{}
+	release chan struct{}
+}
+
+func newWriteFS() *writeFS {
+	return &writeFS{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+}
+
+func (fs *writeFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.started <- struct{}{}
+	select {
+	case <-fs.release:
+		return nil
+
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+// Return a request to write to handle 17 of inode 2, and its payload.
+func newWrite(k *fakekernel.Kernel) (fusekernel.InHeader, []byte) {
+	data := []byte("taco")
+	in := fusekernel.WriteIn{Fh: 17, Size: uint32(len(data))}
+	return k.Header(fusekernel.OpWrite, 2), append(fakekernel.Bytes(&in), data...)
+}
+
+////////////////////////////////////////////////////////////////////////
+// retainFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that keeps the data of every write it is sent, without copying
+// it.
+type retainFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu     sync.Mutex
+	writes [][]byte // GUARDED_BY(mu)
+}
+
+func (fs *retainFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.writes = append(fs.writes, op.Data)
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *retainFS) firstWrite() string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return string(fs.writes[0])
+}
+
+const readSize = 1 << 17
+
+var zeroes = make([]byte, readSize)
+
+////////////////////////////////////////////////////////////////////////
+// connServer
+////////////////////////////////////////////////////////////////////////
+
+// A server that hands out the connection it serves before delegating to
+// another server.
+type connServer struct {
+	fuse.Server
+	conns chan *fuse.Connection
+}
+
+func newConnServer(s fuse.Server) *connServer {
+	return &connServer{
+		Server: s,
+		conns:  make(chan *fuse.Connection, 1),
+	}
+}
+
+func (s *connServer) ServeOps(c *fuse.Connection) {
+	s.conns <- c
+	s.Server.ServeOps(c)
+}
+
+////////////////////////////////////////////////////////////////////////
+// statFSErrorFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose StatFS method fails with a wrapped error.
+type statFSErrorFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *statFSErrorFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fmt.Errorf("Opening backing store: %w", os.ErrPermission)
+}
+
+////////////////////////////////////////////////////////////////////////
+// requestIDFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that remembers the contexts and op contexts of the StatFS
+// calls it sees.
+type requestIDFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu     sync.Mutex
+	ctxs   []context.Context   // GUARDED_BY(mu)
+	opCtxs []fuseops.OpContext // GUARDED_BY(mu)
+}
+
+func (fs *requestIDFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ctxs = append(fs.ctxs, ctx)
+	fs.opCtxs = append(fs.opCtxs, op.OpContext)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestDrainRejectsNewOps(t *testing.T) {
+	fs := newBlockingFS()
+	server := newConnServer(fuseutil.NewFileSystemServer(fs))
+	k, err := fakekernel.Mount(server, &fuse.MountConfig{
+		DrainRejectErrno: syscall.EBUSY,
+	})
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	c := <-server.conns
+
+	// Start an op that will still be in flight when we begin draining.
+	statfs := k.Header(fusekernel.OpStatfs, 1)
+	if err := k.Send(statfs); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-fs.started
+
+	// Draining can't finish while the op is in flight.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Drain: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// New ops are turned away.
+	m, err := k.Do(fusekernel.OpGetattr, 1, fakekernel.Bytes(&fusekernel.GetattrIn{}))
+	if err != nil {
+		t.Fatalf("Do(OpGetattr): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.EBUSY; got != want {
+		t.Errorf("GetInodeAttributes during drain: got errno %v, want %v", got, want)
+	}
+
+	// The op in flight is allowed to finish.
+	close(fs.release)
+	m, err = k.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	if m.Header.Unique != statfs.Unique || m.Errno() != 0 {
+		t.Errorf("Unexpected reply to StatFS: %+v", m.Header)
+	}
+
+	if err := c.Drain(context.Background()); err != nil {
+		t.Errorf("Drain: %v", err)
+	}
+}
+
+func TestSetReadOnly(t *testing.T) {
+	fs := newWriteFS()
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	mfs := k.MountedFileSystem()
+
+	// Start a write that will still be in flight when we go read-only.
+	h, payload := newWrite(k)
+	if err := k.Send(h, payload); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-fs.started
+
+	if err := mfs.SetReadOnly(true); err != nil {
+		t.Fatalf("SetReadOnly: %v", err)
+	}
+
+	// New modifying ops are turned away.
+	mkdir := append(
+		fakekernel.Bytes(&fusekernel.MkdirIn{Mode: 0700}),
+		fakekernel.String("foo")...)
+	m, err := k.Do(fusekernel.OpMkdir, 1, mkdir)
+	if err != nil {
+		t.Fatalf("Do(OpMkdir): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.EROFS; got != want {
+		t.Errorf("MkDir while read-only: got errno %v, want %v", got, want)
+	}
+
+	// The write in flight is allowed to finish.
+	close(fs.release)
+	m, err = k.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	if m.Header.Unique != h.Unique || m.Errno() != 0 {
+		t.Errorf("Unexpected reply to WriteFile: %+v", m.Header)
+	}
+
+	// But the next one isn't.
+	m, err = k.Do(fusekernel.OpWrite, 2, payload)
+	if err != nil {
+		t.Fatalf("Do(OpWrite): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.EROFS; got != want {
+		t.Errorf("WriteFile while read-only: got errno %v, want %v", got, want)
+	}
+
+	// Until the file system is writable again.
+	if err := mfs.SetReadOnly(false); err != nil {
+		t.Fatalf("SetReadOnly: %v", err)
+	}
+
+	m, err = k.Do(fusekernel.OpWrite, 2, payload)
+	if err != nil {
+		t.Fatalf("Do(OpWrite): %v", err)
+	}
+	<-fs.started
+
+	if errno := m.Errno(); errno != 0 {
+		t.Errorf("WriteFile: got errno %v", errno)
+	}
+}
+
+func TestReadOnlyMount(t *testing.T) {
+	fs := newWriteFS()
+	k := mountFS(t, fs, &fuse.MountConfig{ReadOnly: true})
+	defer k.Close()
+
+	_, payload := newWrite(k)
+	m, err := k.Do(fusekernel.OpWrite, 2, payload)
+	if err != nil {
+		t.Fatalf("Do(OpWrite): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.EROFS; got != want {
+		t.Errorf("WriteFile: got errno %v, want %v", got, want)
+	}
+
+	select {
+	case <-fs.started:
+		t.Errorf("WriteFile reached the file system")
+	default:
+	}
+
+	// Nor can the file system be made writable.
+	if err := k.MountedFileSystem().SetReadOnly(false); err == nil {
+		t.Errorf("SetReadOnly(false) succeeded on a read-only mount")
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) fuse.Interceptor {
+		return func(ctx context.Context, op interface{}, next func() error) error {
+			mu.Lock()
+			calls = append(calls, fmt.Sprintf("%s %T", name, op))
+			mu.Unlock()
+
+			// Refuse StatFS.
+			if _, ok := op.(*fuseops.StatFSOp); ok && name == "inner" {
+				return syscall.EACCES
+			}
+
+			return next()
+		}
+	}
+
+	_, k := mountAttrFS(t, &fuse.MountConfig{
+		Interceptors: []fuse.Interceptor{record("outer"), record("inner")},
+	})
+	defer k.Close()
+
+	getattr(t, k)
+
+	m, err := k.Do(fusekernel.OpStatfs, 1)
+	if err != nil {
+		t.Fatalf("Do(OpStatfs): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.EACCES; got != want {
+		t.Errorf("StatFS: got errno %v, want %v", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{
+		"outer *fuseops.GetInodeAttributesOp",
+		"inner *fuseops.GetInodeAttributesOp",
+		"outer *fuseops.StatFSOp",
+		"inner *fuseops.StatFSOp",
+	}
+
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("Got calls %q, want %q", calls, want)
+	}
+}
+
+func TestDispatchPprofLabels(t *testing.T) {
+	fs := newBlockingFS()
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	h := k.Header(fusekernel.OpStatfs, 1)
+	if err := k.Send(h); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	<-fs.started
+
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	close(fs.release)
+	if _, err := k.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	if want := `"op":"StatFSOp"`; !strings.Contains(buf.String(), want) {
+		t.Errorf("Goroutine profile doesn't contain %s:\n%s", want, buf.String())
+	}
+}
+
+func TestNotifyInvalEntries(t *testing.T) {
+	server := newConnServer(fuseutil.NewFileSystemServer(&attrFS{}))
+	k, err := fakekernel.Mount(server, nil)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	c := <-server.conns
+
+	const parent = 17
+	names := []string{"foo", "", "a somewhat longer name than the others"}
+	if err := c.NotifyInvalEntries(parent, names); err != nil {
+		t.Fatalf("NotifyInvalEntries: %v", err)
+	}
+
+	if err := c.NotifyInvalEntry(parent, "bar"); err != nil {
+		t.Fatalf("NotifyInvalEntry: %v", err)
+	}
+
+	for _, name := range append(names, "bar") {
+		m, err := k.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+
+		if m.Header.Unique != 0 || m.Header.Error != fusekernel.NotifyCodeInvalEntry {
+			t.Fatalf("Unexpected header: %+v", m.Header)
+		}
+
+		var out fusekernel.NotifyInvalEntryOut
+		if err := fakekernel.Decode(m.Data, &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		got := string(m.Data[unsafe.Sizeof(out):])
+		if out.Parent != parent || int(out.Namelen) != len(name) || got != name+"\x00" {
+			t.Errorf("Got parent %d, name %q (%d), want %d, %q", out.Parent, got, out.Namelen, parent, name)
+		}
+	}
+}
+
+func TestCancellingOpContextCancelsOps(t *testing.T) {
+	opCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fs := newBlockingFS()
+	k := mountFS(t, fs, &fuse.MountConfig{OpContext: opCtx})
+	defer k.Close()
+
+	// Start several ops that block until their contexts are cancelled.
+	const numOps = 3
+	for i := 0; i < numOps; i++ {
+		if err := k.Send(k.Header(fusekernel.OpStatfs, 1)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		<-fs.started
+	}
+
+	// Cancelling the parent context unblocks them all.
+	cancel()
+
+	for i := 0; i < numOps; i++ {
+		m, err := k.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+
+		if got, want := m.Errno(), syscall.EINTR; got != want {
+			t.Errorf("StatFS: got errno %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReplyMapsWrappedErrors(t *testing.T) {
+	k := mountFS(t, &statFSErrorFS{}, nil)
+	defer k.Close()
+
+	m, err := k.Do(fusekernel.OpStatfs, 1)
+	if err != nil {
+		t.Fatalf("Do(OpStatfs): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.EACCES; got != want {
+		t.Errorf("StatFS: got errno %v, want %v", got, want)
+	}
+}
+
+func TestDisableRequestBufferReuse(t *testing.T) {
+	fs := &retainFS{}
+	k := mountFS(t, fs, &fuse.MountConfig{DisableRequestBufferReuse: true})
+	defer k.Close()
+
+	// Later requests must not overwrite the data of the first.
+	for _, data := range []string{"taco", "burrito", "enchilada", "tamale"} {
+		in := fusekernel.WriteIn{Fh: 17, Size: uint32(len(data))}
+		m, err := k.Do(fusekernel.OpWrite, 2, fakekernel.Bytes(&in), []byte(data))
+		if err != nil {
+			t.Fatalf("Do(OpWrite): %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("WriteFile: errno %v", errno)
+		}
+	}
+
+	if got := fs.firstWrite(); got != "taco" {
+		t.Errorf("First write: got %q, want %q", got, "taco")
+	}
+}
+
+func TestMaxConcurrentOps(t *testing.T) {
+	fs := newBlockingFS()
+	k := mountFS(t, fs, &fuse.MountConfig{MaxConcurrentOps: 1})
+	defer k.Close()
+
+	// The first op takes the only slot.
+	if err := k.Send(k.Header(fusekernel.OpStatfs, 1)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-fs.started
+
+	// Forget ops don't wait. If they did, ops after them would never be read.
+	forget := fusekernel.ForgetIn{Nlookup: 1}
+	if err := k.Send(k.Header(fusekernel.OpForget, 2), fakekernel.Bytes(&forget)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	// The next op isn't handed out until the first finishes.
+	if err := k.Send(k.Header(fusekernel.OpStatfs, 1)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	select {
+	case <-fs.started:
+		t.Fatalf("An op started while the first was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fs.release <- struct{}{}
+	if m, err := k.Recv(); err != nil || m.Errno() != 0 {
+		t.Fatalf("Recv: %v, %v", m, err)
+	}
+
+	<-fs.started
+	fs.release <- struct{}{}
+
+	if m, err := k.Recv(); err != nil || m.Errno() != 0 {
+		t.Fatalf("Recv: %v, %v", m, err)
+	}
+}
+
+func TestMaxConcurrentOpsInterrupt(t *testing.T) {
+	fs := newBlockingFS()
+	k := mountFS(t, fs, &fuse.MountConfig{MaxConcurrentOps: 2})
+	defer k.Close()
+
+	// Fill every slot with a blocked op.
+	first := k.Header(fusekernel.OpStatfs, 1)
+	for _, h := range []fusekernel.InHeader{first, k.Header(fusekernel.OpStatfs, 1)} {
+		if err := k.Send(h); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		<-fs.started
+	}
+
+	interrupt := func(h fusekernel.InHeader) {
+		in := fusekernel.InterruptIn{Unique: h.Unique}
+		if err := k.Send(k.Header(fusekernel.OpInterrupt, 0), fakekernel.Bytes(&in)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+
+		m, err := k.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+
+		if m.Header.Unique != h.Unique || m.Errno() != syscall.EINTR {
+			t.Fatalf("Got reply to %d with errno %v, want %d with EINTR", m.Header.Unique, m.Errno(), h.Unique)
+		}
+	}
+
+	// A further op is held back, but reading goes on, so a running op that is
+	// interrupted has its context cancelled, freeing its slot for the held op.
+	if err := k.Send(k.Header(fusekernel.OpStatfs, 1)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	interrupt(first)
+	<-fs.started
+
+	// A held op that is interrupted is answered without being handed out.
+	held := k.Header(fusekernel.OpStatfs, 1)
+	if err := k.Send(held); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	interrupt(held)
+
+	for i := 0; i < 2; i++ {
+		fs.release <- struct{}{}
+		if m, err := k.Recv(); err != nil || m.Errno() != 0 {
+			t.Fatalf("Recv: %v, %v", m, err)
+		}
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	fs := newBlockingFS()
+	k := mountFS(t, fs, &fuse.MountConfig{WorkerPoolSize: 1})
+	defer k.Close()
+
+	// The first op occupies the only worker.
+	first := k.Header(fusekernel.OpStatfs, 1)
+	if err := k.Send(first); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-fs.started
+
+	// The next op is queued behind it.
+	if err := k.Send(k.Header(fusekernel.OpStatfs, 1)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	select {
+	case <-fs.started:
+		t.Fatalf("An op started while the only worker was busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Interrupts are still read while the worker is busy, so the first op can
+	// be cancelled, freeing the worker for the second.
+	interrupt := fusekernel.InterruptIn{Unique: first.Unique}
+	if err := k.Send(k.Header(fusekernel.OpInterrupt, 0), fakekernel.Bytes(&interrupt)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	m, err := k.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	if m.Header.Unique != first.Unique || m.Errno() != syscall.EINTR {
+		t.Fatalf("Got reply to %d with errno %v, want %d with EINTR", m.Header.Unique, m.Errno(), first.Unique)
+	}
+
+	<-fs.started
+	fs.release <- struct{}{}
+
+	if m, err := k.Recv(); err != nil || m.Errno() != 0 {
+		t.Fatalf("Recv: %v, %v", m, err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	fs := &requestIDFS{}
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	var uniques []uint64
+	for i := 0; i < 2; i++ {
+		m, err := k.Do(fusekernel.OpStatfs, 1)
+		if err != nil || m.Errno() != 0 {
+			t.Fatalf("Do(OpStatfs): %v, %v", m, err)
+		}
+
+		uniques = append(uniques, m.Header.Unique)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// The IDs are still right after the ops have been replied to, and their
+	// buffers reused.
+	for i, ctx := range fs.ctxs {
+		if got := fuse.RequestID(ctx); got != uniques[i] || got != fs.opCtxs[i].FuseID {
+			t.Errorf("Op %d: got ID %d, want %d", i, got, uniques[i])
+		}
+	}
+
+	if got := fuse.RequestID(context.Background()); got != 0 {
+		t.Errorf("Got ID %d for a context without an op", got)
+	}
+}
+
+func TestOnUnknownOp(t *testing.T) {
+	// An opcode that no kernel has sent yet.
+	const opcode = 9999
+
+	var mu sync.Mutex
+	var seen []uint32
+	onUnknownOp := func(errno syscall.Errno) func(uint32) syscall.Errno {
+		return func(code uint32) syscall.Errno {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, code)
+			return errno
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		onUnknownOp func(uint32) syscall.Errno
+		want        syscall.Errno
+	}{
+		{"default", nil, syscall.ENOSYS},
+		{"EOPNOTSUPP", onUnknownOp(syscall.EOPNOTSUPP), syscall.EOPNOTSUPP},
+		{"zero", onUnknownOp(0), syscall.ENOSYS},
+	}
+
+	for _, tc := range testCases {
+		k := mountFS(
+			t,
+			&fuseutil.NotImplementedFileSystem{},
+			&fuse.MountConfig{OnUnknownOp: tc.onUnknownOp})
+
+		m, err := k.Do(opcode, 1)
+		if err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+
+		if got := m.Errno(); got != tc.want {
+			t.Errorf("%s: got errno %v, want %v", tc.name, got, tc.want)
+		}
+
+		k.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(seen) != 2 || seen[0] != opcode || seen[1] != opcode {
+		t.Errorf("OnUnknownOp saw opcodes %v", seen)
+	}
+}
+
+func TestDebugLogTiming(t *testing.T) {
+	var buf bytes.Buffer
+	k := mountFS(
+		t,
+		&fuseutil.NotImplementedFileSystem{},
+		&fuse.MountConfig{DebugLogger: log.New(&buf, "", 0)})
+
+	m, err := k.Do(fusekernel.OpStatfs, 1)
+	if err != nil {
+		t.Fatalf("Do(OpStatfs): %v", err)
+	}
+
+	// Closing waits for the server, and so for the reply to have been logged.
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	id := fmt.Sprintf("Op 0x%08x", m.Header.Unique)
+	re := regexp.MustCompile(regexp.QuoteMeta(id) + `.*\] -> Error: .* \([0-9.]+[µnm]?s\)$`)
+
+	var found bool
+	for _, line := range strings.Split(buf.String(), "\n") {
+		found = found || re.MatchString(line)
+	}
+
+	if !found {
+		t.Errorf("No timed reply for %s in:\n%s", id, buf.String())
+	}
+}
+
+func TestHangUpIsNotConnectionLost(t *testing.T) {
+	var lost atomic.Bool
+	k := mountFS(
+		t,
+		&fuseutil.NotImplementedFileSystem{},
+		&fuse.MountConfig{OnConnectionLost: func() { lost.Store(true) }})
+
+	// Close waits for Join, which reports how serving ended.
+	if err := k.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if lost.Load() {
+		t.Errorf("OnConnectionLost called for a normal hang-up")
+	}
+}
+
+func TestJoinContext(t *testing.T) {
+	fs := newBlockingFS()
+	k := mountFS(t, fs, nil)
+
+	// Leave an op in flight, so that the server can't finish.
+	if err := k.Send(k.Header(fusekernel.OpStatfs, 1)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-fs.started
+
+	mfs := k.MountedFileSystem()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := mfs.Join(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Join with a deadline returned %v", err)
+	}
+
+	close(fs.release)
+	if err := k.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Errorf("Join after unmounting returned %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	k := mountFS(t, &fuseutil.NotImplementedFileSystem{}, nil)
+
+	mfs := k.MountedFileSystem()
+	if err := mfs.Ping(context.Background()); err != nil {
+		t.Errorf("Ping while serving: %v", err)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := mfs.Ping(context.Background()); err == nil {
+		t.Errorf("Ping succeeded after unmounting")
+	}
+}
+
+func TestOpDeadline(t *testing.T) {
+	var buf bytes.Buffer
+	var hadDeadline atomic.Bool
+	fs := newBlockingFS()
+	k := mountFS(t, fs, &fuse.MountConfig{
+		OpDeadline:  50 * time.Millisecond,
+		ErrorLogger: log.New(&buf, "", 0),
+		Interceptors: []fuse.Interceptor{
+			func(ctx context.Context, op interface{}, next func() error) error {
+				_, ok := ctx.Deadline()
+				hadDeadline.Store(ok)
+				return next()
+			},
+		},
+	})
+
+	// A stuck handler is answered for. Its own reply, which follows once its
+	// context is cancelled, must not reach the kernel, which would see a reply
+	// to an op it no longer knows of.
+	m, err := k.Do(fusekernel.OpStatfs, 1)
+	if err != nil {
+		t.Fatalf("Do(OpStatfs): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.ETIMEDOUT; got != want {
+		t.Errorf("StatFS: got errno %v, want %v", got, want)
+	}
+
+	if !hadDeadline.Load() {
+		t.Errorf("StatFS context has no deadline")
+	}
+
+	<-fs.started
+
+	// Ops that are replied to in time are unaffected. Do fails if the next
+	// message is the stale reply.
+	close(fs.release)
+	m, err = k.Do(fusekernel.OpStatfs, 1)
+	if err != nil {
+		t.Fatalf("Do(OpStatfs): %v", err)
+	}
+
+	if got := m.Errno(); got != 0 {
+		t.Errorf("StatFS: got errno %v, want success", got)
+	}
+
+	k.Close()
+
+	if !strings.Contains(buf.String(), "*fuseops.StatFSOp: no reply after 50ms; replying ETIMEDOUT") {
+		t.Errorf("Error log doesn't mention the deadline:\n%s", buf.String())
+	}
+}
@@ -33,6 +33,18 @@ import (
 // Incoming messages
 ////////////////////////////////////////////////////////////////////////
 
+// Return the context shared by every op, describing the request and the
+// process that caused it.
+func opContext(inMsg *buffer.InMessage) fuseops.OpContext {
+	h := inMsg.Header()
+	return fuseops.OpContext{
+		FuseID: h.Unique,
+		Pid:    h.Pid,
+		Uid:    h.Uid,
+		Gid:    h.Gid,
+	}
+}
+
 // Convert a kernel message to an appropriate op. If the op is unknown, a
 // special unexported type will be used.
 //
@@ -42,6 +54,8 @@ func convertInMessage(
 	inMsg *buffer.InMessage,
 	outMsg *buffer.OutMessage,
 	protocol fusekernel.Protocol) (o interface{}, err error) {
+	opCtx := opContext(inMsg)
+
 	switch inMsg.Header().Opcode {
 	case fusekernel.OpLookup:
 		buf := inMsg.ConsumeBytes(inMsg.Len())
@@ -51,23 +65,28 @@ func convertInMessage(
 		}
 
 		o = &fuseops.LookUpInodeOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(buf[:n-1]),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(buf[:n-1]),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpGetattr:
 		o = &fuseops.GetInodeAttributesOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opCtx,
+		}
+
+	case fusekernel.OpStatx:
+		type input fusekernel.StatxIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpStatx")
+		}
+
+		// The reply is encoded differently, see kernelResponseForOp.
+		o = &fuseops.GetInodeAttributesOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpSetattr:
@@ -78,12 +97,9 @@ func convertInMessage(
 		}
 
 		to := &fuseops.SetInodeAttributesOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Valid:     fusekernel.SetattrValid(in.Valid),
+			OpContext: opCtx,
 		}
 		o = to
 
@@ -115,11 +131,23 @@ func convertInMessage(
 			to.Mtime = &t
 		}
 
+		if valid.Ctime() {
+			t := time.Unix(int64(in.Ctime), int64(in.CtimeNsec))
+			to.Ctime = &t
+		}
+
 		if valid.Handle() {
 			t := fuseops.HandleID(in.Fh)
 			to.Handle = &t
 		}
 
+		if valid&fusekernel.SetattrFlags != 0 {
+			flags := (*fusekernel.SetattrIn)(in).Flags()
+			to.Flags = &flags
+		}
+
+		to.KillSuidgid = valid.KillSuidgid()
+
 	case fusekernel.OpForget:
 		type input fusekernel.ForgetIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -128,13 +156,9 @@ func convertInMessage(
 		}
 
 		o = &fuseops.ForgetInodeOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			N:     in.Nlookup,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			N:         in.Nlookup,
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpBatchForget:
@@ -159,12 +183,8 @@ func convertInMessage(
 		}
 
 		o = &fuseops.BatchForgetOp{
-			Entries: entries,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Entries:   entries,
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpMkdir:
@@ -190,12 +210,9 @@ func convertInMessage(
 			// the fact that this is a directory is implicit in the fact that the
 			// opcode is mkdir. But we want the correct mode to go through, so ensure
 			// that os.ModeDir is set.
-			Mode: ConvertFileMode(in.Mode) | os.ModeDir,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Mode:      ConvertFileMode(in.Mode) | os.ModeDir,
+			Umask:     os.FileMode(in.Umask) & os.ModePerm,
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpMknod:
@@ -212,15 +229,12 @@ func convertInMessage(
 		name = name[:i]
 
 		o = &fuseops.MkNodeOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(name),
-			Mode:   ConvertFileMode(in.Mode),
-			Rdev:   in.Rdev,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			Mode:      ConvertFileMode(in.Mode),
+			Rdev:      in.Rdev,
+			Umask:     os.FileMode(in.Umask) & os.ModePerm,
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpCreate:
@@ -237,14 +251,26 @@ func convertInMessage(
 		name = name[:i]
 
 		o = &fuseops.CreateFileOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(name),
-			Mode:   ConvertFileMode(in.Mode),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			Mode:      ConvertFileMode(in.Mode),
+			Umask:     os.FileMode(in.Umask) & os.ModePerm,
+			OpContext: opCtx,
+		}
+
+	case fusekernel.OpTmpfile:
+		// The input is that of OpCreate, with a placeholder for the name, which
+		// the file doesn't have.
+		in := (*fusekernel.CreateIn)(inMsg.Consume(fusekernel.CreateInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpTmpfile")
+		}
+
+		o = &fuseops.CreateTmpfileOp{
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Mode:      ConvertFileMode(in.Mode),
+			Umask:     os.FileMode(in.Umask) & os.ModePerm,
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpSymlink:
@@ -260,14 +286,10 @@ func convertInMessage(
 		newName, target := names[0:i], names[i+1:len(names)-1]
 
 		o = &fuseops.CreateSymlinkOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(newName),
-			Target: string(target),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(newName),
+			Target:    string(target),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpRename:
@@ -309,11 +331,7 @@ func convertInMessage(
 			OldName:   string(oldName),
 			NewParent: fuseops.InodeID(in.Newdir),
 			NewName:   string(newName),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpUnlink:
@@ -324,13 +342,9 @@ func convertInMessage(
 		}
 
 		o = &fuseops.UnlinkOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(buf[:n-1]),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(buf[:n-1]),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpRmdir:
@@ -341,13 +355,9 @@ func convertInMessage(
 		}
 
 		o = &fuseops.RmDirOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(buf[:n-1]),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(buf[:n-1]),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpOpen:
@@ -360,21 +370,20 @@ func convertInMessage(
 		o = &fuseops.OpenFileOp{
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			OpenFlags: fusekernel.OpenFlags(in.Flags),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpOpendir:
+		type input fusekernel.OpenIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpOpendir")
+		}
+
 		o = &fuseops.OpenDirOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpenFlags: fusekernel.OpenFlags(in.Flags),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpRead:
@@ -384,15 +393,11 @@ func convertInMessage(
 		}
 
 		to := &fuseops.ReadFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			Offset: int64(in.Offset),
-			Size:   int64(in.Size),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Offset:    int64(in.Offset),
+			Size:      int64(in.Size),
+			OpContext: opCtx,
 		}
 		if !config.UseVectoredRead {
 			// Use part of the incoming message storage as the read buffer
@@ -408,14 +413,10 @@ func convertInMessage(
 		}
 
 		to := &fuseops.ReadDirOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			Offset: fuseops.DirOffset(in.Offset),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Offset:    fuseops.DirOffset(in.Offset),
+			OpContext: opCtx,
 		}
 		o = to
 
@@ -430,6 +431,20 @@ func convertInMessage(
 		sh.Len = readSize
 		sh.Cap = readSize
 
+	case fusekernel.OpReaddirplus:
+		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpReaddirplus")
+		}
+
+		o = &fuseops.ReadDirPlusOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Offset:    fuseops.DirOffset(in.Offset),
+			Size:      int(in.Size),
+			OpContext: opCtx,
+		}
+
 	case fusekernel.OpRelease:
 		type input fusekernel.ReleaseIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -437,13 +452,13 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpRelease")
 		}
 
+		flags := fusekernel.ReleaseFlags(in.ReleaseFlags)
 		o = &fuseops.ReleaseFileHandleOp{
-			Handle: fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Handle:      fuseops.HandleID(in.Fh),
+			FlockUnlock: flags&fusekernel.ReleaseFlockUnlock != 0,
+			Flush:       flags&fusekernel.ReleaseFlush != 0,
+			LockOwner:   in.LockOwner,
+			OpContext:   opCtx,
 		}
 
 	case fusekernel.OpReleasedir:
@@ -454,12 +469,8 @@ func convertInMessage(
 		}
 
 		o = &fuseops.ReleaseDirHandleOp{
-			Handle: fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Handle:    fuseops.HandleID(in.Fh),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpWrite:
@@ -474,15 +485,15 @@ func convertInMessage(
 		}
 
 		o = &fuseops.WriteFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			Data:   buf,
-			Offset: int64(in.Offset),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:        fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:       fuseops.HandleID(in.Fh),
+			Data:         buf,
+			Offset:       int64(in.Offset),
+			BytesWritten: len(buf),
+			OpenFlags:    fusekernel.OpenFlags(in.Flags),
+			KillSuidgid:  fusekernel.WriteFlags(in.WriteFlags)&fusekernel.WriteKillSuidgid != 0,
+			Writeback:    fusekernel.WriteFlags(in.WriteFlags)&fusekernel.WriteCache != 0,
+			OpContext:    opCtx,
 		}
 
 	case fusekernel.OpFsync, fusekernel.OpFsyncdir:
@@ -493,13 +504,9 @@ func convertInMessage(
 		}
 
 		o = &fuseops.SyncFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpFlush:
@@ -510,27 +517,22 @@ func convertInMessage(
 		}
 
 		o = &fuseops.FlushFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			LockOwner: in.LockOwner,
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpReadlink:
 		o = &fuseops.ReadSymlinkOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpStatfs:
-		o = &fuseops.StatFSOp{}
+		o = &fuseops.StatFSOp{
+			OpContext: opCtx,
+		}
 
 	case fusekernel.OpInterrupt:
 		type input fusekernel.InterruptIn
@@ -544,16 +546,30 @@ func convertInMessage(
 		}
 
 	case fusekernel.OpInit:
-		type input fusekernel.InitIn
-		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		// The size of the request depends on the kernel's protocol version,
+		// which we don't know until we've read the start of it.
+		base := unsafe.Offsetof(fusekernel.InitIn{}.Flags2)
+		in := (*fusekernel.InitIn)(inMsg.Consume(base))
 		if in == nil {
 			return nil, errors.New("Corrupt OpInit")
 		}
 
+		kernel := fusekernel.Protocol{in.Major, in.Minor}
+		flags := fusekernel.InitFlags(in.Flags)
+		if n := fusekernel.InitInSize(kernel) - base; n > 0 {
+			if inMsg.Consume(n) == nil {
+				return nil, errors.New("Corrupt OpInit")
+			}
+
+			if flags&fusekernel.InitExt != 0 {
+				flags |= fusekernel.InitFlags(in.Flags2) << 32
+			}
+		}
+
 		o = &initOp{
-			Kernel:       fusekernel.Protocol{in.Major, in.Minor},
+			Kernel:       kernel,
 			MaxReadahead: in.MaxReadahead,
-			Flags:        fusekernel.InitFlags(in.Flags),
+			Flags:        flags,
 		}
 
 	case fusekernel.OpLink:
@@ -574,14 +590,10 @@ func convertInMessage(
 		}
 
 		o = &fuseops.CreateLinkOp{
-			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:   string(name),
-			Target: fuseops.InodeID(in.Oldnodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Parent:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			Target:    fuseops.InodeID(in.Oldnodeid),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpRemovexattr:
@@ -592,13 +604,9 @@ func convertInMessage(
 		}
 
 		o = &fuseops.RemoveXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(buf[:n-1]),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(buf[:n-1]),
+			OpContext: opCtx,
 		}
 
 	case fusekernel.OpGetxattr:
@@ -616,17 +624,14 @@ func convertInMessage(
 		name = name[:i]
 
 		to := &fuseops.GetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			Size:      int(in.Size),
+			OpContext: opCtx,
 		}
 		o = to
 
-		readSize := int(in.Size)
+		readSize := to.Size
 		if readSize > 0 {
 			p := outMsg.Grow(readSize)
 			if p == nil {
@@ -649,16 +654,13 @@ func convertInMessage(
 		}
 
 		to := &fuseops.ListXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Size:      int(in.Size),
+			OpContext: opCtx,
 		}
 		o = to
 
-		readSize := int(in.Size)
+		readSize := to.Size
 		if readSize != 0 {
 			p := outMsg.Grow(readSize)
 			if p == nil {
@@ -689,15 +691,11 @@ func convertInMessage(
 		name, value := payload[:i], payload[i+1:len(payload)]
 
 		o = &fuseops.SetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
-			Value: value,
-			Flags: in.Flags,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:      string(name),
+			Value:     value,
+			Flags:     (*fusekernel.SetxattrIn)(in).XattrFlags(),
+			OpContext: opCtx,
 		}
 	case fusekernel.OpFallocate:
 		type input fusekernel.FallocateIn
@@ -707,16 +705,134 @@ func convertInMessage(
 		}
 
 		o = &fuseops.FallocateOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			Offset: in.Offset,
-			Length: in.Length,
-			Mode:   in.Mode,
-			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
-			},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Offset:    in.Offset,
+			Length:    in.Length,
+			Mode:      in.Mode,
+			OpContext: opCtx,
+		}
+
+	case fusekernel.OpSetupmapping:
+		type input fusekernel.SetupmappingIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpSetupmapping")
+		}
+
+		o = &fuseops.SetupMappingOp{
+			Inode:        fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:       fuseops.HandleID(in.Fh),
+			Offset:       in.Foffset,
+			Length:       in.Len,
+			Flags:        in.Flags,
+			WindowOffset: in.Moffset,
+			OpContext:    opCtx,
+		}
+
+	case fusekernel.OpRemovemapping:
+		type input fusekernel.RemovemappingIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpRemovemapping")
+		}
+
+		to := &fuseops.RemoveMappingOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opCtx,
+		}
+		o = to
+
+		for i := uint32(0); i < in.Count; i++ {
+			type entry fusekernel.RemovemappingOne
+			e := (*entry)(inMsg.Consume(unsafe.Sizeof(entry{})))
+			if e == nil {
+				return nil, errors.New("Corrupt OpRemovemapping")
+			}
+
+			to.Mappings = append(to.Mappings, fuseops.WindowRange{
+				Offset: e.Moffset,
+				Length: e.Len,
+			})
+		}
+
+	case fusekernel.OpIoctl:
+		type input fusekernel.IoctlIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpIoctl")
+		}
+
+		to := &fuseops.IoctlOp{
+			Inode:      fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:     fuseops.HandleID(in.Fh),
+			Cmd:        in.Cmd,
+			Arg:        in.Arg,
+			OutputSize: in.OutSize,
+			OpContext:  opCtx,
+		}
+		o = to
+
+		if in.InSize != 0 {
+			to.Input = inMsg.ConsumeBytes(uintptr(in.InSize))
+			if to.Input == nil {
+				return nil, errors.New("Corrupt OpIoctl")
+			}
+		}
+
+	case fusekernel.OpGetlk:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpGetlk")
+		}
+
+		o = &fuseops.GetFileLockOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Owner:     in.Owner,
+			Lock:      fuseops.FileLock(in.Lk),
+			OpContext: opCtx,
+		}
+
+	case fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpSetlk")
+		}
+
+		o = &fuseops.SetFileLockOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Owner:     in.Owner,
+			Lock:      fuseops.FileLock(in.Lk),
+			Wait:      inMsg.Header().Opcode == fusekernel.OpSetlkw,
+			Flock:     in.LkFlags&fusekernel.LkFlock != 0,
+			OpContext: opCtx,
+		}
+
+	case fusekernel.OpAccess:
+		type input fusekernel.AccessIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpAccess")
+		}
+
+		o = &fuseops.AccessOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Mask:      in.Mask,
+			OpContext: opCtx,
+		}
+
+	case fusekernel.OpSyncfs:
+		type input fusekernel.SyncfsIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpSyncfs")
+		}
+
+		o = &fuseops.SyncFSOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: opCtx,
 		}
 
 	default:
@@ -737,11 +853,11 @@ func convertInMessage(
 // the op requires no response.
 func (c *Connection) kernelResponse(
 	m *buffer.OutMessage,
-	fuseID uint64,
+	inHeader *fusekernel.InHeader,
 	op interface{},
 	opErr error) (noResponse bool) {
 	h := m.OutHeader()
-	h.Unique = fuseID
+	h.Unique = inHeader.Unique
 
 	// Special case: handle the ops for which the kernel expects no response.
 	// interruptOp .
@@ -756,16 +872,37 @@ func (c *Connection) kernelResponse(
 		return true
 	}
 
+	// A failed lookup becomes a negative entry, if the kernel may cache those.
+	if lookUp, ok := op.(*fuseops.LookUpInodeOp); ok &&
+		c.cfg.NegativeEntryTimeout > 0 &&
+		opErr != nil &&
+		Errno(opErr) == ENOENT {
+		lookUp.Entry = fuseops.ChildInodeEntry{
+			EntryExpiration: time.Now().Add(c.cfg.NegativeEntryTimeout),
+		}
+
+		opErr = nil
+	}
+
+	// A value that doesn't fit in the caller's buffer can't be sent, even if the
+	// file system forgot to say so.
+	if opErr == nil && xattrOverflows(op) {
+		opErr = ERANGE
+	}
+
+	// Nor can a write be reported to have written what it wasn't given, or an
+	// ioctl return more than the caller has room for.
+	if opErr == nil && (writeOverflows(op) || ioctlOverflows(op)) {
+		opErr = EIO
+	}
+
 	// If the user returned the error, fill in the error field of the outgoing
 	// message header.
 	if opErr != nil {
 		handled := false
 
 		if !handled {
-			m.OutHeader().Error = -int32(syscall.EIO)
-			if errno, ok := opErr.(syscall.Errno); ok {
-				m.OutHeader().Error = -int32(errno)
-			}
+			m.OutHeader().Error = -int32(Errno(opErr))
 
 			// Special case: for some types, convertInMessage grew the message in order
 			// to obtain a destination buffer. Make sure that we shrink back to just
@@ -778,7 +915,7 @@ func (c *Connection) kernelResponse(
 
 	// Otherwise, fill in the rest of the response.
 	if opErr == nil {
-		c.kernelResponseForOp(m, op)
+		c.kernelResponseForOp(m, inHeader.Opcode, op)
 	}
 
 	h.Len = uint32(m.Len())
@@ -789,43 +926,61 @@ func (c *Connection) kernelResponse(
 // op.
 func (c *Connection) kernelResponseForOp(
 	m *buffer.OutMessage,
+	opcode uint32,
 	op interface{}) {
 	// Create the appropriate output message
 	switch o := op.(type) {
 	case *fuseops.LookUpInodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.GetInodeAttributesOp:
+		if opcode == fusekernel.OpStatx {
+			out := (*fusekernel.StatxOut)(m.Grow(int(unsafe.Sizeof(fusekernel.StatxOut{}))))
+			out.AttrValid, out.AttrValidNsec = c.convertAttrExpiration(
+				o.AttributesExpiration)
+			c.convertStatx(o.Inode, &o.Attributes, &out.Stat)
+			break
+		}
+
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
+		out.AttrValid, out.AttrValidNsec = c.convertAttrExpiration(
 			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		c.convertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.SetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
+		out.AttrValid, out.AttrValidNsec = c.convertAttrExpiration(
 			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		c.convertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.MkDirOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.MkNodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.CreateFileOp:
 		eSize := int(fusekernel.EntryOutSize(c.protocol))
 
 		e := (*fusekernel.EntryOut)(m.Grow(eSize))
-		convertChildInodeEntry(&o.Entry, e)
+		c.convertChildInodeEntry(&o.Entry, e)
+
+		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
+		oo.Fh = uint64(o.Handle)
+
+	case *fuseops.CreateTmpfileOp:
+		eSize := int(fusekernel.EntryOutSize(c.protocol))
+
+		e := (*fusekernel.EntryOut)(m.Grow(eSize))
+		c.convertChildInodeEntry(&o.Entry, e)
 
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
@@ -833,12 +988,12 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.CreateLinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.RenameOp:
 		// Empty response
@@ -853,11 +1008,11 @@ func (c *Connection) kernelResponseForOp(
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
 
-		if o.CacheDir {
+		if (o.CacheDir || c.cfg.ImmutableData) && c.protocol.HasOpenCacheDir() {
 			out.OpenFlags |= uint32(fusekernel.OpenCacheDir)
 		}
 
-		if o.KeepCache {
+		if o.KeepCache || c.cfg.ImmutableData {
 			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
 		}
 
@@ -867,6 +1022,18 @@ func (c *Connection) kernelResponseForOp(
 		// much the user read.
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
+	case *fuseops.ReadDirPlusOp:
+		entrySize := int(fusekernel.EntryOutSize(c.protocol))
+		n, size := c.direntsPlusToSend(o)
+		if size == 0 {
+			break
+		}
+
+		buf := unsafe.Slice((*byte)(m.Grow(size)), size)
+		for i := 0; i < n; i++ {
+			buf = buf[c.writeDirentPlus(buf, entrySize, &o.Entries[i]):]
+		}
+
 	case *fuseops.ReleaseDirHandleOp:
 		// Empty response
 
@@ -874,7 +1041,7 @@ func (c *Connection) kernelResponseForOp(
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
 
-		if o.KeepPageCache {
+		if o.KeepPageCache || c.cfg.ImmutableData {
 			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
 		}
 
@@ -882,7 +1049,33 @@ func (c *Connection) kernelResponseForOp(
 			out.OpenFlags |= uint32(fusekernel.OpenDirectIO)
 		}
 
+		if o.Nonseekable {
+			out.OpenFlags |= uint32(fusekernel.OpenNonSeekable)
+		}
+
+		if o.Stream {
+			out.OpenFlags |= uint32(fusekernel.OpenStream)
+		}
+
+		if o.NoFlush {
+			out.OpenFlags |= uint32(fusekernel.OpenNoFlush)
+		}
+
+		if o.ParallelDirectWrites {
+			out.OpenFlags |= uint32(fusekernel.OpenParallelDirectWrites)
+		}
+
+		if o.BackingID != 0 {
+			out.OpenFlags |= uint32(fusekernel.OpenPassthrough)
+			out.BackingID = int32(o.BackingID)
+		}
+
 	case *fuseops.ReadFileOp:
+		if o.SpliceFile != nil {
+			// The data is sent by writeSpliced.
+			break
+		}
+
 		if o.Dst != nil {
 			m.Append(o.Dst)
 		} else {
@@ -892,11 +1085,22 @@ func (c *Connection) kernelResponseForOp(
 
 	case *fuseops.WriteFileOp:
 		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
-		out.Size = uint32(len(o.Data))
+		out.Size = uint32(o.BytesWritten)
 
 	case *fuseops.SyncFileOp:
 		// Empty response
 
+	case *fuseops.SetupMappingOp:
+		// Empty response
+
+	case *fuseops.RemoveMappingOp:
+		// Empty response
+
+	case *fuseops.IoctlOp:
+		out := (*fusekernel.IoctlOut)(m.Grow(int(unsafe.Sizeof(fusekernel.IoctlOut{}))))
+		out.Result = o.Result
+		m.Append(o.Output)
+
 	case *fuseops.FlushFileOp:
 		// Empty response
 
@@ -904,6 +1108,7 @@ func (c *Connection) kernelResponseForOp(
 		// Empty response
 
 	case *fuseops.ReadSymlinkOp:
+		c.checkSymlinkTarget(o)
 		m.AppendString(o.Target)
 
 	case *fuseops.StatFSOp:
@@ -949,15 +1154,15 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.GetXattrOp:
 		// convertInMessage already set up the destination buffer to be at the end
 		// of the out message. We need only shrink to the right size based on how
-		// much the user read.
-		if len(o.Dst) == 0 {
+		// much the user read. A size probe gets only the size.
+		if o.Size == 0 {
 			writeXattrSize(m, uint32(o.BytesRead))
 		} else {
 			m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 		}
 
 	case *fuseops.ListXattrOp:
-		if len(o.Dst) == 0 {
+		if o.Size == 0 {
 			writeXattrSize(m, uint32(o.BytesRead))
 		} else {
 			m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
@@ -969,6 +1174,19 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.FallocateOp:
 		// Empty response
 
+	case *fuseops.SyncFSOp:
+		// Empty response
+
+	case *fuseops.AccessOp:
+		// Empty response
+
+	case *fuseops.GetFileLockOp:
+		out := (*fusekernel.LkOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LkOut{}))))
+		out.Lk = fusekernel.FileLock(o.Lock)
+
+	case *fuseops.SetFileLockOp:
+		// Empty response
+
 	case *initOp:
 		out := (*fusekernel.InitOut)(m.Grow(int(unsafe.Sizeof(fusekernel.InitOut{}))))
 
@@ -976,12 +1194,14 @@ func (c *Connection) kernelResponseForOp(
 		out.Minor = o.Library.Minor
 		out.MaxReadahead = o.MaxReadahead
 		out.Flags = uint32(o.Flags)
+		out.Flags2 = uint32(o.Flags >> 32)
 		// Default values
 		out.MaxBackground = 12
 		out.CongestionThreshold = 9
 		out.MaxWrite = o.MaxWrite
-		out.TimeGran = 1
+		out.TimeGran = o.TimeGran
 		out.MaxPages = o.MaxPages
+		out.MaxStackDepth = o.MaxStackDepth
 
 	default:
 		panic(fmt.Sprintf("Unexpected op: %#v", op))
@@ -995,44 +1215,149 @@ func (c *Connection) kernelResponseForOp(
 ////////////////////////////////////////////////////////////////////////
 
 func convertTime(t time.Time) (secs uint64, nsec uint32) {
+	// The zero time is out of range for UnixNano, and means that the time is
+	// unknown.
+	if t.IsZero() {
+		return 0, 0
+	}
+
 	totalNano := t.UnixNano()
 	secs = uint64(totalNano / 1e9)
 	nsec = uint32(totalNano % 1e9)
 	return secs, nsec
 }
 
-func convertAttributes(
+// Round t down to a multiple of res since the Unix epoch. A non-positive res
+// leaves t alone.
+func truncateTime(t time.Time, res time.Duration) time.Time {
+	if res <= 0 || t.IsZero() {
+		return t
+	}
+
+	nsec := t.UnixNano()
+	rem := nsec % int64(res)
+	if rem < 0 {
+		rem += int64(res)
+	}
+
+	return time.Unix(0, nsec-rem)
+}
+
+func (c *Connection) convertAttributes(
 	inodeID fuseops.InodeID,
 	in *fuseops.InodeAttributes,
 	out *fusekernel.Attr) {
+	res := c.cfg.TimestampResolution
+
 	out.Ino = uint64(inodeID)
 	out.Size = in.Size
-	out.Atime, out.AtimeNsec = convertTime(in.Atime)
-	out.Mtime, out.MtimeNsec = convertTime(in.Mtime)
-	out.Ctime, out.CtimeNsec = convertTime(in.Ctime)
-	out.SetCrtime(convertTime(in.Crtime))
+	out.SetFlags(in.Flags)
+	c.recordSymlinkSize(inodeID, in)
+	out.Atime, out.AtimeNsec = convertTime(truncateTime(in.Atime, res))
+	out.Mtime, out.MtimeNsec = convertTime(truncateTime(in.Mtime, res))
+	out.Ctime, out.CtimeNsec = convertTime(truncateTime(in.Ctime, res))
+	out.SetCrtime(convertTime(truncateTime(in.Crtime, res)))
 	out.Nlink = in.Nlink
 	out.Uid = in.Uid
 	out.Gid = in.Gid
-	// round up to the nearest 512 boundary
-	out.Blocks = (in.Size + 512 - 1) / 512
+	if c.cfg.OverrideUID != nil {
+		out.Uid = *c.cfg.OverrideUID
+	}
+	if c.cfg.OverrideGID != nil {
+		out.Gid = *c.cfg.OverrideGID
+	}
+	// Unless told otherwise, round up to the nearest 512 boundary.
+	out.Blocks = in.Blocks
+	if out.Blocks == 0 {
+		out.Blocks = (in.Size + 512 - 1) / 512
+	}
+
+	// Zero leaves the choice to the kernel.
+	out.Blksize = in.BlockSize
 
 	// Set the mode.
 	out.Mode = ConvertGoMode(in.Mode)
+	c.warnIfModeIgnored(in.Mode)
 
-	if out.Mode&(syscall.S_IFCHR|syscall.S_IFBLK) != 0 {
+	switch out.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR, syscall.S_IFBLK:
 		out.Rdev = in.Rdev
 	}
 }
 
+// Warn, once per connection, if the file system reports permission bits that
+// restrict access while MountConfig.DisableDefaultPermissions is set. The
+// kernel doesn't enforce them then, which is a common source of confusion when
+// the file system doesn't check permissions itself.
+func (c *Connection) warnIfModeIgnored(mode os.FileMode) {
+	if !c.cfg.DisableDefaultPermissions || c.errorLogger == nil {
+		return
+	}
+
+	if perm := mode.Perm(); perm == 0 || perm == 0777 {
+		return
+	}
+
+	c.ignoredModeWarning.Do(func() {
+		c.errorLogger.Printf(
+			"Permission bits %v are not enforced by the kernel since "+
+				"DisableDefaultPermissions is set; the file system must check "+
+				"them itself",
+			mode.Perm())
+	})
+}
+
+// Like convertAttributes, but for a statx reply, which unlike fusekernel.Attr
+// can carry the creation time on Linux. A zero Crtime is left out of the mask
+// of fields filled in, rather than reported as the epoch.
+func (c *Connection) convertStatx(
+	inodeID fuseops.InodeID,
+	in *fuseops.InodeAttributes,
+	out *fusekernel.Statx) {
+	var attr fusekernel.Attr
+	c.convertAttributes(inodeID, in, &attr)
+
+	out.Mask = fusekernel.StatxBasicStats
+	out.Ino = attr.Ino
+	out.Size = attr.Size
+	out.Blocks = attr.Blocks
+	out.Blksize = attr.Blksize
+	out.Atime = fusekernel.SxTime{Sec: int64(attr.Atime), Nsec: attr.AtimeNsec}
+	out.Mtime = fusekernel.SxTime{Sec: int64(attr.Mtime), Nsec: attr.MtimeNsec}
+	out.Ctime = fusekernel.SxTime{Sec: int64(attr.Ctime), Nsec: attr.CtimeNsec}
+	out.Mode = uint16(attr.Mode)
+	out.Nlink = attr.Nlink
+	out.Uid = attr.Uid
+	out.Gid = attr.Gid
+
+	// Split the device number the way the kernel's new_decode_dev does.
+	out.RdevMajor = (attr.Rdev & 0xfff00) >> 8
+	out.RdevMinor = (attr.Rdev & 0xff) | ((attr.Rdev >> 12) & 0xfff00)
+
+	if !in.Crtime.IsZero() {
+		out.Mask |= fusekernel.StatxBtime
+		secs, nsec := convertTime(truncateTime(in.Crtime, c.cfg.TimestampResolution))
+		out.Btime = fusekernel.SxTime{Sec: int64(secs), Nsec: nsec}
+	}
+}
+
 // Convert an absolute cache expiration time to a relative time from now for
-// consumption by the fuse kernel module.
+// consumption by the fuse kernel module. The zero time, like any other time
+// not in the future, means that nothing may be cached.
 func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
+	if t.IsZero() {
+		return 0, 0
+	}
+
+	return convertTimeout(t.Sub(time.Now()))
+}
+
+// Convert a cache timeout for consumption by the fuse kernel module.
+func convertTimeout(d time.Duration) (secs uint64, nsecs uint32) {
 	// Fuse represents durations as unsigned 64-bit counts of seconds and 32-bit
 	// counts of nanoseconds (cf. http://goo.gl/EJupJV). So negative durations
 	// are right out. There is no need to cap the positive magnitude, because
 	// 2^64 seconds is well longer than the 2^63 ns range of time.Duration.
-	d := t.Sub(time.Now())
 	if d > 0 {
 		secs = uint64(d / time.Second)
 		nsecs = uint32((d % time.Second) / time.Nanosecond)
@@ -1041,15 +1366,81 @@ func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
 	return secs, nsecs
 }
 
-func convertChildInodeEntry(
+// Like convertExpirationTime, but a zero time means
+// MountConfig.DefaultEntryTimeout from now.
+func (c *Connection) convertEntryExpiration(t time.Time) (secs uint64, nsecs uint32) {
+	if t.IsZero() {
+		return convertTimeout(c.cfg.DefaultEntryTimeout)
+	}
+
+	return convertExpirationTime(t)
+}
+
+// Like convertExpirationTime, but a zero time means
+// MountConfig.DefaultAttrTimeout from now.
+func (c *Connection) convertAttrExpiration(t time.Time) (secs uint64, nsecs uint32) {
+	if t.IsZero() {
+		return convertTimeout(c.cfg.DefaultAttrTimeout)
+	}
+
+	return convertExpirationTime(t)
+}
+
+func (c *Connection) convertChildInodeEntry(
 	in *fuseops.ChildInodeEntry,
 	out *fusekernel.EntryOut) {
 	out.Nodeid = uint64(in.Child)
 	out.Generation = uint64(in.Generation)
-	out.EntryValid, out.EntryValidNsec = convertExpirationTime(in.EntryExpiration)
-	out.AttrValid, out.AttrValidNsec = convertExpirationTime(in.AttributesExpiration)
+	out.EntryValid, out.EntryValidNsec = c.convertEntryExpiration(in.EntryExpiration)
+	out.AttrValid, out.AttrValidNsec = c.convertAttrExpiration(in.AttributesExpiration)
 
-	convertAttributes(in.Child, &in.Attributes, &out.Attr)
+	c.convertAttributes(in.Child, &in.Attributes, &out.Attr)
+}
+
+// Return the number of o.Entries to send, and their total size: those that fit
+// in a single segment, stopping at the first one that doesn't. The kernel will
+// ask for that one again.
+func (c *Connection) direntsPlusToSend(o *fuseops.ReadDirPlusOp) (n int, size int) {
+	entrySize := int(fusekernel.EntryOutSize(c.protocol))
+	for _, e := range o.Entries {
+		if size+direntPlusSize(entrySize, e.Name) > o.Size {
+			break
+		}
+
+		size += direntPlusSize(entrySize, e.Name)
+		n++
+	}
+
+	return n, size
+}
+
+// Write the supplied entry to buf in the layout of fuse_direntplus, returning
+// the number of bytes written. buf must be zeroed and have room for it.
+func (c *Connection) writeDirentPlus(
+	buf []byte,
+	entrySize int,
+	e *fuseops.DirentPlus) int {
+	out := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+	c.convertChildInodeEntry(&e.Entry, out)
+
+	d := (*fusekernel.Dirent)(unsafe.Pointer(&buf[entrySize]))
+	d.Ino = uint64(e.Entry.Child)
+	d.Off = uint64(e.Offset)
+	d.Namelen = uint32(len(e.Name))
+	d.Type = (out.Attr.Mode & syscall.S_IFMT) >> 12
+
+	copy(buf[entrySize+fusekernel.DirentSize:], e.Name)
+
+	return direntPlusSize(entrySize, e.Name)
+}
+
+// Return the size of a fuse_direntplus record for a child with the given
+// name, including the padding that keeps the next record 8-byte aligned.
+func direntPlusSize(entrySize int, name string) int {
+	const direntAlignment = 8
+
+	n := entrySize + fusekernel.DirentSize + len(name)
+	return (n + direntAlignment - 1) &^ (direntAlignment - 1)
 }
 
 // ConvertFileMode returns an os.FileMode with the Go mode and permission bits
@@ -1121,6 +1512,39 @@ func ConvertGoMode(inMode os.FileMode) uint32 {
 	return outMode
 }
 
+// Does the supplied op report an extended attribute value larger than the
+// buffer the caller supplied? Size probes never do.
+func xattrOverflows(op interface{}) bool {
+	switch o := op.(type) {
+	case *fuseops.GetXattrOp:
+		return o.Size != 0 && o.BytesRead > o.Size
+
+	case *fuseops.ListXattrOp:
+		return o.Size != 0 && o.BytesRead > o.Size
+	}
+
+	return false
+}
+
+// Does the supplied op report having written a number of bytes outside the
+// range of the data it was given?
+func writeOverflows(op interface{}) bool {
+	if o, ok := op.(*fuseops.WriteFileOp); ok {
+		return o.BytesWritten < 0 || o.BytesWritten > len(o.Data)
+	}
+
+	return false
+}
+
+// Does the supplied op return more ioctl output than the caller asked for?
+func ioctlOverflows(op interface{}) bool {
+	if o, ok := op.(*fuseops.IoctlOp); ok {
+		return uint32(len(o.Output)) > o.OutputSize
+	}
+
+	return false
+}
+
 func writeXattrSize(m *buffer.OutMessage, size uint32) {
 	out := (*fusekernel.GetxattrOut)(m.Grow(int(unsafe.Sizeof(fusekernel.GetxattrOut{}))))
 	out.Size = size
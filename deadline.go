@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The state of an op with a deadline from MountConfig.OpDeadline, shared by
+// the timer that answers it when the deadline passes and Reply. Whichever of
+// them claims it first replies to the kernel.
+type opDeadline struct {
+	timer    *time.Timer
+	deadline time.Time
+
+	claimed atomic.Bool
+
+	// Set once the timer has claimed the op, before its context is cancelled.
+	timedOut atomic.Bool
+
+	// Closed once the timer has replied, if it claimed the op.
+	expired chan struct{}
+}
+
+// Give the op with the supplied context a deadline if MountConfig.OpDeadline
+// is set, returning the context to hand out with it. Ops that get no reply,
+// and the INIT handshake, have none.
+func (c *Connection) startDeadline(
+	ctx context.Context,
+	opCode uint32,
+	fuseID uint64,
+	op interface{}) (context.Context, *opDeadline) {
+	if c.cfg.OpDeadline <= 0 || isForget(op) {
+		return ctx, nil
+	}
+
+	if _, ok := op.(*initOp); ok {
+		return ctx, nil
+	}
+
+	d := &opDeadline{
+		deadline: time.Now().Add(c.cfg.OpDeadline),
+		expired:  make(chan struct{}),
+	}
+
+	d.timer = time.AfterFunc(c.cfg.OpDeadline, func() {
+		if d.claim() {
+			defer close(d.expired)
+			d.timedOut.Store(true)
+			c.expireOp(opCode, fuseID, op)
+		}
+	})
+
+	return &deadlineContext{Context: ctx, d: d}, d
+}
+
+// The context of an op with a deadline. It reports the deadline, but is only
+// cancelled once the timer has claimed the op, so that a handler that gives up
+// when the deadline passes can't reply before the timer does.
+type deadlineContext struct {
+	context.Context
+	d *opDeadline
+}
+
+func (ctx *deadlineContext) Deadline() (time.Time, bool) {
+	return ctx.d.deadline, true
+}
+
+func (ctx *deadlineContext) Err() error {
+	err := ctx.Context.Err()
+	if err != nil && ctx.d.timedOut.Load() {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+// Claim the right to reply to the op, reporting whether the caller got it.
+// Always true for ops without a deadline.
+func (d *opDeadline) claim() bool {
+	return d == nil || d.claimed.CompareAndSwap(false, true)
+}
+
+// Called by Reply once it has claimed the op, so that the timer never fires.
+func (d *opDeadline) stop() {
+	if d == nil {
+		return
+	}
+
+	d.timer.Stop()
+}
+
+// Answer an op whose handler has not replied by MountConfig.OpDeadline with
+// ETIMEDOUT. The op's messages still belong to the handler, so the reply is
+// built in a buffer of its own. Reply later throws away the handler's.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) expireOp(opCode uint32, fuseID uint64, op interface{}) {
+	// As for any reply, the kernel may reuse the ID as soon as it has this
+	// one. This also cancels the op's context.
+	c.finishOp(opCode, fuseID)
+
+	if c.errorLogger != nil {
+		c.errorLogger.Printf("%T: no reply after %v; replying ETIMEDOUT", op, c.cfg.OpDeadline)
+	}
+
+	if c.debugLogger != nil {
+		c.debugLog(fuseID, 1, "-> Error: %q (OpDeadline)", syscall.ETIMEDOUT.Error())
+	}
+
+	buf := make([]byte, buffer.OutMessageHeaderSize)
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	*h = fusekernel.OutHeader{
+		Len:    uint32(len(buf)),
+		Error:  -int32(syscall.ETIMEDOUT),
+		Unique: fuseID,
+	}
+
+	// ENOENT means that the kernel has given up on the op already, e.g. because
+	// it was interrupted.
+	if err := c.writeMessage(buf); err != nil && err != syscall.ENOENT && c.errorLogger != nil {
+		c.errorLogger.Printf("writeMessage: %v", err)
+	}
+}
@@ -86,6 +86,14 @@ func describeRequest(op interface{}) (s string) {
 			addComponent("mtime %v", *typed.Mtime)
 		}
 
+		if typed.Ctime != nil {
+			addComponent("ctime %v", *typed.Ctime)
+		}
+
+		if typed.Flags != nil {
+			addComponent("flags %#x", *typed.Flags)
+		}
+
 	case *fuseops.RenameOp:
 		addComponent("old_parent %v", typed.OldParent)
 		addComponent("old_name %q", typed.OldName)
@@ -111,13 +119,56 @@ func describeRequest(op interface{}) (s string) {
 	case *fuseops.SetXattrOp:
 		addComponent("name %s", typed.Name)
 
+	case *fuseops.AccessOp:
+		addComponent("mask %#o", typed.Mask)
+
+	case *fuseops.SetupMappingOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("offset %d", typed.Offset)
+		addComponent("length %d", typed.Length)
+		addComponent("flags %#x", typed.Flags)
+		addComponent("window offset %d", typed.WindowOffset)
+
+	case *fuseops.RemoveMappingOp:
+		addComponent("%d mappings", len(typed.Mappings))
+
+	case *fuseops.IoctlOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("cmd %#x", typed.Cmd)
+		addComponent("%d bytes in", len(typed.Input))
+		addComponent("%d bytes out", typed.OutputSize)
+
 	case *fuseops.FallocateOp:
 		addComponent("offset %d", typed.Offset)
 		addComponent("length %d", typed.Length)
 		addComponent("mode %d", typed.Mode)
 
+	case *fuseops.GetFileLockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner 0x%x", typed.Owner)
+		addComponent("lock %+v", typed.Lock)
+
+	case *fuseops.SetFileLockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner 0x%x", typed.Owner)
+		addComponent("lock %+v", typed.Lock)
+		if typed.Wait {
+			addComponent("wait")
+		}
+
 	case *fuseops.ReleaseFileHandleOp:
 		addComponent("handle %d", typed.Handle)
+		if typed.Flush {
+			addComponent("flush")
+		}
+
+		if typed.FlockUnlock {
+			addComponent("flock unlock")
+		}
+
+		if typed.Flush || typed.FlockUnlock {
+			addComponent("owner 0x%x", typed.LockOwner)
+		}
 	}
 
 	// Use just the name if there is no extra info.
@@ -0,0 +1,1180 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// mknodFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that creates nodes with whatever mode and device number it is
+// asked for, and remembers the last umask it saw.
+type mknodFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu        sync.Mutex
+	lastUmask os.FileMode // GUARDED_BY(mu)
+}
+
+func (fs *mknodFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.mu.Lock()
+	fs.lastUmask = op.Umask
+	fs.mu.Unlock()
+
+	op.Entry.Child = 2
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  op.Mode,
+		Rdev:  op.Rdev,
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// generationFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system with a single child of the root, inode 2, which is recreated
+// with a new generation number each time it is made with MkDir.
+type generationFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu         sync.Mutex
+	generation fuseops.GenerationNumber // GUARDED_BY(mu)
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *generationFS) entry() fuseops.ChildInodeEntry {
+	return fuseops.ChildInodeEntry{
+		Child:      2,
+		Generation: fs.generation,
+		Attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0700 | os.ModeDir,
+		},
+	}
+}
+
+func (fs *generationFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Entry = fs.entry()
+	return nil
+}
+
+func (fs *generationFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.generation++
+	op.Entry = fs.entry()
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// flipFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system with a single child of the root, inode 2, whose type is set
+// with flip, as in a union file system where another layer takes precedence.
+// Each change of type bumps the generation.
+type flipFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu         sync.Mutex
+	mode       os.FileMode              // GUARDED_BY(mu)
+	generation fuseops.GenerationNumber // GUARDED_BY(mu)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *flipFS) flip(mode os.FileMode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.mode = mode
+	fs.generation++
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *flipFS) attributes() fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  fs.mode,
+	}
+}
+
+func (fs *flipFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Entry = fuseops.ChildInodeEntry{
+		Child:      2,
+		Generation: fs.generation,
+		Attributes: fs.attributes(),
+	}
+
+	return nil
+}
+
+func (fs *flipFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes = fs.attributes()
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// negativeFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system with an empty root, which answers lookups of "cached" with a
+// negative entry and all others with ENOENT.
+type negativeFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *negativeFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Name != "cached" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.EntryExpiration = time.Now().Add(time.Minute)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// cacheDirFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that asks the kernel to cache the listing of every directory
+// opened.
+type cacheDirFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *cacheDirFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	op.CacheDir = true
+	op.KeepCache = true
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// openDirFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose root is a directory and whose inode 2 has stopped being
+// one, which records the flags of the last directory opened.
+type openDirFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu    sync.Mutex
+	flags fusekernel.OpenFlags
+}
+
+func (fs *openDirFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.flags = op.OpenFlags
+	if op.Inode != fuseops.RootInodeID {
+		return syscall.ENOTDIR
+	}
+
+	return nil
+}
+
+func (fs *openDirFS) lastFlags() fusekernel.OpenFlags {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.flags
+}
+
+////////////////////////////////////////////////////////////////////////
+// readDirPlusFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system with a single directory of empty files, which takes a
+// snapshot of the listing for each handle opened on it.
+type readDirPlusFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu         sync.Mutex
+	names      []string                      // GUARDED_BY(mu)
+	nextHandle fuseops.HandleID              // GUARDED_BY(mu)
+	listings   map[fuseops.HandleID][]string // GUARDED_BY(mu)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *readDirPlusFS) add(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.names = append(fs.names, name)
+}
+
+func (fs *readDirPlusFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.nextHandle++
+	op.Handle = fs.nextHandle
+	fs.listings[op.Handle] = append([]string(nil), fs.names...)
+	return nil
+}
+
+func (fs *readDirPlusFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	fs.mu.Lock()
+	listing, ok := fs.listings[op.Handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	for i := int(op.Offset); i < len(listing); i++ {
+		e := fuseops.DirentPlus{
+			Offset: fuseops.DirOffset(i + 1),
+			Name:   listing[i],
+			Entry: fuseops.ChildInodeEntry{
+				Child:      fuseops.InodeID(100 + i),
+				Generation: fuseops.GenerationNumber(1000 + i),
+				Attributes: fuseops.InodeAttributes{
+					Nlink: 1,
+					Mode:  0644,
+				},
+			},
+		}
+
+		if !fuseutil.AppendDirentPlus(op, e) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Open the root directory, returning the handle.
+func opendir(t *testing.T, k *fakekernel.Kernel) uint64 {
+	m, err := k.Do(fusekernel.OpOpendir, 1, fakekernel.Bytes(&fusekernel.OpenIn{}))
+	if err != nil {
+		t.Fatalf("Do(OpOpendir): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("OpenDir: errno %v", errno)
+	}
+
+	var out fusekernel.OpenOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	return out.Fh
+}
+
+// Read from the root directory with READDIRPLUS, returning the entries in the
+// reply.
+func readdirplus(
+	t *testing.T,
+	k *fakekernel.Kernel,
+	fh uint64,
+	offset uint64,
+	size uint32) (entries []fusekernel.EntryOut, dirents []fusekernel.Dirent, names []string) {
+	m, err := k.Do(fusekernel.OpReaddirplus, 1, fakekernel.Bytes(&fusekernel.ReadIn{
+		Fh:     fh,
+		Offset: offset,
+		Size:   size,
+	}))
+	if err != nil {
+		t.Fatalf("Do(OpReaddirplus): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("ReadDirPlus: errno %v", errno)
+	}
+
+	if len(m.Data) > int(size) {
+		t.Fatalf("ReadDirPlus: got %d bytes for a %d-byte read", len(m.Data), size)
+	}
+
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	for b := m.Data; len(b) > 0; {
+		var e fusekernel.EntryOut
+		var d fusekernel.Dirent
+		if err := fakekernel.Decode(b, &e); err != nil {
+			t.Fatalf("Decode entry: %v", err)
+		}
+
+		if err := fakekernel.Decode(b[entrySize:], &d); err != nil {
+			t.Fatalf("Decode dirent: %v", err)
+		}
+
+		nameStart := entrySize + fusekernel.DirentSize
+		entries = append(entries, e)
+		dirents = append(dirents, d)
+		names = append(names, string(b[nameStart:nameStart+int(d.Namelen)]))
+
+		n := (nameStart + int(d.Namelen) + 7) &^ 7
+		if n > len(b) {
+			t.Fatalf("Entry %q overruns the reply", names[len(names)-1])
+		}
+
+		b = b[n:]
+	}
+
+	return entries, dirents, names
+}
+
+////////////////////////////////////////////////////////////////////////
+// linkFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that links any inode, which it says has one other link, and
+// remembers the last link it was asked to create.
+type linkFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu   sync.Mutex
+	last fuseops.CreateLinkOp // GUARDED_BY(mu)
+}
+
+func (fs *linkFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.mu.Lock()
+	fs.last = *op
+	fs.mu.Unlock()
+
+	op.Entry.Child = op.Target
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Nlink: 2,
+		Mode:  0644,
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// symlinkFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system with a single symlink, whose target is "target" but whose
+// reported size is whatever the test says.
+type symlinkFS struct {
+	fuseutil.NotImplementedFileSystem
+	size uint64
+}
+
+func (fs *symlinkFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 2
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Size:  fs.size,
+		Nlink: 1,
+		Mode:  os.ModeSymlink | 0777,
+	}
+
+	return nil
+}
+
+func (fs *symlinkFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	op.Target = "target"
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// lookupCountFS
+////////////////////////////////////////////////////////////////////////
+
+// A readDirPlusFS in which "foo" can also be looked up, as inode 2, and which
+// accepts forgets.
+type lookupCountFS struct {
+	*readDirPlusFS
+}
+
+func (fs lookupCountFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = 2
+	op.Entry.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0644}
+	return nil
+}
+
+func (fs lookupCountFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// pointerFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system in which creating a file makes a symlink, as if the backend
+// stored the new name as a pointer to something else.
+type pointerFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *pointerFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	op.Entry.Child = 2
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  os.ModeSymlink | 0777,
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// forgetFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that records the forgets that it is sent.
+type forgetFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	singles int
+	batches int
+	counts  map[fuseops.InodeID]uint64
+}
+
+func (fs *forgetFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.singles++
+	fs.counts[op.Inode] += op.N
+	return nil
+}
+
+func (fs *forgetFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.batches++
+	for _, e := range op.Entries {
+		fs.counts[e.Inode] += e.N
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestMkNodeSpecialFiles(t *testing.T) {
+	k := mountFS(t, &mknodFS{}, nil)
+	defer k.Close()
+
+	testCases := []struct {
+		mode     uint32
+		rdev     uint32
+		wantRdev uint32
+	}{
+		{syscall.S_IFREG | 0644, 0, 0},
+		{syscall.S_IFIFO | 0600, 0, 0},
+		{syscall.S_IFSOCK | 0755, 0x1234, 0},
+		{syscall.S_IFCHR | 0666, 0x103, 0x103},
+		{syscall.S_IFBLK | 0660, 0x801, 0x801},
+	}
+
+	for _, tc := range testCases {
+		in := fusekernel.MknodIn{Mode: tc.mode, Rdev: tc.rdev}
+		m, err := k.Do(fusekernel.OpMknod, 1, fakekernel.Bytes(&in), fakekernel.String("foo"))
+		if err != nil {
+			t.Fatalf("Do(OpMknod): %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("MkNode(0%o): errno %v", tc.mode, errno)
+		}
+
+		var out fusekernel.EntryOut
+		if err := fakekernel.Decode(m.Data, &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		if out.Attr.Mode != tc.mode || out.Attr.Rdev != tc.wantRdev {
+			t.Errorf(
+				"MkNode(0%o, 0x%x): got mode 0%o, rdev 0x%x; want 0%o, 0x%x",
+				tc.mode, tc.rdev,
+				out.Attr.Mode, out.Attr.Rdev,
+				tc.mode, tc.wantRdev)
+		}
+	}
+}
+
+func TestDontMask(t *testing.T) {
+	for _, dontMask := range []bool{false, true} {
+		fs := &mknodFS{}
+		k := mountFS(t, fs, &fuse.MountConfig{DontMask: dontMask})
+
+		got := fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitDontMask != 0
+		if got != dontMask {
+			t.Errorf("DontMask %v: got flags %v", dontMask, fusekernel.InitFlags(k.Init.Flags))
+		}
+
+		// The umask is delivered either way.
+		in := fusekernel.MknodIn{Mode: syscall.S_IFREG | 0666, Umask: 022}
+		m, err := k.Do(fusekernel.OpMknod, 1, fakekernel.Bytes(&in), fakekernel.String("foo"))
+		if err != nil {
+			t.Fatalf("Do(OpMknod): %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("MkNode: errno %v", errno)
+		}
+
+		fs.mu.Lock()
+		if fs.lastUmask != 022 {
+			t.Errorf("Got umask %v, want %v", fs.lastUmask, os.FileMode(022))
+		}
+		fs.mu.Unlock()
+
+		k.Close()
+	}
+}
+
+func TestReaddirplusNegotiation(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		k := mountFS(
+			t,
+			&fuseutil.NotImplementedFileSystem{},
+			&fuse.MountConfig{EnableReaddirplus: enable})
+
+		got := fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitDoReaddirplus != 0
+		if got != enable {
+			t.Errorf("EnableReaddirplus %v: got flags %v", enable, fusekernel.InitFlags(k.Init.Flags))
+		}
+
+		k.Close()
+	}
+}
+
+func TestOpenDirCacheDir(t *testing.T) {
+	testCases := []struct {
+		minor uint32
+		want  fusekernel.OpenResponseFlags
+	}{
+		// Protocol 7.28 introduced FOPEN_CACHE_DIR.
+		{27, fusekernel.OpenKeepCache},
+		{28, fusekernel.OpenKeepCache | fusekernel.OpenCacheDir},
+	}
+
+	for _, tc := range testCases {
+		server := fuseutil.NewFileSystemServer(&cacheDirFS{})
+		k, err := fakekernel.MountWithInit(server, nil, fusekernel.InitIn{
+			Major:        7,
+			Minor:        tc.minor,
+			MaxReadahead: 1 << 20,
+		})
+		if err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+
+		m, err := k.Do(fusekernel.OpOpendir, 1, fakekernel.Bytes(&fusekernel.OpenIn{}))
+		if err != nil {
+			t.Fatalf("Do(OpOpendir): %v", err)
+		}
+
+		var out fusekernel.OpenOut
+		if err := fakekernel.Decode(m.Data, &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		if got := fusekernel.OpenResponseFlags(out.OpenFlags); got != tc.want {
+			t.Errorf("Protocol 7.%d: got flags %v, want %v", tc.minor, got, tc.want)
+		}
+
+		k.Close()
+	}
+}
+
+func TestOpenDirFlags(t *testing.T) {
+	fs := &openDirFS{}
+	k := mountFS(t, fs, nil)
+
+	in := fusekernel.OpenIn{Flags: uint32(syscall.O_RDONLY | syscall.O_DIRECTORY)}
+	m, err := k.Do(fusekernel.OpOpendir, 1, fakekernel.Bytes(&in))
+	if err != nil {
+		t.Fatalf("Do(OpOpendir): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("OpenDir: errno %v", errno)
+	}
+
+	if got := fs.lastFlags(); !got.IsDirectory() || !got.IsReadOnly() {
+		t.Errorf("Got flags %v, want OpenReadOnly+OpenDirectory", got)
+	}
+
+	// The error for what is no longer a directory reaches the process.
+	m, err = k.Do(fusekernel.OpOpendir, 2, fakekernel.Bytes(&in))
+	if err != nil {
+		t.Fatalf("Do(OpOpendir): %v", err)
+	}
+
+	if got := m.Errno(); got != syscall.ENOTDIR {
+		t.Errorf("OpenDir of a file: got errno %v, want ENOTDIR", got)
+	}
+}
+
+func TestEntryGeneration(t *testing.T) {
+	k := mountFS(t, &generationFS{generation: 7}, nil)
+	defer k.Close()
+
+	generation := func(m *fakekernel.Message, err error) uint64 {
+		if err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("Errno: %v", errno)
+		}
+
+		var out fusekernel.EntryOut
+		if err := fakekernel.Decode(m.Data, &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		return out.Generation
+	}
+
+	lookup := func() uint64 {
+		return generation(k.Do(fusekernel.OpLookup, 1, fakekernel.String("foo")))
+	}
+
+	if got := lookup(); got != 7 {
+		t.Errorf("LookUpInode: got generation %d, want 7", got)
+	}
+
+	// Recreating the inode with the same ID bumps the generation, which the
+	// kernel must see in both the reply and later lookups.
+	mkdir := append(
+		fakekernel.Bytes(&fusekernel.MkdirIn{Mode: 0700}),
+		fakekernel.String("foo")...)
+	if got := generation(k.Do(fusekernel.OpMkdir, 1, mkdir)); got != 8 {
+		t.Errorf("MkDir: got generation %d, want 8", got)
+	}
+
+	if got := lookup(); got != 8 {
+		t.Errorf("LookUpInode after MkDir: got generation %d, want 8", got)
+	}
+}
+
+func TestEntryTypeChange(t *testing.T) {
+	fs := &flipFS{mode: 0644}
+	k := mountFS(t, fs, &fuse.MountConfig{EnableSymlinkCaching: true})
+	defer k.Close()
+
+	check := func(wantType uint32, wantGeneration uint64) {
+		t.Helper()
+
+		m, err := k.Do(fusekernel.OpLookup, 1, fakekernel.String("foo"))
+		if err != nil {
+			t.Fatalf("Do(OpLookup): %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("LookUpInode: errno %v", errno)
+		}
+
+		var entry fusekernel.EntryOut
+		if err := fakekernel.Decode(m.Data, &entry); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		if entry.Nodeid != 2 || entry.Generation != wantGeneration {
+			t.Errorf(
+				"LookUpInode: got inode %d generation %d, want inode 2 generation %d",
+				entry.Nodeid,
+				entry.Generation,
+				wantGeneration)
+		}
+
+		if got := entry.Attr.Mode & syscall.S_IFMT; got != wantType {
+			t.Errorf("LookUpInode: got type %#o, want %#o", got, wantType)
+		}
+
+		// Fresh attributes for the inode agree.
+		m, err = k.Do(fusekernel.OpGetattr, 2, fakekernel.Bytes(&fusekernel.GetattrIn{}))
+		if err != nil {
+			t.Fatalf("Do(OpGetattr): %v", err)
+		}
+
+		var attr fusekernel.AttrOut
+		if err := fakekernel.Decode(m.Data, &attr); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		if got := attr.Attr.Mode & syscall.S_IFMT; got != wantType {
+			t.Errorf("GetInodeAttributes: got type %#o, want %#o", got, wantType)
+		}
+	}
+
+	check(syscall.S_IFREG, 0)
+
+	fs.flip(0755 | os.ModeDir)
+	check(syscall.S_IFDIR, 1)
+
+	fs.flip(os.ModeSymlink | 0777)
+	check(syscall.S_IFLNK, 2)
+
+	fs.flip(0644)
+	check(syscall.S_IFREG, 3)
+}
+
+func TestNegativeEntries(t *testing.T) {
+	testCases := []struct {
+		name      string
+		timeout   time.Duration
+		wantErrno syscall.Errno
+		wantValid uint64
+	}{
+		{"cached", 0, 0, 60},
+		{"missing", 0, syscall.ENOENT, 0},
+		{"missing", 2 * time.Minute, 0, 120},
+	}
+
+	for _, tc := range testCases {
+		k := mountFS(t, &negativeFS{}, &fuse.MountConfig{NegativeEntryTimeout: tc.timeout})
+
+		m, err := k.Do(fusekernel.OpLookup, 1, fakekernel.String(tc.name))
+		if err != nil {
+			t.Fatalf("Do(OpLookup): %v", err)
+		}
+
+		if got := m.Errno(); got != tc.wantErrno {
+			t.Errorf("%s with timeout %v: got errno %v, want %v", tc.name, tc.timeout, got, tc.wantErrno)
+		}
+
+		if tc.wantErrno == 0 {
+			var out fusekernel.EntryOut
+			if err := fakekernel.Decode(m.Data, &out); err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			// The expiration is measured from when the reply is built, so allow
+			// for time passing since.
+			if out.Nodeid != 0 || out.EntryValid+1 < tc.wantValid || out.EntryValid > tc.wantValid {
+				t.Errorf(
+					"%s with timeout %v: got node %d valid for %ds, want 0 for %ds",
+					tc.name,
+					tc.timeout,
+					out.Nodeid,
+					out.EntryValid,
+					tc.wantValid)
+			}
+		}
+
+		k.Close()
+	}
+}
+
+func TestSymlinkSizeWarning(t *testing.T) {
+	testCases := []struct {
+		size    uint64
+		caching bool
+		want    int
+	}{
+		{6, true, 0},
+		{3, true, 1},
+		{3, false, 0},
+	}
+
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		k := mountFS(t, &symlinkFS{size: tc.size}, &fuse.MountConfig{
+			EnableSymlinkCaching: tc.caching,
+			ErrorLogger:          log.New(&buf, "", 0),
+		})
+
+		do := func(opcode uint32, nodeID uint64, payload ...[]byte) {
+			m, err := k.Do(opcode, nodeID, payload...)
+			if err != nil {
+				t.Fatalf("Do(%d): %v", opcode, err)
+			}
+
+			if errno := m.Errno(); errno != 0 {
+				t.Fatalf("Opcode %d: errno %v", opcode, errno)
+			}
+		}
+
+		do(fusekernel.OpLookup, 1, fakekernel.String("link"))
+		do(fusekernel.OpReadlink, 2)
+
+		if err := k.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		// The target is too long only for a size of 3, and that matters only if
+		// the kernel caches it.
+		if got := strings.Count(buf.String(), "truncated"); got != tc.want {
+			t.Errorf(
+				"Size %d, caching %v: got %d warnings, want %d. Log:\n%s",
+				tc.size,
+				tc.caching,
+				got,
+				tc.want,
+				buf.String())
+		}
+	}
+}
+
+func TestReadDirPlusInterleavedHandles(t *testing.T) {
+	fs := &readDirPlusFS{
+		names:    []string{"foo", "bar", "baz", "qux", "quux"},
+		listings: make(map[fuseops.HandleID][]string),
+	}
+
+	k := mountFS(t, fs, &fuse.MountConfig{EnableReaddirplus: true})
+	defer k.Close()
+
+	// The second handle sees a file created after the first was opened.
+	fh1 := opendir(t, k)
+	fs.add("corge")
+	fh2 := opendir(t, k)
+
+	// Room for two entries at a time, so that each listing takes several reads.
+	size := uint32(2 * fuseutil.DirentPlusSize(fuseops.DirentPlus{Name: "quux"}))
+
+	type reader struct {
+		fh     uint64
+		offset uint64
+		done   bool
+		names  []string
+	}
+
+	readers := []*reader{{fh: fh1}, {fh: fh2}}
+	for !readers[0].done || !readers[1].done {
+		for _, r := range readers {
+			if r.done {
+				continue
+			}
+
+			entries, dirents, names := readdirplus(t, k, r.fh, r.offset, size)
+			if len(names) == 0 {
+				r.done = true
+				continue
+			}
+
+			for i, name := range names {
+				index := len(r.names) + i
+				e := entries[i]
+				d := dirents[i]
+
+				if want := uint64(100 + index); e.Nodeid != want || d.Ino != want {
+					t.Errorf("%q: got inode %v and %v, want %v", name, e.Nodeid, d.Ino, want)
+				}
+
+				if e.Generation != uint64(1000+index) {
+					t.Errorf("%q: got generation %v, want %v", name, e.Generation, 1000+index)
+				}
+
+				if e.Attr.Ino != e.Nodeid || e.Attr.Mode != syscall.S_IFREG|0644 {
+					t.Errorf("%q: got attributes %+v", name, e.Attr)
+				}
+
+				if d.Type != syscall.DT_REG {
+					t.Errorf("%q: got type %v, want %v", name, d.Type, syscall.DT_REG)
+				}
+
+				if d.Off != uint64(index+1) {
+					t.Errorf("%q: got offset %v, want %v", name, d.Off, index+1)
+				}
+			}
+
+			r.names = append(r.names, names...)
+			r.offset = dirents[len(dirents)-1].Off
+		}
+	}
+
+	if got, want := fmt.Sprint(readers[0].names), "[foo bar baz qux quux]"; got != want {
+		t.Errorf("First handle: got %v, want %v", got, want)
+	}
+
+	if got, want := fmt.Sprint(readers[1].names), "[foo bar baz qux quux corge]"; got != want {
+		t.Errorf("Second handle: got %v, want %v", got, want)
+	}
+}
+
+func TestCreateLink(t *testing.T) {
+	fs := &linkFS{}
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	const parent, target = 3, 17
+	in := fusekernel.LinkIn{Oldnodeid: target}
+	m, err := k.Do(fusekernel.OpLink, parent, fakekernel.Bytes(&in), fakekernel.String("foo"))
+	if err != nil {
+		t.Fatalf("Do(OpLink): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("CreateLink: errno %v", errno)
+	}
+
+	fs.mu.Lock()
+	last := fs.last
+	fs.mu.Unlock()
+
+	if last.Parent != parent || last.Name != "foo" || last.Target != target {
+		t.Errorf("Got parent %v, name %q and target %v", last.Parent, last.Name, last.Target)
+	}
+
+	var out fusekernel.EntryOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if out.Nodeid != target || out.Attr.Ino != target || out.Attr.Nlink != 2 {
+		t.Errorf("Got entry for inode %v with attributes %+v", out.Nodeid, out.Attr)
+	}
+}
+
+func TestTrackLookupCounts(t *testing.T) {
+	var buf bytes.Buffer
+	server := newConnServer(fuseutil.NewFileSystemServer(lookupCountFS{
+		&readDirPlusFS{
+			names:    []string{".", "..", "foo", "bar"},
+			listings: make(map[fuseops.HandleID][]string),
+		},
+	}))
+
+	k, err := fakekernel.Mount(server, &fuse.MountConfig{
+		EnableReaddirplus: true,
+		TrackLookupCounts: true,
+		ErrorLogger:       log.New(&buf, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	c := <-server.conns
+
+	lookup := func(name string) {
+		m, err := k.Do(fusekernel.OpLookup, 1, fakekernel.String(name))
+		if err != nil {
+			t.Fatalf("Do(OpLookup): %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 && errno != syscall.ENOENT {
+			t.Fatalf("LookUpInode(%q): errno %v", name, errno)
+		}
+	}
+
+	// Forgets aren't replied to, but are handled before the next op is read.
+	forget := func(inode uint64, n uint64) {
+		h := k.Header(fusekernel.OpForget, inode)
+		if err := k.Send(h, fakekernel.Bytes(&fusekernel.ForgetIn{Nlookup: n})); err != nil {
+			t.Fatalf("Send(OpForget): %v", err)
+		}
+
+		lookup("missing")
+	}
+
+	lookup("foo")
+	lookup("foo")
+	lookup("missing")
+
+	// Room for ".", ".." and "foo" (inode 102) but not "bar", with "." and ".."
+	// not counted.
+	size := uint32(3 * fuseutil.DirentPlusSize(fuseops.DirentPlus{Name: "foo"}))
+	readdirplus(t, k, opendir(t, k), 0, size)
+
+	want := map[fuseops.InodeID]uint64{1: 1, 2: 2, 100: 0, 101: 0, 102: 1, 103: 0}
+	for inode, n := range want {
+		if got := c.LookupCount(inode); got != n {
+			t.Errorf("LookupCount(%v) = %d, want %d", inode, got, n)
+		}
+	}
+
+	forget(2, 1)
+	if got := c.LookupCount(2); got != 1 {
+		t.Errorf("LookupCount(2) after forget = %d, want 1", got)
+	}
+
+	forget(102, 3)
+	if got := c.LookupCount(102); got != 0 {
+		t.Errorf("LookupCount(102) after forget = %d, want 0", got)
+	}
+
+	// The log is written to at unmount, so it can only be read afterward. The
+	// over-forget is logged, and so is inode 2, which is left behind.
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	wantLog := "TrackLookupCounts: inode 102 forgotten 3 times, but its lookup count was 1\n" +
+		"TrackLookupCounts: inode 2 still has lookup count 1 at unmount\n"
+	if got := buf.String(); got != wantLog {
+		t.Errorf("Log = %q, want %q", got, wantLog)
+	}
+}
+
+func TestCreateNonRegular(t *testing.T) {
+	k := mountFS(t, &pointerFS{}, nil)
+	defer k.Close()
+
+	create := append(
+		fakekernel.Bytes(&fusekernel.CreateIn{
+			Flags: uint32(os.O_CREATE | os.O_EXCL | os.O_WRONLY),
+			Mode:  0644,
+		}),
+		fakekernel.String("foo")...)
+	m, err := k.Do(fusekernel.OpCreate, 1, create)
+	if err != nil {
+		t.Fatalf("Do(OpCreate): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.EEXIST; got != want {
+		t.Errorf("CreateFile: got errno %v, want %v", got, want)
+	}
+
+	// The kernel is told to forget that "foo" doesn't exist.
+	m, err = k.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	if m.Header.Unique != 0 || m.Header.Error != fusekernel.NotifyCodeInvalEntry {
+		t.Fatalf("Unexpected header: %+v", m.Header)
+	}
+
+	var out fusekernel.NotifyInvalEntryOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if got := string(m.Data[unsafe.Sizeof(out):]); out.Parent != 1 || got != "foo\x00" {
+		t.Errorf("Got parent %d, name %q, want 1, \"foo\"", out.Parent, got)
+	}
+}
+
+func TestCoalesceForgets(t *testing.T) {
+	fs := &forgetFS{counts: make(map[fuseops.InodeID]uint64)}
+	k := mountFS(t, fs, &fuse.MountConfig{CoalesceForgets: true})
+
+	forget := func(inode uint64, n uint64) {
+		h := k.Header(fusekernel.OpForget, inode)
+		if err := k.Send(h, fakekernel.Bytes(&fusekernel.ForgetIn{Nlookup: n})); err != nil {
+			t.Fatalf("Send(OpForget): %v", err)
+		}
+	}
+
+	// A run of forgets ends at the next op...
+	forget(2, 1)
+	forget(3, 2)
+	forget(2, 3)
+	if _, err := k.Do(fusekernel.OpStatfs, 1); err != nil {
+		t.Fatalf("Do(OpStatfs): %v", err)
+	}
+
+	// ...or shortly after its first forget, even if nothing follows.
+	forget(3, 1)
+	forget(4, 5)
+	for deadline := time.Now().Add(time.Second); ; {
+		fs.mu.Lock()
+		batches := fs.batches
+		fs.mu.Unlock()
+
+		if batches >= 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("The last run of forgets wasn't handed out")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+	k.Close()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.singles != 0 {
+		t.Errorf("Got %d ForgetInode calls, want none", fs.singles)
+	}
+
+	// Runs may be split if the test is slow, but not joined.
+	if fs.batches < 2 || fs.batches > 5 {
+		t.Errorf("Got %d BatchForget calls, want 2 to 5", fs.batches)
+	}
+
+	want := map[fuseops.InodeID]uint64{2: 4, 3: 3, 4: 5}
+	if !reflect.DeepEqual(fs.counts, want) {
+		t.Errorf("Forgotten: got %v, want %v", fs.counts, want)
+	}
+}
@@ -33,4 +33,14 @@
 // have FUSE for OS X installed (see http://osxfuse.github.io/). Do note that
 // there are several OS X-specific oddities; grep through the documentation for
 // more info.
+//
+// On FreeBSD, the fusefs kernel module must be loaded (kldload fusefs), and
+// mounting as a user other than root requires the vfs.usermount sysctl. The
+// FreeBSD kernel speaks the same protocol as Linux, but supports fewer of its
+// features; Connection.Capabilities says which were negotiated.
+//
+// Windows is not supported. This package speaks the FUSE protocol over a
+// kernel device, whereas WinFsp's FUSE compatibility layer is a C API that
+// calls into the file system in-process, so supporting it would take a
+// separate cgo backend rather than a port of Mount.
 package fuse
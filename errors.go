@@ -14,17 +14,128 @@
 
 package fuse
 
-import "syscall"
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
 
 const (
 	// Errors corresponding to kernel error numbers. These may be treated
 	// specially by Connection.Reply.
-	EEXIST    = syscall.EEXIST
-	EINVAL    = syscall.EINVAL
-	EIO       = syscall.EIO
-	ENOATTR   = syscall.ENODATA
-	ENOENT    = syscall.ENOENT
-	ENOSYS    = syscall.ENOSYS
-	ENOTDIR   = syscall.ENOTDIR
-	ENOTEMPTY = syscall.ENOTEMPTY
+	EACCES     = syscall.EACCES
+	EBADF      = syscall.EBADF
+	EEXIST     = syscall.EEXIST
+	EINVAL     = syscall.EINVAL
+	EIO        = syscall.EIO
+	ENOENT     = syscall.ENOENT
+	ENOSPC     = syscall.ENOSPC
+	ENOSYS     = syscall.ENOSYS
+	ENOTDIR    = syscall.ENOTDIR
+	ENOTEMPTY  = syscall.ENOTEMPTY
+	EOPNOTSUPP = syscall.EOPNOTSUPP
+	EPERM      = syscall.EPERM
+	ERANGE     = syscall.ERANGE
+	EROFS      = syscall.EROFS
+	ESTALE     = syscall.ESTALE
 )
+
+// Errno returns the error number with which the kernel is told about err when
+// a file system returns it from an op, so that file systems can return errors
+// from the os package and the like without translating them:
+//
+//   - The first error in err's chain that is a syscall.Errno, or that has an
+//     Errno method, decides. This covers wrapped errors such as *os.PathError
+//     from failed system calls, while letting an error that states its errno
+//     override whatever it wraps.
+//
+//   - Otherwise, os.ErrNotExist, os.ErrPermission and os.ErrExist map to
+//     ENOENT, EACCES and EEXIST, and context.Canceled and
+//     context.DeadlineExceeded to EINTR and ETIMEDOUT.
+//
+// Any other error maps to EIO, and nil to zero.
+func Errno(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+
+	if errno, ok := findErrno(err); ok {
+		return errno
+	}
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ENOENT
+
+	case errors.Is(err, os.ErrPermission):
+		return EACCES
+
+	case errors.Is(err, os.ErrExist):
+		return EEXIST
+
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+
+	case errors.Is(err, context.DeadlineExceeded):
+		return syscall.ETIMEDOUT
+	}
+
+	return EIO
+}
+
+// Walk err's chain in the order that errors.As does, returning the errno of
+// the first error that is one or has an Errno method.
+func findErrno(err error) (syscall.Errno, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case syscall.Errno:
+			return e, true
+
+		case errnoer:
+			return e.Errno(), true
+
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				if errno, ok := findErrno(err); ok {
+					return errno, true
+				}
+			}
+
+			return 0, false
+		}
+
+		err = errors.Unwrap(err)
+	}
+
+	return 0, false
+}
+
+// An error that knows which errno to report for it.
+type errnoer interface {
+	Errno() syscall.Errno
+}
+
+// NewErrno returns an error that reports the supplied errno to the kernel,
+// however deeply it is wrapped (e.g. with fmt.Errorf and %w) before being
+// returned from an op. Its Unwrap method returns the errno itself, so that
+// errors.Is(err, syscall.EROFS) and the like hold for it.
+func NewErrno(errno syscall.Errno) error {
+	return &errnoError{errno}
+}
+
+type errnoError struct {
+	errno syscall.Errno
+}
+
+func (e *errnoError) Error() string {
+	return e.errno.Error()
+}
+
+func (e *errnoError) Errno() syscall.Errno {
+	return e.errno
+}
+
+func (e *errnoError) Unwrap() error {
+	return e.errno
+}
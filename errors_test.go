@@ -0,0 +1,91 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+)
+
+// An error that knows its own errno.
+type errnoError struct{}
+
+func (errnoError) Error() string        { return "taco" }
+func (errnoError) Errno() syscall.Errno { return syscall.ENOSPC }
+
+// An error that knows its own errno, whatever it wraps.
+type wrappingErrnoError struct {
+	err error
+}
+
+func (e wrappingErrnoError) Error() string        { return "wrapping: " + e.err.Error() }
+func (e wrappingErrnoError) Errno() syscall.Errno { return syscall.EROFS }
+func (e wrappingErrnoError) Unwrap() error        { return e.err }
+
+func TestErrno(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{nil, 0},
+		{syscall.EROFS, syscall.EROFS},
+		{fmt.Errorf("wrapped: %w", syscall.ENOTEMPTY), syscall.ENOTEMPTY},
+		{&os.PathError{Op: "open", Path: "foo", Err: syscall.ELOOP}, syscall.ELOOP},
+		{errnoError{}, syscall.ENOSPC},
+		{fmt.Errorf("wrapped: %w", errnoError{}), syscall.ENOSPC},
+		{wrappingErrnoError{syscall.ENOENT}, syscall.EROFS},
+		{wrappingErrnoError{&os.PathError{Op: "open", Path: "foo", Err: syscall.ELOOP}}, syscall.EROFS},
+		{fmt.Errorf("wrapped: %w", wrappingErrnoError{os.ErrNotExist}), syscall.EROFS},
+		{errors.Join(errors.New("taco"), syscall.ENOTDIR), syscall.ENOTDIR},
+		{os.ErrNotExist, syscall.ENOENT},
+		{fmt.Errorf("wrapped: %w", os.ErrNotExist), syscall.ENOENT},
+		{os.ErrPermission, syscall.EACCES},
+		{os.ErrExist, syscall.EEXIST},
+		{context.Canceled, syscall.EINTR},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), syscall.ETIMEDOUT},
+		{errors.New("taco"), syscall.EIO},
+		{fuse.NewErrno(syscall.EROFS), syscall.EROFS},
+		{fmt.Errorf("writing foo: %w", fuse.NewErrno(syscall.EROFS)), syscall.EROFS},
+		{fmt.Errorf("a: %w", fmt.Errorf("b: %w", fuse.NewErrno(fuse.EACCES))), syscall.EACCES},
+	}
+
+	for _, tc := range testCases {
+		if got := fuse.Errno(tc.err); got != tc.want {
+			t.Errorf("Errno(%v): got %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestNewErrnoUnwrapsToErrno(t *testing.T) {
+	err := fmt.Errorf("writing foo: %w", fuse.NewErrno(fuse.ENOENT))
+
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("errors.Is(%v, ENOENT) is false", err)
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("errors.Is(%v, os.ErrNotExist) is false", err)
+	}
+
+	if got, want := err.Error(), "writing foo: "+syscall.ENOENT.Error(); got != want {
+		t.Errorf("Got message %q, want %q", got, want)
+	}
+}
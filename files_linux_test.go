@@ -0,0 +1,1067 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+////////////////////////////////////////////////////////////////////////
+// openFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that opens files by calling a function to fill in the op.
+type openFS struct {
+	fuseutil.NotImplementedFileSystem
+	open func(*fuseops.OpenFileOp)
+}
+
+func (fs *openFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.open(op)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// readFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system serving vectored reads of zeroes, copied into
+// ReadFileOp.Buffer when one is supplied and into a fresh buffer otherwise.
+// If record is set, it remembers the buffers it was given.
+type readFS struct {
+	fuseutil.NotImplementedFileSystem
+	record bool
+
+	mu      sync.Mutex
+	buffers [][]byte // GUARDED_BY(mu)
+}
+
+func (fs *readFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if fs.record {
+		fs.mu.Lock()
+		fs.buffers = append(fs.buffers, op.Buffer)
+		fs.mu.Unlock()
+	}
+
+	buf := op.Buffer
+	if buf == nil {
+		buf = make([]byte, op.Size)
+	}
+
+	op.BytesRead = copy(buf, zeroes[:op.Size])
+	op.Data = [][]byte{buf[:op.BytesRead]}
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *readFS) readBuffers() [][]byte {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.buffers
+}
+
+func read(tb testing.TB, k *fakekernel.Kernel, fh uint64, offset uint64) {
+	m, err := k.Do(fusekernel.OpRead, 2, fakekernel.Bytes(&fusekernel.ReadIn{
+		Fh:     fh,
+		Offset: offset,
+		Size:   readSize,
+	}))
+	if err != nil {
+		tb.Fatalf("Do(OpRead): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		tb.Fatalf("ReadFile: errno %v", errno)
+	}
+
+	if len(m.Data) != readSize {
+		tb.Fatalf("ReadFile: got %d bytes, want %d", len(m.Data), readSize)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// growingFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system with a file that is still being written until done is set,
+// reads of which past what has been written so far are short.
+type growingFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu   sync.Mutex
+	data []byte // GUARDED_BY(mu)
+	done bool   // GUARDED_BY(mu)
+}
+
+func (fs *growingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Offset < int64(len(fs.data)) {
+		op.BytesRead = copy(op.Dst, fs.data[op.Offset:])
+	}
+
+	op.ShortRead = op.BytesRead < len(op.Dst) && !fs.done
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *growingFS) finish() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.done = true
+}
+
+////////////////////////////////////////////////////////////////////////
+// spliceFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that serves reads from a file on another file system.
+type spliceFS struct {
+	fuseutil.NotImplementedFileSystem
+	f *os.File
+}
+
+func (fs *spliceFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	op.SpliceFile = fs.f
+	op.SpliceOffset = op.Offset
+	op.BytesRead = int(op.Size)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// tmpfileFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that creates unnamed files as inode 7, opened as handle 11.
+type tmpfileFS struct {
+	fuseutil.NotImplementedFileSystem
+	op fuseops.CreateTmpfileOp
+}
+
+func (fs *tmpfileFS) CreateTmpfile(
+	ctx context.Context,
+	op *fuseops.CreateTmpfileOp) error {
+	fs.op = *op
+	op.Entry.Child = 7
+	op.Entry.Attributes = fuseops.InodeAttributes{Mode: op.Mode}
+	op.Handle = 11
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// killPrivFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that remembers whether the last write and setattr asked for
+// the setuid and setgid bits to be cleared.
+type killPrivFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu           sync.Mutex
+	writeKill    bool // GUARDED_BY(mu)
+	truncateKill bool // GUARDED_BY(mu)
+}
+
+func (fs *killPrivFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.writeKill = op.KillSuidgid
+	return nil
+}
+
+func (fs *killPrivFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.truncateKill = op.KillSuidgid
+	op.Attributes = fuseops.InodeAttributes{Mode: 0644}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// appendFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system with a single file, whose writes in append mode go to the end
+// of the file whatever their offset.
+type appendFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu       sync.Mutex
+	contents []byte // GUARDED_BY(mu)
+}
+
+func (fs *appendFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	offset := int(op.Offset)
+	if op.OpenFlags.IsAppend() {
+		offset = len(fs.contents)
+	}
+
+	if end := offset + len(op.Data); end > len(fs.contents) {
+		fs.contents = append(fs.contents, make([]byte, end-len(fs.contents))...)
+	}
+
+	copy(fs.contents[offset:], op.Data)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// shortWriteFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that reports writes as having written whatever write says,
+// given the default.
+type shortWriteFS struct {
+	fuseutil.NotImplementedFileSystem
+	write func(n int) int
+}
+
+func (fs *shortWriteFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	op.BytesWritten = fs.write(op.BytesWritten)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// ioctlFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that supports FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, with the
+// int-sized argument that chattr(1) and the kernel use, for a single set of
+// flags.
+type ioctlFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu    sync.Mutex
+	flags uint32 // GUARDED_BY(mu)
+}
+
+func (fs *ioctlFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch op.Cmd {
+	case unix.FS_IOC_GETFLAGS:
+		op.Output = binary.LittleEndian.AppendUint32(nil, fs.flags)
+		return nil
+
+	case unix.FS_IOC_SETFLAGS:
+		if len(op.Input) < 4 {
+			return syscall.EINVAL
+		}
+
+		fs.flags = binary.LittleEndian.Uint32(op.Input)
+		return nil
+	}
+
+	return syscall.ENOTTY
+}
+
+// FS_IMMUTABLE_FL from linux/fs.h, set by chattr +i.
+const fsImmutableFL = 0x10
+
+////////////////////////////////////////////////////////////////////////
+// daxFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that remembers the DAX mapping ops it is sent.
+type daxFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	setup   fuseops.SetupMappingOp // GUARDED_BY(mu)
+	removed []fuseops.WindowRange  // GUARDED_BY(mu)
+}
+
+func (fs *daxFS) SetupMapping(
+	ctx context.Context,
+	op *fuseops.SetupMappingOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.setup = *op
+	return nil
+}
+
+func (fs *daxFS) RemoveMapping(
+	ctx context.Context,
+	op *fuseops.RemoveMappingOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.removed = op.Mappings
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestHandleReadBuffers(t *testing.T) {
+	fs := &readFS{record: true}
+	k := mountFS(t, fs, &fuse.MountConfig{
+		UseVectoredRead:   true,
+		HandleReadBuffers: true,
+	})
+	defer k.Close()
+
+	// Sequential reads on one handle reuse buffers, and another handle gets its
+	// own. (A read may arrive before the previous one has given its buffer back,
+	// so we can't say exactly how many buffers there are.)
+	const n = 10
+	for i := 0; i < n; i++ {
+		read(t, k, 17, uint64(i)*readSize)
+	}
+
+	read(t, k, 19, 0)
+
+	// Once the handle is released its buffers are gone. (The file system doesn't
+	// implement ReleaseFileHandle, but errors from it are ignored anyway.)
+	if _, err := k.Do(fusekernel.OpRelease, 2, fakekernel.Bytes(&fusekernel.ReleaseIn{Fh: 17})); err != nil {
+		t.Fatalf("Do(OpRelease): %v", err)
+	}
+
+	read(t, k, 17, 0)
+
+	buffers := fs.readBuffers()
+	seen := make(map[*byte]bool)
+	for i, b := range buffers {
+		if len(b) != readSize {
+			t.Fatalf("Read %d: got a buffer of %d bytes, want %d", i, len(b), readSize)
+		}
+
+		if i < n {
+			seen[&b[0]] = true
+		}
+	}
+
+	if len(seen) == n {
+		t.Errorf("%d sequential reads on one handle got %d buffers", n, len(seen))
+	}
+
+	if seen[&buffers[n][0]] {
+		t.Errorf("Reads on different handles got the same buffer")
+	}
+
+	if seen[&buffers[n+1][0]] {
+		t.Errorf("Read after release got one of the released handle's buffers")
+	}
+}
+
+func BenchmarkSequentialRead(b *testing.B) {
+	for _, handleReadBuffers := range []bool{false, true} {
+		name := fmt.Sprintf("HandleReadBuffers=%v", handleReadBuffers)
+		b.Run(name, func(b *testing.B) {
+			fs := &readFS{}
+			k := mountFS(b, fs, &fuse.MountConfig{
+				UseVectoredRead:   true,
+				HandleReadBuffers: handleReadBuffers,
+			})
+			defer k.Close()
+
+			b.SetBytes(readSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				read(b, k, 17, uint64(i)*readSize)
+			}
+		})
+	}
+}
+
+func TestOpenResponseFlags(t *testing.T) {
+	testCases := []struct {
+		name string
+		open func(*fuseops.OpenFileOp)
+		want fusekernel.OpenResponseFlags
+	}{
+		{"none", func(op *fuseops.OpenFileOp) {}, 0},
+		{"KeepPageCache", func(op *fuseops.OpenFileOp) { op.KeepPageCache = true }, fusekernel.OpenKeepCache},
+		{"UseDirectIO", func(op *fuseops.OpenFileOp) { op.UseDirectIO = true }, fusekernel.OpenDirectIO},
+		{"Nonseekable", func(op *fuseops.OpenFileOp) { op.Nonseekable = true }, fusekernel.OpenNonSeekable},
+		{
+			"NonseekableDirectIO",
+			func(op *fuseops.OpenFileOp) {
+				op.Nonseekable = true
+				op.UseDirectIO = true
+			},
+			fusekernel.OpenNonSeekable | fusekernel.OpenDirectIO,
+		},
+		{"Stream", func(op *fuseops.OpenFileOp) { op.Stream = true }, fusekernel.OpenStream},
+		{"NoFlush", func(op *fuseops.OpenFileOp) { op.NoFlush = true }, fusekernel.OpenNoFlush},
+		{
+			"ParallelDirectWrites",
+			func(op *fuseops.OpenFileOp) {
+				op.UseDirectIO = true
+				op.ParallelDirectWrites = true
+			},
+			fusekernel.OpenDirectIO | fusekernel.OpenParallelDirectWrites,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &openFS{open: tc.open}
+			k := mountFS(t, fs, nil)
+			defer k.Close()
+
+			m, err := k.Do(fusekernel.OpOpen, 2, fakekernel.Bytes(&fusekernel.OpenIn{}))
+			if err != nil {
+				t.Fatalf("Do(OpOpen): %v", err)
+			}
+
+			if errno := m.Errno(); errno != 0 {
+				t.Fatalf("OpenFile: errno %v", errno)
+			}
+
+			var out fusekernel.OpenOut
+			if err := fakekernel.Decode(m.Data, &out); err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			if got := fusekernel.OpenResponseFlags(out.OpenFlags); got != tc.want {
+				t.Errorf("Got flags %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	const backingID = 3
+	server := newConnServer(fuseutil.NewFileSystemServer(&openFS{
+		open: func(op *fuseops.OpenFileOp) { op.BackingID = backingID },
+	}))
+
+	cfg := &fuse.MountConfig{
+		EnablePassthrough:       true,
+		DisableWritebackCaching: true,
+	}
+
+	k, err := fakekernel.MountWithInit(server, cfg, fusekernel.InitIn{
+		Major:        7,
+		Minor:        40,
+		MaxReadahead: 1 << 20,
+		Flags:        uint32(fusekernel.InitExt),
+		Flags2:       uint32(fusekernel.InitPassthrough >> 32),
+	})
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	<-server.conns
+
+	flags := fusekernel.InitFlags(k.Init.Flags) | fusekernel.InitFlags(k.Init.Flags2)<<32
+	if flags&fusekernel.InitPassthrough == 0 {
+		t.Errorf("InitPassthrough not requested: %v", flags)
+	}
+
+	if k.Init.MaxStackDepth != 1 {
+		t.Errorf("Got max stack depth %d, want 1", k.Init.MaxStackDepth)
+	}
+
+	m, err := k.Do(fusekernel.OpOpen, 2, fakekernel.Bytes(&fusekernel.OpenIn{}))
+	if err != nil {
+		t.Fatalf("Do(OpOpen): %v", err)
+	}
+
+	var out fusekernel.OpenOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if fusekernel.OpenResponseFlags(out.OpenFlags)&fusekernel.OpenPassthrough == 0 {
+		t.Errorf("OpenPassthrough not set: %v", fusekernel.OpenResponseFlags(out.OpenFlags))
+	}
+
+	if out.BackingID != backingID {
+		t.Errorf("Got backing ID %d, want %d", out.BackingID, backingID)
+	}
+}
+
+func TestPassthroughNotNegotiated(t *testing.T) {
+	server := newConnServer(fuseutil.NewFileSystemServer(&attrFS{}))
+
+	// The kernel doesn't offer passthrough.
+	cfg := &fuse.MountConfig{
+		EnablePassthrough:       true,
+		DisableWritebackCaching: true,
+	}
+
+	k, err := fakekernel.Mount(server, cfg)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	c := <-server.conns
+
+	if k.Init.MaxStackDepth != 0 {
+		t.Errorf("Got max stack depth %d, want 0", k.Init.MaxStackDepth)
+	}
+
+	if _, err := c.OpenBackingFd(0); err == nil {
+		t.Errorf("OpenBackingFd succeeded without passthrough")
+	}
+}
+
+func TestHandleKillPriv(t *testing.T) {
+	fs := &killPrivFS{}
+	k := mountFS(t, fs, &fuse.MountConfig{HandleKillPriv: true})
+	defer k.Close()
+
+	if fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitHandleKillprivV2 == 0 {
+		t.Errorf("InitHandleKillprivV2 not in %v", fusekernel.InitFlags(k.Init.Flags))
+	}
+
+	data := []byte("taco")
+	write := fusekernel.WriteIn{
+		Fh:         17,
+		Size:       uint32(len(data)),
+		WriteFlags: uint32(fusekernel.WriteKillSuidgid),
+	}
+
+	m, err := k.Do(fusekernel.OpWrite, 2, fakekernel.Bytes(&write), data)
+	if err != nil {
+		t.Fatalf("Do(OpWrite): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("WriteFile: errno %v", errno)
+	}
+
+	var setattr fusekernel.SetattrIn
+	setattr.Valid = uint32(fusekernel.SetattrSize | fusekernel.SetattrKillSuidgid)
+	m, err = k.Do(fusekernel.OpSetattr, 2, fakekernel.Bytes(&setattr))
+	if err != nil {
+		t.Fatalf("Do(OpSetattr): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("SetInodeAttributes: errno %v", errno)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.writeKill || !fs.truncateKill {
+		t.Errorf("Got KillSuidgid %v for the write and %v for the truncation", fs.writeKill, fs.truncateKill)
+	}
+}
+
+func TestAppendingWrites(t *testing.T) {
+	fs := &appendFS{}
+	k := mountFS(t, fs, &fuse.MountConfig{DisableWritebackCaching: true})
+	defer k.Close()
+
+	// Two processes append to the file at once, both believing it to be empty.
+	for _, data := range []string{"taco", "burrito"} {
+		in := fusekernel.WriteIn{
+			Fh:    17,
+			Size:  uint32(len(data)),
+			Flags: uint32(os.O_WRONLY | os.O_APPEND),
+		}
+
+		h := k.Header(fusekernel.OpWrite, 2)
+		if err := k.Send(h, fakekernel.Bytes(&in), []byte(data)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		m, err := k.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Errorf("WriteFile: errno %v", errno)
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if got := string(fs.contents); got != "tacoburrito" && got != "burritotaco" {
+		t.Errorf("Got contents %q", got)
+	}
+}
+
+func TestHandleReadBuffersDisabledWithRequestBufferReuse(t *testing.T) {
+	fs := &readFS{record: true}
+	k := mountFS(t, fs, &fuse.MountConfig{
+		UseVectoredRead:           true,
+		HandleReadBuffers:         true,
+		DisableRequestBufferReuse: true,
+	})
+	defer k.Close()
+
+	read(t, k, 17, 0)
+
+	if buffers := fs.readBuffers(); len(buffers) != 1 || buffers[0] != nil {
+		t.Errorf("Got read buffers %v, want none", buffers)
+	}
+}
+
+func TestShortWrites(t *testing.T) {
+	testCases := []struct {
+		name      string
+		write     func(n int) int
+		wantSize  uint32
+		wantErrno syscall.Errno
+	}{
+		{"Default", func(n int) int { return n }, 4, 0},
+		{"Short", func(n int) int { return 3 }, 3, 0},
+		{"None", func(n int) int { return 0 }, 0, 0},
+		{"TooMany", func(n int) int { return 5 }, 0, syscall.EIO},
+		{"Negative", func(n int) int { return -1 }, 0, syscall.EIO},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			k := mountFS(t, &shortWriteFS{write: tc.write}, nil)
+			defer k.Close()
+
+			h, payload := newWrite(k)
+			if err := k.Send(h, payload); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+
+			m, err := k.Recv()
+			if err != nil {
+				t.Fatalf("Recv: %v", err)
+			}
+
+			if got := m.Errno(); got != tc.wantErrno {
+				t.Fatalf("Got errno %v, want %v", got, tc.wantErrno)
+			}
+
+			if tc.wantErrno != 0 {
+				return
+			}
+
+			var out fusekernel.WriteOut
+			if err := fakekernel.Decode(m.Data, &out); err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			if out.Size != tc.wantSize {
+				t.Errorf("Got size %d, want %d", out.Size, tc.wantSize)
+			}
+		})
+	}
+}
+
+func TestIoctl(t *testing.T) {
+	k := mountFS(t, &ioctlFS{}, nil)
+	defer k.Close()
+
+	ioctl := func(cmd uint32, input []byte, outSize uint32) ([]byte, syscall.Errno) {
+		in := fusekernel.IoctlIn{
+			Fh:      1,
+			Cmd:     cmd,
+			InSize:  uint32(len(input)),
+			OutSize: outSize,
+		}
+
+		m, err := k.Do(fusekernel.OpIoctl, 2, fakekernel.Bytes(&in), input)
+		if err != nil {
+			t.Fatalf("Do(OpIoctl): %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			return nil, errno
+		}
+
+		var out fusekernel.IoctlOut
+		if err := fakekernel.Decode(m.Data, &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		return m.Data[unsafe.Sizeof(out):], 0
+	}
+
+	// chattr +i
+	flags := binary.LittleEndian.AppendUint32(nil, fsImmutableFL)
+	if _, errno := ioctl(unix.FS_IOC_SETFLAGS, flags, 0); errno != 0 {
+		t.Fatalf("FS_IOC_SETFLAGS: %v", errno)
+	}
+
+	// lsattr
+	out, errno := ioctl(unix.FS_IOC_GETFLAGS, nil, 4)
+	if errno != 0 {
+		t.Fatalf("FS_IOC_GETFLAGS: %v", errno)
+	}
+
+	if len(out) != 4 || binary.LittleEndian.Uint32(out) != fsImmutableFL {
+		t.Errorf("FS_IOC_GETFLAGS: got %x", out)
+	}
+
+	// More output than the caller has room for can't be sent.
+	if _, errno := ioctl(unix.FS_IOC_GETFLAGS, nil, 2); errno != syscall.EIO {
+		t.Errorf("FS_IOC_GETFLAGS into 2 bytes: got errno %v, want EIO", errno)
+	}
+
+	if _, errno := ioctl(0x1234, nil, 0); errno != syscall.ENOTTY {
+		t.Errorf("Unknown ioctl: got errno %v, want ENOTTY", errno)
+	}
+
+	// While the file system is read-only, ioctls that pass data in are turned
+	// away, but those that only read aren't.
+	if err := k.MountedFileSystem().SetReadOnly(true); err != nil {
+		t.Fatalf("SetReadOnly: %v", err)
+	}
+
+	if _, errno := ioctl(unix.FS_IOC_SETFLAGS, flags, 0); errno != syscall.EROFS {
+		t.Errorf("FS_IOC_SETFLAGS while read-only: got errno %v, want EROFS", errno)
+	}
+
+	if _, errno := ioctl(unix.FS_IOC_GETFLAGS, nil, 4); errno != 0 {
+		t.Errorf("FS_IOC_GETFLAGS while read-only: %v", errno)
+	}
+}
+
+func TestDAXMappings(t *testing.T) {
+	fs := &daxFS{}
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	setup := fusekernel.SetupmappingIn{
+		Fh:      3,
+		Foffset: 1 << 21,
+		Len:     1 << 21,
+		Flags:   fuseops.SetupMappingRead | fuseops.SetupMappingWrite,
+		Moffset: 4 << 21,
+	}
+
+	if m, err := k.Do(fusekernel.OpSetupmapping, 2, fakekernel.Bytes(&setup)); err != nil || m.Errno() != 0 {
+		t.Fatalf("Do(OpSetupmapping): %v, %v", m, err)
+	}
+
+	remove := []fusekernel.RemovemappingOne{
+		{Moffset: 4 << 21, Len: 1 << 21},
+		{Moffset: 6 << 21, Len: 1 << 21},
+	}
+
+	m, err := k.Do(
+		fusekernel.OpRemovemapping,
+		2,
+		fakekernel.Bytes(&fusekernel.RemovemappingIn{Count: 2}),
+		fakekernel.Bytes(&remove[0]),
+		fakekernel.Bytes(&remove[1]))
+	if err != nil || m.Errno() != 0 {
+		t.Fatalf("Do(OpRemovemapping): %v, %v", m, err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	got := fs.setup
+	if got.Inode != 2 ||
+		got.Handle != 3 ||
+		got.Offset != setup.Foffset ||
+		got.Length != setup.Len ||
+		got.Flags != setup.Flags ||
+		got.WindowOffset != setup.Moffset {
+		t.Errorf("Got SetupMappingOp %+v", got)
+	}
+
+	want := []fuseops.WindowRange{
+		{Offset: 4 << 21, Length: 1 << 21},
+		{Offset: 6 << 21, Length: 1 << 21},
+	}
+	if len(fs.removed) != len(want) || fs.removed[0] != want[0] || fs.removed[1] != want[1] {
+		t.Errorf("Got removed mappings %v, want %v", fs.removed, want)
+	}
+}
+
+func TestShortReads(t *testing.T) {
+	fs := &growingFS{data: []byte("taco")}
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	read := func(offset uint64) {
+		m, err := k.Do(fusekernel.OpRead, 2, fakekernel.Bytes(&fusekernel.ReadIn{
+			Fh:     17,
+			Offset: offset,
+			Size:   4096,
+		}))
+		if err != nil {
+			t.Fatalf("Do(OpRead): %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("ReadFile: errno %v", errno)
+		}
+	}
+
+	// A read that is short because there's no more data yet is followed by an
+	// invalidation from the end of the read on.
+	read(2)
+
+	m, err := k.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	if m.Header.Unique != 0 || m.Header.Error != fusekernel.NotifyCodeInvalInode {
+		t.Fatalf("Got %+v, want an inode invalidation", m.Header)
+	}
+
+	var out fusekernel.NotifyInvalInodeOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	want := fusekernel.NotifyInvalInodeOut{Ino: 2, Off: 4, Len: 0}
+	if out != want {
+		t.Errorf("Got %+v, want %+v", out, want)
+	}
+
+	// Once the file is finished, a short read is EOF, so that the next reply
+	// is for the next read.
+	fs.finish()
+	read(2)
+	read(0)
+}
+
+func TestStats(t *testing.T) {
+	server := newConnServer(fuseutil.NewFileSystemServer(&shortWriteFS{
+		write: func(n int) int { return 3 },
+	}))
+
+	k, err := fakekernel.Mount(server, nil)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	defer k.Close()
+	c := <-server.conns
+
+	for i := 0; i < 2; i++ {
+		h, payload := newWrite(k)
+		if err := k.Send(h, payload); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+
+		if _, err := k.Recv(); err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+	}
+
+	// The file system doesn't implement reads, so they fail and read nothing.
+	if _, err := k.Do(fusekernel.OpRead, 2, fakekernel.Bytes(&fusekernel.ReadIn{Fh: 17, Size: 4})); err != nil {
+		t.Fatalf("Do(OpRead): %v", err)
+	}
+
+	want := fuse.ConnectionStats{
+		Ops: 3,
+		OpsByType: map[string]uint64{
+			"WriteFileOp": 2,
+			"ReadFileOp":  1,
+		},
+		BytesWritten: 6,
+	}
+
+	if got := c.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestBackgroundOps(t *testing.T) {
+	fs := newWriteFS()
+	server := newConnServer(fuseutil.NewFileSystemServer(fs))
+
+	k, err := fakekernel.Mount(server, nil)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	defer k.Close()
+	c := <-server.conns
+
+	// A write back from the page cache, and one from write(2).
+	data := []byte("taco")
+	for _, flags := range []fusekernel.WriteFlags{fusekernel.WriteCache, 0} {
+		in := fusekernel.WriteIn{Fh: 17, Size: uint32(len(data)), WriteFlags: uint32(flags)}
+		if err := k.Send(k.Header(fusekernel.OpWrite, 2), append(fakekernel.Bytes(&in), data...)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+
+		<-fs.started
+	}
+
+	if got := c.BackgroundOps(); got != 1 {
+		t.Errorf("BackgroundOps while writing: got %d, want 1", got)
+	}
+
+	if got := c.Stats().BackgroundOps; got != 1 {
+		t.Errorf("Stats().BackgroundOps while writing: got %d, want 1", got)
+	}
+
+	close(fs.release)
+	for i := 0; i < 2; i++ {
+		if _, err := k.Recv(); err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+	}
+
+	if got := c.BackgroundOps(); got != 0 {
+		t.Errorf("BackgroundOps after writing: got %d, want 0", got)
+	}
+}
+
+func TestSpliceFile(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString("burrito"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	// The fake kernel is a socket rather than the device, so the data is
+	// copied rather than spliced; see splice_linux_test.go for that.
+	k := mountFS(t, &spliceFS{f: f}, &fuse.MountConfig{EnableSplice: true})
+	defer k.Close()
+
+	if k.Init.Flags&uint32(fusekernel.InitSpliceWrite) == 0 {
+		t.Errorf("FUSE_SPLICE_WRITE not negotiated: %v", k.Init.Flags)
+	}
+
+	testCases := []struct {
+		offset uint64
+		size   uint32
+		want   string
+	}{
+		{0, 3, "bur"},
+		{2, 100, "rrito"},
+		{7, 10, ""},
+	}
+
+	for _, tc := range testCases {
+		m, err := k.Do(fusekernel.OpRead, 2, fakekernel.Bytes(&fusekernel.ReadIn{
+			Fh:     17,
+			Offset: tc.offset,
+			Size:   tc.size,
+		}))
+		if err != nil {
+			t.Fatalf("Do(OpRead): %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("ReadFile: errno %v", errno)
+		}
+
+		if got := string(m.Data); got != tc.want {
+			t.Errorf("Read %d bytes at %d: got %q, want %q", tc.size, tc.offset, got, tc.want)
+		}
+	}
+}
+
+func TestCreateTmpfile(t *testing.T) {
+	// The input is that of a create, named "/".
+	tmpfile := append(
+		fakekernel.Bytes(&fusekernel.CreateIn{
+			Flags: uint32(os.O_RDWR) | unix.O_TMPFILE,
+			Mode:  syscall.S_IFREG | 0640,
+			Umask: 022,
+		}),
+		fakekernel.String("/")...)
+
+	fs := &tmpfileFS{}
+	k := mountFS(t, fs, nil)
+
+	m, err := k.Do(fusekernel.OpTmpfile, 1, tmpfile)
+	if err != nil {
+		t.Fatalf("Do(OpTmpfile): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("CreateTmpfile: errno %v", errno)
+	}
+
+	var out struct {
+		Entry fusekernel.EntryOut
+		Open  fusekernel.OpenOut
+	}
+
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if out.Entry.Nodeid != 7 || out.Entry.Attr.Mode != syscall.S_IFREG|0640 || out.Open.Fh != 11 {
+		t.Errorf("Got %+v", out)
+	}
+
+	k.Close()
+
+	if fs.op.Parent != 1 || fs.op.Mode != 0640 || fs.op.Umask != 022 {
+		t.Errorf("Got op %+v", fs.op)
+	}
+
+	// File systems that don't implement it leave the kernel to fall back.
+	k = mountFS(t, &fuseutil.NotImplementedFileSystem{}, nil)
+	defer k.Close()
+
+	m, err = k.Do(fusekernel.OpTmpfile, 1, tmpfile)
+	if err != nil {
+		t.Fatalf("Do(OpTmpfile): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.ENOSYS; got != want {
+		t.Errorf("CreateTmpfile: got errno %v, want %v", got, want)
+	}
+}
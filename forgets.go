@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// How long after its first forget a batch for MountConfig.CoalesceForgets is
+// handed out, even if no other message arrives, and how many inodes it may
+// hold before it is handed out sooner.
+const (
+	forgetCoalesceWindow = 10 * time.Millisecond
+	maxCoalescedForgets  = 1024
+)
+
+// Forget ops being coalesced for MountConfig.CoalesceForgets. Touched only by
+// ReadOp, which is never called concurrently.
+type forgetBatch struct {
+	// The entries so far, with one per inode, and the index in entries of
+	// each inode.
+	entries []fuseops.BatchForgetEntry
+	index   map[fuseops.InodeID]int
+
+	// The messages and context of the first forget, which stand in for those of
+	// the batch.
+	inMsg     *buffer.InMessage
+	outMsg    *buffer.OutMessage
+	opContext fuseops.OpContext
+	start     time.Time
+
+	// When the first forget was read.
+	first time.Time
+
+	// A message read after the batch that must wait until the batch has been
+	// handed out, or the error from reading one.
+	next    *buffer.InMessage
+	nextErr error
+}
+
+// Add a forget op, read in the supplied messages, to the batch, and report
+// whether the batch is due to be handed out. Forgets of the same inode are
+// merged by adding up their counts, so that the file system is told to drop
+// exactly as many lookups as the kernel did.
+func (c *Connection) addForget(
+	inMsg *buffer.InMessage,
+	outMsg *buffer.OutMessage,
+	op *fuseops.ForgetInodeOp,
+	start time.Time) bool {
+	b := &c.forgets
+	if b.inMsg == nil {
+		b.inMsg, b.outMsg = inMsg, outMsg
+		b.opContext = op.OpContext
+		b.start = start
+		b.first = time.Now()
+		b.index = make(map[fuseops.InodeID]int)
+	} else {
+		c.putInMessage(inMsg)
+		c.putOutMessage(outMsg)
+	}
+
+	if i, ok := b.index[op.Inode]; ok {
+		b.entries[i].N += op.N
+	} else {
+		b.index[op.Inode] = len(b.entries)
+		b.entries = append(b.entries, fuseops.BatchForgetEntry{
+			Inode: op.Inode,
+			N:     op.N,
+		})
+	}
+
+	return len(b.entries) >= maxCoalescedForgets ||
+		time.Since(b.first) >= forgetCoalesceWindow
+}
+
+// Report whether there is a batch of forgets to hand out before whatever
+// comes next.
+func (c *Connection) forgetsPending() bool {
+	return c.forgets.inMsg != nil
+}
+
+// Hand out the pending forgets as a single BatchForgetOp, as ReadOp would
+// have handed out one from the kernel.
+func (c *Connection) flushForgets() (context.Context, interface{}, error) {
+	b := &c.forgets
+	op := &fuseops.BatchForgetOp{
+		Entries:   b.entries,
+		OpContext: b.opContext,
+	}
+
+	state := opState{
+		inMsg:  b.inMsg,
+		outMsg: b.outMsg,
+		op:     op,
+		start:  b.start,
+		fuseID: b.inMsg.Header().Unique,
+	}
+
+	// The first forget's header, whose opcode is OpForget, tells beginOp and
+	// finishOp not to keep state keyed on an ID that the kernel may reuse.
+	ctx := c.beginOp(fusekernel.OpForget, state.fuseID)
+	c.countOpStarted(op)
+	ctx = context.WithValue(ctx, contextKey, state)
+
+	if c.debugLogger != nil {
+		c.debugLog(state.fuseID, 1, "<- %s (coalesced)", describeRequest(op))
+	}
+
+	b.entries, b.index = nil, nil
+	b.inMsg, b.outMsg = nil, nil
+
+	return ctx, op, nil
+}
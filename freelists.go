@@ -17,6 +17,7 @@ package fuse
 import (
 	"unsafe"
 
+	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
 )
 
@@ -24,24 +25,31 @@ import (
 // buffer.InMessage
 ////////////////////////////////////////////////////////////////////////
 
-// LOCKS_EXCLUDED(c.mu)
+// Return a message to read a request into, reusing the buffer of an earlier
+// request unless MountConfig.DisableRequestBufferReuse is set. Buffers from
+// before Init that are too small for the negotiated writes are dropped.
 func (c *Connection) getInMessage() *buffer.InMessage {
-	c.mu.Lock()
-	x := (*buffer.InMessage)(c.inMessages.Get())
-	c.mu.Unlock()
+	if c.maxWrite == 0 {
+		return buffer.NewInMessage()
+	}
 
-	if x == nil {
-		x = buffer.NewInMessage()
+	if !c.cfg.DisableRequestBufferReuse {
+		if x, ok := c.inMessages.Get().(*buffer.InMessage); ok && x.MaxWrite() >= c.maxWrite {
+			return x
+		}
 	}
 
-	return x
+	return buffer.NewInMessageSize(c.maxWrite)
 }
 
-// LOCKS_EXCLUDED(c.mu)
+// Give back a message obtained from getInMessage once the request it holds has
+// been replied to. Unlike the other freelists, the pool lets the garbage
+// collector reclaim idle buffers, which are large enough to hold the biggest
+// write the kernel may send, after a burst of concurrent requests.
 func (c *Connection) putInMessage(x *buffer.InMessage) {
-	c.mu.Lock()
-	c.inMessages.Put(unsafe.Pointer(x))
-	c.mu.Unlock()
+	if !c.cfg.DisableRequestBufferReuse {
+		c.inMessages.Put(x)
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -68,3 +76,94 @@ func (c *Connection) putOutMessage(x *buffer.OutMessage) {
 	c.outMessages.Put(unsafe.Pointer(x))
 	c.mu.Unlock()
 }
+
+////////////////////////////////////////////////////////////////////////
+// Handle read buffers
+////////////////////////////////////////////////////////////////////////
+
+// Report whether vectored reads are given buffers belonging to their handle.
+// Like request buffers, these are reused only while
+// MountConfig.DisableRequestBufferReuse is unset, so that it turns off all
+// buffer reuse at once.
+func (c *Connection) handleReadBuffers() bool {
+	return c.cfg.UseVectoredRead &&
+		c.cfg.HandleReadBuffers &&
+		!c.cfg.DisableRequestBufferReuse
+}
+
+// The most buffers a handle keeps for reuse. The kernel may send the next read
+// on a handle as soon as it has the reply to the previous one, before that
+// read's buffer has been given back, so sequential reads need two.
+const maxReadBuffersPerHandle = 2
+
+// Read buffers belonging to an open file handle.
+type handleReadBuffers struct {
+	// Buffers free for the handle's next reads.
+	//
+	// GUARDED_BY(Connection.mu)
+	free [][]byte
+
+	// Set once the handle has been released, after which buffers are no
+	// longer kept.
+	//
+	// GUARDED_BY(Connection.mu)
+	released bool
+}
+
+// Return a read buffer of n bytes for the supplied handle, preferring one used
+// by an earlier read on it, along with the handle's buffers to give it back to.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) getReadBuffer(
+	h fuseops.HandleID,
+	n int) ([]byte, *handleReadBuffers) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.readBuffers == nil {
+		c.readBuffers = make(map[fuseops.HandleID]*handleReadBuffers)
+	}
+
+	hb := c.readBuffers[h]
+	if hb == nil {
+		hb = &handleReadBuffers{}
+		c.readBuffers[h] = hb
+	}
+
+	// Take the most recently used buffer, unless it's too small.
+	if l := len(hb.free); l > 0 {
+		b := hb.free[l-1]
+		hb.free = hb.free[:l-1]
+		if cap(b) >= n {
+			return b[:n], hb
+		}
+	}
+
+	return make([]byte, n), hb
+}
+
+// Give back a buffer obtained from getReadBuffer.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) putReadBuffer(hb *handleReadBuffers, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !hb.released && len(hb.free) < maxReadBuffersPerHandle {
+		hb.free = append(hb.free, b)
+	}
+}
+
+// Forget the read buffers for a handle that is being released.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) releaseReadBuffers(h fuseops.HandleID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if hb := c.readBuffers[h]; hb != nil {
+		hb.released = true
+		hb.free = nil
+		delete(c.readBuffers, h)
+	}
+}
@@ -1,3 +1,6 @@
+//go:build !linux
+// +build !linux
+
 // Copyright 2015 Google Inc. All Rights Reserved.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
@@ -27,17 +27,29 @@ import (
 
 // OpContext contains extra context that may be needed by some file systems.
 // See https://libfuse.github.io/doxygen/structfuse__context.html as a reference.
+//
+// Every op carries the credentials of the process that caused the kernel to
+// send it, which file systems may use to make access control decisions of
+// their own, for example when MountConfig.DisableDefaultPermissions is set.
 type OpContext struct {
-	// FuseID is the Unique identifier for each operation from the kernel.
+	// FuseID is the Unique identifier for each operation from the kernel. It is
+	// also available from the op's context, with fuse.RequestID.
 	FuseID uint64
 
-	// PID of the process that is invoking the operation.
+	// PID of the process that is invoking the operation, as seen from the PID
+	// namespace of the file system daemon, or zero if it isn't visible there.
+	// This is best effort only: the process may have exited by the time the op
+	// is handled, and its PID may even have been reused.
 	// Not filled in case of a writepage operation.
 	Pid uint32
 
 	// UID of the process that is invoking the operation.
 	// Not filled in case of a writepage operation.
 	Uid uint32
+
+	// GID of the process that is invoking the operation.
+	// Not filled in case of a writepage operation.
+	Gid uint32
 }
 
 // Return statistics about the file system's capacity and available resources.
@@ -109,6 +121,22 @@ type StatFSOp struct {
 	// The total number of inodes in the file system, and how many remain free.
 	Inodes     uint64
 	InodesFree uint64
+
+	OpContext OpContext
+}
+
+// Flush all dirty state for the file system to durable storage.
+//
+// Sent by Linux 5.15 and later, using protocol 7.34, when syncfs(2) or sync(2)
+// is called for the mount. Note that at the time of writing the kernel only
+// sends this op to virtio-fs servers, so ordinary fuse file systems may never
+// see it. If the file system returns ENOSYS the kernel treats it as success
+// and doesn't send the op again.
+type SyncFSOp struct {
+	// The inode the syncing process used to reach the file system, normally
+	// the root.
+	Inode     InodeID
+	OpContext OpContext
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -130,12 +158,25 @@ type LookUpInodeOp struct {
 	//
 	// the file system may receive a request to look up the child named "bar" for
 	// the parent foo/.
+	//
+	// If MountConfig.EnableExport is set, the kernel also looks up "." and ".."
+	// to resolve NFS file handles: "." asks for Parent itself, and ".." for the
+	// directory containing Parent. Either may be sent for an inode that the
+	// kernel has already forgotten, so the file system must be able to find any
+	// inode by ID, and should fail with ESTALE if it no longer exists. Neither is
+	// sent otherwise.
 	Name string
 
 	// The resulting entry. Must be filled out by the file system.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
 	// ForgetInodeOp for more information.
+	//
+	// To say that the name doesn't exist in a way the kernel can cache, leave
+	// Entry.Child zero and set Entry.EntryExpiration, rather than returning
+	// ENOENT: until the entry expires, the kernel fails lookups of the name
+	// itself. Nothing else in the entry is used, and the lookup count of no
+	// inode changes. See also MountConfig.NegativeEntryTimeout.
 	Entry     ChildInodeEntry
 	OpContext OpContext
 }
@@ -160,20 +201,48 @@ type GetInodeAttributesOp struct {
 //
 // The kernel sends this for obvious cases like chmod(2), and for less obvious
 // cases like ftrunctate(2).
+//
+// Only the attributes the kernel asked to change are set, so that for example
+// a chmod(2) has a Mode but no Mtime, and the file system should leave the
+// others alone (apart from updating the ctime, as it would for any change).
 type SetInodeAttributesOp struct {
 	// The inode of interest.
 	Inode InodeID
 
-	// If set, this is ftruncate(2), otherwise it's truncate(2)
+	// The handle through which the change is being made, or nil if there is
+	// none. The kernel supplies one when truncating an open file, as for
+	// ftruncate(2) or open(2) with O_TRUNC, but not for truncate(2) or for
+	// changes to other attributes, even through an open file as with fchmod(2).
+	// So the file system must be prepared to change the size of a file with no
+	// handle, but may use the handle's state when there is one.
 	Handle *HandleID
 
 	// The attributes to modify, or nil for attributes that don't need a change.
+	// Ctime is only sent with writeback caching, when the kernel keeps track of
+	// it.
 	Uid   *uint32
 	Gid   *uint32
 	Size  *uint64
 	Mode  *os.FileMode
 	Atime *time.Time
 	Mtime *time.Time
+	Ctime *time.Time
+
+	// OS X only: the new chflags(2) flags, as for InodeAttributes.Flags.
+	Flags *uint32
+
+	// The FATTR_* mask the kernel sent, from which the fields above were
+	// decoded. Besides the methods corresponding to them, such as Mode() and
+	// Size(), it reports with AtimeNow() and MtimeNow() whether Atime and Mtime
+	// are the current time, as for utimensat(2) with UTIME_NOW, rather than
+	// times chosen by the caller. File systems with their own notion of the
+	// current time may prefer it in that case.
+	Valid fusekernel.SetattrValid
+
+	// With MountConfig.HandleKillPriv, set for truncations by callers who
+	// aren't privileged to keep the setuid and setgid bits of the file, which
+	// the file system should then clear as for WriteFileOp.KillSuidgid.
+	KillSuidgid bool
 
 	// Set by the file system: the new attributes for the inode, and the time at
 	// which they should expire. See notes on
@@ -183,6 +252,27 @@ type SetInodeAttributesOp struct {
 	OpContext            OpContext
 }
 
+// Check whether the caller may access an inode in the supplied ways, for
+// access(2) and chdir(2).
+//
+// The kernel sends this only if fuse.MountConfig.DisableDefaultPermissions is
+// set, since otherwise it checks the inode's attributes itself. Return EACCES
+// to deny access. If the file system returns ENOSYS the kernel treats it as
+// success and doesn't send the op again, so file systems that don't enforce
+// permissions of their own can leave this alone.
+type AccessOp struct {
+	// The inode of interest.
+	Inode InodeID
+
+	// The kinds of access to check, as for the mode argument of access(2): a
+	// combination of R_OK (4), W_OK (2) and X_OK (1), or F_OK (0) to check only
+	// that the inode exists. chdir(2) checks X_OK on the directory.
+	Mask uint32
+
+	// The caller whose access is being checked.
+	OpContext OpContext
+}
+
 // Decrement the reference count for an inode ID previously issued by the file
 // system.
 //
@@ -280,6 +370,10 @@ type MkDirOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The umask of the calling process. Unless MountConfig.DontMask is set, the
+	// kernel has already applied it to Mode, and it is for information only.
+	Umask os.FileMode
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -305,13 +399,22 @@ type MkNodeOp struct {
 	Parent InodeID
 
 	// The name of the child to create, and the mode with which to create it.
+	// The mode includes the type of the file: none for a regular file, or one
+	// of os.ModeNamedPipe, os.ModeSocket, and os.ModeDevice (together with
+	// os.ModeCharDevice for a character device).
 	Name string
 	Mode os.FileMode
 
+	// The umask of the calling process. Unless MountConfig.DontMask is set, the
+	// kernel has already applied it to Mode, and it is for information only.
+	Umask os.FileMode
+
 	// The device number (only valid if created file is a device)
 	Rdev uint32
 
 	// Set by the file system: information about the inode that was created.
+	// Entry.Attributes.Mode must have the same type as Mode, or the kernel
+	// fails the mknod(2) call with EIO.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
 	// ForgetInodeOp for more information.
@@ -337,10 +440,29 @@ type CreateFileOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The umask of the calling process. Unless MountConfig.DontMask is set, the
+	// kernel has already applied it to Mode, and it is for information only.
+	Umask os.FileMode
+
 	// Set by the file system: information about the inode that was created.
+	// It is sent to the kernel in the same reply as Handle, and cached for
+	// EntryExpiration and AttributesExpiration like the result of a lookup, so
+	// no LookUpInodeOp or GetInodeAttributesOp follows for the new file until
+	// those expire.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
 	// ForgetInodeOp for more information.
+	//
+	// The kernel only takes a regular file in reply to a create. If creating
+	// the name legitimately makes something else, such as a symlink, set
+	// Attributes.Mode to its type and leave Handle unset: the create then fails
+	// with EEXIST, as it would for O_EXCL had the name already existed, and the
+	// kernel is told to drop the entry it had for the name so that the next
+	// lookup finds what was made. In that case the kernel doesn't learn of the
+	// inode from this op, so the lookup count is not incremented. Names that
+	// are already of such a type should be reported by LookUpInodeOp instead,
+	// so that no create is sent for them; the kernel then follows symlinks for
+	// O_CREAT without O_EXCL itself.
 	Entry ChildInodeEntry
 
 	// Set by the file system: an opaque ID that will be echoed in follow-up
@@ -355,6 +477,35 @@ type CreateFileOp struct {
 	OpContext OpContext
 }
 
+// Create a file inode with no name and open it. The kernel sends this for an
+// open(2) with O_TMPFILE on Linux 6.3 and later, if the file system answers
+// it; if it fails with ENOSYS, the kernel stops sending it and such opens
+// fail with EOPNOTSUPP. The file can be given a name later with linkat(2),
+// which arrives as a CreateLinkOp with the inode as its Target.
+type CreateTmpfileOp struct {
+	// The ID of the directory inode in which the file is to be created, e.g.
+	// for choosing where to store it.
+	Parent InodeID
+
+	// The mode with which to create the file, and the umask of the calling
+	// process, as for CreateFileOp.
+	Mode  os.FileMode
+	Umask os.FileMode
+
+	// Set by the file system: information about the inode that was created,
+	// which must be a regular file, as for CreateFileOp, or the kernel fails
+	// the open(2) with EIO.
+	//
+	// The lookup count for the inode is implicitly incremented. See notes on
+	// ForgetInodeOp for more information.
+	Entry ChildInodeEntry
+
+	// Set by the file system: an opaque ID for the open file, as for
+	// CreateFileOp.
+	Handle    HandleID
+	OpContext OpContext
+}
+
 // Create a symlink inode. If the name already exists, the file system should
 // return EEXIST (cf. the notes on CreateFileOp and MkDirOp).
 type CreateSymlinkOp struct {
@@ -386,13 +537,17 @@ type CreateLinkOp struct {
 	// The name of the new inode.
 	Name string
 
-	// The ID of the target inode.
+	// The ID of the target inode. The kernel refuses to link directories, so
+	// this is never one.
 	Target InodeID
 
-	// Set by the file system: information about the inode that was created.
+	// Set by the file system: information about the target inode, under its
+	// new name. Entry.Child must be Target, and Entry.Attributes must reflect
+	// the new link, in particular with Nlink incremented, since the kernel
+	// replaces its cached attributes for the inode with them.
 	//
-	// The lookup count for the inode is implicitly incremented. See notes on
-	// ForgetInodeOp for more information.
+	// The lookup count for the target is implicitly incremented, as for
+	// LookUpInodeOp. See notes on ForgetInodeOp for more information.
 	Entry     ChildInodeEntry
 	OpContext OpContext
 }
@@ -416,6 +571,14 @@ type CreateLinkOp struct {
 //     is empty before replacing it, returning ENOTEMPTY otherwise. (This is
 //     per the posix spec: http://goo.gl/4XtT79)
 //
+//   - A directory must not be moved into itself or a directory beneath it,
+//     for which rename(2) fails with EINVAL. The kernel refuses such renames
+//     by walking up from the new parent in its cache of the tree, so only file
+//     systems that may change behind the kernel's back need to check again;
+//     fuseutil.CheckRenameLoop does so given a way to find a directory's
+//     parent. The op names the entry to move rather than its inode, which the
+//     file system finds by looking up OldName in OldParent.
+//
 //   - The rename must be atomic from the point of view of an observer of the
 //     new name. That is, if the new name already exists, there must be no
 //     point at which it doesn't exist.
@@ -490,20 +653,41 @@ type OpenDirOp struct {
 	// The ID of the inode to be opened.
 	Inode InodeID
 
+	// The flags passed to open(2), including OpenDirectory if the process
+	// insisted on a directory with O_DIRECTORY, as opendir(3) does.
+	//
+	// The kernel sends OpenDirOp only for inodes whose attributes say that they
+	// are directories, and fails open(2) with ENOTDIR by itself when
+	// O_DIRECTORY is used on anything else. A file system whose inodes may
+	// change type behind the kernel's back should check that the inode is still
+	// a directory, and fail with ENOTDIR if it isn't, whatever the flags. A
+	// file system whose inodes can be opened both ways can decide with
+	// OpenFlags.IsDirectory.
+	OpenFlags fusekernel.OpenFlags
+
 	// Set by the file system: an opaque ID that will be echoed in follow-up
 	// calls for this directory using the same struct file in the kernel. In
 	// practice this usually means follow-up calls using the file descriptor
 	// returned by open(2).
 	//
-	// The handle may be supplied in future ops like ReadDirOp that contain a
-	// directory handle. The file system must ensure this ID remains valid until
-	// a later call to ReleaseDirHandle.
+	// The handle may be supplied in future ops like ReadDirOp and ReadDirPlusOp
+	// that contain a directory handle. The file system must ensure this ID
+	// remains valid until a later call to ReleaseDirHandle.
 	Handle    HandleID
 	OpContext OpContext
 
 	// CacheDir conveys to the kernel to cache the response of next
 	// ReadDirOp as page cache. Once cached, listing on that directory will be
 	// served from the kernel until invalidated.
+	//
+	// The cache outlives the handle only if KeepCache is also set; otherwise
+	// each open starts afresh. Either way, the kernel doesn't ask the file
+	// system again while the cache is valid, so a file system that sets this
+	// must tell the kernel when the directory changes behind its back, by
+	// calling Connection.NotifyInvalEntry for an entry that was added, removed
+	// or renamed. Changes made through the mount invalidate the cache by
+	// themselves. This is ignored by kernels older than protocol 7.28 (Linux
+	// 4.20), which don't support it.
 	CacheDir bool
 
 	// KeepCache instructs the kernel to not invalidate the data cache on open calls.
@@ -582,7 +766,12 @@ type ReadDirOp struct {
 	// The output data should consist of a sequence of FUSE directory entries in
 	// the format generated by fuse_add_direntry (http://goo.gl/qCcHCV), which is
 	// consumed by parse_dirfile (http://goo.gl/2WUmD2). Use fuseutil.WriteDirent
-	// to generate this data.
+	// or fuseutil.AppendDirent to generate this data.
+	//
+	// The room left for further entries is len(Dst) - BytesRead. An entry that
+	// doesn't fit must be left out along with all those after it, to be
+	// returned by a later read starting at the Offset of the last entry
+	// written.
 	//
 	// Each entry returned exposes a directory offset to the user that may later
 	// show up in ReadDirRequest.Offset. See notes on that field for more
@@ -603,6 +792,45 @@ type ReadDirOp struct {
 	OpContext OpContext
 }
 
+// Like ReadDirOp, but also look up each entry returned, so that the kernel can
+// prime its dentry and attribute caches while listing the directory. This
+// saves a LookUpInodeOp per entry for callers like `ls -l`.
+//
+// The kernel sends this instead of ReadDirOp only if
+// MountConfig.EnableReaddirplus is set, and even then may switch between the
+// two from one read to the next on the same handle. File systems enabling it
+// must therefore implement both, with the same offsets.
+type ReadDirPlusOp struct {
+	// The directory inode that we are reading, and the handle previously
+	// returned by OpenDir when opening that inode.
+	//
+	// Several handles may be open on the same directory at once, each being
+	// read from its own offset, and reads on different handles may be
+	// interleaved. File systems that keep per-listing state (e.g. a snapshot
+	// taken when Offset is zero) should key it by Handle.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset within the directory at which to read: zero, or the Offset of
+	// an entry previously returned for this handle. See notes on
+	// ReadDirOp.Offset for details.
+	Offset DirOffset
+
+	// The size of the read. The entries returned must fit in this many bytes,
+	// as measured by fuseutil.DirentPlusSize. fuseutil.AppendDirentPlus does
+	// the accounting.
+	Size int
+
+	// Set by the file system: the entries following Offset, in order. Empty
+	// means that the end of the directory has been reached.
+	//
+	// Entries that don't fit in Size are not sent to the kernel, and so their
+	// lookup counts are not incremented. The kernel asks for them again in a
+	// later read starting at the Offset of the last entry it received.
+	Entries   []DirentPlus
+	OpContext OpContext
+}
+
 // Release a previously-minted directory handle. The kernel sends this when
 // there are no more references to an open directory: all file descriptors are
 // closed and all memory mappings are unmapped.
@@ -665,8 +893,50 @@ type OpenFileOp struct {
 	// Enabling direct IO ensures that all client operations reach the fuse
 	// layer. This allows for filesystems whose file sizes are not known in
 	// advance, for example, because contents are generated on the fly.
+	//
+	// Since the page cache is bypassed, nothing is read ahead for the handle
+	// either: ReadFileOp asks for just what the process did. This is the way
+	// to turn readahead off for particular files; see MountConfig.MaxReadahead.
 	UseDirectIO bool
 
+	// Linux only. Make the file non-seekable, like a live log tail: lseek(2)
+	// on it fails with ESPIPE in the kernel, and pread(2) and pwrite(2) are
+	// rejected too, so that ReadFileOp and WriteFileOp only see offsets that
+	// follow on from the previous ones. Typically combined with UseDirectIO, so
+	// that every read reaches the file system rather than being served from
+	// the page cache.
+	Nonseekable bool
+
+	// Linux only. Treat the file as a stream with no notion of a file position,
+	// like a pipe or socket: the kernel rejects lseek(2), and doesn't
+	// serialize reads and writes on the handle to keep a position consistent.
+	// Offsets in ReadFileOp and WriteFileOp are then meaningless. Usually
+	// combined with UseDirectIO.
+	Stream bool
+
+	// Linux only, protocol 7.35 and later. Don't send a FlushFileOp when a file
+	// descriptor for the handle is closed, for file systems with nothing to do
+	// there. Note that POSIX locks are released in FlushFileOp.
+	NoFlush bool
+
+	// Linux only, protocol 7.36 and later. With UseDirectIO, allow writes to
+	// the handle to be sent concurrently with other writes to the inode, for
+	// file systems that can cope with that. The kernel serializes them by
+	// default.
+	ParallelDirectWrites bool
+
+	// Linux 6.9 and later. If non-zero, a backing file ID obtained from
+	// Connection.OpenBackingFd, to which the kernel will send reads and writes
+	// on the handle directly, bypassing the file system altogether. Requires
+	// MountConfig.EnablePassthrough. Other ops on the handle, such as
+	// FlushFileOp and ReleaseFileHandleOp, are still sent as usual.
+	BackingID uint32
+
+	// The flags passed to open(2). O_TRUNC is among them only if
+	// fuse.CapAtomicTrunc was negotiated (see MountConfig.EnableAtomicTrunc),
+	// in which case the file system must truncate the file itself. Otherwise
+	// the kernel leaves it out and truncates with a SetInodeAttributesOp after
+	// the open instead.
 	OpenFlags fusekernel.OpenFlags
 
 	OpContext OpContext
@@ -697,6 +967,28 @@ type ReadFileOp struct {
 	// A list of slices of data to send back to the client for vectored reads.
 	Data [][]byte
 
+	// For vectored reads with fuse.MountConfig.HandleReadBuffers set, a
+	// scratch buffer of Size bytes that belongs to Handle and is reused by later
+	// reads on it. The file system may read into it and return (part of) it in
+	// Data, saving an allocation per read.
+	//
+	// The buffer is valid only until the op is replied to (i.e. until the
+	// FileSystem method returns, or Callback has been invoked); after that it
+	// will be handed to the next read, and must not be retained.
+	Buffer []byte
+
+	// Set by the file system instead of Dst or Data: a file from which to send
+	// the data, BytesRead bytes of it starting at SpliceOffset, as for a file
+	// system passing on the contents of files on another one. With
+	// fuse.MountConfig.EnableSplice on Linux, the data is spliced (cf.
+	// splice(2)) from the file to the kernel through a pipe, without passing
+	// through this process. Otherwise, or if that isn't possible, it is read
+	// from the file and sent as usual. If the file has fewer bytes there than
+	// BytesRead, the read is short. The file must stay open until the op has
+	// been replied to (e.g. until Callback is invoked).
+	SpliceFile   *os.File
+	SpliceOffset int64
+
 	// Set by the file system: the number of bytes read.
 	//
 	// The FUSE documentation requires that exactly the requested number of bytes
@@ -708,6 +1000,27 @@ type ReadFileOp struct {
 	//
 	// If direct IO is enabled, semantics should match those of read(2).
 	BytesRead int
+
+	// Set by the file system along with a short BytesRead to say that the read
+	// stopped short because no more data is available yet, as for a file that
+	// is still growing, rather than at the end of the file.
+	//
+	// The protocol has no way to tell the kernel this, so what happens depends
+	// on how the file was opened. With OpenFileOp.UseDirectIO, a short read
+	// reaches the process as it is, as from read(2), and it's up to the process
+	// what it means: most programs read again, but take a read of zero bytes as
+	// EOF, with or without ShortRead.
+	//
+	// Otherwise the read was made for the page cache, and the kernel takes any
+	// short read as EOF: it zero-fills the rest of the page and shrinks its idea
+	// of the file's size to end where the read did, so that later reads stop
+	// there too. ShortRead has the connection undo that once the reply has been
+	// sent, by telling the kernel to drop its cached attributes for the inode
+	// and its cached data from the end of the read on. The next read then gets
+	// the size afresh with GetInodeAttributesOp and reads what has been added
+	// since. Nothing can be done about what the read that was short has already
+	// returned to the process.
+	ShortRead bool
 	OpContext OpContext
 
 	// If set, this function will be invoked after the operation response has been
@@ -771,14 +1084,53 @@ type WriteFileOp struct {
 	// The FUSE documentation requires that exactly the number of bytes supplied
 	// be written, except on error (http://goo.gl/KUpwwn). This appears to be
 	// because it uses file mmapping machinery (http://goo.gl/SGxnaN) to write a
-	// page at a time.
+	// page at a time. See BytesWritten for the exception.
+	//
+	// Data points into the buffer the request was read into, which is reused
+	// for later requests once the op has been replied to. Copy it if it must be
+	// kept for longer.
 	Data      []byte
 	OpContext OpContext
 
+	// The number of bytes of Data that were written, which starts out as
+	// len(Data). A file system that can only take part of the data, e.g.
+	// because it is nearly out of space, may lower it to report a short write
+	// rather than failing the whole op; a value outside the range of Data fails
+	// the op with EIO.
+	//
+	// With MountConfig.DisableWritebackCaching or OpenFileOp.UseDirectIO, the
+	// kernel passes a short count back to the process as the return value of
+	// write(2). Otherwise the write was made to the page cache long before, and
+	// the kernel can only treat a short count when writing back as an I/O error.
+	BytesWritten int
+
 	// If set, this function will be invoked after the operation response has been
 	// sent to the kernel and before the buffers containing the response data are
 	// freed.
 	Callback func()
+
+	// The flags the file was opened with, as for OpenFileOp.OpenFlags.
+	//
+	// If OpenFlags.IsAppend(), the process expects the data to land at the end
+	// of the file whatever Offset says, which may be stale if others are
+	// writing to it. To make such appends atomic, write at the current size of
+	// the file, chosen under the same lock that serializes the writes, and
+	// ignore Offset. This only works with MountConfig.DisableWritebackCaching:
+	// with writeback caching the kernel handles O_APPEND itself, using the size
+	// it has cached, and sends the result as ordinary page writes.
+	OpenFlags fusekernel.OpenFlags
+
+	// With MountConfig.HandleKillPriv, set if the writer isn't privileged to
+	// keep the setuid and setgid bits of the file, which the file system should
+	// then clear along with the write. (The setgid bit is only cleared if the
+	// group execute bit is set, otherwise it means mandatory locking.)
+	KillSuidgid bool
+
+	// Set if the data is being written back from the kernel's page cache, as
+	// happens with writeback caching (cf. MountConfig.DisableWritebackCaching),
+	// rather than passed to write(2) just now. Such writes are sent in the
+	// background, with no process waiting for them.
+	Writeback bool
 }
 
 // Synchronize the current contents of an open file to storage.
@@ -852,10 +1204,22 @@ type SyncFileOp struct {
 // data. A file system that writes to remote storage however probably wants
 // to at least schedule a real flush, and maybe do it immediately in order to
 // return any errors that occur.
+//
+// Flushing is also the point at which POSIX record locks must be released:
+// closing any file descriptor for a file releases all of the process's locks
+// on it (cf. fcntl(2)), even though other descriptors may keep the handle
+// open. A file system implementing SetFileLockOp should therefore drop all
+// locks on the inode held by LockOwner here, rather than in
+// ReleaseFileHandleOp, which may come much later or, for a dup'd descriptor,
+// not at all.
 type FlushFileOp struct {
 	// The file and handle being flushed.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// The lock owner of the file table doing the closing, as seen in
+	// SetFileLockOp.Owner.
+	LockOwner uint64
 	OpContext OpContext
 }
 
@@ -864,14 +1228,85 @@ type FlushFileOp struct {
 // and all memory mappings are unmapped.
 //
 // The kernel guarantees that the handle ID will not be used in further calls
-// to the file system (unless it is reissued by the file system).
+// to the file system (unless it is reissued by the file system). Every other
+// op on the handle, including the FlushFileOp for the last close(2), has been
+// replied to by the time this is sent. The release itself is asynchronous:
+// close(2) doesn't wait for it, and with memory mappings it may come long
+// after the last close.
 //
 // Errors from this op are ignored by the kernel (cf. http://goo.gl/RL38Do).
 type ReleaseFileHandleOp struct {
 	// The handle ID to be released. The kernel guarantees that this ID will not
 	// be used in further calls to the file system (unless it is reissued by the
 	// file system).
-	Handle    HandleID
+	Handle HandleID
+
+	// Set if the handle holds flock(2) locks, which must be released along
+	// with it. In that case LockOwner is the owner with which they were taken.
+	// POSIX record locks are released by FlushFileOp instead.
+	FlockUnlock bool
+
+	// Set if the release also stands in for a flush, which the file system
+	// should then carry out as for FlushFileOp, including dropping the POSIX
+	// locks of LockOwner. Linux sends a separate FlushFileOp for every close
+	// and never sets this, but other kernels may.
+	Flush bool
+
+	LockOwner uint64
+	OpContext OpContext
+}
+
+////////////////////////////////////////////////////////////////////////
+// File locks
+////////////////////////////////////////////////////////////////////////
+
+// Test for a lock conflicting with the supplied one, for fcntl(2) with
+// F_GETLK. Only sent if fuse.MountConfig.EnablePosixLocks is set; otherwise
+// the kernel handles locks itself, and they apply to this machine only.
+type GetFileLockOp struct {
+	// The file and handle the request was made through.
+	Inode  InodeID
+	Handle HandleID
+
+	// The owner of the lock: an opaque value identifying the file table (and so
+	// roughly the process) making the request.
+	Owner uint64
+
+	// The lock to test. Set by the file system: a lock that conflicts with it
+	// and is held by another owner, or Lock.Type = syscall.F_UNLCK if there is
+	// none.
+	Lock      FileLock
+	OpContext OpContext
+}
+
+// Acquire, change or release a lock on a range of a file, for fcntl(2) with
+// F_SETLK or F_SETLKW, or for flock(2). Only sent if
+// fuse.MountConfig.EnablePosixLocks (for fcntl) or EnableFlockLocks (for
+// flock) is set.
+//
+// Setting a lock replaces any lock held by the same owner on the same range,
+// and setting Type = syscall.F_UNLCK releases the owner's locks in the range.
+// Locks held by an owner must be released when it flushes the file; see
+// FlushFileOp.
+type SetFileLockOp struct {
+	// The file and handle the request was made through.
+	Inode  InodeID
+	Handle HandleID
+
+	// The owner of the lock. See GetFileLockOp.Owner.
+	Owner uint64
+
+	// The lock to acquire or release.
+	Lock FileLock
+
+	// Set for F_SETLKW: wait for conflicting locks to be released rather than
+	// failing with EAGAIN. The wait is abandoned, with ctx cancelled, if the
+	// caller is interrupted.
+	Wait bool
+
+	// Set if the request is for flock(2). Such locks always cover the whole
+	// file, and belong to the open file description rather than the process.
+	Flock     bool
 	OpContext OpContext
 }
 
@@ -884,7 +1319,10 @@ type ReadSymlinkOp struct {
 	// The symlink inode that we are reading.
 	Inode InodeID
 
-	// Set by the file system: the target of the symlink.
+	// Set by the file system: the target of the symlink. When the kernel caches
+	// symlink targets (cf. MountConfig.EnableSymlinkCaching), it truncates this
+	// to the Size reported in the symlink's attributes, which must therefore be
+	// the length of the target.
 	Target    string
 	OpContext OpContext
 }
@@ -917,13 +1355,20 @@ type GetXattrOp struct {
 	// The name of the extended attribute.
 	Name string
 
-	// The destination buffer.  If the size is too small for the
+	// The size of the caller's buffer. Zero means that the caller only wants to
+	// know the size of the value, which should be reported in BytesRead without
+	// copying anything. This is the first of the two calls usually made by
+	// getfattr and the like.
+	Size int
+
+	// The destination buffer, of length Size.  If the size is too small for the
 	// value, the ERANGE error should be sent.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
 	// the number of bytes that would have been read into Dst if Dst was
-	// big enough (return ERANGE in this case).
+	// big enough (return ERANGE in this case). If a non-zero Size is exceeded
+	// the kernel is sent ERANGE regardless, rather than a truncated value.
 	BytesRead int
 	OpContext OpContext
 }
@@ -935,7 +1380,12 @@ type ListXattrOp struct {
 	// The inode whose extended attributes we are listing.
 	Inode InodeID
 
-	// The destination buffer.  If the size is too small for the
+	// The size of the caller's buffer. As with GetXattrOp.Size, zero means that
+	// the caller only wants to know the total length of the list, which should
+	// be reported in BytesRead.
+	Size int
+
+	// The destination buffer, of length Size.  If the size is too small for the
 	// value, the ERANGE error should be sent.
 	//
 	// The output data should consist of a sequence of NUL-terminated strings,
@@ -944,7 +1394,8 @@ type ListXattrOp struct {
 
 	// Set by the file system: the number of bytes read into Dst, or
 	// the number of bytes that would have been read into Dst if Dst was
-	// big enough (return ERANGE in this case).
+	// big enough (return ERANGE in this case). As for GetXattrOp, a non-zero
+	// Size that is exceeded results in ERANGE regardless.
 	BytesRead int
 	OpContext OpContext
 }
@@ -953,24 +1404,46 @@ type ListXattrOp struct {
 //
 // This is sent in response to setxattr(2). Return ENOSPC if there is
 // insufficient space remaining to store the extended attribute.
+//
+// Some xattr semantics depend on the platform. On Linux, names carry a
+// namespace prefix such as user. or trusted., and the kernel refuses names
+// without one before they get here. On OS X there are no namespaces, but names
+// like com.apple.FinderInfo have special meaning to the system, and the
+// position argument of setxattr(2), used for resource forks, is not passed on.
+// The flags are translated to the same values on both.
 type SetXattrOp struct {
 	// The inode whose extended attribute we are setting.
 	Inode InodeID
 
-	// The name of the extended attribute
+	// The name of the extended attribute, including its namespace prefix. Names
+	// are passed on as the caller gave them, so this may be e.g.
+	// security.capability, or with MountConfig.EnablePosixACL
+	// system.posix_acl_access, whose value is the kernel's binary encoding of
+	// the ACL and should be stored verbatim.
 	Name string
 
-	// The value to for the extened attribute.
+	// The value to for the extened attribute. Like WriteFileOp.Data, it is only
+	// valid until the op has been replied to.
 	Value []byte
 
-	// If Flags is 0x1, and the attribute exists already, EEXIST should be returned.
-	// If Flags is 0x2, and the attribute does not exist, ENOATTR should be returned.
-	// If Flags is 0x0, the extended attribute will be created if need be, or will
-	// simply replace the value if the attribute exists.
+	// If Flags is SetXattrCreate, and the attribute exists already, EEXIST
+	// should be returned. If Flags is SetXattrReplace, and the attribute does
+	// not exist, ENOATTR should be returned. If Flags is 0x0, the extended
+	// attribute will be created if need be, or will simply replace the value if
+	// the attribute exists.
 	Flags     uint32
 	OpContext OpContext
 }
 
+// Flags for SetXattrOp.Flags, with the values of the Linux XATTR_* constants
+// whatever the platform.
+const (
+	SetXattrCreate  = 0x1
+	SetXattrReplace = 0x2
+)
+
+// Manipulate the space allocated to a byte range of a file, as with
+// fallocate(2).
 type FallocateOp struct {
 	// The inode and handle we are fallocating
 	Inode  InodeID
@@ -982,11 +1455,127 @@ type FallocateOp struct {
 	// Length of the byte range
 	Length uint64
 
-	// If Mode is 0x0, allocate disk space within the range specified
-	// If Mode has 0x1, allocate the space but don't increase the file size
-	// If Mode has 0x2, deallocate space within the range specified
-	// If Mode has 0x2, it sbould also have 0x1 (deallocate should not increase
-	// file size)
+	// The fallocate(2) mode, a combination of the Falloc* flags below. If Mode
+	// is 0x0, allocate disk space within the range specified, extending the
+	// file if necessary. FallocPunchHole always comes with FallocKeepSize.
+	//
+	// File systems should fail with EOPNOTSUPP for modes they don't support.
+	// Failing with ENOSYS instead makes the kernel stop sending FallocateOp
+	// altogether, so that every later fallocate(2) fails, whatever its mode.
 	Mode      uint32
 	OpContext OpContext
 }
+
+// Perform an ioctl(2) on an open file or directory.
+//
+// The kernel copies the data that the argument points to in and out itself,
+// going by the direction and size encoded in the request code by the _IOR and
+// _IOW macros; for request codes without them, only the argument itself is
+// passed. On Linux this is how lsattr(1) and chattr(1) read and change flags
+// such as FS_IMMUTABLE_FL and FS_APPEND_FL, with FS_IOC_GETFLAGS and
+// FS_IOC_SETFLAGS, since Linux carries no such flags in the attributes of an
+// inode. The kernel turns ENOSYS into ENOTTY, the usual error for an ioctl
+// that isn't supported.
+type IoctlOp struct {
+	// The inode and handle the ioctl was made on, which is a directory handle if
+	// the inode is a directory.
+	Inode  InodeID
+	Handle HandleID
+
+	// The ioctl request code, and its argument as passed to ioctl(2). For
+	// ioctls that take a pointer, Arg is an address in the caller, of no use to
+	// the file system.
+	Cmd uint32
+	Arg uint64
+
+	// The data the argument points to, for ioctls that pass data in (_IOW and
+	// _IOWR).
+	Input []byte
+
+	// The most data the caller expects back, for ioctls that pass data out (_IOR
+	// and _IOWR). Zero otherwise.
+	OutputSize uint32
+
+	// Set by the file system: the data to copy out to the caller, no more than
+	// OutputSize bytes, and the value for ioctl(2) to return.
+	//
+	// Note that FS_IOC_GETFLAGS is defined to take a long, but the kernel and
+	// most callers really pass an int, so OutputSize may be 4 or 8 depending on
+	// who is asking; the file system should fill in as many bytes as asked for.
+	Output    []byte
+	Result    int32
+	OpContext OpContext
+}
+
+// Map a range of a file into the DAX window, the shared memory through which
+// virtio-fs lets a virtual machine's page cache reach the host's file
+// directly (cf. https://virtio-fs.gitlab.io/).
+//
+// The kernel sends this only to virtio-fs devices mounted with the dax
+// option, never through /dev/fuse, so it reaches a file system only if its
+// messages are relayed from such a device. Mapping the range into the window
+// is up to the file system, which must know where the window lives.
+type SetupMappingOp struct {
+	// The inode and handle whose file is to be mapped.
+	Inode  InodeID
+	Handle HandleID
+
+	// The range of the file to map.
+	Offset uint64
+	Length uint64
+
+	// How the mapping may be accessed: a combination of SetupMappingRead and
+	// SetupMappingWrite.
+	Flags uint64
+
+	// Where in the DAX window to map the range.
+	WindowOffset uint64
+
+	OpContext OpContext
+}
+
+// Flags for SetupMappingOp.Flags, with the values of the
+// FUSE_SETUPMAPPING_FLAG_* constants.
+const (
+	SetupMappingWrite = 0x1
+	SetupMappingRead  = 0x2
+)
+
+// Remove mappings set up with SetupMappingOp from the DAX window. Like
+// SetupMappingOp, this is sent only to virtio-fs devices.
+type RemoveMappingOp struct {
+	// The inode the ranges were mapped for.
+	Inode InodeID
+
+	// The ranges of the window to unmap.
+	Mappings  []WindowRange
+	OpContext OpContext
+}
+
+// A range of the DAX window, for RemoveMappingOp.
+type WindowRange struct {
+	Offset uint64
+	Length uint64
+}
+
+// Flags for FallocateOp.Mode, with the values of the Linux FALLOC_FL_*
+// constants.
+const (
+	// Don't change the file size, even if the range extends beyond it.
+	FallocKeepSize = 0x01
+
+	// Deallocate the range, which then reads as zeroes.
+	FallocPunchHole = 0x02
+
+	// Remove the range from the file, shifting what follows down.
+	FallocCollapseRange = 0x08
+
+	// Make the range read as zeroes, allocating it if necessary.
+	FallocZeroRange = 0x10
+
+	// Insert a hole at the start of the range, shifting what follows up.
+	FallocInsertRange = 0x20
+
+	// Unshare the range's blocks from other files sharing them.
+	FallocUnshareRange = 0x40
+)
@@ -61,6 +61,19 @@ func init() {
 type InodeAttributes struct {
 	Size uint64
 
+	// The number of 512-byte blocks allocated to the inode, as reported in
+	// st_blocks by stat(2) and used by du(1). This can differ from what Size
+	// suggests, e.g. for sparse or compressed files. If zero, it is derived from
+	// Size by rounding up to a whole number of blocks.
+	Blocks uint64
+
+	// The preferred size for I/O on the inode, as reported in st_blksize by
+	// stat(2) and used by tools such as cp(1) and dd(1) to size their buffers.
+	// The kernel rounds it down to a power of two. If zero, the kernel's
+	// default is used, which on Linux is the page size. StatFSOp.IoSize is
+	// separate, and is only what statfs(2) reports.
+	BlockSize uint32
+
 	// The number of incoming hard links to this inode.
 	Nlink uint32
 
@@ -91,14 +104,24 @@ type InodeAttributes struct {
 	Rdev uint32
 
 	// Time information. See `man 2 stat` for full details.
+	//
+	// The creation time reaches the kernel on OS X, and on Linux 6.6 and later
+	// in replies to statx(2) asking for the birth time. There, a zero Crtime is
+	// reported as unknown. Elsewhere, zero times are reported as the epoch.
 	Atime  time.Time // Time of last access
 	Mtime  time.Time // Time of last modification
 	Ctime  time.Time // Time of last modification to inode
-	Crtime time.Time // Time of creation (OS X only)
+	Crtime time.Time // Time of creation (OS X, and Linux statx(2))
 
 	// Ownership information
 	Uid uint32
 	Gid uint32
+
+	// OS X only: flags such as UF_IMMUTABLE and UF_APPEND, reported in st_flags
+	// and changed with chflags(2) (see SetInodeAttributesOp.Flags). Linux has
+	// no equivalent in its attributes; lsattr(1) and chattr(1) use ioctls
+	// there, which reach the file system as IoctlOp.
+	Flags uint32
 }
 
 func (a *InodeAttributes) DebugString() string {
@@ -114,7 +137,9 @@ func (a *InodeAttributes) DebugString() string {
 // GenerationNumber represents a generation of an inode. It is irrelevant for
 // file systems that won't be exported over NFS. For those that will and that
 // reuse inode IDs when they become free, the generation number must change
-// when an ID is reused.
+// when an ID is reused. The kernel checks it when resolving an NFS file handle
+// (see MountConfig.EnableExport), so that a handle for a deleted file doesn't
+// reach a new file that happens to have been given the same ID.
 //
 // This corresponds to struct inode::i_generation in the VFS layer.
 // (Cf. http://goo.gl/tvYyQt)
@@ -128,6 +153,20 @@ func (a *InodeAttributes) DebugString() string {
 //	http://goo.gl/wvo3MB
 type GenerationNumber uint64
 
+// FileLock describes a byte range lock on a file, as in struct flock.
+type FileLock struct {
+	// The first and last bytes covered by the lock. End is math.MaxUint64 for
+	// a lock that extends to the end of the file, however large it grows.
+	Start uint64
+	End   uint64
+
+	// syscall.F_RDLCK, syscall.F_WRLCK or syscall.F_UNLCK.
+	Type uint32
+
+	// The process that holds the lock, reported to callers of F_GETLK.
+	Pid uint32
+}
+
 // HandleID is an opaque 64-bit number used to identify a particular open
 // handle to a file or directory.
 //
@@ -149,6 +188,11 @@ type ChildInodeEntry struct {
 
 	// A generation number for this incarnation of the inode with the given ID.
 	// See comments on type GenerationNumber for more.
+	//
+	// It is sent to the kernel with every entry, including those in
+	// ReadDirPlusOp. On Linux 5.12 and later, if the kernel still has an inode
+	// with this ID but a different generation, it discards the old inode and its
+	// cached attributes and data rather than reusing them.
 	Generation GenerationNumber
 
 	// Current attributes for the child inode.
@@ -162,6 +206,17 @@ type ChildInodeEntry struct {
 	// to do anything useful. In traditional file systems in the kernel, the
 	// function inode_init_owner (http://goo.gl/5qavg8) contains the
 	// standards-compliant logic for this.
+	//
+	// The type in Attributes.Mode is authoritative, and needn't be the type
+	// that the name or the inode ID had before, as when a union file system
+	// resolves a name to a file in one layer and a directory in another. When
+	// an inode ID that the kernel has comes back with another type (or, see
+	// above, another generation), it discards the old inode rather than reusing
+	// it. But it only finds out when it asks: until EntryExpiration it resolves
+	// the name from its dentry cache without a LookUpInodeOp, and until
+	// AttributesExpiration it answers stat(2) from the old attributes. A file
+	// system whose names change type should keep those short, or call
+	// fuse.Connection.NotifyInvalEntry on the parent when a name changes.
 	Attributes InodeAttributes
 
 	// The FUSE VFS layer in the kernel maintains a cache of file attributes,
@@ -192,7 +247,8 @@ type ChildInodeEntry struct {
 	//
 	// This field controls when the attributes returned in this response and
 	// stashed in the struct inode should be re-queried. Leave at the zero value
-	// to disable caching.
+	// to use MountConfig.DefaultAttrTimeout, which by default disables caching.
+	// A time that isn't in the future disables caching regardless.
 	//
 	// More reading:
 	//     http://stackoverflow.com/q/21540315/1505451
@@ -216,9 +272,30 @@ type ChildInodeEntry struct {
 	//     inode if fuse_dentry_time(entry) hasn't passed. Otherwise it sends a
 	//     lookup request.
 	//
-	// Leave at the zero value to disable caching.
+	// Leave at the zero value to use MountConfig.DefaultEntryTimeout, which by
+	// default disables caching. A time that isn't in the future disables
+	// caching regardless.
 	//
 	// Beware: this value is ignored on OS X, where entry caching is disabled by
 	// default. See notes on MountConfig.EnableVnodeCaching for more.
 	EntryExpiration time.Time
 }
+
+// DirentPlus is an entry in the listing returned by ReadDirPlusOp: the name of
+// a child together with the result of looking it up, as if by LookUpInodeOp.
+type DirentPlus struct {
+	// The (opaque) offset within the directory of the entry following this one.
+	// See notes on ReadDirOp.Offset for details.
+	Offset DirOffset
+
+	// The name of the child within the directory.
+	Name string
+
+	// The child itself. Its type in the directory entry is taken from
+	// Entry.Attributes.Mode.
+	//
+	// As with LookUpInodeOp, the kernel increments the lookup count of
+	// Entry.Child for each entry it receives, so the file system must account
+	// for every entry it returns.
+	Entry ChildInodeEntry
+}
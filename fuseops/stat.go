@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// AttributesFromStat returns attributes for the file described by fi, as
+// returned by e.g. os.Lstat, for file systems that pass on the attributes of
+// files on another file system. If fi.Sys() is a *syscall.Stat_t, as it is for
+// files on the local file system, they are taken from that with
+// AttributesFromStatT. Otherwise only Size, Mode and Mtime are known; Nlink is
+// one, the other times are Mtime, and the file is owned by root.
+func AttributesFromStat(fi os.FileInfo) InodeAttributes {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return AttributesFromStatT(st)
+	}
+
+	return InodeAttributes{
+		Size:  uint64(fi.Size()),
+		Nlink: 1,
+		Mode:  fi.Mode(),
+		Atime: fi.ModTime(),
+		Mtime: fi.ModTime(),
+		Ctime: fi.ModTime(),
+	}
+}
+
+// AttributesFromStatT returns attributes for the file described by st, as
+// filled in by e.g. syscall.Lstat. Its fields are named and sized differently
+// on each platform; this takes care of that, along with converting the mode
+// as os.Lstat would. Crtime and Flags are filled in where the platform has
+// them (OS X and FreeBSD).
+//
+// Rdev is truncated to 32 bits, which on Linux is how the kernel encodes
+// device numbers with majors below 4096 and minors below 2^20 in the protocol.
+func AttributesFromStatT(st *syscall.Stat_t) InodeAttributes {
+	attrs := InodeAttributes{
+		Size:      uint64(st.Size),
+		Blocks:    uint64(st.Blocks),
+		BlockSize: uint32(st.Blksize),
+		Nlink:     uint32(st.Nlink),
+		Mode:      fileMode(uint32(st.Mode)),
+		Rdev:      uint32(st.Rdev),
+		Uid:       st.Uid,
+		Gid:       st.Gid,
+	}
+
+	fillTimes(&attrs, st)
+	return attrs
+}
+
+// Convert a mode as found in struct stat to the Go equivalent. This is what
+// fuse.ConvertFileMode does, which this package can't use.
+func fileMode(unixMode uint32) os.FileMode {
+	mode := os.FileMode(unixMode & 0777)
+	switch unixMode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFCHR:
+		mode |= os.ModeCharDevice | os.ModeDevice
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+
+	if unixMode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+
+	if unixMode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+
+	if unixMode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
+
+func timespec(ts syscall.Timespec) time.Time {
+	return time.Unix(ts.Unix())
+}
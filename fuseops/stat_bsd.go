@@ -0,0 +1,28 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops
+
+import "syscall"
+
+func fillTimes(attrs *InodeAttributes, st *syscall.Stat_t) {
+	attrs.Atime = timespec(st.Atimespec)
+	attrs.Mtime = timespec(st.Mtimespec)
+	attrs.Ctime = timespec(st.Ctimespec)
+	attrs.Crtime = timespec(st.Birthtimespec)
+	attrs.Flags = st.Flags
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseops_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A FileInfo that doesn't come from a file system.
+type memFileInfo struct {
+	os.FileInfo
+	mtime time.Time
+}
+
+func (fi memFileInfo) Size() int64        { return 4 }
+func (fi memFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi memFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func TestAttributesFromStat(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("taco"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := os.Chmod(file, 0640); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	if err := os.Chmod(sub, 0755|os.ModeSticky); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatalf("Mkfifo: %v", err)
+	}
+
+	for _, path := range []string{file, sub, link, fifo} {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("Lstat: %v", err)
+		}
+
+		attrs := fuseops.AttributesFromStat(fi)
+		if attrs.Mode != fi.Mode() {
+			t.Errorf("%s: got mode %v, want %v", path, attrs.Mode, fi.Mode())
+		}
+
+		if attrs.Size != uint64(fi.Size()) {
+			t.Errorf("%s: got size %d, want %d", path, attrs.Size, fi.Size())
+		}
+
+		if !attrs.Mtime.Equal(fi.ModTime()) {
+			t.Errorf("%s: got mtime %v, want %v", path, attrs.Mtime, fi.ModTime())
+		}
+
+		if attrs.Atime.IsZero() || attrs.Ctime.IsZero() {
+			t.Errorf("%s: got atime %v and ctime %v", path, attrs.Atime, attrs.Ctime)
+		}
+
+		if st := fi.Sys().(*syscall.Stat_t); attrs.BlockSize != uint32(st.Blksize) {
+			t.Errorf("%s: got block size %d, want %d", path, attrs.BlockSize, st.Blksize)
+		}
+
+		if attrs.Nlink == 0 {
+			t.Errorf("%s: got no links", path)
+		}
+
+		if attrs.Uid != uint32(os.Getuid()) || attrs.Gid != uint32(os.Getgid()) {
+			t.Errorf("%s: got owner %d:%d", path, attrs.Uid, attrs.Gid)
+		}
+	}
+
+	// Without a Stat_t, only what the FileInfo says is known.
+	mtime := time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)
+	attrs := fuseops.AttributesFromStat(memFileInfo{mtime: mtime})
+	want := fuseops.InodeAttributes{
+		Size:  4,
+		Nlink: 1,
+		Mode:  0444,
+		Atime: mtime,
+		Mtime: mtime,
+		Ctime: mtime,
+	}
+
+	if attrs != want {
+		t.Errorf("Got %+v, want %+v", attrs, want)
+	}
+}
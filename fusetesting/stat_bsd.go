@@ -1,3 +1,6 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
 // Copyright 2015 Google Inc. All Rights Reserved.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
@@ -0,0 +1,213 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Header describes the header of a request sent over a Transport. Opcode is
+// the kernel's opcode for the request, as defined by linux/fuse.h, and Nodeid
+// the inode it concerns. Uid, Gid and Pid identify the caller, and end up in
+// the op's OpContext.
+type Header struct {
+	Opcode uint32
+	Nodeid uint64
+	Uid    uint32
+	Gid    uint32
+	Pid    uint32
+}
+
+// Reply is the server's reply to a request sent over a Transport.
+type Reply struct {
+	// The error with which the request failed, or zero if it succeeded.
+	Errno syscall.Errno
+
+	// The encoded body of the reply, following the header.
+	Data []byte
+}
+
+// Transport serves a file system over an in-memory connection, playing the
+// part of the kernel so that the file system can be tested without mounting
+// it, and hence without /dev/fuse or the privileges needed to mount.
+//
+// Requests may be sent in their encoded form with Send, or built from
+// arguments and decoded by the helpers such as LookUpInode. Requests are
+// handled one at a time, so a Transport must not be used concurrently.
+type Transport struct {
+	k *fakekernel.Kernel
+
+	// The caller used for requests sent by the helpers, initially the current
+	// process. Change it to exercise the file system's access checks.
+	Caller Header
+}
+
+// NewTransport starts serving the supplied file system with the supplied
+// config, which may be nil. Call Close when finished with the transport.
+func NewTransport(
+	fs fuseutil.FileSystem,
+	cfg *fuse.MountConfig) (*Transport, error) {
+	k, err := fakekernel.Mount(fuseutil.NewFileSystemServer(fs), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Transport{
+		k: k,
+		Caller: Header{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+			Pid: uint32(os.Getpid()),
+		},
+	}
+
+	return t, nil
+}
+
+// Close hangs up on the file system, which is then destroyed, and waits for
+// the server to return.
+func (t *Transport) Close() error {
+	return t.k.Close()
+}
+
+// Send sends a request with the supplied header, followed by the supplied
+// payload encoded as the kernel would, and returns the server's reply. Errors
+// returned by the file system are reported in the reply, not as an error.
+func (t *Transport) Send(h Header, payload ...[]byte) (*Reply, error) {
+	in := t.k.Header(h.Opcode, h.Nodeid)
+	in.Uid = h.Uid
+	in.Gid = h.Gid
+	in.Pid = h.Pid
+
+	if err := t.k.Send(in, payload...); err != nil {
+		return nil, err
+	}
+
+	m, err := t.k.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Header.Unique != in.Unique {
+		return nil, fmt.Errorf(
+			"Reply for request %d; expected %d",
+			m.Header.Unique,
+			in.Unique)
+	}
+
+	return &Reply{Errno: m.Errno(), Data: m.Data}, nil
+}
+
+// Send a request from t.Caller, returning the error with which it failed, if
+// any, as a syscall.Errno.
+func (t *Transport) do(
+	opcode uint32,
+	nodeid uint64,
+	payload ...[]byte) (*Reply, error) {
+	h := t.Caller
+	h.Opcode = opcode
+	h.Nodeid = nodeid
+
+	r, err := t.Send(h, payload...)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Errno != 0 {
+		return nil, r.Errno
+	}
+
+	return r, nil
+}
+
+// LookUpInode sends a LookUpInodeOp for the named child of the supplied
+// parent, returning the entry decoded from the reply. If the file system
+// returns an error, it is returned as a syscall.Errno, e.g. syscall.ENOENT.
+//
+// The expiration times in the entry are relative to the time of the reply.
+func (t *Transport) LookUpInode(
+	parent fuseops.InodeID,
+	name string) (e fuseops.ChildInodeEntry, err error) {
+	r, err := t.do(fusekernel.OpLookup, uint64(parent), fakekernel.String(name))
+	if err != nil {
+		return e, err
+	}
+
+	var out fusekernel.EntryOut
+	if err = fakekernel.Decode(r.Data, &out); err != nil {
+		return e, err
+	}
+
+	now := time.Now()
+	e.Child = fuseops.InodeID(out.Nodeid)
+	e.Generation = fuseops.GenerationNumber(out.Generation)
+	e.Attributes = convertAttr(&out.Attr)
+	e.AttributesExpiration = now.Add(duration(out.AttrValid, out.AttrValidNsec))
+	e.EntryExpiration = now.Add(duration(out.EntryValid, out.EntryValidNsec))
+
+	return e, nil
+}
+
+// GetInodeAttributes sends a GetInodeAttributesOp for the supplied inode,
+// returning the attributes decoded from the reply. If the file system returns
+// an error, it is returned as a syscall.Errno.
+func (t *Transport) GetInodeAttributes(
+	inode fuseops.InodeID) (attrs fuseops.InodeAttributes, err error) {
+	r, err := t.do(
+		fusekernel.OpGetattr,
+		uint64(inode),
+		fakekernel.Bytes(&fusekernel.GetattrIn{}))
+	if err != nil {
+		return attrs, err
+	}
+
+	var out fusekernel.AttrOut
+	if err = fakekernel.Decode(r.Data, &out); err != nil {
+		return attrs, err
+	}
+
+	return convertAttr(&out.Attr), nil
+}
+
+// Convert attributes as encoded for the kernel back to the form in which the
+// file system supplied them.
+func convertAttr(in *fusekernel.Attr) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:   in.Size,
+		Blocks: in.Blocks,
+		Nlink:  in.Nlink,
+		Mode:   fuse.ConvertFileMode(in.Mode),
+		Rdev:   in.Rdev,
+		Atime:  time.Unix(int64(in.Atime), int64(in.AtimeNsec)),
+		Mtime:  time.Unix(int64(in.Mtime), int64(in.MtimeNsec)),
+		Ctime:  time.Unix(int64(in.Ctime), int64(in.CtimeNsec)),
+		Crtime: in.Crtime(),
+		Uid:    in.Uid,
+		Gid:    in.Gid,
+	}
+}
+
+func duration(secs uint64, nsecs uint32) time.Duration {
+	return time.Duration(secs)*time.Second + time.Duration(nsecs)
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with a single file named "foo" in the root, which only root
+// and the current user may look up.
+type fooFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+const fooID = fuseops.RootInodeID + 1
+
+func (fs *fooFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.OpContext.Uid != 0 && op.OpContext.Uid != uint32(os.Getuid()) {
+		return syscall.EACCES
+	}
+
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return syscall.ENOENT
+	}
+
+	op.Entry.Child = fooID
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Size:  17,
+		Nlink: 1,
+		Mode:  0644,
+	}
+
+	return nil
+}
+
+func TestTransportLookUpInode(t *testing.T) {
+	tr, err := fusetesting.NewTransport(&fooFS{}, nil)
+	if err != nil {
+		t.Fatalf("NewTransport: %v", err)
+	}
+	defer tr.Close()
+
+	e, err := tr.LookUpInode(fuseops.RootInodeID, "foo")
+	if err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if e.Child != fooID || e.Attributes.Size != 17 || e.Attributes.Mode != 0644 {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+
+	if _, err := tr.LookUpInode(fuseops.RootInodeID, "bar"); err != syscall.ENOENT {
+		t.Errorf("LookUpInode(bar): got %v, want %v", err, syscall.ENOENT)
+	}
+
+	tr.Caller.Uid = uint32(os.Getuid()) + 1
+	if _, err := tr.LookUpInode(fuseops.RootInodeID, "foo"); err != syscall.EACCES {
+		t.Errorf("LookUpInode as someone else: got %v, want %v", err, syscall.EACCES)
+	}
+}
+
+func TestTransportSend(t *testing.T) {
+	tr, err := fusetesting.NewTransport(&fooFS{}, nil)
+	if err != nil {
+		t.Fatalf("NewTransport: %v", err)
+	}
+	defer tr.Close()
+
+	// FUSE_LOOKUP, whose payload is the NUL-terminated name.
+	h := tr.Caller
+	h.Opcode = 1
+	h.Nodeid = uint64(fuseops.RootInodeID)
+
+	r, err := tr.Send(h, []byte("foo\x00"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	// The reply is a struct fuse_entry_out, starting with the node ID.
+	if r.Errno != 0 || len(r.Data) < 8 || r.Data[0] != byte(fooID) {
+		t.Errorf("Unexpected reply: %+v", r)
+	}
+
+	r, err = tr.Send(h, []byte("bar\x00"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if r.Errno != syscall.ENOENT || len(r.Data) != 0 {
+		t.Errorf("Unexpected reply: %+v", r)
+	}
+}
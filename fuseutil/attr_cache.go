@@ -0,0 +1,362 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// NewAttrCacheServer returns a server that serves ops with inner, except that
+// it remembers the results of LookUpInodeOp and GetInodeAttributesOp for ttl
+// and answers repeats of them itself. This is independent of the caching that
+// the kernel does according to the expiration times in the results, and helps
+// when those must be short.
+//
+// Ops that may change an inode's attributes drop what is remembered about it
+// before they are replied to: SetInodeAttributesOp, WriteFileOp, FallocateOp,
+// the xattr ops and OpenFileOp with O_TRUNC, as well as the ops that create
+// files for the parent directory and CreateLinkOp for the target. UnlinkOp,
+// RmDirOp and RenameOp drop everything. Results that arrive from inner after
+// such an op has finished, but were asked for before, are not remembered.
+//
+// Lookups answered here count towards the kernel's lookup counts (cf.
+// ForgetInodeOp) without inner knowing of them, so the counts in forget ops
+// are reduced by as many before they are passed on, and forget ops left with
+// nothing to forget are not passed on at all.
+//
+// Only ops that inner handles through Connection.Dispatch are cached, as with
+// any interceptor; servers created by this package do so.
+func NewAttrCacheServer(inner fuse.Server, ttl time.Duration) fuse.Server {
+	return &attrCacheServer{
+		inner: inner,
+		ttl:   ttl,
+	}
+}
+
+type attrCacheServer struct {
+	inner fuse.Server
+	ttl   time.Duration
+}
+
+func (s *attrCacheServer) ServeOps(c *fuse.Connection) {
+	cache := &attrCache{
+		ttl:      s.ttl,
+		attrs:    make(map[fuseops.InodeID]attrCacheEntry),
+		lookups:  make(map[attrCacheKey]lookUpCacheEntry),
+		names:    make(map[fuseops.InodeID]map[attrCacheKey]struct{}),
+		lookedUp: make(map[fuseops.InodeID]uint64),
+	}
+
+	c.Intercept(cache.intercept)
+	s.inner.ServeOps(c)
+}
+
+// A name within a directory.
+type attrCacheKey struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+type attrCacheEntry struct {
+	attrs      fuseops.InodeAttributes
+	expiration time.Time
+	expires    time.Time
+}
+
+type lookUpCacheEntry struct {
+	entry   fuseops.ChildInodeEntry
+	expires time.Time
+}
+
+type attrCache struct {
+	ttl time.Duration
+
+	mu sync.Mutex
+
+	// Incremented whenever entries are dropped, so that results asked for
+	// before then can be recognized.
+	//
+	// GUARDED_BY(mu)
+	epoch uint64
+
+	// GUARDED_BY(mu)
+	attrs   map[fuseops.InodeID]attrCacheEntry
+	lookups map[attrCacheKey]lookUpCacheEntry
+
+	// The keys in lookups for each child inode.
+	//
+	// GUARDED_BY(mu)
+	names map[fuseops.InodeID]map[attrCacheKey]struct{}
+
+	// The number of lookups answered from the cache for each inode that the
+	// kernel hasn't yet forgotten.
+	//
+	// GUARDED_BY(mu)
+	lookedUp map[fuseops.InodeID]uint64
+}
+
+func (c *attrCache) intercept(
+	ctx context.Context,
+	op interface{},
+	next func() error) error {
+	switch o := op.(type) {
+	case *fuseops.GetInodeAttributesOp:
+		if c.getAttributes(o) {
+			return nil
+		}
+
+		epoch := c.currentEpoch()
+		err := next()
+		if err == nil {
+			c.putAttributes(epoch, o.Inode, o.Attributes, o.AttributesExpiration)
+		}
+
+		return err
+
+	case *fuseops.LookUpInodeOp:
+		if c.lookUp(o) {
+			return nil
+		}
+
+		epoch := c.currentEpoch()
+		err := next()
+		if err == nil {
+			c.putLookUp(epoch, o)
+		}
+
+		return err
+
+	case *fuseops.ForgetInodeOp:
+		o.N = c.forget(o.Inode, o.N)
+		if o.N == 0 {
+			return nil
+		}
+
+		return next()
+
+	case *fuseops.BatchForgetOp:
+		var entries []fuseops.BatchForgetEntry
+		for _, e := range o.Entries {
+			if e.N = c.forget(e.Inode, e.N); e.N > 0 {
+				entries = append(entries, e)
+			}
+		}
+
+		if len(entries) == 0 {
+			return nil
+		}
+
+		o.Entries = entries
+		return next()
+	}
+
+	err := next()
+	c.invalidate(op)
+	return err
+}
+
+// Drop what is remembered about the inodes that op may have changed.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *attrCache) invalidate(op interface{}) {
+	var inodes []fuseops.InodeID
+	switch o := op.(type) {
+	case *fuseops.SetInodeAttributesOp:
+		inodes = append(inodes, o.Inode)
+	case *fuseops.WriteFileOp:
+		inodes = append(inodes, o.Inode)
+	case *fuseops.FallocateOp:
+		inodes = append(inodes, o.Inode)
+	case *fuseops.SetXattrOp:
+		inodes = append(inodes, o.Inode)
+	case *fuseops.RemoveXattrOp:
+		inodes = append(inodes, o.Inode)
+	case *fuseops.OpenFileOp:
+		if o.OpenFlags&fusekernel.OpenTruncate == 0 {
+			return
+		}
+
+		inodes = append(inodes, o.Inode)
+	case *fuseops.MkDirOp:
+		inodes = append(inodes, o.Parent)
+	case *fuseops.MkNodeOp:
+		inodes = append(inodes, o.Parent)
+	case *fuseops.CreateFileOp:
+		inodes = append(inodes, o.Parent)
+	case *fuseops.CreateSymlinkOp:
+		inodes = append(inodes, o.Parent)
+	case *fuseops.CreateLinkOp:
+		inodes = append(inodes, o.Parent, o.Target)
+
+	case *fuseops.UnlinkOp, *fuseops.RmDirOp, *fuseops.RenameOp:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.epoch++
+		c.attrs = make(map[fuseops.InodeID]attrCacheEntry)
+		c.lookups = make(map[attrCacheKey]lookUpCacheEntry)
+		c.names = make(map[fuseops.InodeID]map[attrCacheKey]struct{})
+		return
+
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	for _, inode := range inodes {
+		c.dropLocked(inode)
+	}
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *attrCache) dropLocked(inode fuseops.InodeID) {
+	delete(c.attrs, inode)
+	for key := range c.names[inode] {
+		delete(c.lookups, key)
+	}
+
+	delete(c.names, inode)
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *attrCache) currentEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.epoch
+}
+
+// Fill in op from the cache, reporting whether that was possible.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *attrCache) getAttributes(op *fuseops.GetInodeAttributesOp) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.attrs[op.Inode]
+	if !ok || !time.Now().Before(e.expires) {
+		return false
+	}
+
+	op.Attributes = e.attrs
+	op.AttributesExpiration = e.expiration
+	return true
+}
+
+// Remember the attributes of an inode, unless entries have been dropped since
+// the supplied epoch.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *attrCache) putAttributes(
+	epoch uint64,
+	inode fuseops.InodeID,
+	attrs fuseops.InodeAttributes,
+	expiration time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if epoch != c.epoch {
+		return
+	}
+
+	c.attrs[inode] = attrCacheEntry{
+		attrs:      attrs,
+		expiration: expiration,
+		expires:    time.Now().Add(c.ttl),
+	}
+}
+
+// Fill in op from the cache, reporting whether that was possible, in which
+// case it counts as a lookup of the child.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *attrCache) lookUp(op *fuseops.LookUpInodeOp) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.lookups[attrCacheKey{op.Parent, op.Name}]
+	if !ok || !time.Now().Before(e.expires) {
+		return false
+	}
+
+	op.Entry = e.entry
+	c.lookedUp[e.entry.Child]++
+	return true
+}
+
+// Remember the result of a lookup, unless entries have been dropped since the
+// supplied epoch.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *attrCache) putLookUp(epoch uint64, op *fuseops.LookUpInodeOp) {
+	if op.Entry.Child == 0 {
+		// A negative entry, which doesn't count as a lookup.
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if epoch != c.epoch {
+		return
+	}
+
+	expires := time.Now().Add(c.ttl)
+	key := attrCacheKey{op.Parent, op.Name}
+	c.lookups[key] = lookUpCacheEntry{entry: op.Entry, expires: expires}
+	c.attrs[op.Entry.Child] = attrCacheEntry{
+		attrs:      op.Entry.Attributes,
+		expiration: op.Entry.AttributesExpiration,
+		expires:    expires,
+	}
+
+	if c.names[op.Entry.Child] == nil {
+		c.names[op.Entry.Child] = make(map[attrCacheKey]struct{})
+	}
+
+	c.names[op.Entry.Child][key] = struct{}{}
+}
+
+// Drop what is remembered about an inode that the kernel is forgetting n
+// lookups of, and return the number of those that inner needs to hear about.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *attrCache) forget(inode fuseops.InodeID, n uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	c.dropLocked(inode)
+
+	ours := c.lookedUp[inode]
+	if ours > n {
+		ours = n
+	}
+
+	if c.lookedUp[inode] -= ours; c.lookedUp[inode] == 0 {
+		delete(c.lookedUp, inode)
+	}
+
+	return n - ours
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// countingFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system with a single file "foo" as inode 2, which counts the
+// metadata ops it sees.
+type countingFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu       sync.Mutex
+	size     uint64
+	lookUps  int
+	getAttrs int
+	forgets  uint64
+}
+
+func (fs *countingFS) attributes() fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:  fs.size,
+		Nlink: 1,
+		Mode:  0644,
+	}
+}
+
+func (fs *countingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Name != "foo" {
+		return syscall.ENOENT
+	}
+
+	fs.lookUps++
+	op.Entry.Child = 2
+	op.Entry.Attributes = fs.attributes()
+	return nil
+}
+
+func (fs *countingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.getAttrs++
+	op.Attributes = fs.attributes()
+	return nil
+}
+
+func (fs *countingFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Size != nil {
+		fs.size = *op.Size
+	}
+
+	op.Attributes = fs.attributes()
+	return nil
+}
+
+func (fs *countingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forgets += op.N
+	return nil
+}
+
+func (fs *countingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return nil
+}
+
+func (fs *countingFS) counts() (lookUps, getAttrs int, forgets uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.lookUps, fs.getAttrs, fs.forgets
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestAttrCacheServer(t *testing.T) {
+	fs := &countingFS{size: 3}
+	server := fuseutil.NewAttrCacheServer(fuseutil.NewFileSystemServer(fs), time.Hour)
+
+	k, err := fakekernel.Mount(server, nil)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	do := func(opcode uint32, nodeID uint64, payload ...[]byte) []byte {
+		m, err := k.Do(opcode, nodeID, payload...)
+		if err != nil {
+			t.Fatalf("Do(%d): %v", opcode, err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("Opcode %d: errno %v", opcode, errno)
+		}
+
+		return m.Data
+	}
+
+	size := func() uint64 {
+		var out fusekernel.AttrOut
+		if err := fakekernel.Decode(do(fusekernel.OpGetattr, 2, fakekernel.Bytes(&fusekernel.GetattrIn{})), &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		return out.Attr.Size
+	}
+
+	// The file system is asked for a lookup only once, and for attributes not
+	// at all, since the lookup gave them.
+	for i := 0; i < 3; i++ {
+		var out fusekernel.EntryOut
+		if err := fakekernel.Decode(do(fusekernel.OpLookup, 1, fakekernel.String("foo")), &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		if out.Nodeid != 2 || out.Attr.Size != 3 {
+			t.Errorf("LookUpInode: got inode %d of size %d", out.Nodeid, out.Attr.Size)
+		}
+
+		if got := size(); got != 3 {
+			t.Errorf("GetInodeAttributes: got size %d, want 3", got)
+		}
+	}
+
+	if lookUps, getAttrs, _ := fs.counts(); lookUps != 1 || getAttrs != 0 {
+		t.Errorf("Got %d lookups and %d getattrs, want 1 and 0", lookUps, getAttrs)
+	}
+
+	// Setting the size drops the cached attributes before the reply.
+	in := fusekernel.SetattrIn{}
+	in.Valid = uint32(fusekernel.SetattrSize)
+	in.Size = 7
+	do(fusekernel.OpSetattr, 2, fakekernel.Bytes(&in))
+
+	if got := size(); got != 7 {
+		t.Errorf("GetInodeAttributes after SetInodeAttributes: got size %d, want 7", got)
+	}
+
+	if _, getAttrs, _ := fs.counts(); getAttrs != 1 {
+		t.Errorf("Got %d getattrs, want 1", getAttrs)
+	}
+
+	// The kernel forgets all three lookups, but the file system only heard of
+	// one of them.
+	forget := fusekernel.ForgetIn{Nlookup: 3}
+	if err := k.Send(k.Header(fusekernel.OpForget, 2), fakekernel.Bytes(&forget)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	// Unlinking drops the cached lookups, so the next one reaches the file
+	// system. It also follows the forget, which is handled synchronously.
+	do(fusekernel.OpUnlink, 1, fakekernel.String("foo"))
+	do(fusekernel.OpLookup, 1, fakekernel.String("foo"))
+
+	if lookUps, _, forgets := fs.counts(); lookUps != 2 || forgets != 1 {
+		t.Errorf("Got %d lookups and %d forgets, want 2 and 1", lookUps, forgets)
+	}
+}
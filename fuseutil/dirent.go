@@ -19,6 +19,7 @@ import (
 	"unsafe"
 
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
 type DirentType uint32
@@ -52,7 +53,7 @@ type Dirent struct {
 
 // Write the supplied directory entry into the given buffer in the format
 // expected in fuseops.ReadFileOp.Data, returning the number of bytes written.
-// Return zero if the entry would not fit.
+// Return zero if the entry would not fit. See also AppendDirent.
 func WriteDirent(buf []byte, d Dirent) (n int) {
 	// We want to write bytes with the layout of fuse_dirent
 	// (http://goo.gl/BmFxob) in host order. The struct must be aligned according
@@ -103,3 +104,50 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 
 	return n
 }
+
+// Return the number of bytes that WriteDirent writes for the supplied entry,
+// for comparison with the room left in fuseops.ReadDirOp.Dst.
+func DirentSize(d Dirent) int {
+	const direntAlignment = 8
+
+	n := fusekernel.DirentSize + len(d.Name)
+	return (n + direntAlignment - 1) &^ (direntAlignment - 1)
+}
+
+// Append the supplied entry to the unused part of op.Dst, updating
+// op.BytesRead. Return false, leaving op untouched, if there isn't room for
+// it, in which case the file system should stop: the entry will be asked for
+// again in a later ReadDirOp whose Offset is that of the last entry appended.
+func AppendDirent(op *fuseops.ReadDirOp, d Dirent) bool {
+	n := WriteDirent(op.Dst[op.BytesRead:], d)
+	op.BytesRead += n
+	return n != 0
+}
+
+// Return the number of bytes the supplied entry takes up in a reply to
+// fuseops.ReadDirPlusOp, for comparison with its Size field.
+func DirentPlusSize(d fuseops.DirentPlus) int {
+	// The layout is that of fuse_direntplus (http://goo.gl/BmFxob): a
+	// fuse_entry_out followed by a fuse_dirent, aligned as above.
+	const direntAlignment = 8
+
+	n := int(unsafe.Sizeof(fusekernel.EntryOut{})) + fusekernel.DirentSize + len(d.Name)
+	return (n + direntAlignment - 1) &^ (direntAlignment - 1)
+}
+
+// Like AppendDirent, but for fuseops.ReadDirPlusOp: append the supplied entry
+// to op.Entries unless that would take them over op.Size, and report whether
+// it was appended.
+func AppendDirentPlus(op *fuseops.ReadDirPlusOp, d fuseops.DirentPlus) bool {
+	size := DirentPlusSize(d)
+	for _, e := range op.Entries {
+		size += DirentPlusSize(e)
+	}
+
+	if size > op.Size {
+		return false
+	}
+
+	op.Entries = append(op.Entries, d)
+	return true
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestAppendDirentResumesAtDroppedEntry(t *testing.T) {
+	names := []string{"a", "bbbbbbbbb", "cc", "dddddddddddddddddddd", "e"}
+
+	// Read the listing the way a file system would, stopping at the first entry
+	// that doesn't fit and resuming from the offset of the last one written.
+	// The buffer holds the longest entry, but not much more.
+	var got []string
+	var offset fuseops.DirOffset
+	for {
+		op := &fuseops.ReadDirOp{
+			Offset: offset,
+			Dst:    make([]byte, 56),
+		}
+
+		for i := int(op.Offset); i < len(names); i++ {
+			d := fuseutil.Dirent{
+				Offset: fuseops.DirOffset(i + 1),
+				Inode:  fuseops.InodeID(i + 2),
+				Name:   names[i],
+				Type:   fuseutil.DT_File,
+			}
+
+			before := op.BytesRead
+			if !fuseutil.AppendDirent(op, d) {
+				if op.BytesRead != before {
+					t.Fatalf("AppendDirent wrote %d bytes for %q without fitting", op.BytesRead-before, d.Name)
+				}
+
+				if room := len(op.Dst) - op.BytesRead; fuseutil.DirentSize(d) <= room {
+					t.Fatalf("%q takes %d bytes, but didn't fit in %d", d.Name, fuseutil.DirentSize(d), room)
+				}
+
+				break
+			}
+
+			if op.BytesRead-before != fuseutil.DirentSize(d) {
+				t.Errorf("%q: wrote %d bytes, DirentSize says %d", d.Name, op.BytesRead-before, fuseutil.DirentSize(d))
+			}
+
+			got = append(got, d.Name)
+			offset = d.Offset
+		}
+
+		if op.BytesRead == 0 {
+			break
+		}
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(names) {
+		t.Errorf("Got %v, want %v", got, names)
+	}
+}
+
+func TestAppendDirentPlus(t *testing.T) {
+	d := fuseops.DirentPlus{Name: "foo"}
+	op := &fuseops.ReadDirPlusOp{Size: 2*fuseutil.DirentPlusSize(d) + 1}
+
+	for i := 0; i < 2; i++ {
+		if !fuseutil.AppendDirentPlus(op, d) {
+			t.Fatalf("Entry %d didn't fit", i)
+		}
+	}
+
+	if fuseutil.AppendDirentPlus(op, d) {
+		t.Errorf("Third entry fit in %d bytes", op.Size)
+	}
+
+	if len(op.Entries) != 2 {
+		t.Errorf("Got %d entries, want 2", len(op.Entries))
+	}
+}
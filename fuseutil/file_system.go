@@ -43,6 +43,7 @@ type FileSystem interface {
 	MkDir(context.Context, *fuseops.MkDirOp) error
 	MkNode(context.Context, *fuseops.MkNodeOp) error
 	CreateFile(context.Context, *fuseops.CreateFileOp) error
+	CreateTmpfile(context.Context, *fuseops.CreateTmpfileOp) error
 	CreateLink(context.Context, *fuseops.CreateLinkOp) error
 	CreateSymlink(context.Context, *fuseops.CreateSymlinkOp) error
 	Rename(context.Context, *fuseops.RenameOp) error
@@ -50,6 +51,7 @@ type FileSystem interface {
 	Unlink(context.Context, *fuseops.UnlinkOp) error
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
 	ReadDir(context.Context, *fuseops.ReadDirOp) error
+	ReadDirPlus(context.Context, *fuseops.ReadDirPlusOp) error
 	ReleaseDirHandle(context.Context, *fuseops.ReleaseDirHandleOp) error
 	OpenFile(context.Context, *fuseops.OpenFileOp) error
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
@@ -63,6 +65,13 @@ type FileSystem interface {
 	ListXattr(context.Context, *fuseops.ListXattrOp) error
 	SetXattr(context.Context, *fuseops.SetXattrOp) error
 	Fallocate(context.Context, *fuseops.FallocateOp) error
+	Ioctl(context.Context, *fuseops.IoctlOp) error
+	SetupMapping(context.Context, *fuseops.SetupMappingOp) error
+	RemoveMapping(context.Context, *fuseops.RemoveMappingOp) error
+	SyncFS(context.Context, *fuseops.SyncFSOp) error
+	Access(context.Context, *fuseops.AccessOp) error
+	GetFileLock(context.Context, *fuseops.GetFileLockOp) error
+	SetFileLock(context.Context, *fuseops.SetFileLockOp) error
 
 	// Regard all inodes (including the root inode) as having their lookup counts
 	// decremented to zero, and clean up any resources associated with the file
@@ -75,9 +84,10 @@ type FileSystem interface {
 // directly with ENOSYS.
 //
 // Each call to a FileSystem method (except ForgetInode) is made on
-// its own goroutine, and is free to block. ForgetInode may be called
-// synchronously, and should not depend on calls to other methods
-// being received concurrently.
+// its own goroutine, or on one of a pool of them if
+// fuse.MountConfig.WorkerPoolSize is set, and is free to block. ForgetInode
+// may be called synchronously, and should not depend on calls to other
+// methods being received concurrently.
 //
 // (It is safe to naively process ops concurrently because the kernel
 // guarantees to serialize operations that the user expects to happen in order,
@@ -89,8 +99,26 @@ func NewFileSystemServer(fs FileSystem) fuse.Server {
 	}
 }
 
+// NewSupervisedFileSystemServer is like NewFileSystemServer, except that the
+// returned server doesn't give up the first time reading an op from the
+// connection fails with an error that fuse.IsTransientReadError considers
+// transient. Instead it goes back to reading ops, up to maxRestarts times
+// over the life of the connection. The file system is left alone across
+// restarts; in particular it is not destroyed.
+//
+// Clean termination (the kernel hanging up after an unmount) is not an error
+// and never causes a restart. Other errors, and transient errors beyond the
+// budget, cause a panic as they do for NewFileSystemServer.
+func NewSupervisedFileSystemServer(fs FileSystem, maxRestarts int) fuse.Server {
+	return &fileSystemServer{
+		fs:          fs,
+		maxRestarts: maxRestarts,
+	}
+}
+
 type fileSystemServer struct {
 	fs          FileSystem
+	maxRestarts int
 	opsInFlight sync.WaitGroup
 }
 
@@ -102,6 +130,7 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 		s.fs.Destroy()
 	}()
 
+	restarts := 0
 	for {
 		ctx, op, err := c.ReadOp()
 		if err == io.EOF {
@@ -109,6 +138,11 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 		}
 
 		if err != nil {
+			if restarts < s.maxRestarts && fuse.IsTransientReadError(err) {
+				restarts++
+				continue
+			}
+
 			panic(err)
 		}
 
@@ -120,7 +154,7 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 			// cheap for the file system to handle
 			s.handleOp(c, ctx, op)
 		} else {
-			go s.handleOp(c, ctx, op)
+			c.Go(op, func() { s.handleOp(c, ctx, op) })
 		}
 	}
 }
@@ -131,7 +165,17 @@ func (s *fileSystemServer) handleOp(
 	op interface{}) {
 	defer s.opsInFlight.Done()
 
-	// Dispatch to the appropriate method.
+	err := c.Dispatch(ctx, op, func() error {
+		return s.dispatch(ctx, op)
+	})
+
+	c.Reply(ctx, err)
+}
+
+// Call the file system method for the supplied op.
+func (s *fileSystemServer) dispatch(
+	ctx context.Context,
+	op interface{}) error {
 	var err error
 	switch typed := op.(type) {
 	default:
@@ -177,6 +221,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.CreateFileOp:
 		err = s.fs.CreateFile(ctx, typed)
 
+	case *fuseops.CreateTmpfileOp:
+		err = s.fs.CreateTmpfile(ctx, typed)
+
 	case *fuseops.CreateLinkOp:
 		err = s.fs.CreateLink(ctx, typed)
 
@@ -198,6 +245,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.ReadDirOp:
 		err = s.fs.ReadDir(ctx, typed)
 
+	case *fuseops.ReadDirPlusOp:
+		err = s.fs.ReadDirPlus(ctx, typed)
+
 	case *fuseops.ReleaseDirHandleOp:
 		err = s.fs.ReleaseDirHandle(ctx, typed)
 
@@ -236,7 +286,28 @@ func (s *fileSystemServer) handleOp(
 
 	case *fuseops.FallocateOp:
 		err = s.fs.Fallocate(ctx, typed)
+
+	case *fuseops.IoctlOp:
+		err = s.fs.Ioctl(ctx, typed)
+
+	case *fuseops.SetupMappingOp:
+		err = s.fs.SetupMapping(ctx, typed)
+
+	case *fuseops.RemoveMappingOp:
+		err = s.fs.RemoveMapping(ctx, typed)
+
+	case *fuseops.SyncFSOp:
+		err = s.fs.SyncFS(ctx, typed)
+
+	case *fuseops.AccessOp:
+		err = s.fs.Access(ctx, typed)
+
+	case *fuseops.GetFileLockOp:
+		err = s.fs.GetFileLock(ctx, typed)
+
+	case *fuseops.SetFileLockOp:
+		err = s.fs.SetFileLock(ctx, typed)
 	}
 
-	c.Reply(ctx, err)
+	return err
 }
@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+type statFS struct {
+	fuseutil.NotImplementedFileSystem
+	calls int32
+}
+
+func (fs *statFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	atomic.AddInt32(&fs.calls, 1)
+	return nil
+}
+
+func TestSupervisedServerRestartsAfterTransientError(t *testing.T) {
+	fs := &statFS{}
+	k, err := fakekernel.Mount(fuseutil.NewSupervisedFileSystemServer(fs, 1), nil)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	// A lookup whose name isn't NUL-terminated can't be converted to an op,
+	// which ReadOp reports as a transient error.
+	m, err := k.Do(fusekernel.OpLookup, 1, []byte("foo"))
+	if err != nil {
+		t.Fatalf("Do(OpLookup): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.EIO; got != want {
+		t.Errorf("Corrupt lookup: got errno %v, want %v", got, want)
+	}
+
+	// The server should still be serving ops, with the same file system.
+	m, err = k.Do(fusekernel.OpStatfs, 1)
+	if err != nil {
+		t.Fatalf("Do(OpStatfs): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Errorf("StatFS: got errno %v", errno)
+	}
+
+	if got := atomic.LoadInt32(&fs.calls); got != 1 {
+		t.Errorf("StatFS calls: got %d, want 1", got)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+type syncFS struct {
+	fuseutil.NotImplementedFileSystem
+	synced chan fuseops.InodeID
+}
+
+func (fs *syncFS) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	fs.synced <- op.Inode
+	return nil
+}
+
+func TestSyncFS(t *testing.T) {
+	fs := &syncFS{synced: make(chan fuseops.InodeID, 1)}
+	k, err := fakekernel.Mount(fuseutil.NewFileSystemServer(fs), nil)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	m, err := k.Do(
+		fusekernel.OpSyncfs,
+		fuseops.RootInodeID,
+		fakekernel.Bytes(&fusekernel.SyncfsIn{}))
+	if err != nil {
+		t.Fatalf("Do(OpSyncfs): %v", err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Errorf("SyncFS: got errno %v", errno)
+	}
+
+	if got := <-fs.synced; got != fuseops.RootInodeID {
+		t.Errorf("SyncFS inode: got %v, want %v", got, fuseops.RootInodeID)
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A ContentGenerator returns length bytes of file content starting at the
+// given offset. It must be deterministic, so that the content at a given
+// offset is the same however it is read.
+type ContentGenerator func(offset int64, length int) []byte
+
+// PseudoRandomContent returns a ContentGenerator for content that looks
+// random, but is entirely determined by the seed and the offset.
+func PseudoRandomContent(seed uint64) ContentGenerator {
+	return func(offset int64, length int) []byte {
+		b := make([]byte, length)
+		for i := range b {
+			p := uint64(offset) + uint64(i)
+			b[i] = byte(splitmix64(seed^(p/8)) >> (8 * (p % 8)))
+		}
+
+		return b
+	}
+}
+
+// The finalizer of the SplitMix64 generator, which scrambles its input well.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// GeneratorFileSystem is a read-only file system serving files of arbitrary
+// size whose content is produced on the fly, which makes it a convenient
+// target for read benchmarks that shouldn't be limited by a real backend. All
+// of its files live in the root directory, and share the content of their
+// generator. Ops that would modify the file system fail with EROFS.
+//
+// Create one with NewGeneratorFileSystem, and serve it with
+// NewFileSystemServer.
+type GeneratorFileSystem struct {
+	NotImplementedFileSystem
+
+	generate ContentGenerator
+
+	// The files, sorted by name. The file at index i has inode ID i+2.
+	names []string
+	sizes []int64
+}
+
+var _ FileSystem = &GeneratorFileSystem{}
+
+// NewGeneratorFileSystem returns a file system serving files with the
+// supplied names and sizes, whose content is produced by generate. If
+// generate is nil, files are filled with zeroes.
+func NewGeneratorFileSystem(
+	files map[string]int64,
+	generate ContentGenerator) *GeneratorFileSystem {
+	fs := &GeneratorFileSystem{
+		generate: generate,
+	}
+
+	for name := range files {
+		fs.names = append(fs.names, name)
+	}
+
+	sort.Strings(fs.names)
+	for _, name := range fs.names {
+		fs.sizes = append(fs.sizes, files[name])
+	}
+
+	return fs
+}
+
+// Return the index of the file with the given inode ID, or -1 if there is
+// none.
+func (fs *GeneratorFileSystem) fileIndex(id fuseops.InodeID) int {
+	i := int(id) - 2
+	if i < 0 || i >= len(fs.names) {
+		return -1
+	}
+
+	return i
+}
+
+func (fs *GeneratorFileSystem) attributes(
+	id fuseops.InodeID) (attrs fuseops.InodeAttributes, err error) {
+	if id == fuseops.RootInodeID {
+		attrs = fuseops.InodeAttributes{
+			Nlink: 2,
+			Mode:  os.ModeDir | 0555,
+		}
+
+		return attrs, nil
+	}
+
+	i := fs.fileIndex(id)
+	if i < 0 {
+		return attrs, fuse.ENOENT
+	}
+
+	attrs = fuseops.InodeAttributes{
+		Size:  uint64(fs.sizes[i]),
+		Nlink: 1,
+		Mode:  0444,
+	}
+
+	return attrs, nil
+}
+
+func (fs *GeneratorFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *GeneratorFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID {
+		return fuse.ENOENT
+	}
+
+	i := sort.SearchStrings(fs.names, op.Name)
+	if i == len(fs.names) || fs.names[i] != op.Name {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = fuseops.InodeID(i + 2)
+	op.Entry.Attributes, _ = fs.attributes(op.Entry.Child)
+
+	return nil
+}
+
+func (fs *GeneratorFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	var err error
+	op.Attributes, err = fs.attributes(op.Inode)
+	return err
+}
+
+func (fs *GeneratorFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *GeneratorFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return nil
+}
+
+func (fs *GeneratorFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if op.Inode != fuseops.RootInodeID {
+		return fuse.ENOTDIR
+	}
+
+	return nil
+}
+
+func (fs *GeneratorFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Inode != fuseops.RootInodeID {
+		return fuse.ENOTDIR
+	}
+
+	// Resume at the specified offset into the list of files.
+	for i := int(op.Offset); i < len(fs.names); i++ {
+		fit := AppendDirent(op, Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fuseops.InodeID(i + 2),
+			Name:   fs.names[i],
+			Type:   DT_File,
+		})
+		if !fit {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (fs *GeneratorFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *GeneratorFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if fs.fileIndex(op.Inode) < 0 {
+		return fuse.ENOENT
+	}
+
+	if !op.OpenFlags.IsReadOnly() {
+		return syscall.EROFS
+	}
+
+	op.KeepPageCache = true
+	return nil
+}
+
+// ReadFile serves the generated content, stopping short at the end of the
+// file.
+func (fs *GeneratorFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	i := fs.fileIndex(op.Inode)
+	if i < 0 {
+		return fuse.ENOENT
+	}
+
+	n := op.Size
+	if remaining := fs.sizes[i] - op.Offset; remaining < n {
+		n = remaining
+	}
+
+	if n <= 0 {
+		return nil
+	}
+
+	var b []byte
+	if fs.generate != nil {
+		b = fs.generate(op.Offset, int(n))
+	} else {
+		b = make([]byte, n)
+	}
+
+	if op.Dst != nil {
+		op.BytesRead = copy(op.Dst, b)
+	} else {
+		op.Data = [][]byte{b}
+		op.BytesRead = len(b)
+	}
+
+	return nil
+}
+
+func (fs *GeneratorFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func (fs *GeneratorFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) CreateTmpfile(
+	ctx context.Context,
+	op *fuseops.CreateTmpfileOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return syscall.EROFS
+}
+
+func (fs *GeneratorFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return syscall.EROFS
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+const generatedSize = 1000
+
+func lookUpGenerated(
+	t *testing.T,
+	fs *fuseutil.GeneratorFileSystem,
+	name string) fuseops.InodeID {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+	}
+
+	if err := fs.LookUpInode(context.Background(), op); err != nil {
+		t.Fatalf("LookUpInode(%q): %v", name, err)
+	}
+
+	return op.Entry.Child
+}
+
+func TestPseudoRandomContentIsDeterministic(t *testing.T) {
+	gen := fuseutil.PseudoRandomContent(17)
+	whole := gen(0, generatedSize)
+
+	for _, offset := range []int64{0, 1, 7, 8, 513, 900} {
+		if got := gen(offset, 100); !bytes.Equal(got, whole[offset:offset+100]) {
+			t.Errorf("Content at offset %d differs from the whole", offset)
+		}
+	}
+
+	if bytes.Equal(whole, fuseutil.PseudoRandomContent(18)(0, generatedSize)) {
+		t.Errorf("Different seeds gave the same content")
+	}
+}
+
+func TestGeneratorFileSystemRead(t *testing.T) {
+	gen := fuseutil.PseudoRandomContent(17)
+	whole := gen(0, generatedSize)
+
+	fs := fuseutil.NewGeneratorFileSystem(
+		map[string]int64{"foo": generatedSize, "bar": 0},
+		gen)
+	foo := lookUpGenerated(t, fs, "foo")
+
+	testCases := []struct {
+		offset int64
+		size   int64
+		want   []byte
+	}{
+		{0, 100, whole[:100]},
+		{513, 100, whole[513:613]},
+		{950, 100, whole[950:]}, // Short read at EOF
+		{generatedSize, 100, nil},
+		{2 * generatedSize, 100, nil},
+	}
+
+	for _, tc := range testCases {
+		// Both plain and vectored reads.
+		op := &fuseops.ReadFileOp{
+			Inode:  foo,
+			Offset: tc.offset,
+			Size:   tc.size,
+			Dst:    make([]byte, tc.size),
+		}
+
+		if err := fs.ReadFile(context.Background(), op); err != nil {
+			t.Fatalf("ReadFile(%d, %d): %v", tc.offset, tc.size, err)
+		}
+
+		if got := op.Dst[:op.BytesRead]; !bytes.Equal(got, tc.want) {
+			t.Errorf("ReadFile(%d, %d): got %d bytes, want %d", tc.offset, tc.size, len(got), len(tc.want))
+		}
+
+		op = &fuseops.ReadFileOp{
+			Inode:  foo,
+			Offset: tc.offset,
+			Size:   tc.size,
+		}
+
+		if err := fs.ReadFile(context.Background(), op); err != nil {
+			t.Fatalf("ReadFile(%d, %d): %v", tc.offset, tc.size, err)
+		}
+
+		got := bytes.Join(op.Data, nil)
+		if op.BytesRead != len(got) || !bytes.Equal(got, tc.want) {
+			t.Errorf("Vectored ReadFile(%d, %d): got %d bytes, want %d", tc.offset, tc.size, len(got), len(tc.want))
+		}
+	}
+
+	// The empty file has no content at all.
+	op := &fuseops.ReadFileOp{
+		Inode: lookUpGenerated(t, fs, "bar"),
+		Size:  100,
+		Dst:   make([]byte, 100),
+	}
+
+	if err := fs.ReadFile(context.Background(), op); err != nil || op.BytesRead != 0 {
+		t.Errorf("ReadFile(bar): got %d bytes, %v", op.BytesRead, err)
+	}
+}
+
+func TestGeneratorFileSystemRejectsWrites(t *testing.T) {
+	fs := fuseutil.NewGeneratorFileSystem(map[string]int64{"foo": generatedSize}, nil)
+	foo := lookUpGenerated(t, fs, "foo")
+	ctx := context.Background()
+
+	err := fs.OpenFile(ctx, &fuseops.OpenFileOp{
+		Inode:     foo,
+		OpenFlags: fusekernel.OpenReadWrite,
+	})
+	if err != syscall.EROFS {
+		t.Errorf("OpenFile(O_RDWR): got %v, want %v", err, syscall.EROFS)
+	}
+
+	err = fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: foo, Data: []byte("taco")})
+	if err != syscall.EROFS {
+		t.Errorf("WriteFile: got %v, want %v", err, syscall.EROFS)
+	}
+
+	err = fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "bar"})
+	if err != syscall.EROFS {
+		t.Errorf("CreateFile: got %v, want %v", err, syscall.EROFS)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A HandleMap holds the state of type T that a file system keeps for each
+// open file or directory handle, such as a connection to its backend. It is
+// safe for concurrent use, and its zero value is empty and ready to use.
+//
+// Handle IDs are never reused (they are counted up from one), so an op that
+// carries a handle that has already been released, e.g. one that raced with
+// the release, finds nothing rather than the state of a file opened since.
+//
+// File systems typically call OpenFile, OpenDir, CreateFile or CreateTmpfile
+// to issue a handle, Get in the ops that carry it, and ReleaseFileHandle or
+// ReleaseDirHandle to take the state back out and free it.
+type HandleMap[T any] struct {
+	mu sync.Mutex
+
+	// The ID most recently issued.
+	//
+	// GUARDED_BY(mu)
+	last fuseops.HandleID
+
+	// GUARDED_BY(mu)
+	entries map[fuseops.HandleID]T
+}
+
+// Add stores v under a new handle ID, which it returns.
+func (m *HandleMap[T]) Add(v T) fuseops.HandleID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.entries == nil {
+		m.entries = make(map[fuseops.HandleID]T)
+	}
+
+	m.last++
+	m.entries[m.last] = v
+	return m.last
+}
+
+// Get returns the value stored under h, if any.
+func (m *HandleMap[T]) Get(h fuseops.HandleID) (v T, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok = m.entries[h]
+	return v, ok
+}
+
+// Remove takes the value stored under h out of the map and returns it, if
+// there was one, so that the caller can free it.
+func (m *HandleMap[T]) Remove(h fuseops.HandleID) (v T, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok = m.entries[h]
+	delete(m.entries, h)
+	return v, ok
+}
+
+// Len returns the number of handles in the map, e.g. for checking that all
+// have been released.
+func (m *HandleMap[T]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries)
+}
+
+// OpenFile stores v under a new handle and sets op.Handle to it.
+func (m *HandleMap[T]) OpenFile(op *fuseops.OpenFileOp, v T) {
+	op.Handle = m.Add(v)
+}
+
+// OpenDir stores v under a new handle and sets op.Handle to it.
+func (m *HandleMap[T]) OpenDir(op *fuseops.OpenDirOp, v T) {
+	op.Handle = m.Add(v)
+}
+
+// CreateFile stores v under a new handle and sets op.Handle to it.
+func (m *HandleMap[T]) CreateFile(op *fuseops.CreateFileOp, v T) {
+	op.Handle = m.Add(v)
+}
+
+// CreateTmpfile stores v under a new handle and sets op.Handle to it.
+func (m *HandleMap[T]) CreateTmpfile(op *fuseops.CreateTmpfileOp, v T) {
+	op.Handle = m.Add(v)
+}
+
+// ReleaseFileHandle removes and returns the value stored under op.Handle, as
+// for Remove.
+func (m *HandleMap[T]) ReleaseFileHandle(op *fuseops.ReleaseFileHandleOp) (T, bool) {
+	return m.Remove(op.Handle)
+}
+
+// ReleaseDirHandle removes and returns the value stored under op.Handle, as
+// for Remove.
+func (m *HandleMap[T]) ReleaseDirHandle(op *fuseops.ReleaseDirHandleOp) (T, bool) {
+	return m.Remove(op.Handle)
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestHandleMap(t *testing.T) {
+	var m fuseutil.HandleMap[string]
+
+	taco := m.Add("taco")
+	burrito := m.Add("burrito")
+	if taco == burrito {
+		t.Fatalf("Add returned %v twice", taco)
+	}
+
+	if v, ok := m.Get(taco); !ok || v != "taco" {
+		t.Errorf("Get(%v): got %q, %v", taco, v, ok)
+	}
+
+	if v, ok := m.Remove(taco); !ok || v != "taco" {
+		t.Errorf("Remove(%v): got %q, %v", taco, v, ok)
+	}
+
+	if _, ok := m.Get(taco); ok {
+		t.Errorf("Get(%v) found a removed handle", taco)
+	}
+
+	if _, ok := m.Remove(taco); ok {
+		t.Errorf("Remove(%v) found a removed handle", taco)
+	}
+
+	// A removed handle isn't issued again.
+	if enchilada := m.Add("enchilada"); enchilada == taco || enchilada == burrito {
+		t.Errorf("Add reused %v", enchilada)
+	}
+
+	if got := m.Len(); got != 2 {
+		t.Errorf("Len: got %d, want 2", got)
+	}
+}
+
+func TestHandleMapConcurrentAdds(t *testing.T) {
+	var m fuseutil.HandleMap[int]
+
+	const n = 100
+	handles := make([]fuseops.HandleID, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			handles[i] = m.Add(i)
+		}(i)
+	}
+
+	wg.Wait()
+
+	seen := make(map[fuseops.HandleID]bool)
+	for i, h := range handles {
+		if seen[h] {
+			t.Fatalf("Add returned %v twice", h)
+		}
+
+		seen[h] = true
+		if v, ok := m.Get(h); !ok || v != i {
+			t.Errorf("Get(%v): got %d, %v, want %d", h, v, ok, i)
+		}
+	}
+}
+
+func TestHandleMapOps(t *testing.T) {
+	var m fuseutil.HandleMap[string]
+
+	open := &fuseops.OpenFileOp{}
+	m.OpenFile(open, "file")
+
+	openDir := &fuseops.OpenDirOp{}
+	m.OpenDir(openDir, "dir")
+
+	if open.Handle == openDir.Handle {
+		t.Fatalf("OpenFile and OpenDir both issued %v", open.Handle)
+	}
+
+	v, ok := m.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: open.Handle})
+	if !ok || v != "file" {
+		t.Errorf("ReleaseFileHandle: got %q, %v", v, ok)
+	}
+
+	v, ok = m.ReleaseDirHandle(&fuseops.ReleaseDirHandleOp{Handle: openDir.Handle})
+	if !ok || v != "dir" {
+		t.Errorf("ReleaseDirHandle: got %q, %v", v, ok)
+	}
+
+	if got := m.Len(); got != 0 {
+		t.Errorf("Len after releasing: got %d, want 0", got)
+	}
+}
@@ -0,0 +1,911 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/sys/unix"
+)
+
+// NewLoopbackServer returns a server for a file system that mirrors the
+// directory root on the host, passing every op through to the corresponding
+// system call. Errors from the host are passed back to the kernel as they are.
+//
+// Each inode holds an O_PATH descriptor for the host file that it was looked
+// up as, so that it keeps referring to that file when it or one of its parents
+// is renamed behind the server's back. The descriptor is closed once the
+// kernel has forgotten the inode. Inode IDs are assigned per host file, i.e.
+// device and inode number, so hard links share an inode, and a file keeps its
+// ID for the life of the server.
+//
+// New files are created by the server's own user, with the server's umask
+// applied on top of the mode that the kernel sends. File locks are left to the
+// kernel, and access checks to the default_permissions mount option.
+func NewLoopbackServer(root string) (fuse.Server, error) {
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return nil, &os.PathError{Op: "stat", Path: root, Err: err}
+	}
+
+	fs := &loopbackFS{
+		inodes: map[fuseops.InodeID]*loopbackInode{
+			fuseops.RootInodeID: {fd: fd, lookups: 1},
+		},
+		ids:    map[loopbackKey]fuseops.InodeID{keyOf(&st): fuseops.RootInodeID},
+		nextID: fuseops.RootInodeID + 1,
+		dirs:   make(map[fuseops.HandleID]*loopbackDir),
+		files:  make(map[fuseops.HandleID]*os.File),
+		nextFh: 1,
+	}
+
+	return NewFileSystemServer(fs), nil
+}
+
+// A host file, identified by device and inode number.
+type loopbackKey struct {
+	dev uint64
+	ino uint64
+}
+
+func keyOf(st *unix.Stat_t) loopbackKey {
+	return loopbackKey{dev: uint64(st.Dev), ino: st.Ino}
+}
+
+// An inode that the kernel knows about.
+type loopbackInode struct {
+	// An O_PATH descriptor for the host file.
+	fd int
+
+	// The kernel's lookup count (cf. ForgetInodeOp).
+	lookups uint64
+}
+
+// The listing of an open directory, made when it was opened.
+type loopbackDir struct {
+	dev     uint64
+	entries []loopbackDirent
+}
+
+type loopbackDirent struct {
+	name string
+	ino  uint64
+	typ  DirentType
+}
+
+type loopbackFS struct {
+	NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// The inodes that the kernel knows about.
+	//
+	// INVARIANT: For each inode, lookups > 0
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*loopbackInode
+
+	// The ID assigned to each host file that we have seen. Entries are never
+	// removed, so that IDs stay the same even once the kernel has forgotten
+	// them, and are never reused.
+	//
+	// GUARDED_BY(mu)
+	ids    map[loopbackKey]fuseops.InodeID
+	nextID fuseops.InodeID
+
+	// Open directories and files. An *os.File may be used and closed
+	// concurrently: once it is closed, ops on it fail rather than landing on
+	// whatever file descriptor number gets reused.
+	//
+	// GUARDED_BY(mu)
+	dirs   map[fuseops.HandleID]*loopbackDir
+	files  map[fuseops.HandleID]*os.File
+	nextFh fuseops.HandleID
+}
+
+// A path through which the host file with the supplied O_PATH descriptor can
+// be opened, or passed to system calls with no *at variant that takes one.
+func procPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
+
+// Return the O_PATH descriptor of the supplied inode.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *loopbackFS) fd(id fuseops.InodeID) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[id]
+	if !ok {
+		return -1, fuse.ENOENT
+	}
+
+	return in.fd, nil
+}
+
+// Return the ID for the supplied host file, assigning one if need be.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *loopbackFS) idLocked(key loopbackKey) fuseops.InodeID {
+	id, ok := fs.ids[key]
+	if !ok {
+		id = fs.nextID
+		fs.nextID++
+		fs.ids[key] = id
+	}
+
+	return id
+}
+
+// Look up the named child of the directory with the supplied descriptor,
+// filling in entry and incrementing the child's lookup count.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *loopbackFS) lookUp(
+	parent int,
+	name string,
+	entry *fuseops.ChildInodeEntry) error {
+	fd, err := unix.Openat(parent, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id := fs.idLocked(keyOf(&st))
+	if in, ok := fs.inodes[id]; ok {
+		in.lookups++
+		unix.Close(fd)
+	} else {
+		fs.inodes[id] = &loopbackInode{fd: fd, lookups: 1}
+	}
+
+	entry.Child = id
+	entry.Attributes = loopbackAttributes(&st)
+	return nil
+}
+
+// Decrement the lookup count of the supplied inode, closing its descriptor if
+// the kernel has forgotten it altogether.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *loopbackFS) forget(id fuseops.InodeID, n uint64) {
+	if id == fuseops.RootInodeID {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[id]
+	if !ok {
+		return
+	}
+
+	if n < in.lookups {
+		in.lookups -= n
+		return
+	}
+
+	unix.Close(in.fd)
+	delete(fs.inodes, id)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *loopbackFS) file(h fuseops.HandleID) (*os.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, ok := fs.files[h]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return f, nil
+}
+
+// Stat the host file with the supplied descriptor.
+func loopbackStat(fd int) (fuseops.InodeAttributes, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	return loopbackAttributes(&st), nil
+}
+
+func loopbackAttributes(st *unix.Stat_t) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:   uint64(st.Size),
+		Blocks: uint64(st.Blocks),
+		Nlink:  uint32(st.Nlink),
+		Mode:   fuse.ConvertFileMode(st.Mode),
+		Rdev:   uint32(st.Rdev),
+		Atime:  time.Unix(st.Atim.Unix()),
+		Mtime:  time.Unix(st.Mtim.Unix()),
+		Ctime:  time.Unix(st.Ctim.Unix()),
+		Uid:    st.Uid,
+		Gid:    st.Gid,
+	}
+}
+
+// The permission bits of the supplied mode, in the form taken by system calls.
+func loopbackPerm(mode os.FileMode) uint32 {
+	return fuse.ConvertGoMode(mode) &^ syscall.S_IFMT
+}
+
+func (fs *loopbackFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fd, err := fs.fd(fuseops.RootInodeID)
+	if err != nil {
+		return err
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(fd, &st); err != nil {
+		return err
+	}
+
+	op.BlockSize = uint32(st.Bsize)
+	op.Blocks = st.Blocks
+	op.BlocksFree = st.Bfree
+	op.BlocksAvailable = st.Bavail
+	op.IoSize = uint32(st.Bsize)
+	op.Inodes = st.Files
+	op.InodesFree = st.Ffree
+	return nil
+}
+
+func (fs *loopbackFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.fd(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(parent, op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, err = loopbackStat(fd)
+	return err
+}
+
+func (fs *loopbackFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	if op.Mode != nil {
+		if err := unix.Chmod(procPath(fd), loopbackPerm(*op.Mode)); err != nil {
+			return err
+		}
+	}
+
+	if op.Uid != nil || op.Gid != nil {
+		uid, gid := -1, -1
+		if op.Uid != nil {
+			uid = int(*op.Uid)
+		}
+
+		if op.Gid != nil {
+			gid = int(*op.Gid)
+		}
+
+		err := unix.Fchownat(fd, "", uid, gid, unix.AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return err
+		}
+	}
+
+	if op.Size != nil {
+		if op.Handle != nil {
+			f, err := fs.file(*op.Handle)
+			if err != nil {
+				return err
+			}
+
+			err = f.Truncate(int64(*op.Size))
+		} else {
+			err = unix.Truncate(procPath(fd), int64(*op.Size))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if op.Atime != nil || op.Mtime != nil {
+		ts := []unix.Timespec{
+			{Nsec: unix.UTIME_OMIT},
+			{Nsec: unix.UTIME_OMIT},
+		}
+
+		for i, t := range []*time.Time{op.Atime, op.Mtime} {
+			if t != nil {
+				ts[i] = unix.NsecToTimespec(t.UnixNano())
+			}
+		}
+
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, procPath(fd), ts, 0); err != nil {
+			return err
+		}
+	}
+
+	op.Attributes, err = loopbackStat(fd)
+	return err
+}
+
+func (fs *loopbackFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forget(op.Inode, op.N)
+	return nil
+}
+
+func (fs *loopbackFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	parent, err := fs.fd(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Mkdirat(parent, op.Name, loopbackPerm(op.Mode)); err != nil {
+		return err
+	}
+
+	return fs.lookUp(parent, op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	parent, err := fs.fd(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	err = unix.Mknodat(parent, op.Name, fuse.ConvertGoMode(op.Mode), int(op.Rdev))
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(parent, op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	parent, err := fs.fd(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	fd, err := unix.Openat(
+		parent,
+		op.Name,
+		unix.O_CREAT|unix.O_RDWR|unix.O_CLOEXEC,
+		loopbackPerm(op.Mode))
+	if err != nil {
+		return err
+	}
+
+	f := os.NewFile(uintptr(fd), op.Name)
+	if err := fs.lookUp(parent, op.Name, &op.Entry); err != nil {
+		f.Close()
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextFh
+	fs.nextFh++
+	fs.files[op.Handle] = f
+	return nil
+}
+
+func (fs *loopbackFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	parent, err := fs.fd(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Symlinkat(op.Target, parent, op.Name); err != nil {
+		return err
+	}
+
+	return fs.lookUp(parent, op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	parent, err := fs.fd(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	target, err := fs.fd(op.Target)
+	if err != nil {
+		return err
+	}
+
+	// Linking an O_PATH descriptor with AT_EMPTY_PATH takes CAP_DAC_READ_SEARCH,
+	// while following its /proc link doesn't.
+	err = unix.Linkat(unix.AT_FDCWD, procPath(target), parent, op.Name, unix.AT_SYMLINK_FOLLOW)
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(parent, op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	oldParent, err := fs.fd(op.OldParent)
+	if err != nil {
+		return err
+	}
+
+	newParent, err := fs.fd(op.NewParent)
+	if err != nil {
+		return err
+	}
+
+	return unix.Renameat(oldParent, op.OldName, newParent, op.NewName)
+}
+
+func (fs *loopbackFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	parent, err := fs.fd(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	return unix.Unlinkat(parent, op.Name, unix.AT_REMOVEDIR)
+}
+
+func (fs *loopbackFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	parent, err := fs.fd(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	return unix.Unlinkat(parent, op.Name, 0)
+}
+
+func (fs *loopbackFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	dir, err := readLoopbackDir(fd)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextFh
+	fs.nextFh++
+	fs.dirs[op.Handle] = dir
+	return nil
+}
+
+// List the directory with the supplied O_PATH descriptor. getdents(2) is used
+// rather than os.File.ReadDir, which doesn't give the inode numbers.
+func readLoopbackDir(fd int) (*loopbackDir, error) {
+	dirfd, err := unix.Openat(fd, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dirfd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(dirfd, &st); err != nil {
+		return nil, err
+	}
+
+	dir := &loopbackDir{dev: uint64(st.Dev)}
+	buf := make([]byte, 8192)
+	for {
+		n, err := unix.Getdents(dirfd, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n <= 0 {
+			break
+		}
+
+		var d unix.Dirent
+		for off := 0; off < n; {
+			rec := buf[off:n]
+			reclen := int(*(*uint16)(unsafe.Pointer(&rec[unsafe.Offsetof(d.Reclen)])))
+			name := rec[unsafe.Offsetof(d.Name):reclen]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+
+			off += reclen
+			if string(name) == "." || string(name) == ".." {
+				continue
+			}
+
+			dir.entries = append(dir.entries, loopbackDirent{
+				name: string(name),
+				ino:  *(*uint64)(unsafe.Pointer(&rec[unsafe.Offsetof(d.Ino)])),
+				typ:  DirentType(rec[unsafe.Offsetof(d.Type)]),
+			})
+		}
+	}
+
+	return dir, nil
+}
+
+func (fs *loopbackFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, ok := fs.dirs[op.Handle]
+	if !ok {
+		return syscall.EBADF
+	}
+
+	// Resume at the specified offset into the listing.
+	for i := int(op.Offset); i < len(dir.entries); i++ {
+		e := dir.entries[i]
+		fit := AppendDirent(op, Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fs.idLocked(loopbackKey{dev: dir.dev, ino: e.ino}),
+			Name:   e.name,
+			Type:   e.typ,
+		})
+		if !fit {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.dirs, op.Handle)
+	return nil
+}
+
+// OpenFile opens the host file for reading as well as writing when asked to
+// write to it, since with writeback caching the kernel may need to read pages
+// before writing them back. O_APPEND is dropped: the kernel works out the
+// offsets of appending writes itself.
+func (fs *loopbackFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	flags := int(op.OpenFlags) &^ (unix.O_CREAT | unix.O_EXCL | unix.O_NOCTTY | unix.O_APPEND)
+	flags |= unix.O_CLOEXEC
+
+	var hostfd int
+	if flags&unix.O_ACCMODE == unix.O_WRONLY {
+		hostfd, err = unix.Open(procPath(fd), flags&^unix.O_ACCMODE|unix.O_RDWR, 0)
+	}
+
+	if flags&unix.O_ACCMODE != unix.O_WRONLY || err == unix.EACCES {
+		hostfd, err = unix.Open(procPath(fd), flags, 0)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	f := os.NewFile(uintptr(hostfd), procPath(fd))
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextFh
+	fs.nextFh++
+	fs.files[op.Handle] = f
+	return nil
+}
+
+func (fs *loopbackFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	b := op.Dst
+	if b == nil {
+		b = make([]byte, op.Size)
+	}
+
+	n, err := f.ReadAt(b, op.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	op.BytesRead = n
+	if op.Dst == nil {
+		op.Data = [][]byte{b[:n]}
+	}
+
+	return nil
+}
+
+// WriteFile reports a short write, rather than failing, if the host file
+// system takes only part of the data.
+func (fs *loopbackFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	n, err := f.WriteAt(op.Data, op.Offset)
+	if err != nil && n == 0 {
+		return err
+	}
+
+	op.BytesWritten = n
+	return nil
+}
+
+func (fs *loopbackFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// FlushFile closes a duplicate of the host descriptor, so that file systems
+// like NFS that report write errors on close(2) get the chance to.
+func (fs *loopbackFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return loopbackControl(f, func(fd int) error {
+		dup, err := unix.Dup(fd)
+		if err != nil {
+			return err
+		}
+
+		return unix.Close(dup)
+	})
+}
+
+// Call fn with the descriptor of f, which stays open until fn returns.
+func loopbackControl(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var fnErr error
+	err = rc.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+
+	return fnErr
+}
+
+func (fs *loopbackFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	f, ok := fs.files[op.Handle]
+	delete(fs.files, op.Handle)
+	fs.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return f.Close()
+}
+
+func (fs *loopbackFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(fd, "", buf)
+	if err != nil {
+		return err
+	}
+
+	op.Target = string(buf[:n])
+	return nil
+}
+
+func (fs *loopbackFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead, err = unix.Getxattr(procPath(fd), op.Name, op.Dst)
+	return err
+}
+
+func (fs *loopbackFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead, err = unix.Listxattr(procPath(fd), op.Dst)
+	return err
+}
+
+func (fs *loopbackFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	return unix.Setxattr(procPath(fd), op.Name, op.Value, int(op.Flags))
+}
+
+func (fs *loopbackFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	return unix.Removexattr(procPath(fd), op.Name)
+}
+
+func (fs *loopbackFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	f, err := fs.file(op.Handle)
+	if err != nil {
+		return err
+	}
+
+	return loopbackControl(f, func(fd int) error {
+		return unix.Fallocate(fd, op.Mode, int64(op.Offset), int64(op.Length))
+	})
+}
+
+func (fs *loopbackFS) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	fd, err := fs.fd(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// syncfs(2) doesn't take O_PATH descriptors.
+	dirfd, err := unix.Openat(fd, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	return unix.Syncfs(dirfd)
+}
+
+// Destroy closes the host files that are still open.
+func (fs *loopbackFS) Destroy() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for h, f := range fs.files {
+		f.Close()
+		delete(fs.files, h)
+	}
+
+	for id, in := range fs.inodes {
+		unix.Close(in.fd)
+		delete(fs.inodes, id)
+	}
+}
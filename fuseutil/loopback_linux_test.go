@@ -0,0 +1,195 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestLoopbackServer(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "hello"), []byte("Hello, world!"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := os.Link(filepath.Join(root, "hello"), filepath.Join(root, "link")); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	server, err := fuseutil.NewLoopbackServer(root)
+	if err != nil {
+		t.Fatalf("NewLoopbackServer: %v", err)
+	}
+
+	k, err := fakekernel.Mount(server, nil)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	do := func(opcode uint32, nodeID uint64, payload ...[]byte) []byte {
+		m, err := k.Do(opcode, nodeID, payload...)
+		if err != nil {
+			t.Fatalf("Do(%d): %v", opcode, err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("Opcode %d: errno %v", opcode, errno)
+		}
+
+		return m.Data
+	}
+
+	errno := func(opcode uint32, nodeID uint64, payload ...[]byte) syscall.Errno {
+		m, err := k.Do(opcode, nodeID, payload...)
+		if err != nil {
+			t.Fatalf("Do(%d): %v", opcode, err)
+		}
+
+		return m.Errno()
+	}
+
+	lookUp := func(parent uint64, name string) fusekernel.EntryOut {
+		var out fusekernel.EntryOut
+		if err := fakekernel.Decode(do(fusekernel.OpLookup, parent, fakekernel.String(name)), &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		return out
+	}
+
+	// Attributes come from the host file, and hard links share an inode.
+	hello := lookUp(1, "hello")
+	if hello.Attr.Size != 13 || hello.Attr.Mode != syscall.S_IFREG|0644 || hello.Attr.Nlink != 2 {
+		t.Errorf("hello: got attributes %+v", hello.Attr)
+	}
+
+	if link := lookUp(1, "link"); link.Nodeid != hello.Nodeid {
+		t.Errorf("link: got inode %d, want %d", link.Nodeid, hello.Nodeid)
+	}
+
+	// Host errors are passed through.
+	if got := errno(fusekernel.OpLookup, 1, fakekernel.String("missing")); got != syscall.ENOENT {
+		t.Errorf("missing: got errno %v", got)
+	}
+
+	// Create a file in the directory and write to it.
+	dir := lookUp(1, "dir")
+	create := append(
+		fakekernel.Bytes(&fusekernel.CreateIn{Flags: uint32(os.O_WRONLY), Mode: syscall.S_IFREG | 0600}),
+		fakekernel.String("new")...)
+	data := do(fusekernel.OpCreate, dir.Nodeid, create)
+
+	var entry fusekernel.EntryOut
+	var open fusekernel.OpenOut
+	if err := fakekernel.Decode(data, &entry); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if err := fakekernel.Decode(data[unsafe.Sizeof(entry):], &open); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	write := fusekernel.WriteIn{Fh: open.Fh, Offset: 0, Size: 5}
+	do(fusekernel.OpWrite, entry.Nodeid, fakekernel.Bytes(&write), []byte("taco!"))
+	do(fusekernel.OpRelease, entry.Nodeid, fakekernel.Bytes(&fusekernel.ReleaseIn{Fh: open.Fh}))
+
+	if got, err := os.ReadFile(filepath.Join(root, "dir", "new")); err != nil || string(got) != "taco!" {
+		t.Errorf("ReadFile: got %q, %v", got, err)
+	}
+
+	// The directory's inode follows it when it is renamed on the host.
+	if err := os.Rename(filepath.Join(root, "dir"), filepath.Join(root, "moved")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if got := lookUp(dir.Nodeid, "new"); got.Nodeid != entry.Nodeid || got.Attr.Size != 5 {
+		t.Errorf("new: got inode %d with attributes %+v", got.Nodeid, got.Attr)
+	}
+
+	// Reading the file back through the server.
+	var reopen fusekernel.OpenOut
+	if err := fakekernel.Decode(do(fusekernel.OpOpen, entry.Nodeid, fakekernel.Bytes(&fusekernel.OpenIn{})), &reopen); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	read := fusekernel.ReadIn{Fh: reopen.Fh, Offset: 1, Size: 100}
+	if got := do(fusekernel.OpRead, entry.Nodeid, fakekernel.Bytes(&read)); string(got) != "aco!" {
+		t.Errorf("Read: got %q", got)
+	}
+
+	// Forgetting an inode doesn't change its ID.
+	forget := fusekernel.ForgetIn{Nlookup: 2}
+	if err := k.Send(k.Header(fusekernel.OpForget, hello.Nodeid), fakekernel.Bytes(&forget)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if again := lookUp(1, "hello"); again.Nodeid != hello.Nodeid {
+		t.Errorf("hello: got inode %d after forgetting, want %d", again.Nodeid, hello.Nodeid)
+	}
+
+	// Listings give the same inode IDs as lookups.
+	var opendir fusekernel.OpenOut
+	if err := fakekernel.Decode(do(fusekernel.OpOpendir, 1, fakekernel.Bytes(&fusekernel.OpenIn{})), &opendir); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	var names []string
+	in := fusekernel.ReadIn{Fh: opendir.Fh, Size: 4096}
+	for data := do(fusekernel.OpReaddir, 1, fakekernel.Bytes(&in)); len(data) > 0; {
+		var d fusekernel.Dirent
+		if err := fakekernel.Decode(data, &d); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		name := string(data[fusekernel.DirentSize : fusekernel.DirentSize+int(d.Namelen)])
+		names = append(names, name)
+		if name == "hello" && d.Ino != hello.Nodeid {
+			t.Errorf("hello: got inode %d in listing, want %d", d.Ino, hello.Nodeid)
+		}
+
+		data = data[(fusekernel.DirentSize+int(d.Namelen)+7)&^7:]
+	}
+
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "hello,link,moved" {
+		t.Errorf("ReadDir: got %s", got)
+	}
+
+	// Removing a non-empty directory fails as it does on the host.
+	if got := errno(fusekernel.OpRmdir, 1, fakekernel.String("moved")); got != syscall.ENOTEMPTY {
+		t.Errorf("RmDir: got errno %v", got)
+	}
+
+	do(fusekernel.OpUnlink, dir.Nodeid, fakekernel.String("new"))
+	do(fusekernel.OpRmdir, 1, fakekernel.String("moved"))
+	if _, err := os.Stat(filepath.Join(root, "moved")); !os.IsNotExist(err) {
+		t.Errorf("Stat after RmDir: %v", err)
+	}
+}
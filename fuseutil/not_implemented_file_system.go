@@ -84,6 +84,12 @@ func (fs *NotImplementedFileSystem) CreateFile(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) CreateTmpfile(
+	ctx context.Context,
+	op *fuseops.CreateTmpfileOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) CreateSymlink(
 	ctx context.Context,
 	op *fuseops.CreateSymlinkOp) error {
@@ -126,6 +132,12 @@ func (fs *NotImplementedFileSystem) ReadDir(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) error {
@@ -204,5 +216,52 @@ func (fs *NotImplementedFileSystem) Fallocate(
 	return fuse.ENOSYS
 }
 
+// Ioctl returns ENOSYS, which the kernel passes on to the caller as ENOTTY.
+func (fs *NotImplementedFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetupMapping(
+	ctx context.Context,
+	op *fuseops.SetupMappingOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) RemoveMapping(
+	ctx context.Context,
+	op *fuseops.RemoveMappingOp) error {
+	return fuse.ENOSYS
+}
+
+// SyncFS returns ENOSYS, which the kernel treats as success: file systems
+// that don't need a whole-file-system flush can leave this alone.
+func (fs *NotImplementedFileSystem) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	return fuse.ENOSYS
+}
+
+// Access returns ENOSYS, which the kernel treats as granting access: file
+// systems that don't enforce permissions of their own can leave this alone.
+func (fs *NotImplementedFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) GetFileLock(
+	ctx context.Context,
+	op *fuseops.GetFileLockOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetFileLock(
+	ctx context.Context,
+	op *fuseops.SetFileLockOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) Destroy() {
 }
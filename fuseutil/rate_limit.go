@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitAll is the key in the limits given to NewRateLimitedServer and
+// RateLimitInterceptor for the limit on op types without one of their own.
+const RateLimitAll = "*"
+
+// Options for RateLimitInterceptor.
+type RateLimitOptions struct {
+	// The number of ops of a type that may be let through at once after a lull,
+	// beyond which they are held to the limit for their type. Zero means a
+	// second's worth of ops at that limit.
+	Burst int
+
+	// Fail ops over the limit with EAGAIN rather than waiting for the limiter
+	// to let them through.
+	NoWait bool
+}
+
+// NewRateLimitedServer returns a server that serves ops with inner, holding
+// each type of op to at most the number per second in limits. That is keyed by
+// the name of the op type without the package or the "Op" suffix, e.g.
+// "ReadFile" or "LookUpInode", with RateLimitAll for the rest, each of which
+// has a limiter of its own. Types with no limit and no RateLimitAll entry are
+// not limited.
+//
+// Ops over the limit wait until it lets them through, or until they are
+// interrupted, in which case they fail with EINTR. See RateLimitInterceptor for
+// other behavior.
+//
+// Only ops that inner handles through Connection.Dispatch are limited, as with
+// any interceptor; servers created by this package do so.
+func NewRateLimitedServer(
+	inner fuse.Server,
+	limits map[string]rate.Limit) fuse.Server {
+	return &rateLimitedServer{
+		inner:       inner,
+		interceptor: RateLimitInterceptor(limits, RateLimitOptions{}),
+	}
+}
+
+type rateLimitedServer struct {
+	inner       fuse.Server
+	interceptor fuse.Interceptor
+}
+
+func (s *rateLimitedServer) ServeOps(c *fuse.Connection) {
+	c.Intercept(s.interceptor)
+	s.inner.ServeOps(c)
+}
+
+// RateLimitInterceptor returns an interceptor, for use in
+// fuse.MountConfig.Interceptors, that limits ops like NewRateLimitedServer
+// does according to opts. Forget ops are never limited, since the kernel
+// doesn't wait for them.
+func RateLimitInterceptor(
+	limits map[string]rate.Limit,
+	opts RateLimitOptions) fuse.Interceptor {
+	limiters := make(map[string]*rate.Limiter)
+	for name, limit := range limits {
+		burst := opts.Burst
+		if burst == 0 {
+			burst = int(math.Min(math.MaxInt32, math.Max(1, math.Ceil(float64(limit)))))
+		}
+
+		limiters[name] = rate.NewLimiter(limit, burst)
+	}
+
+	return func(ctx context.Context, op interface{}, next func() error) error {
+		switch op.(type) {
+		case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+			return next()
+		}
+
+		l, ok := limiters[rateLimitName(op)]
+		if !ok {
+			l, ok = limiters[RateLimitAll]
+		}
+
+		if !ok {
+			return next()
+		}
+
+		if opts.NoWait {
+			if !l.Allow() {
+				return syscall.EAGAIN
+			}
+
+			return next()
+		}
+
+		// Wait fails without waiting if ctx has a deadline too soon to make.
+		if err := l.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return syscall.EAGAIN
+		}
+
+		return next()
+	}
+}
+
+// Return the name by which the limit for op is keyed, e.g. "ReadFile" for a
+// *fuseops.ReadFileOp.
+func rateLimitName(op interface{}) string {
+	return strings.TrimSuffix(reflect.TypeOf(op).Elem().Name(), "Op")
+}
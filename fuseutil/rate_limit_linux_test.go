@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimitInterceptor(t *testing.T) {
+	interceptor := fuseutil.RateLimitInterceptor(
+		map[string]rate.Limit{"StatFS": 0.001},
+		fuseutil.RateLimitOptions{NoWait: true})
+
+	cfg := &fuse.MountConfig{
+		Interceptors: []fuse.Interceptor{interceptor},
+	}
+
+	server := fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{})
+	k, err := fakekernel.Mount(server, cfg)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	errno := func(opcode uint32) syscall.Errno {
+		m, err := k.Do(opcode, 1)
+		if err != nil {
+			t.Fatalf("Do(%d): %v", opcode, err)
+		}
+
+		return m.Errno()
+	}
+
+	// The burst is a second's worth, rounded up to one op, which reaches the
+	// file system.
+	if got := errno(fusekernel.OpStatfs); got != syscall.ENOSYS {
+		t.Errorf("First StatFS: got errno %v, want ENOSYS", got)
+	}
+
+	if got := errno(fusekernel.OpStatfs); got != syscall.EAGAIN {
+		t.Errorf("Second StatFS: got errno %v, want EAGAIN", got)
+	}
+
+	// Other op types aren't limited.
+	for i := 0; i < 3; i++ {
+		if got := errno(fusekernel.OpGetattr); got != syscall.ENOSYS {
+			t.Errorf("GetInodeAttributes: got errno %v, want ENOSYS", got)
+		}
+	}
+}
+
+func TestRateLimitedServer(t *testing.T) {
+	server := fuseutil.NewRateLimitedServer(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		map[string]rate.Limit{fuseutil.RateLimitAll: 0.001})
+
+	k, err := fakekernel.Mount(server, nil)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	if m, err := k.Do(fusekernel.OpStatfs, 1); err != nil || m.Errno() != syscall.ENOSYS {
+		t.Fatalf("First StatFS: got %v, %v", m, err)
+	}
+
+	// The next op waits for the limiter until it is interrupted.
+	h := k.Header(fusekernel.OpGetattr, 1)
+	if err := k.Send(h); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	interrupt := fusekernel.InterruptIn{Unique: h.Unique}
+	if err := k.Send(k.Header(fusekernel.OpInterrupt, 0), fakekernel.Bytes(&interrupt)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	m, err := k.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	if m.Header.Unique != h.Unique || m.Errno() != syscall.EINTR {
+		t.Errorf("Got reply to %d with errno %v, want %d with EINTR", m.Header.Unique, m.Errno(), h.Unique)
+	}
+}
@@ -0,0 +1,544 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewReadOnlyFSServer returns a server for a read-only file system with the
+// content of fsys, such as an embed.FS, a *zip.Reader or os.DirFS. Ops that
+// would modify it fail with EROFS.
+//
+// Every name that the kernel looks up gets an inode ID of its own, which stays
+// the same for the life of the server: they are never reused, even once the
+// kernel has forgotten them. Attributes come from fs.Stat, with the write bits
+// taken out of the mode and the modification time standing in for the others.
+// Symlinks show up as such only if fsys has Lstat and ReadLink methods, like
+// fs.ReadLinkFS in Go 1.25; otherwise they are followed, as by fs.Stat.
+//
+// A directory is listed once, when it is opened, so that reading it in pieces
+// sees a consistent listing even if fsys changes in the meantime.
+func NewReadOnlyFSServer(fsys iofs.FS) fuse.Server {
+	return NewFileSystemServer(&readOnlyFS{
+		fsys:   fsys,
+		paths:  map[fuseops.InodeID]string{fuseops.RootInodeID: "."},
+		inodes: map[string]fuseops.InodeID{".": fuseops.RootInodeID},
+		nextID: fuseops.RootInodeID + 1,
+		dirs:   make(map[fuseops.HandleID][]iofs.DirEntry),
+		files:  make(map[fuseops.HandleID]*readOnlyFile),
+		nextFh: 1,
+	})
+}
+
+// The methods of fs.ReadLinkFS (Go 1.25 and later).
+type readLinkFS interface {
+	iofs.FS
+	ReadLink(name string) (string, error)
+	Lstat(name string) (iofs.FileInfo, error)
+}
+
+type readOnlyFS struct {
+	NotImplementedFileSystem
+
+	fsys iofs.FS
+
+	mu sync.Mutex
+
+	// The path within fsys of each inode, and the other way around.
+	//
+	// GUARDED_BY(mu)
+	paths  map[fuseops.InodeID]string
+	inodes map[string]fuseops.InodeID
+	nextID fuseops.InodeID
+
+	// The listings of open directories, and the open files.
+	//
+	// GUARDED_BY(mu)
+	dirs   map[fuseops.HandleID][]iofs.DirEntry
+	files  map[fuseops.HandleID]*readOnlyFile
+	nextFh fuseops.HandleID
+}
+
+// An open file, which may have to be read sequentially.
+type readOnlyFile struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	f   iofs.File
+	pos int64
+}
+
+// Return the path of the supplied inode.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *readOnlyFS) path(id fuseops.InodeID) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p, ok := fs.paths[id]
+	if !ok {
+		return "", fuse.ENOENT
+	}
+
+	return p, nil
+}
+
+// Return the inode ID for the supplied path, assigning one if need be.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *readOnlyFS) inode(p string) fuseops.InodeID {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.inodes[p]
+	if !ok {
+		id = fs.nextID
+		fs.nextID++
+		fs.inodes[p] = id
+		fs.paths[id] = p
+	}
+
+	return id
+}
+
+func (fs *readOnlyFS) stat(p string) (os.FileInfo, error) {
+	if rl, ok := fs.fsys.(readLinkFS); ok {
+		return rl.Lstat(p)
+	}
+
+	return iofs.Stat(fs.fsys, p)
+}
+
+func (fs *readOnlyFS) attributes(p string) (fuseops.InodeAttributes, error) {
+	info, err := fs.stat(p)
+	if err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	attrs := fuseops.InodeAttributes{
+		Size:  uint64(info.Size()),
+		Nlink: 1,
+		Mode:  info.Mode() &^ 0222,
+		Atime: info.ModTime(),
+		Mtime: info.ModTime(),
+		Ctime: info.ModTime(),
+	}
+
+	if info.IsDir() {
+		attrs.Nlink = 2
+	}
+
+	// The kernel caps symlink targets at their size.
+	if rl, ok := fs.fsys.(readLinkFS); ok && info.Mode()&os.ModeSymlink != 0 {
+		target, err := rl.ReadLink(p)
+		if err != nil {
+			return fuseops.InodeAttributes{}, err
+		}
+
+		attrs.Size = uint64(len(target))
+	}
+
+	return attrs, nil
+}
+
+func (fs *readOnlyFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *readOnlyFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.path(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	p := path.Join(parent, op.Name)
+	if !iofs.ValidPath(p) {
+		return fuse.ENOENT
+	}
+
+	attrs, err := fs.attributes(p)
+	if err != nil {
+		return err
+	}
+
+	op.Entry.Child = fs.inode(p)
+	op.Entry.Attributes = attrs
+	return nil
+}
+
+func (fs *readOnlyFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	p, err := fs.path(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, err = fs.attributes(p)
+	return err
+}
+
+func (fs *readOnlyFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *readOnlyFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return nil
+}
+
+func (fs *readOnlyFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	p, err := fs.path(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	entries, err := iofs.ReadDir(fs.fsys, p)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextFh
+	fs.nextFh++
+	fs.dirs[op.Handle] = entries
+	return nil
+}
+
+func (fs *readOnlyFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	p, err := fs.path(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	entries, ok := fs.dirs[op.Handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return syscall.EBADF
+	}
+
+	// Resume at the specified offset into the listing.
+	for i := int(op.Offset); i < len(entries); i++ {
+		e := entries[i]
+		fit := AppendDirent(op, Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fs.inode(path.Join(p, e.Name())),
+			Name:   e.Name(),
+			Type:   direntType(e.Type()),
+		})
+		if !fit {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Convert the type bits of an fs.FileMode to a DirentType.
+func direntType(t iofs.FileMode) DirentType {
+	switch {
+	case t&iofs.ModeDir != 0:
+		return DT_Directory
+	case t&iofs.ModeSymlink != 0:
+		return DT_Link
+	case t&iofs.ModeNamedPipe != 0:
+		return DT_FIFO
+	case t&iofs.ModeSocket != 0:
+		return DT_Socket
+	case t&iofs.ModeCharDevice != 0:
+		return DT_Char
+	case t&iofs.ModeDevice != 0:
+		return DT_Block
+	case t&iofs.ModeType == 0:
+		return DT_File
+	}
+
+	return DT_Unknown
+}
+
+func (fs *readOnlyFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.dirs, op.Handle)
+	return nil
+}
+
+func (fs *readOnlyFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if !op.OpenFlags.IsReadOnly() {
+		return syscall.EROFS
+	}
+
+	p, err := fs.path(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.fsys.Open(p)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextFh
+	fs.nextFh++
+	fs.files[op.Handle] = &readOnlyFile{f: f}
+	op.KeepPageCache = true
+	return nil
+}
+
+// ReadFile reads at the offset asked for, with ReadAt or Seek if the file
+// supports them. Otherwise it reads sequentially, reopening the file to go
+// backwards.
+func (fs *readOnlyFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	file, ok := fs.files[op.Handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return syscall.EBADF
+	}
+
+	b := op.Dst
+	if b == nil {
+		b = make([]byte, op.Size)
+	}
+
+	n, err := fs.readAt(file, op.Inode, b, op.Offset)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead = n
+	if op.Dst == nil {
+		op.Data = [][]byte{b[:n]}
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(file.mu)
+func (fs *readOnlyFS) readAt(
+	file *readOnlyFile,
+	id fuseops.InodeID,
+	b []byte,
+	off int64) (int, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	if r, ok := file.f.(io.ReaderAt); ok {
+		n, err := r.ReadAt(b, off)
+		if err == io.EOF {
+			err = nil
+		}
+
+		return n, err
+	}
+
+	if s, ok := file.f.(io.Seeker); ok {
+		pos, err := s.Seek(off, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+
+		file.pos = pos
+	}
+
+	if off < file.pos {
+		p, err := fs.path(id)
+		if err != nil {
+			return 0, err
+		}
+
+		f, err := fs.fsys.Open(p)
+		if err != nil {
+			return 0, err
+		}
+
+		file.f.Close()
+		file.f, file.pos = f, 0
+	}
+
+	if off > file.pos {
+		skipped, err := io.CopyN(io.Discard, file.f, off-file.pos)
+		file.pos += skipped
+		if err == io.EOF {
+			return 0, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(file.f, b)
+	file.pos += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (fs *readOnlyFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	file, ok := fs.files[op.Handle]
+	delete(fs.files, op.Handle)
+	fs.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	return file.f.Close()
+}
+
+func (fs *readOnlyFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	rl, ok := fs.fsys.(readLinkFS)
+	if !ok {
+		return fuse.ENOSYS
+	}
+
+	p, err := fs.path(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Target, err = rl.ReadLink(p)
+	return err
+}
+
+func (fs *readOnlyFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) CreateTmpfile(
+	ctx context.Context,
+	op *fuseops.CreateTmpfileOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return syscall.EROFS
+}
+
+func (fs *readOnlyFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return syscall.EROFS
+}
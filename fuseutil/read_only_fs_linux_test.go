@@ -0,0 +1,135 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestReadOnlyFSServer(t *testing.T) {
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"hello":   {Data: []byte("Hello, world!"), Mode: 0644, ModTime: mtime},
+		"dir/a":   {Data: []byte("a")},
+		"dir/bb":  {Data: []byte("bb")},
+		"dir/ccc": {Data: []byte("ccc")},
+	}
+
+	k, err := fakekernel.Mount(fuseutil.NewReadOnlyFSServer(fsys), nil)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	do := func(opcode uint32, nodeID uint64, payload ...[]byte) []byte {
+		m, err := k.Do(opcode, nodeID, payload...)
+		if err != nil {
+			t.Fatalf("Do(%d): %v", opcode, err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("Opcode %d: errno %v", opcode, errno)
+		}
+
+		return m.Data
+	}
+
+	lookUp := func(parent uint64, name string) fusekernel.EntryOut {
+		var out fusekernel.EntryOut
+		if err := fakekernel.Decode(do(fusekernel.OpLookup, parent, fakekernel.String(name)), &out); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+
+		return out
+	}
+
+	// Attributes come from the FileInfo, without the write bits.
+	hello := lookUp(1, "hello")
+	if hello.Attr.Size != 13 || hello.Attr.Mode != syscall.S_IFREG|0444 || hello.Attr.Mtime != uint64(mtime.Unix()) {
+		t.Errorf("hello: got attributes %+v", hello.Attr)
+	}
+
+	// Inode IDs are stable.
+	if again := lookUp(1, "hello"); again.Nodeid != hello.Nodeid {
+		t.Errorf("hello: got inode %d, then %d", hello.Nodeid, again.Nodeid)
+	}
+
+	if m, err := k.Do(fusekernel.OpLookup, 1, fakekernel.String("missing")); err != nil || m.Errno() != syscall.ENOENT {
+		t.Errorf("missing: got %v, %v", m, err)
+	}
+
+	// Read part of the file.
+	var open fusekernel.OpenOut
+	if err := fakekernel.Decode(do(fusekernel.OpOpen, hello.Nodeid, fakekernel.Bytes(&fusekernel.OpenIn{})), &open); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	read := fusekernel.ReadIn{Fh: open.Fh, Offset: 7, Size: 100}
+	if got := do(fusekernel.OpRead, hello.Nodeid, fakekernel.Bytes(&read)); string(got) != "world!" {
+		t.Errorf("Read: got %q", got)
+	}
+
+	// Writing is refused.
+	write := fusekernel.OpenIn{Flags: uint32(os.O_WRONLY)}
+	if m, err := k.Do(fusekernel.OpOpen, hello.Nodeid, fakekernel.Bytes(&write)); err != nil || m.Errno() != syscall.EROFS {
+		t.Errorf("Open for writing: got %v, %v", m, err)
+	}
+
+	// List the directory a piece at a time: room for two of its entries.
+	dir := lookUp(1, "dir")
+	var opendir fusekernel.OpenOut
+	if err := fakekernel.Decode(do(fusekernel.OpOpendir, dir.Nodeid, fakekernel.Bytes(&fusekernel.OpenIn{})), &opendir); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	var names []string
+	var offset uint64
+	for {
+		in := fusekernel.ReadIn{Fh: opendir.Fh, Offset: offset, Size: 2 * 32}
+		data := do(fusekernel.OpReaddir, dir.Nodeid, fakekernel.Bytes(&in))
+		if len(data) == 0 {
+			break
+		}
+
+		for len(data) > 0 {
+			var d fusekernel.Dirent
+			if err := fakekernel.Decode(data, &d); err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			name := data[fusekernel.DirentSize : fusekernel.DirentSize+int(d.Namelen)]
+			names = append(names, string(name))
+			if d.Type != syscall.DT_REG {
+				t.Errorf("%s: got type %d", name, d.Type)
+			}
+
+			offset = d.Off
+			data = data[(fusekernel.DirentSize+int(d.Namelen)+7)&^7:]
+		}
+	}
+
+	if got := strings.Join(names, ","); got != "a,bb,ccc" {
+		t.Errorf("ReadDir: got %s", got)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// CheckRenameLoop enforces the rule that a directory may not be moved into
+// itself or one of its descendants (cf. rename(2)), which would cut the
+// subtree off from the rest of the file system. It returns syscall.EINVAL if
+// newParent is dir or lies beneath it, and nil otherwise. parent must return
+// the parent of the supplied directory; the walk up from newParent stops at
+// fuseops.RootInodeID, and any error from parent is returned as is.
+//
+// The kernel makes this check itself, against the tree as it has cached it.
+// So this is only needed by file systems that may change other than through
+// the kernel, such as network file systems, where that cache can be out of
+// date. They should call it for RenameOp when the entry being moved out of
+// OldParent is a directory, with NewParent, holding whatever locks keep the
+// tree from changing until the rename is done.
+func CheckRenameLoop(
+	dir fuseops.InodeID,
+	newParent fuseops.InodeID,
+	parent func(fuseops.InodeID) (fuseops.InodeID, error)) error {
+	for id := newParent; ; {
+		if id == dir {
+			return syscall.EINVAL
+		}
+
+		if id == fuseops.RootInodeID {
+			return nil
+		}
+
+		p, err := parent(id)
+		if err != nil {
+			return err
+		}
+
+		// Don't go round in circles if the file system's tree is already broken.
+		if p == id {
+			return nil
+		}
+
+		id = p
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestCheckRenameLoop(t *testing.T) {
+	// The tree:
+	//
+	//     1 (root)
+	//     ├── 2
+	//     │   └── 3
+	//     │       └── 4
+	//     └── 5
+	//
+	parents := map[fuseops.InodeID]fuseops.InodeID{
+		2: fuseops.RootInodeID,
+		3: 2,
+		4: 3,
+		5: fuseops.RootInodeID,
+	}
+
+	parent := func(id fuseops.InodeID) (fuseops.InodeID, error) {
+		p, ok := parents[id]
+		if !ok {
+			return 0, syscall.ENOENT
+		}
+
+		return p, nil
+	}
+
+	testCases := []struct {
+		name      string
+		dir       fuseops.InodeID
+		newParent fuseops.InodeID
+		want      error
+	}{
+		{"into itself", 2, 2, syscall.EINVAL},
+		{"into its child", 2, 3, syscall.EINVAL},
+		{"into its grandchild", 2, 4, syscall.EINVAL},
+		{"into a sibling", 2, 5, nil},
+		{"into its parent", 3, 2, nil},
+		{"into the root", 4, fuseops.RootInodeID, nil},
+		{"into a cousin", 5, 4, nil},
+		{"into an unknown directory", 2, 6, syscall.ENOENT},
+	}
+
+	for _, tc := range testCases {
+		if got := fuseutil.CheckRenameLoop(tc.dir, tc.newParent, parent); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
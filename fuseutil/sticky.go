@@ -0,0 +1,52 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// CheckSticky enforces the restricted deletion rule for directories with the
+// sticky bit set (cf. unlink(2), rename(2)): an entry in such a directory may
+// only be removed or renamed by root, the owner of the directory, or the
+// owner of the entry. It returns syscall.EPERM if the caller identified by
+// opCtx may not remove the child with attributes child from the directory
+// with attributes parent, and nil otherwise.
+//
+// With the default_permissions mount option the kernel applies this rule
+// itself, so this is only needed by file systems mounted with
+// fuse.MountConfig.DisableDefaultPermissions. They should call it for:
+//
+//   - UnlinkOp and RmDirOp, with the entry being removed.
+//   - RenameOp, with the entry being moved out of OldParent, and with the
+//     entry it replaces in NewParent, if any.
+func CheckSticky(
+	opCtx fuseops.OpContext,
+	parent fuseops.InodeAttributes,
+	child fuseops.InodeAttributes) error {
+	if parent.Mode&os.ModeSticky == 0 {
+		return nil
+	}
+
+	switch opCtx.Uid {
+	case 0, parent.Uid, child.Uid:
+		return nil
+	}
+
+	return syscall.EPERM
+}
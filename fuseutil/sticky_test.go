@@ -0,0 +1,69 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestCheckSticky(t *testing.T) {
+	const (
+		dirOwner  = 1000
+		fileOwner = 1001
+		stranger  = 1002
+	)
+
+	sticky := fuseops.InodeAttributes{
+		Mode: os.ModeDir | os.ModeSticky | 0777,
+		Uid:  dirOwner,
+	}
+
+	plain := fuseops.InodeAttributes{
+		Mode: os.ModeDir | 0777,
+		Uid:  dirOwner,
+	}
+
+	file := fuseops.InodeAttributes{
+		Mode: 0644,
+		Uid:  fileOwner,
+	}
+
+	testCases := []struct {
+		name   string
+		uid    uint32
+		parent fuseops.InodeAttributes
+		want   error
+	}{
+		{"stranger in sticky dir", stranger, sticky, syscall.EPERM},
+		{"file owner in sticky dir", fileOwner, sticky, nil},
+		{"dir owner in sticky dir", dirOwner, sticky, nil},
+		{"root in sticky dir", 0, sticky, nil},
+		{"stranger in plain dir", stranger, plain, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opCtx := fuseops.OpContext{Uid: tc.uid}
+			if got := fuseutil.CheckSticky(opCtx, tc.parent, file); got != tc.want {
+				t.Errorf("CheckSticky: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ require (
 	github.com/kylelemons/godebug v1.1.0
 	golang.org/x/net v0.23.0
 	golang.org/x/sys v0.18.0
+	golang.org/x/time v0.5.0
 )
 
 require (
@@ -0,0 +1,314 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestInitFlags2(t *testing.T) {
+	cfg := &fuse.MountConfig{EnableDirectIOAllowMmap: true}
+	k, err := fakekernel.MountWithInit(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		cfg,
+		fusekernel.InitIn{
+			Major:        7,
+			Minor:        36,
+			MaxReadahead: 1 << 20,
+			Flags:        uint32(fusekernel.InitExt),
+			Flags2:       uint32(fusekernel.InitDirectIOAllowMmap >> 32),
+		})
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	if k.Init.Minor != 36 {
+		t.Errorf("Got protocol 7.%d, want 7.36", k.Init.Minor)
+	}
+
+	if fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitExt == 0 {
+		t.Errorf("InitExt not set in flags: %v", fusekernel.InitFlags(k.Init.Flags))
+	}
+
+	flags := fusekernel.InitFlags(k.Init.Flags) | fusekernel.InitFlags(k.Init.Flags2)<<32
+	if flags&fusekernel.InitDirectIOAllowMmap == 0 {
+		t.Errorf("InitDirectIOAllowMmap not requested: %v", flags)
+	}
+}
+
+func TestInitFlags2OldKernel(t *testing.T) {
+	// Before protocol 7.36 there is no flags2 field, even if the kernel sets
+	// the bit that later came to mean InitExt.
+	cfg := &fuse.MountConfig{EnableDirectIOAllowMmap: true}
+	k := mountFS(t, &fuseutil.NotImplementedFileSystem{}, cfg)
+	defer k.Close()
+
+	if fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitExt != 0 {
+		t.Errorf("InitExt set in flags: %v", fusekernel.InitFlags(k.Init.Flags))
+	}
+
+	if k.Init.Flags2 != 0 {
+		t.Errorf("Got flags2 %#x, want 0", k.Init.Flags2)
+	}
+}
+
+func TestNegotiatedCapabilities(t *testing.T) {
+	server := newConnServer(fuseutil.NewFileSystemServer(&attrFS{}))
+	k, err := fakekernel.Mount(server, &fuse.MountConfig{
+		EnablePosixLocks:        true,
+		EnablePassthrough:       true,
+		DisableWritebackCaching: true,
+	})
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer k.Close()
+
+	c := <-server.conns
+
+	if major, minor := c.ProtocolVersion(); major != 7 || minor != 31 {
+		t.Errorf("Got protocol %v.%v, want 7.31", major, minor)
+	}
+
+	caps := c.Capabilities()
+	if caps != uint64(k.Init.Flags) {
+		t.Errorf("Got capabilities %#x, but replied with flags %#x", caps, k.Init.Flags)
+	}
+
+	if caps&fuse.CapPosixLocks == 0 {
+		t.Errorf("CapPosixLocks not set in %#x", caps)
+	}
+
+	// Passthrough needs protocol 7.36, and writeback caching was turned off.
+	if caps&(fuse.CapPassthrough|fuse.CapWritebackCache) != 0 {
+		t.Errorf("Unexpected capabilities in %#x", caps)
+	}
+}
+
+func TestPosixACL(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		k := mountFS(
+			t,
+			&fuseutil.NotImplementedFileSystem{},
+			&fuse.MountConfig{EnablePosixACL: enable})
+
+		got := fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitPosixACL != 0
+		if got != enable {
+			t.Errorf("EnablePosixACL %v: got flags %v", enable, fusekernel.InitFlags(k.Init.Flags))
+		}
+
+		k.Close()
+	}
+
+	// The kernel checks ACLs as part of the default permissions.
+	_, err := fakekernel.Mount(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		&fuse.MountConfig{EnablePosixACL: true, DisableDefaultPermissions: true})
+	if err == nil {
+		t.Errorf("Mount succeeded with EnablePosixACL and DisableDefaultPermissions")
+	}
+}
+
+func TestExportNegotiation(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		k := mountFS(
+			t,
+			&fuseutil.NotImplementedFileSystem{},
+			&fuse.MountConfig{EnableExport: enable})
+
+		got := fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitExportSupport != 0
+		if got != enable {
+			t.Errorf("EnableExport %v: got flags %v", enable, fusekernel.InitFlags(k.Init.Flags))
+		}
+
+		k.Close()
+	}
+}
+
+func TestAtomicTruncNegotiation(t *testing.T) {
+	testCases := []struct {
+		enable     bool
+		kernelFlag bool
+		want       bool
+	}{
+		{false, true, false},
+		{true, false, false},
+		{true, true, true},
+	}
+
+	for _, tc := range testCases {
+		flags := ^uint32(fusekernel.InitAtomicTrunc)
+		if tc.kernelFlag {
+			flags = ^uint32(0)
+		}
+
+		server := newConnServer(fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}))
+		k, err := fakekernel.MountWithInit(
+			server,
+			&fuse.MountConfig{EnableAtomicTrunc: tc.enable},
+			fusekernel.InitIn{
+				Major:        7,
+				Minor:        31,
+				MaxReadahead: 1 << 20,
+				Flags:        flags,
+			})
+		if err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+
+		// The reply and the reported capabilities must agree.
+		c := <-server.conns
+		replied := fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitAtomicTrunc != 0
+		reported := c.Capabilities()&fuse.CapAtomicTrunc != 0
+		if replied != tc.want || reported != tc.want {
+			t.Errorf(
+				"Enable %v, kernel %v: replied %v, reported %v, want %v",
+				tc.enable,
+				tc.kernelFlag,
+				replied,
+				reported,
+				tc.want)
+		}
+
+		k.Close()
+	}
+}
+
+func TestOnInit(t *testing.T) {
+	var major, minor uint32
+	var flags uint64
+	onInit := func(kernelMajor, kernelMinor uint32, kernelFlags uint64) error {
+		major, minor, flags = kernelMajor, kernelMinor, kernelFlags
+		return nil
+	}
+
+	k := mountFS(t, &fuseutil.NotImplementedFileSystem{}, &fuse.MountConfig{OnInit: onInit})
+	k.Close()
+
+	// The fake kernel offers protocol 7.31 and every flag in the first word,
+	// whether or not we ask for it.
+	if major != 7 || minor != 31 || flags != uint64(^uint32(0)) {
+		t.Errorf("Got protocol %d.%d with flags %#x", major, minor, flags)
+	}
+
+	// An error refuses the mount.
+	_, err := fakekernel.Mount(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		&fuse.MountConfig{
+			OnInit: func(kernelMajor, kernelMinor uint32, kernelFlags uint64) error {
+				return errors.New("kernel too old")
+			},
+		})
+	if err == nil || !strings.Contains(err.Error(), "kernel too old") {
+		t.Errorf("Mount: got error %v", err)
+	}
+}
+
+func TestMaxReadahead(t *testing.T) {
+	testCases := []struct {
+		maxReadahead int
+		want         uint32
+	}{
+		{0, 1 << 20},
+		{4096, 4096},
+		{-1, 0},
+	}
+
+	for _, tc := range testCases {
+		k := mountFS(
+			t,
+			&fuseutil.NotImplementedFileSystem{},
+			&fuse.MountConfig{MaxReadahead: tc.maxReadahead})
+
+		if k.Init.MaxReadahead != tc.want {
+			t.Errorf("MaxReadahead %d: got %d, want %d", tc.maxReadahead, k.Init.MaxReadahead, tc.want)
+		}
+
+		k.Close()
+	}
+}
+
+func TestMaxPages(t *testing.T) {
+	pageSize := uint32(os.Getpagesize())
+	testCases := []struct {
+		maxPages     int
+		kernelFlags  fusekernel.InitFlags
+		wantPages    uint16
+		wantMaxWrite uint32
+	}{
+		{0, fusekernel.InitMaxPages, 256, 1 << 20},
+		{512, fusekernel.InitMaxPages, 512, 512 * pageSize},
+
+		// Kernels before 4.20 send at most 32 pages whatever we say.
+		{0, 0, 0, 32 * pageSize},
+		{512, 0, 0, 32 * pageSize},
+	}
+
+	for _, tc := range testCases {
+		k, err := fakekernel.MountWithInit(
+			fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+			&fuse.MountConfig{MaxPages: tc.maxPages},
+			fusekernel.InitIn{
+				Major:        7,
+				Minor:        31,
+				MaxReadahead: 1 << 20,
+				Flags:        uint32(tc.kernelFlags),
+			})
+		if err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+
+		negotiated := fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitMaxPages != 0
+		if negotiated != (tc.kernelFlags != 0) {
+			t.Errorf("MaxPages %d: got flags %v", tc.maxPages, fusekernel.InitFlags(k.Init.Flags))
+		}
+
+		if k.Init.MaxPages != tc.wantPages || k.Init.MaxWrite != tc.wantMaxWrite {
+			t.Errorf(
+				"MaxPages %d: got %d pages and MaxWrite %d, want %d and %d",
+				tc.maxPages,
+				k.Init.MaxPages,
+				k.Init.MaxWrite,
+				tc.wantPages,
+				tc.wantMaxWrite)
+		}
+
+		// Requests are still read into buffers of the right size.
+		m, err := k.Do(fusekernel.OpGetattr, 1, fakekernel.Bytes(&fusekernel.GetattrIn{}))
+		if err != nil {
+			t.Fatalf("Do(OpGetattr): %v", err)
+		}
+
+		if got, want := m.Errno(), syscall.ENOSYS; got != want {
+			t.Errorf("MaxPages %d: got errno %v, want %v", tc.maxPages, got, want)
+		}
+
+		k.Close()
+	}
+}
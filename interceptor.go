@@ -0,0 +1,158 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"reflect"
+	"runtime/pprof"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// An Interceptor wraps the handling of an op, for behavior that cuts across
+// all ops such as access checks, rate limiting or metrics. It is called with
+// the context and op returned by ReadOp, where op is the concrete fuseops
+// pointer (e.g. *fuseops.LookUpInodeOp), and must call next to continue
+// handling the op, returning its error. An interceptor may instead return an
+// error without calling next, in which case the op fails with that error and
+// the file system never sees it.
+type Interceptor func(ctx context.Context, op interface{}, next func() error) error
+
+// Dispatch handles the supplied op, as returned by ReadOp along with ctx, by
+// calling handler through the interceptors in MountConfig.Interceptors, and
+// returns the resulting error for the caller to pass to Reply. Servers created
+// by package fuseutil do this for every op; other servers should too if they
+// want interceptors to apply.
+//
+// While it does so, the goroutine carries the pprof label "op" with the name
+// of the op type, e.g. "ReadFileOp", as do goroutines that it starts, so that
+// a goroutine profile (e.g. /debug/pprof/goroutine?debug=1) shows which ops
+// are stuck. The interceptors are given a context with the label too.
+func (c *Connection) Dispatch(
+	ctx context.Context,
+	op interface{},
+	handler func() error) (err error) {
+	labels := pprof.Labels("op", opTypeName(reflect.TypeOf(op)))
+	pprof.Do(ctx, labels, func(ctx context.Context) {
+		next := handler
+		for i := len(c.cfg.Interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := c.cfg.Interceptors[i], next
+			next = func() error {
+				return interceptor(ctx, op, inner)
+			}
+		}
+
+		err = next()
+	})
+
+	return err
+}
+
+// Intercept adds i to the interceptors that Dispatch calls, inside those in
+// MountConfig.Interceptors. It is for servers that wrap other servers, and
+// must be called before the first call to ReadOp, e.g. from ServeOps before it
+// hands the connection on.
+func (c *Connection) Intercept(i Interceptor) {
+	n := len(c.cfg.Interceptors)
+	c.cfg.Interceptors = append(c.cfg.Interceptors[:n:n], i)
+}
+
+// An op that ReadOp has read but holds back until there is a slot for it
+// under MountConfig.MaxConcurrentOps.
+type heldOp struct {
+	inMsg  *buffer.InMessage
+	outMsg *buffer.OutMessage
+	op     interface{}
+	start  time.Time
+}
+
+// Take one of the slots allowed by MountConfig.MaxConcurrentOps for op, just
+// read, reporting whether op took one that Reply must give back. ok is false
+// if op must wait for a slot instead, because none is free or other ops are
+// waiting already, in which case ReadOp holds it and goes on reading. Forget
+// ops, which the kernel doesn't wait for, and INIT never take a slot.
+func (c *Connection) takeOpSlot(op interface{}) (held bool, ok bool) {
+	if c.opSlots == nil || isForget(op) {
+		return false, true
+	}
+
+	if _, isInit := op.(*initOp); isInit {
+		return false, true
+	}
+
+	if len(c.held) > 0 {
+		return false, false
+	}
+
+	select {
+	case c.opSlots <- struct{}{}:
+		return true, true
+
+	default:
+		return false, false
+	}
+}
+
+// Take the first held op, for which nextMessage has taken a slot.
+func (c *Connection) popHeldOp() heldOp {
+	h := c.held[0]
+	c.held[0] = heldOp{}
+	c.held = c.held[1:]
+	return h
+}
+
+// Answer a held op that the kernel has interrupted with EINTR, since its
+// handler will never see the interrupt, reporting whether there was one.
+func (c *Connection) interruptHeldOp(fuseID uint64) bool {
+	for i, h := range c.held {
+		if h.inMsg.Header().Unique == fuseID {
+			c.held = append(c.held[:i], c.held[i+1:]...)
+			c.rejectMessage(h.inMsg, h.outMsg, syscall.EINTR)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Answer all held ops with EINTR, once the connection's OpContext has ended
+// and no slot will be waited for.
+func (c *Connection) rejectHeldOps() {
+	for _, h := range c.held {
+		c.rejectMessage(h.inMsg, h.outMsg, syscall.EINTR)
+	}
+
+	c.held = nil
+}
+
+// Give back a slot taken by takeOpSlot.
+func (c *Connection) releaseOpSlot() {
+	<-c.opSlots
+}
+
+// Report whether op is one of the ops with which the kernel drops inode
+// references.
+func isForget(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+		return true
+	}
+
+	return false
+}
@@ -53,6 +53,20 @@ func NewInMessage() *InMessage {
 	}
 }
 
+// NewInMessageSize is like NewInMessage, but makes room for writes of up to
+// maxWrite bytes rather than MaxWriteSize.
+func NewInMessageSize(maxWrite int) *InMessage {
+	return &InMessage{
+		storage: make([]byte, pageSize+maxWrite),
+	}
+}
+
+// MaxWrite returns the size of the largest write that the message has room
+// for.
+func (m *InMessage) MaxWrite() int {
+	return len(m.storage) - pageSize
+}
+
 var readLock sync.Mutex
 
 func (m *InMessage) ReadSingle(r io.Reader) (int, error) {
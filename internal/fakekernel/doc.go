@@ -0,0 +1,23 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakekernel plays the part of the kernel in a fuse connection, so
+// that servers can be exercised in tests without /dev/fuse or the privileges
+// needed to mount a file system.
+//
+// The fake kernel speaks to the server over a socket pair, which fuse.Mount
+// accepts in place of /dev/fuse by way of the /dev/fd/N mount point
+// convention. That convention is only supported on Linux, so neither is this
+// package.
+package fakekernel
@@ -0,0 +1,261 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakekernel
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The largest message we expect to read from the server. Note that messages
+// on a SOCK_SEQPACKET socket are also limited by the socket's send buffer
+// size, which by default is a couple of hundred KiB.
+const maxMessageSize = 1 << 21
+
+// A Message is a message written by the server: either a reply to a request
+// or a notification.
+type Message struct {
+	Header fusekernel.OutHeader
+	Data   []byte
+}
+
+// Errno returns the error carried by a reply, or zero if it indicates success.
+func (m *Message) Errno() syscall.Errno {
+	return syscall.Errno(-m.Header.Error)
+}
+
+// Kernel is the kernel side of a connection to a mounted server.
+type Kernel struct {
+	sock *os.File
+	mfs  *fuse.MountedFileSystem
+
+	// The server's reply to the INIT request sent while mounting.
+	Init fusekernel.InitOut
+
+	mu sync.Mutex
+
+	// The unique ID to use for the next request.
+	//
+	// GUARDED_BY(mu)
+	nextUnique uint64
+
+	// A buffer for reading messages, allocated on first use.
+	//
+	// GUARDED_BY(recvMu)
+	recvMu  sync.Mutex
+	recvBuf []byte
+}
+
+// Mount starts serving a new connection with the supplied server, using the
+// supplied config (which may be nil), and performs the INIT handshake. The
+// kernel advertises protocol version 7.31 and every capability flag the
+// package knows about.
+func Mount(server fuse.Server, cfg *fuse.MountConfig) (*Kernel, error) {
+	return MountWithInit(server, cfg, fusekernel.InitIn{
+		Major:        7,
+		Minor:        31,
+		MaxReadahead: 1 << 20,
+		Flags:        ^uint32(0),
+	})
+}
+
+// MountWithInit is like Mount, but sends the supplied INIT request.
+func MountWithInit(
+	server fuse.Server,
+	cfg *fuse.MountConfig,
+	init fusekernel.InitIn) (*Kernel, error) {
+	if cfg == nil {
+		cfg = &fuse.MountConfig{}
+	}
+
+	// SOCK_SEQPACKET preserves message boundaries, which the server relies on
+	// just as it does with /dev/fuse.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Socketpair: %v", err)
+	}
+
+	k := &Kernel{
+		sock:       os.NewFile(uintptr(fds[0]), "fakekernel"),
+		nextUnique: 1,
+	}
+
+	// The server reads the INIT request while mounting, so it must already be
+	// waiting for it.
+	h := k.Header(fusekernel.OpInit, 0)
+	if err := k.Send(h, Bytes(&init)); err != nil {
+		k.sock.Close()
+		syscall.Close(fds[1])
+		return nil, fmt.Errorf("Sending INIT: %v", err)
+	}
+
+	k.mfs, err = fuse.Mount(fmt.Sprintf("/dev/fd/%d", fds[1]), server, cfg)
+	if err != nil {
+		k.sock.Close()
+		return nil, fmt.Errorf("Mount: %v", err)
+	}
+
+	reply, err := k.Recv()
+	if err != nil {
+		k.Close()
+		return nil, fmt.Errorf("Reading INIT reply: %v", err)
+	}
+
+	if errno := reply.Errno(); errno != 0 {
+		k.Close()
+		return nil, fmt.Errorf("INIT failed: %v", errno)
+	}
+
+	if err := Decode(reply.Data, &k.Init); err != nil {
+		k.Close()
+		return nil, fmt.Errorf("Decoding INIT reply: %v", err)
+	}
+
+	return k, nil
+}
+
+// MountedFileSystem returns the mounted file system being served.
+func (k *Kernel) MountedFileSystem() *fuse.MountedFileSystem {
+	return k.mfs
+}
+
+// Header returns a header for a request with the given opcode and node ID,
+// using a fresh unique ID and the credentials of the current process.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *Kernel) Header(opcode uint32, nodeid uint64) fusekernel.InHeader {
+	k.mu.Lock()
+	unique := k.nextUnique
+	k.nextUnique++
+	k.mu.Unlock()
+
+	return fusekernel.InHeader{
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: nodeid,
+		Uid:    uint32(os.Getuid()),
+		Gid:    uint32(os.Getgid()),
+		Pid:    uint32(os.Getpid()),
+	}
+}
+
+// Send sends a request made up of the supplied header, whose length field is
+// filled in, followed by the supplied payload.
+func (k *Kernel) Send(h fusekernel.InHeader, payload ...[]byte) error {
+	msg := make([]byte, fusekernel.InHeaderSize)
+	for _, p := range payload {
+		msg = append(msg, p...)
+	}
+
+	h.Len = uint32(len(msg))
+	copy(msg, Bytes(&h))
+
+	_, err := k.sock.Write(msg)
+	return err
+}
+
+// Recv reads the next message written by the server.
+//
+// LOCKS_EXCLUDED(k.recvMu)
+func (k *Kernel) Recv() (*Message, error) {
+	k.recvMu.Lock()
+	defer k.recvMu.Unlock()
+
+	if k.recvBuf == nil {
+		k.recvBuf = make([]byte, maxMessageSize)
+	}
+
+	buf := k.recvBuf
+	n, err := k.sock.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+	if err := Decode(buf[:n], &m.Header); err != nil {
+		return nil, err
+	}
+
+	if int(m.Header.Len) != n {
+		return nil, fmt.Errorf("Header says %d bytes, but read %d", m.Header.Len, n)
+	}
+
+	m.Data = append([]byte(nil), buf[unsafe.Sizeof(m.Header):n]...)
+	return m, nil
+}
+
+// Do sends a request with a fresh header and returns the reply. It must not be
+// used while other requests are outstanding.
+func (k *Kernel) Do(
+	opcode uint32,
+	nodeid uint64,
+	payload ...[]byte) (*Message, error) {
+	h := k.Header(opcode, nodeid)
+	if err := k.Send(h, payload...); err != nil {
+		return nil, err
+	}
+
+	m, err := k.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Header.Unique != h.Unique {
+		return nil, fmt.Errorf(
+			"Reply for request %d; expected %d",
+			m.Header.Unique,
+			h.Unique)
+	}
+
+	return m, nil
+}
+
+// Close hangs up on the server, as the kernel does when the file system is
+// unmounted, and waits for the server to return.
+func (k *Kernel) Close() error {
+	if err := k.sock.Close(); err != nil {
+		return err
+	}
+
+	return k.mfs.Join(context.Background())
+}
+
+// Bytes returns the memory of *p as a byte slice.
+func Bytes[T any](p *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(p)), unsafe.Sizeof(*p))
+}
+
+// String returns s as a NUL-terminated byte slice.
+func String(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// Decode fills in *p from the start of b.
+func Decode[T any](b []byte, p *T) error {
+	dst := Bytes(p)
+	if len(b) < len(dst) {
+		return fmt.Errorf("Have %d bytes; need %d", len(b), len(dst))
+	}
+
+	copy(dst, b)
+	return nil
+}
@@ -46,7 +46,7 @@ const (
 	ProtoVersionMinMajor = 7
 	ProtoVersionMinMinor = 18
 	ProtoVersionMaxMajor = 7
-	ProtoVersionMaxMinor = 31
+	ProtoVersionMaxMinor = 40
 )
 
 const (
@@ -66,7 +66,10 @@ type Kstatfs struct {
 	Spare   [6]uint32
 }
 
-type fileLock struct {
+// FileLock is struct fuse_file_lock: a byte range lock, or the range a lock
+// request concerns. End is inclusive, with ^uint64(0) meaning the end of the
+// file.
+type FileLock struct {
 	Start uint64
 	End   uint64
 	Type  uint32
@@ -82,11 +85,11 @@ const (
 )
 
 var getattrFlagsNames = []flagName{
-	{uint32(GetattrFh), "GetattrFh"},
+	{uint64(GetattrFh), "GetattrFh"},
 }
 
 func (fl GetattrFlags) String() string {
-	return flagString(uint32(fl), getattrFlagsNames)
+	return flagString(uint64(fl), getattrFlagsNames)
 }
 
 // The SetattrValid are bit flags describing which fields in the SetattrRequest
@@ -103,9 +106,11 @@ const (
 	SetattrHandle SetattrValid = 1 << 6
 
 	// Linux only(?)
-	SetattrAtimeNow  SetattrValid = 1 << 7
-	SetattrMtimeNow  SetattrValid = 1 << 8
-	SetattrLockOwner SetattrValid = 1 << 9 // http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
+	SetattrAtimeNow    SetattrValid = 1 << 7
+	SetattrMtimeNow    SetattrValid = 1 << 8
+	SetattrLockOwner   SetattrValid = 1 << 9  // http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
+	SetattrCtime       SetattrValid = 1 << 10 // with writeback caching
+	SetattrKillSuidgid SetattrValid = 1 << 11 // with InitHandleKillprivV2
 
 	// OS X only
 	SetattrCrtime   SetattrValid = 1 << 28
@@ -114,40 +119,44 @@ const (
 	SetattrFlags    SetattrValid = 1 << 31
 )
 
-func (fl SetattrValid) Mode() bool      { return fl&SetattrMode != 0 }
-func (fl SetattrValid) Uid() bool       { return fl&SetattrUid != 0 }
-func (fl SetattrValid) Gid() bool       { return fl&SetattrGid != 0 }
-func (fl SetattrValid) Size() bool      { return fl&SetattrSize != 0 }
-func (fl SetattrValid) Atime() bool     { return fl&SetattrAtime != 0 }
-func (fl SetattrValid) Mtime() bool     { return fl&SetattrMtime != 0 }
-func (fl SetattrValid) Handle() bool    { return fl&SetattrHandle != 0 }
-func (fl SetattrValid) AtimeNow() bool  { return fl&SetattrAtimeNow != 0 }
-func (fl SetattrValid) MtimeNow() bool  { return fl&SetattrMtimeNow != 0 }
-func (fl SetattrValid) LockOwner() bool { return fl&SetattrLockOwner != 0 }
-func (fl SetattrValid) Crtime() bool    { return fl&SetattrCrtime != 0 }
-func (fl SetattrValid) Chgtime() bool   { return fl&SetattrChgtime != 0 }
-func (fl SetattrValid) Bkuptime() bool  { return fl&SetattrBkuptime != 0 }
-func (fl SetattrValid) Flags() bool     { return fl&SetattrFlags != 0 }
+func (fl SetattrValid) Mode() bool        { return fl&SetattrMode != 0 }
+func (fl SetattrValid) Uid() bool         { return fl&SetattrUid != 0 }
+func (fl SetattrValid) Gid() bool         { return fl&SetattrGid != 0 }
+func (fl SetattrValid) Size() bool        { return fl&SetattrSize != 0 }
+func (fl SetattrValid) Atime() bool       { return fl&SetattrAtime != 0 }
+func (fl SetattrValid) Mtime() bool       { return fl&SetattrMtime != 0 }
+func (fl SetattrValid) Handle() bool      { return fl&SetattrHandle != 0 }
+func (fl SetattrValid) AtimeNow() bool    { return fl&SetattrAtimeNow != 0 }
+func (fl SetattrValid) MtimeNow() bool    { return fl&SetattrMtimeNow != 0 }
+func (fl SetattrValid) LockOwner() bool   { return fl&SetattrLockOwner != 0 }
+func (fl SetattrValid) Ctime() bool       { return fl&SetattrCtime != 0 }
+func (fl SetattrValid) KillSuidgid() bool { return fl&SetattrKillSuidgid != 0 }
+func (fl SetattrValid) Crtime() bool      { return fl&SetattrCrtime != 0 }
+func (fl SetattrValid) Chgtime() bool     { return fl&SetattrChgtime != 0 }
+func (fl SetattrValid) Bkuptime() bool    { return fl&SetattrBkuptime != 0 }
+func (fl SetattrValid) Flags() bool       { return fl&SetattrFlags != 0 }
 
 func (fl SetattrValid) String() string {
-	return flagString(uint32(fl), setattrValidNames)
+	return flagString(uint64(fl), setattrValidNames)
 }
 
 var setattrValidNames = []flagName{
-	{uint32(SetattrMode), "SetattrMode"},
-	{uint32(SetattrUid), "SetattrUid"},
-	{uint32(SetattrGid), "SetattrGid"},
-	{uint32(SetattrSize), "SetattrSize"},
-	{uint32(SetattrAtime), "SetattrAtime"},
-	{uint32(SetattrMtime), "SetattrMtime"},
-	{uint32(SetattrHandle), "SetattrHandle"},
-	{uint32(SetattrAtimeNow), "SetattrAtimeNow"},
-	{uint32(SetattrMtimeNow), "SetattrMtimeNow"},
-	{uint32(SetattrLockOwner), "SetattrLockOwner"},
-	{uint32(SetattrCrtime), "SetattrCrtime"},
-	{uint32(SetattrChgtime), "SetattrChgtime"},
-	{uint32(SetattrBkuptime), "SetattrBkuptime"},
-	{uint32(SetattrFlags), "SetattrFlags"},
+	{uint64(SetattrMode), "SetattrMode"},
+	{uint64(SetattrUid), "SetattrUid"},
+	{uint64(SetattrGid), "SetattrGid"},
+	{uint64(SetattrSize), "SetattrSize"},
+	{uint64(SetattrAtime), "SetattrAtime"},
+	{uint64(SetattrMtime), "SetattrMtime"},
+	{uint64(SetattrHandle), "SetattrHandle"},
+	{uint64(SetattrAtimeNow), "SetattrAtimeNow"},
+	{uint64(SetattrMtimeNow), "SetattrMtimeNow"},
+	{uint64(SetattrLockOwner), "SetattrLockOwner"},
+	{uint64(SetattrCtime), "SetattrCtime"},
+	{uint64(SetattrKillSuidgid), "SetattrKillSuidgid"},
+	{uint64(SetattrCrtime), "SetattrCrtime"},
+	{uint64(SetattrChgtime), "SetattrChgtime"},
+	{uint64(SetattrBkuptime), "SetattrBkuptime"},
+	{uint64(SetattrFlags), "SetattrFlags"},
 }
 
 // Flags that can be seen in OpenRequest.Flags.
@@ -164,6 +173,7 @@ const (
 	OpenExclusive OpenFlags = syscall.O_EXCL
 	OpenSync      OpenFlags = syscall.O_SYNC
 	OpenTruncate  OpenFlags = syscall.O_TRUNC
+	OpenDirectory OpenFlags = syscall.O_DIRECTORY
 )
 
 // OpenAccessModeMask is a bitmask that separates the access mode
@@ -179,7 +189,7 @@ func (fl OpenFlags) String() string {
 	s := accModeName(fl & OpenAccessModeMask)
 	flags := uint32(fl &^ OpenAccessModeMask)
 	if flags != 0 {
-		s = s + "+" + flagString(flags, openFlagNames)
+		s = s + "+" + flagString(uint64(flags), openFlagNames)
 	}
 	return s
 }
@@ -199,6 +209,16 @@ func (fl OpenFlags) IsReadWrite() bool {
 	return fl&OpenAccessModeMask == OpenReadWrite
 }
 
+// Return true if OpenAppend is set.
+func (fl OpenFlags) IsAppend() bool {
+	return fl&OpenAppend != 0
+}
+
+// Return true if OpenDirectory is set.
+func (fl OpenFlags) IsDirectory() bool {
+	return fl&OpenDirectory != 0
+}
+
 func accModeName(flags OpenFlags) string {
 	switch flags {
 	case OpenReadOnly:
@@ -213,11 +233,12 @@ func accModeName(flags OpenFlags) string {
 }
 
 var openFlagNames = []flagName{
-	{uint32(OpenCreate), "OpenCreate"},
-	{uint32(OpenExclusive), "OpenExclusive"},
-	{uint32(OpenTruncate), "OpenTruncate"},
-	{uint32(OpenAppend), "OpenAppend"},
-	{uint32(OpenSync), "OpenSync"},
+	{uint64(OpenCreate), "OpenCreate"},
+	{uint64(OpenExclusive), "OpenExclusive"},
+	{uint64(OpenTruncate), "OpenTruncate"},
+	{uint64(OpenAppend), "OpenAppend"},
+	{uint64(OpenSync), "OpenSync"},
+	{uint64(OpenDirectory), "OpenDirectory"},
 }
 
 // The OpenResponseFlags are returned in the OpenResponse.
@@ -228,26 +249,39 @@ const (
 	OpenKeepCache   OpenResponseFlags = 1 << 1 // don't invalidate the data cache on open
 	OpenNonSeekable OpenResponseFlags = 1 << 2 // mark the file as non-seekable (not supported on OS X)
 	OpenCacheDir    OpenResponseFlags = 1 << 3 // allow caching this directory
+	OpenStream      OpenResponseFlags = 1 << 4 // the file is stream-like (no file position at all)
+	OpenNoFlush     OpenResponseFlags = 1 << 5 // don't flush data cache on close (protocol 7.35)
+
+	OpenParallelDirectWrites OpenResponseFlags = 1 << 6 // allow concurrent direct writes on the same inode (protocol 7.36)
+	OpenPassthrough          OpenResponseFlags = 1 << 7 // route reads and writes to the backing file (protocol 7.40)
 
 	OpenPurgeAttr OpenResponseFlags = 1 << 30 // OS X
 	OpenPurgeUBC  OpenResponseFlags = 1 << 31 // OS X
 )
 
 func (fl OpenResponseFlags) String() string {
-	return flagString(uint32(fl), openResponseFlagNames)
+	return flagString(uint64(fl), openResponseFlagNames)
 }
 
 var openResponseFlagNames = []flagName{
-	{uint32(OpenDirectIO), "OpenDirectIO"},
-	{uint32(OpenKeepCache), "OpenKeepCache"},
-	{uint32(OpenNonSeekable), "OpenNonSeekable"},
-	{uint32(OpenCacheDir), "OpenCacheDir"},
-	{uint32(OpenPurgeAttr), "OpenPurgeAttr"},
-	{uint32(OpenPurgeUBC), "OpenPurgeUBC"},
+	{uint64(OpenDirectIO), "OpenDirectIO"},
+	{uint64(OpenKeepCache), "OpenKeepCache"},
+	{uint64(OpenNonSeekable), "OpenNonSeekable"},
+	{uint64(OpenCacheDir), "OpenCacheDir"},
+	{uint64(OpenStream), "OpenStream"},
+	{uint64(OpenNoFlush), "OpenNoFlush"},
+	{uint64(OpenParallelDirectWrites), "OpenParallelDirectWrites"},
+	{uint64(OpenPassthrough), "OpenPassthrough"},
+	{uint64(OpenPurgeAttr), "OpenPurgeAttr"},
+	{uint64(OpenPurgeUBC), "OpenPurgeUBC"},
 }
 
 // The InitFlags are used in the Init exchange.
-type InitFlags uint32
+//
+// Flags up to bit 31 are sent in the flags field of the INIT request and
+// reply. Since protocol 7.36, bits 32 to 63 are sent in the flags2 field,
+// shifted down by 32, provided InitExt is set in flags.
+type InitFlags uint64
 
 const (
 	InitAsyncRead        InitFlags = 1 << 0
@@ -269,9 +303,23 @@ const (
 	InitWritebackCache   InitFlags = 1 << 16
 	InitNoOpenSupport    InitFlags = 1 << 17
 	InitParallelDirOps   InitFlags = 1 << 18
+	InitHandleKillpriv   InitFlags = 1 << 19
+	InitPosixACL         InitFlags = 1 << 20
 	InitMaxPages         InitFlags = 1 << 22
 	InitCacheSymlinks    InitFlags = 1 << 23
 	InitNoOpendirSupport InitFlags = 1 << 24
+	InitHandleKillprivV2 InitFlags = 1 << 28 // Linux, protocol 7.33
+	InitExt              InitFlags = 1 << 30 // Linux, protocol 7.36
+
+	// Linux, carried in flags2.
+	InitSecurityCtx       InitFlags = 1 << 32
+	InitHasInodeDAX       InitFlags = 1 << 33
+	InitCreateSuppGroup   InitFlags = 1 << 34
+	InitHasExpireOnly     InitFlags = 1 << 35
+	InitDirectIOAllowMmap InitFlags = 1 << 36
+	InitPassthrough       InitFlags = 1 << 37
+	InitNoExportSupport   InitFlags = 1 << 38
+	InitHasResend         InitFlags = 1 << 39
 
 	InitCaseSensitive InitFlags = 1 << 29 // OS X only
 	InitVolRename     InitFlags = 1 << 30 // OS X only
@@ -279,43 +327,45 @@ const (
 )
 
 type flagName struct {
-	bit  uint32
+	bit  uint64
 	name string
 }
 
-var initFlagNames = []flagName{
-	{uint32(InitAsyncRead), "InitAsyncRead"},
-	{uint32(InitPosixLocks), "InitPosixLocks"},
-	{uint32(InitFileOps), "InitFileOps"},
-	{uint32(InitAtomicTrunc), "InitAtomicTrunc"},
-	{uint32(InitExportSupport), "InitExportSupport"},
-	{uint32(InitBigWrites), "InitBigWrites"},
-	{uint32(InitMaxPages), "InitMaxPages"},
-	{uint32(InitDontMask), "InitDontMask"},
-	{uint32(InitSpliceWrite), "InitSpliceWrite"},
-	{uint32(InitSpliceMove), "InitSpliceMove"},
-	{uint32(InitSpliceRead), "InitSpliceRead"},
-	{uint32(InitFlockLocks), "InitFlockLocks"},
-	{uint32(InitHasIoctlDir), "InitHasIoctlDir"},
-	{uint32(InitAutoInvalData), "InitAutoInvalData"},
-	{uint32(InitDoReaddirplus), "InitDoReaddirplus"},
-	{uint32(InitReaddirplusAuto), "InitReaddirplusAuto"},
-	{uint32(InitAsyncDIO), "InitAsyncDIO"},
-	{uint32(InitWritebackCache), "InitWritebackCache"},
-	{uint32(InitNoOpenSupport), "InitNoOpenSupport"},
-	{uint32(InitCacheSymlinks), "InitCacheSymlinks"},
-	{uint32(InitNoOpendirSupport), "InitNoOpendirSupport"},
-
-	{uint32(InitCaseSensitive), "InitCaseSensitive"},
-	{uint32(InitVolRename), "InitVolRename"},
-	{uint32(InitXtimes), "InitXtimes"},
-}
+// Some bits mean different things on different platforms, so their names are
+// in osInitFlagNames.
+var initFlagNames = append([]flagName{
+	{uint64(InitAsyncRead), "InitAsyncRead"},
+	{uint64(InitPosixLocks), "InitPosixLocks"},
+	{uint64(InitFileOps), "InitFileOps"},
+	{uint64(InitAtomicTrunc), "InitAtomicTrunc"},
+	{uint64(InitExportSupport), "InitExportSupport"},
+	{uint64(InitBigWrites), "InitBigWrites"},
+	{uint64(InitMaxPages), "InitMaxPages"},
+	{uint64(InitDontMask), "InitDontMask"},
+	{uint64(InitSpliceWrite), "InitSpliceWrite"},
+	{uint64(InitSpliceMove), "InitSpliceMove"},
+	{uint64(InitSpliceRead), "InitSpliceRead"},
+	{uint64(InitFlockLocks), "InitFlockLocks"},
+	{uint64(InitHasIoctlDir), "InitHasIoctlDir"},
+	{uint64(InitAutoInvalData), "InitAutoInvalData"},
+	{uint64(InitDoReaddirplus), "InitDoReaddirplus"},
+	{uint64(InitReaddirplusAuto), "InitReaddirplusAuto"},
+	{uint64(InitAsyncDIO), "InitAsyncDIO"},
+	{uint64(InitWritebackCache), "InitWritebackCache"},
+	{uint64(InitNoOpenSupport), "InitNoOpenSupport"},
+	{uint64(InitParallelDirOps), "InitParallelDirOps"},
+	{uint64(InitHandleKillpriv), "InitHandleKillpriv"},
+	{uint64(InitPosixACL), "InitPosixACL"},
+	{uint64(InitCacheSymlinks), "InitCacheSymlinks"},
+	{uint64(InitNoOpendirSupport), "InitNoOpendirSupport"},
+	{uint64(InitHandleKillprivV2), "InitHandleKillprivV2"},
+}, osInitFlagNames...)
 
 func (fl InitFlags) String() string {
-	return flagString(uint32(fl), initFlagNames)
+	return flagString(uint64(fl), initFlagNames)
 }
 
-func flagString(f uint32, names []flagName) string {
+func flagString(f uint64, names []flagName) string {
 	var s string
 
 	if f == 0 {
@@ -338,59 +388,92 @@ func flagString(f uint32, names []flagName) string {
 type ReleaseFlags uint32
 
 const (
-	ReleaseFlush ReleaseFlags = 1 << 0
+	ReleaseFlush       ReleaseFlags = 1 << 0
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1
 )
 
 func (fl ReleaseFlags) String() string {
-	return flagString(uint32(fl), releaseFlagNames)
+	return flagString(uint64(fl), releaseFlagNames)
 }
 
 var releaseFlagNames = []flagName{
-	{uint32(ReleaseFlush), "ReleaseFlush"},
+	{uint64(ReleaseFlush), "ReleaseFlush"},
+	{uint64(ReleaseFlockUnlock), "ReleaseFlockUnlock"},
+}
+
+// The IoctlFlags are used in the Ioctl exchange.
+type IoctlFlags uint32
+
+const (
+	IoctlCompat       IoctlFlags = 1 << 0
+	IoctlUnrestricted IoctlFlags = 1 << 1
+	IoctlRetry        IoctlFlags = 1 << 2
+	Ioctl32Bit        IoctlFlags = 1 << 3
+	IoctlDir          IoctlFlags = 1 << 4
+	IoctlCompatX32    IoctlFlags = 1 << 5
+)
+
+func (fl IoctlFlags) String() string {
+	return flagString(uint64(fl), ioctlFlagNames)
+}
+
+var ioctlFlagNames = []flagName{
+	{uint64(IoctlCompat), "IoctlCompat"},
+	{uint64(IoctlUnrestricted), "IoctlUnrestricted"},
+	{uint64(IoctlRetry), "IoctlRetry"},
+	{uint64(Ioctl32Bit), "Ioctl32Bit"},
+	{uint64(IoctlDir), "IoctlDir"},
+	{uint64(IoctlCompatX32), "IoctlCompatX32"},
 }
 
 // Opcodes
 const (
-	OpLookup      = 1
-	OpForget      = 2 // no reply
-	OpGetattr     = 3
-	OpSetattr     = 4
-	OpReadlink    = 5
-	OpSymlink     = 6
-	OpMknod       = 8
-	OpMkdir       = 9
-	OpUnlink      = 10
-	OpRmdir       = 11
-	OpRename      = 12
-	OpLink        = 13
-	OpOpen        = 14
-	OpRead        = 15
-	OpWrite       = 16
-	OpStatfs      = 17
-	OpRelease     = 18
-	OpFsync       = 20
-	OpSetxattr    = 21
-	OpGetxattr    = 22
-	OpListxattr   = 23
-	OpRemovexattr = 24
-	OpFlush       = 25
-	OpInit        = 26
-	OpOpendir     = 27
-	OpReaddir     = 28
-	OpReleasedir  = 29
-	OpFsyncdir    = 30
-	OpGetlk       = 31
-	OpSetlk       = 32
-	OpSetlkw      = 33
-	OpAccess      = 34
-	OpCreate      = 35
-	OpInterrupt   = 36
-	OpBmap        = 37
-	OpDestroy     = 38
-	OpIoctl       = 39 // Linux?
-	OpPoll        = 40 // Linux?
-	OpBatchForget = 42
-	OpFallocate   = 43
+	OpLookup        = 1
+	OpForget        = 2 // no reply
+	OpGetattr       = 3
+	OpSetattr       = 4
+	OpReadlink      = 5
+	OpSymlink       = 6
+	OpMknod         = 8
+	OpMkdir         = 9
+	OpUnlink        = 10
+	OpRmdir         = 11
+	OpRename        = 12
+	OpLink          = 13
+	OpOpen          = 14
+	OpRead          = 15
+	OpWrite         = 16
+	OpStatfs        = 17
+	OpRelease       = 18
+	OpFsync         = 20
+	OpSetxattr      = 21
+	OpGetxattr      = 22
+	OpListxattr     = 23
+	OpRemovexattr   = 24
+	OpFlush         = 25
+	OpInit          = 26
+	OpOpendir       = 27
+	OpReaddir       = 28
+	OpReleasedir    = 29
+	OpFsyncdir      = 30
+	OpGetlk         = 31
+	OpSetlk         = 32
+	OpSetlkw        = 33
+	OpAccess        = 34
+	OpCreate        = 35
+	OpInterrupt     = 36
+	OpBmap          = 37
+	OpDestroy       = 38
+	OpIoctl         = 39 // Linux?
+	OpPoll          = 40 // Linux?
+	OpBatchForget   = 42
+	OpFallocate     = 43
+	OpReaddirplus   = 44
+	OpSetupmapping  = 48 // virtio-fs DAX, protocol 7.31
+	OpRemovemapping = 49 // virtio-fs DAX, protocol 7.31
+	OpSyncfs        = 50 // Linux 5.15+, protocol 7.34
+	OpTmpfile       = 51 // Linux 6.3+
+	OpStatx         = 52 // Linux 6.6+, protocol 7.39
 
 	// OS X
 	OpSetvolname = 61
@@ -444,6 +527,58 @@ type AttrOut struct {
 	Attr          Attr
 }
 
+type StatxIn struct {
+	GetattrFlags uint32
+	Reserved     uint32
+	Fh           uint64
+	SxFlags      uint32
+	SxMask       uint32
+}
+
+// The fields of Statx that are filled in, as in statx(2).
+const (
+	StatxBasicStats = 0x7ff
+	StatxBtime      = 0x800
+)
+
+type SxTime struct {
+	Sec      int64
+	Nsec     uint32
+	reserved int32
+}
+
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          SxTime
+	Btime          SxTime
+	Ctime          SxTime
+	Mtime          SxTime
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	spare2         [14]uint64
+}
+
+type StatxOut struct {
+	AttrValid     uint64 // Cache timeout for the attributes
+	AttrValidNsec uint32
+	Flags         uint32
+	Spare         [2]uint64
+	Stat          Statx
+}
+
 func AttrOutSize(p Protocol) uintptr {
 	switch {
 	case p.LT(Protocol{7, 9}):
@@ -517,10 +652,10 @@ type setattrInCommon struct {
 	LockOwner uint64 // unused on OS X?
 	Atime     uint64
 	Mtime     uint64
-	Unused2   uint64
+	Ctime     uint64
 	AtimeNsec uint32
 	MtimeNsec uint32
-	Unused3   uint32
+	CtimeNsec uint32
 	Mode      uint32
 	Unused4   uint32
 	Uid       uint32
@@ -536,7 +671,7 @@ type OpenIn struct {
 type OpenOut struct {
 	Fh        uint64
 	OpenFlags uint32
-	Padding   uint32
+	BackingID int32
 }
 
 type CreateIn struct {
@@ -559,7 +694,7 @@ type ReleaseIn struct {
 	Fh           uint64
 	Flags        uint32
 	ReleaseFlags uint32
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 type FlushIn struct {
@@ -597,11 +732,11 @@ const (
 )
 
 var readFlagNames = []flagName{
-	{uint32(ReadLockOwner), "ReadLockOwner"},
+	{uint64(ReadLockOwner), "ReadLockOwner"},
 }
 
 func (fl ReadFlags) String() string {
-	return flagString(uint32(fl), readFlagNames)
+	return flagString(uint64(fl), readFlagNames)
 }
 
 type WriteIn struct {
@@ -635,15 +770,18 @@ const (
 	WriteCache WriteFlags = 1 << 0
 	// LockOwner field is valid.
 	WriteLockOwner WriteFlags = 1 << 1
+	// Clear the setuid and setgid bits (with InitHandleKillprivV2).
+	WriteKillSuidgid WriteFlags = 1 << 2
 )
 
 var writeFlagNames = []flagName{
-	{uint32(WriteCache), "WriteCache"},
-	{uint32(WriteLockOwner), "WriteLockOwner"},
+	{uint64(WriteCache), "WriteCache"},
+	{uint64(WriteLockOwner), "WriteLockOwner"},
+	{uint64(WriteKillSuidgid), "WriteKillSuidgid"},
 }
 
 func (fl WriteFlags) String() string {
-	return flagString(uint32(fl), writeFlagNames)
+	return flagString(uint64(fl), writeFlagNames)
 }
 
 const compatStatfsSize = 48
@@ -658,6 +796,12 @@ type FsyncIn struct {
 	Padding    uint32
 }
 
+// Flags for setxattr(2), as passed on by SetxattrIn.XattrFlags.
+const (
+	XattrCreate  = 0x1 // fail if the attribute exists
+	XattrReplace = 0x2 // fail if the attribute doesn't exist
+)
+
 type setxattrInCommon struct {
 	Size  uint32
 	Flags uint32
@@ -694,14 +838,56 @@ type FallocateIn struct {
 	Padding uint32
 }
 
+type IoctlIn struct {
+	Fh      uint64
+	Flags   uint32
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32
+}
+
+type IoctlOut struct {
+	Result  int32
+	Flags   uint32
+	InIovs  uint32
+	OutIovs uint32
+}
+
+type SetupmappingIn struct {
+	Fh      uint64
+	Foffset uint64
+	Len     uint64
+	Flags   uint64
+	Moffset uint64
+}
+
+type RemovemappingIn struct {
+	Count uint32
+}
+
+type RemovemappingOne struct {
+	Moffset uint64
+	Len     uint64
+}
+
+type SyncfsIn struct {
+	Padding uint64
+}
+
 type LkIn struct {
 	Fh      uint64
 	Owner   uint64
-	Lk      fileLock
+	Lk      FileLock
 	LkFlags uint32
 	padding uint32
 }
 
+// LkFlags are bit flags that can be seen in LkIn.
+const (
+	LkFlock = 1 << 0 // The request is for flock(2), not fcntl(2)
+)
+
 func LkInSize(p Protocol) uintptr {
 	switch {
 	case p.LT(Protocol{7, 9}):
@@ -712,7 +898,7 @@ func LkInSize(p Protocol) uintptr {
 }
 
 type LkOut struct {
-	Lk fileLock
+	Lk FileLock
 }
 
 type AccessIn struct {
@@ -725,9 +911,18 @@ type InitIn struct {
 	Minor        uint32
 	MaxReadahead uint32
 	Flags        uint32
+	Flags2       uint32
+	Unused       [11]uint32
 }
 
-const InitInSize = int(unsafe.Sizeof(InitIn{}))
+func InitInSize(p Protocol) uintptr {
+	switch {
+	case p.LT(Protocol{7, 36}):
+		return unsafe.Offsetof(InitIn{}.Flags2)
+	default:
+		return unsafe.Sizeof(InitIn{})
+	}
+}
 
 type InitOut struct {
 	Major               uint32
@@ -740,7 +935,9 @@ type InitOut struct {
 	TimeGran            uint32
 	MaxPages            uint16
 	MapAlignment        uint16
-	Unused              [8]uint32
+	Flags2              uint32
+	MaxStackDepth       uint32
+	Unused              [6]uint32
 }
 
 type InterruptIn struct {
@@ -803,3 +1000,17 @@ type NotifyInvalEntryOut struct {
 	Namelen uint32
 	padding uint32
 }
+
+// The argument to the DevIocBackingOpen ioctl (protocol 7.40).
+type BackingMap struct {
+	Fd      int32
+	Flags   uint32
+	Padding uint64
+}
+
+// Ioctls on /dev/fuse for registering backing files for passthrough, i.e.
+// _IOW(229, 1, struct fuse_backing_map) and _IOW(229, 2, uint32_t).
+const (
+	DevIocBackingOpen  = 0x4010e501
+	DevIocBackingClose = 0x4004e502
+)
@@ -86,3 +86,31 @@ type SetxattrIn struct {
 func (s *SetxattrIn) GetPosition() uint32 {
 	return s.Position
 }
+
+// Return the setxattr(2) flags as XattrCreate and XattrReplace. OS X has its
+// own values for these, and other flags such as XATTR_NOFOLLOW, which the
+// kernel has already dealt with and are dropped.
+func (s *SetxattrIn) XattrFlags() uint32 {
+	const (
+		xattrCreate  = 0x2
+		xattrReplace = 0x4
+	)
+
+	var flags uint32
+	if s.Flags&xattrCreate != 0 {
+		flags |= XattrCreate
+	}
+
+	if s.Flags&xattrReplace != 0 {
+		flags |= XattrReplace
+	}
+
+	return flags
+}
+
+// Init flags whose bits mean something else on Linux.
+var osInitFlagNames = []flagName{
+	{uint64(InitCaseSensitive), "InitCaseSensitive"},
+	{uint64(InitVolRename), "InitVolRename"},
+	{uint64(InitXtimes), "InitXtimes"},
+}
@@ -0,0 +1,81 @@
+package fusekernel
+
+import "time"
+
+type Attr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	AtimeNsec uint32
+	MtimeNsec uint32
+	CtimeNsec uint32
+	Mode      uint32
+	Nlink     uint32
+	Uid       uint32
+	Gid       uint32
+	Rdev      uint32
+	Blksize   uint32
+	padding   uint32
+}
+
+func (a *Attr) Crtime() time.Time {
+	return time.Time{}
+}
+
+func (a *Attr) SetCrtime(s uint64, ns uint32) {
+	// Ignored on FreeBSD.
+}
+
+func (a *Attr) SetFlags(f uint32) {
+	// Ignored on FreeBSD.
+}
+
+type SetattrIn struct {
+	setattrInCommon
+}
+
+func (in *SetattrIn) BkupTime() time.Time {
+	return time.Time{}
+}
+
+func (in *SetattrIn) Chgtime() time.Time {
+	return time.Time{}
+}
+
+func (in *SetattrIn) Flags() uint32 {
+	return 0
+}
+
+func openFlags(flags uint32) OpenFlags {
+	return OpenFlags(flags)
+}
+
+type GetxattrIn struct {
+	getxattrInCommon
+}
+
+type SetxattrIn struct {
+	setxattrInCommon
+}
+
+// Return the flags as XattrCreate and XattrReplace. FreeBSD's extattr(2)
+// interface has no such flags, so the kernel never sends any.
+func (s *SetxattrIn) XattrFlags() uint32 {
+	return s.Flags
+}
+
+// Init flags whose bits mean something else on OS X.
+var osInitFlagNames = []flagName{
+	{uint64(InitExt), "InitExt"},
+	{uint64(InitSecurityCtx), "InitSecurityCtx"},
+	{uint64(InitHasInodeDAX), "InitHasInodeDAX"},
+	{uint64(InitCreateSuppGroup), "InitCreateSuppGroup"},
+	{uint64(InitHasExpireOnly), "InitHasExpireOnly"},
+	{uint64(InitDirectIOAllowMmap), "InitDirectIOAllowMmap"},
+	{uint64(InitPassthrough), "InitPassthrough"},
+	{uint64(InitNoExportSupport), "InitNoExportSupport"},
+	{uint64(InitHasResend), "InitHasResend"},
+}
@@ -68,3 +68,22 @@ type GetxattrIn struct {
 type SetxattrIn struct {
 	setxattrInCommon
 }
+
+// Return the setxattr(2) flags as XattrCreate and XattrReplace, which have the
+// Linux values.
+func (s *SetxattrIn) XattrFlags() uint32 {
+	return s.Flags
+}
+
+// Init flags whose bits mean something else on OS X.
+var osInitFlagNames = []flagName{
+	{uint64(InitExt), "InitExt"},
+	{uint64(InitSecurityCtx), "InitSecurityCtx"},
+	{uint64(InitHasInodeDAX), "InitHasInodeDAX"},
+	{uint64(InitCreateSuppGroup), "InitCreateSuppGroup"},
+	{uint64(InitHasExpireOnly), "InitHasExpireOnly"},
+	{uint64(InitDirectIOAllowMmap), "InitDirectIOAllowMmap"},
+	{uint64(InitPassthrough), "InitPassthrough"},
+	{uint64(InitNoExportSupport), "InitNoExportSupport"},
+	{uint64(InitHasResend), "InitHasResend"},
+}
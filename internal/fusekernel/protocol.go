@@ -73,3 +73,9 @@ func (a Protocol) HasUmask() bool {
 func (a Protocol) HasInvalidate() bool {
 	return a.is712()
 }
+
+// HasOpenCacheDir returns whether OpenCacheDir is understood in the reply to
+// an opendir request.
+func (a Protocol) HasOpenCacheDir() bool {
+	return a.GE(Protocol{7, 28})
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sort"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// With MountConfig.TrackLookupCounts, we keep our own tally of the kernel's
+// lookup count for each inode (cf. ForgetInodeOp): the number of times that a
+// reply has given it the inode, less the number of times it has forgotten it.
+
+// LookupCount returns the kernel's lookup count for the supplied inode, as of
+// the replies sent so far, if MountConfig.TrackLookupCounts is set, or zero if
+// not. A file system that counts lookups itself can check its counts against
+// this, e.g. when handling ForgetInodeOp, whose count has not yet been taken
+// off at that point.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) LookupCount(inode fuseops.InodeID) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lookupCounts[inode]
+}
+
+// Add the lookups that the successful reply to op gives the kernel.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) countLookups(op interface{}) {
+	if !c.cfg.TrackLookupCounts {
+		return
+	}
+
+	var inodes []fuseops.InodeID
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		inodes = append(inodes, o.Entry.Child)
+	case *fuseops.MkDirOp:
+		inodes = append(inodes, o.Entry.Child)
+	case *fuseops.MkNodeOp:
+		inodes = append(inodes, o.Entry.Child)
+	case *fuseops.CreateFileOp:
+		inodes = append(inodes, o.Entry.Child)
+	case *fuseops.CreateTmpfileOp:
+		inodes = append(inodes, o.Entry.Child)
+	case *fuseops.CreateSymlinkOp:
+		inodes = append(inodes, o.Entry.Child)
+	case *fuseops.CreateLinkOp:
+		inodes = append(inodes, o.Entry.Child)
+
+	case *fuseops.ReadDirPlusOp:
+		// The kernel doesn't count "." and "..".
+		n, _ := c.direntsPlusToSend(o)
+		for _, e := range o.Entries[:n] {
+			if e.Name != "." && e.Name != ".." {
+				inodes = append(inodes, e.Entry.Child)
+			}
+		}
+
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, inode := range inodes {
+		// Zero is a negative entry, which isn't counted.
+		if inode != 0 {
+			c.lookupCounts[inode]++
+		}
+	}
+}
+
+// Take off the lookups that a forget op drops, logging an error for any that
+// the kernel was never given.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) countForgets(op interface{}) {
+	if !c.cfg.TrackLookupCounts {
+		return
+	}
+
+	var entries []fuseops.BatchForgetEntry
+	switch o := op.(type) {
+	case *fuseops.ForgetInodeOp:
+		entries = append(entries, fuseops.BatchForgetEntry{Inode: o.Inode, N: o.N})
+
+	case *fuseops.BatchForgetOp:
+		entries = o.Entries
+
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range entries {
+		n := c.lookupCounts[e.Inode]
+		if e.N > n && c.errorLogger != nil {
+			c.errorLogger.Printf(
+				"TrackLookupCounts: inode %v forgotten %d times, but its lookup "+
+					"count was %d",
+				e.Inode,
+				e.N,
+				n)
+		}
+
+		if e.N >= n {
+			delete(c.lookupCounts, e.Inode)
+		} else {
+			c.lookupCounts[e.Inode] = n - e.N
+		}
+	}
+}
+
+// Log an error for each inode that the kernel hasn't forgotten, other than the
+// root with its initial reference.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) reportLookupCounts() {
+	if !c.cfg.TrackLookupCounts || c.errorLogger == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var inodes []fuseops.InodeID
+	for inode, n := range c.lookupCounts {
+		if inode != fuseops.RootInodeID || n != 1 {
+			inodes = append(inodes, inode)
+		}
+	}
+
+	sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+	for _, inode := range inodes {
+		c.errorLogger.Printf(
+			"TrackLookupCounts: inode %v still has lookup count %d at unmount",
+			inode,
+			c.lookupCounts[inode])
+	}
+}
@@ -15,16 +15,34 @@
 package fuse
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
 )
 
+// ErrAllowOtherNotPermitted is returned by Mount when MountConfig.AllowOther
+// or MountConfig.AllowRoot is set, but the mount helper refuses to honor it
+// because user_allow_other is not set in /etc/fuse.conf.
+var ErrAllowOtherNotPermitted = errors.New(
+	"allow_other is only permitted if user_allow_other is set in /etc/fuse.conf")
+
+// ErrMountpointBusy is returned by Mount, wrapped, when the mount point can't
+// be mounted on because it is in use, for example because something is already
+// mounted there. This may pass, unlike failures that wrap os.ErrPermission
+// (e.g. no write access to the mount point, or to /dev/fuse) or
+// os.ErrNotExist (the mount point doesn't exist), which Mount also returns
+// for the corresponding failures of the mount helper.
+var ErrMountpointBusy = errors.New("mount point is busy")
+
 // Server is an interface for any type that knows how to serve ops read from a
 // connection.
 type Server interface {
@@ -36,11 +54,64 @@ type Server interface {
 
 // Mount attempts to mount a file system on the given directory, using the
 // supplied Server to serve connection requests. It blocks until the file
-// system is successfully mounted.
+// system is successfully mounted, or until MountConfig.MountTimeout has passed.
 func Mount(
 	dir string,
 	server Server,
 	config *MountConfig) (*MountedFileSystem, error) {
+	return MountContext(context.Background(), dir, server, config)
+}
+
+// The result of mounting in the background, for MountContext.
+type mountResult struct {
+	conn *Connection
+	err  error
+}
+
+// MountContext is like Mount, but gives up if ctx is done before the file
+// system is mounted, returning an error wrapping ctx.Err(). As with
+// MountConfig.MountTimeout, the directory is then unmounted, once the mount
+// helper has returned if it is stuck.
+//
+// The context only governs mounting: cancelling it afterward has no effect on
+// the mounted file system. See MountConfig.OpContext for that.
+func MountContext(
+	ctx context.Context,
+	dir string,
+	server Server,
+	config *MountConfig) (*MountedFileSystem, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.MountTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, config.MountTimeout)
+		defer cancel()
+	}
+
+	// Give up straight away if ctx is already done, rather than racing it
+	// against a quick mount.
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("mount abandoned: %w", err)
+	}
+
+	// Create the mount point if asked to, and remove it again unless the file
+	// system ends up mounted on it.
+	created, err := prepareMountPoint(dir, config)
+	if err != nil {
+		return nil, err
+	}
+
+	mounted := false
+	if created {
+		defer func() {
+			if !mounted {
+				os.Remove(dir)
+			}
+		}()
+	}
+
 	// Sanity check: make sure the mount point exists and is a directory. This
 	// saves us from some confusing errors later on OS X.
 	if err := checkMountPoint(dir); err != nil {
@@ -53,14 +124,95 @@ func Mount(
 		joinStatusAvailable: make(chan struct{}),
 	}
 
+	// Mount and perform the INIT handshake in the background, since neither can
+	// be interrupted.
+	ready := make(chan error, 1)
+	result := make(chan mountResult, 1)
+	go func() {
+		connection, err := establishConnection(dir, config, ready)
+		result <- mountResult{connection, err}
+	}()
+
+	var connection *Connection
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		connection = r.conn
+
+	case <-ctx.Done():
+		go abandonMount(dir, result)
+		return nil, fmt.Errorf("mount abandoned: %w", ctx.Err())
+	}
+
+	mfs.conn = connection
+
+	// Serve the connection in the background. When done, set the join status.
+	go func() {
+		server.ServeOps(connection)
+		mfs.joinStatus = connection.close()
+
+		if mfs.joinStatus == nil && connectionAborted(dir) {
+			mfs.joinStatus = ErrConnectionLost
+			if config.OnConnectionLost != nil {
+				config.OnConnectionLost()
+			}
+		}
+
+		// Remove the mount point if we created it, unless the file system is
+		// still mounted on it after losing the connection.
+		if created && mfs.joinStatus != ErrConnectionLost {
+			if err := os.Remove(dir); err != nil && config.ErrorLogger != nil {
+				config.ErrorLogger.Printf("Removing mount point: %v", err)
+			}
+		}
+
+		close(mfs.joinStatusAvailable)
+	}()
+
+	if config.DebugLogger != nil {
+		config.DebugLogger.Println("Waiting for mounting process to complete")
+	}
+
+	// Wait for the mount process to complete.
+	select {
+	case err := <-ready:
+		if err != nil {
+			return nil, fmt.Errorf("mount (background): %w", err)
+		}
+
+	case <-ctx.Done():
+		// Unmounting makes the kernel hang up, which ends ServeOps. A file
+		// system mounted by someone else on /dev/fd/N can't be unmounted, so
+		// close the device instead, which ends ServeOps once its read returns.
+		if strings.HasPrefix(dir, "/dev/fd") {
+			connection.close()
+		} else {
+			unmountAbandoned(dir)
+		}
+
+		return nil, fmt.Errorf("mount abandoned: %w", ctx.Err())
+	}
+
+	mounted = true
+	return mfs, nil
+}
+
+// Begin mounting at the given directory and create a connection to the kernel
+// once it has sent INIT. See mount for the meaning of ready.
+func establishConnection(
+	dir string,
+	config *MountConfig,
+	ready chan<- error) (*Connection, error) {
 	// Begin the mounting process, which will continue in the background.
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Beginning the mounting kickoff process")
 	}
-	ready := make(chan error, 1)
 	dev, err := mount(dir, config, ready)
 	if err != nil {
-		return nil, fmt.Errorf("mount: %v", err)
+		return nil, fmt.Errorf("mount: %w", err)
 	}
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Completed the mounting kickoff process")
@@ -72,6 +224,8 @@ func Mount(
 		cfgCopy.OpContext = context.Background()
 	}
 
+	cfgCopy.applyImmutableData()
+
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Creating a connection object")
 	}
@@ -88,23 +242,83 @@ func Mount(
 		config.DebugLogger.Println("Successfully created the connection")
 	}
 
-	// Serve the connection in the background. When done, set the join status.
-	go func() {
-		server.ServeOps(connection)
-		mfs.joinStatus = connection.close()
-		close(mfs.joinStatusAvailable)
-	}()
+	return connection, nil
+}
 
-	if config.DebugLogger != nil {
-		config.DebugLogger.Println("Waiting for mounting process to complete")
+// Clean up after a mount that was given up on before establishConnection
+// returned, sending its result to the supplied channel. The directory is
+// unmounted straight away, in case the kernel is waiting for INIT to be
+// answered, and again if the connection was established in the meantime.
+func abandonMount(dir string, result <-chan mountResult) {
+	unmountAbandoned(dir)
+
+	if r := <-result; r.err == nil {
+		r.conn.close()
+		unmountAbandoned(dir)
 	}
+}
 
-	// Wait for the mount process to complete.
-	if err := <-ready; err != nil {
-		return nil, fmt.Errorf("mount (background): %v", err)
+// Unmount a file system whose mounting was abandoned, if it was mounted at all.
+// Errors are ignored: most likely the directory isn't a mount point.
+func unmountAbandoned(dir string) {
+	if strings.HasPrefix(dir, "/dev/fd") {
+		return
 	}
 
-	return mfs, nil
+	unmount(dir, UnmountOptions{})
+}
+
+// Report whether the connection for the file system mounted on dir was aborted
+// rather than unmounted: the kernel hangs up in both cases, but only in the
+// first does the mount point remain, failing with ENOTCONN.
+func connectionAborted(dir string) bool {
+	if strings.HasPrefix(dir, "/dev/fd") {
+		return false
+	}
+
+	_, err := os.Stat(dir)
+	return errors.Is(err, syscall.ENOTCONN)
+}
+
+// Create the mount point for MountConfig.CreateMountpoint, if it is set and
+// the directory doesn't exist, reporting whether it was created. An existing
+// mount point must be an empty directory then.
+func prepareMountPoint(dir string, config *MountConfig) (created bool, err error) {
+	if !config.CreateMountpoint || strings.HasPrefix(dir, "/dev/fd") {
+		return false, nil
+	}
+
+	mode := config.MountpointMode
+	if mode == 0 {
+		mode = 0755
+	}
+
+	err = os.Mkdir(dir, mode)
+	switch {
+	case err == nil:
+		return true, nil
+
+	case !os.IsExist(err):
+		return false, fmt.Errorf("Creating mount point: %w", err)
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, fmt.Errorf("Opening mount point: %w", err)
+	}
+
+	defer f.Close()
+
+	names, err := f.Readdirnames(1)
+	switch {
+	case err == io.EOF:
+		return false, nil
+
+	case err != nil:
+		return false, fmt.Errorf("Reading mount point: %w", err)
+	}
+
+	return false, fmt.Errorf("Mount point %s is not empty (contains %q)", dir, names[0])
 }
 
 func checkMountPoint(dir string) error {
@@ -127,6 +341,62 @@ func checkMountPoint(dir string) error {
 	return nil
 }
 
+// Return the supplied error from mounting, along with what the mount helper
+// printed if it was one, wrapped so that the failures that callers commonly
+// need to tell apart match ErrMountpointBusy, os.ErrPermission,
+// os.ErrNotExist or ErrAllowOtherNotPermitted with errors.Is. The helpers
+// report errors only as text, which is matched against the messages for the
+// errnos concerned on each platform.
+func mountError(err error, output string) error {
+	output = strings.TrimSpace(output)
+
+	var kind error
+	switch {
+	case strings.Contains(output, "user_allow_other"):
+		kind = ErrAllowOtherNotPermitted
+
+	case errors.Is(err, syscall.EBUSY) ||
+		strings.Contains(output, "Device or resource busy") ||
+		strings.Contains(output, "Resource busy"):
+		kind = ErrMountpointBusy
+
+	case errors.Is(err, os.ErrPermission) ||
+		strings.Contains(output, "Permission denied") ||
+		strings.Contains(output, "Operation not permitted") ||
+		strings.Contains(output, "no write access"):
+		kind = os.ErrPermission
+
+	case errors.Is(err, os.ErrNotExist) ||
+		strings.Contains(output, "No such file or directory"):
+		kind = os.ErrNotExist
+	}
+
+	if output != "" {
+		err = fmt.Errorf("%w: %s", err, output)
+	}
+
+	if kind == nil || errors.Is(err, kind) {
+		return err
+	}
+
+	return fmt.Errorf("%w (%w)", kind, err)
+}
+
+// Parse a mount point of the form /dev/fd/N, which means that file descriptor N
+// is an already open FUSE channel.
+func parseFuseFd(dir string) (int, error) {
+	if !strings.HasPrefix(dir, "/dev/fd/") {
+		return -1, fmt.Errorf("not a /dev/fd path")
+	}
+
+	fd, err := strconv.ParseUint(strings.TrimPrefix(dir, "/dev/fd/"), 10, 32)
+	if err != nil {
+		return -1, fmt.Errorf("invalid /dev/fd/N path: N must be a positive integer")
+	}
+
+	return int(fd), nil
+}
+
 func fusermount(binary string, argv []string, additionalEnv []string, wait bool, debugLogger *log.Logger) (*os.File, error) {
 	if debugLogger != nil {
 		debugLogger.Println("Creating a socket pair")
@@ -155,7 +425,11 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
 	cmd.Env = append(cmd.Env, additionalEnv...)
 	cmd.ExtraFiles = []*os.File{writeFile}
-	cmd.Stderr = os.Stderr
+
+	// Pass on the helper's complaints, but keep a copy so that we can tell
+	// what went wrong.
+	var stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 
 	// Run the command.
 	if wait {
@@ -164,7 +438,7 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 		err = cmd.Start()
 	}
 	if err != nil {
-		return nil, fmt.Errorf("running %v: %v", binary, err)
+		return nil, fmt.Errorf("running %v: %w", binary, mountError(err, stderr.String()))
 	}
 
 	if debugLogger != nil {
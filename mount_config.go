@@ -16,16 +16,27 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"os"
 	"runtime"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // Optional configuration accepted by Mount.
 type MountConfig struct {
 	// The context from which every op read from the connetion by the sever
 	// should inherit. If nil, context.Background() will be used.
+	//
+	// The context passed to each op is a child of this one, so cancelling it
+	// cancels every op in flight, and a deadline on it becomes a deadline on
+	// every op. This can be used to unblock all slow handlers at once when
+	// shutting down.
 	OpContext context.Context
 
 	// If non-empty, the name of the file system as displayed by e.g. `mount`.
@@ -36,8 +47,46 @@ type MountConfig struct {
 	// Mount the file system in read-only mode. File modes will appear as normal,
 	// but opening a file for writing and metadata operations like chmod,
 	// chtimes, etc. will fail.
+	//
+	// The kernel is told so and shouldn't send ops that would modify the file
+	// system, but should it ever do so they fail with EROFS before reaching the
+	// server, as with MountedFileSystem.SetReadOnly, so that file systems
+	// needn't guard against them themselves.
 	ReadOnly bool
 
+	// Mount the file system with the noatime option, telling it that access
+	// times don't matter.
+	//
+	// FUSE has no INIT capability for access times, and the kernel never
+	// updates them on its own for a FUSE file system: reads reach the server as
+	// ReadFileOp and ReadDirOp and never as SetInodeAttributesOp, whether the
+	// mount uses relatime (the default), strictatime or noatime. The mount
+	// option only affects what the file system itself chooses to do, so a file
+	// system that records access times on reads can check
+	// Connection.NoAtime and skip writing them. Explicit changes, e.g. with
+	// utimensat(2), still arrive as SetInodeAttributesOp with Atime set.
+	NoAtime bool
+
+	// Allow users other than the one that mounted the file system to access it.
+	// By default even root is turned away. Unless the file system is mounted
+	// by root, Linux requires user_allow_other to be set in /etc/fuse.conf for
+	// this, and Mount fails with ErrAllowOtherNotPermitted otherwise.
+	//
+	// May not be combined with AllowRoot.
+	AllowOther bool
+
+	// Like AllowOther, but allow access only by root in addition to the user
+	// that mounted the file system.
+	//
+	// The Linux and FreeBSD kernels know only allow_other, so there the file
+	// system is mounted with that option (and on Linux the same /etc/fuse.conf
+	// requirement), and requests from other users are refused with EACCES
+	// before they reach the server. As with libfuse, requests on handles that
+	// have already been opened are exempt.
+	//
+	// May not be combined with AllowOther.
+	AllowRoot bool
+
 	// A logger to use for logging errors. All errors are logged, with the
 	// exception of a few blacklisted errors that are expected. If nil, no error
 	// logging is performed.
@@ -45,8 +94,37 @@ type MountConfig struct {
 
 	// A logger to use for logging debug information. If nil, no debug logging is
 	// performed.
+	//
+	// Each op is logged when it is read and again when it is replied to, both
+	// times with the unique ID the kernel gave it so that the two lines can be
+	// matched up. The second line includes the time from reading the op to
+	// writing the last byte of the reply.
 	DebugLogger *log.Logger
 
+	// Interceptors to invoke around the handling of each op, outermost first.
+	// See Interceptor and Connection.Dispatch.
+	Interceptors []Interceptor
+
+	// Keep a tally of the kernel's lookup count for each inode (cf.
+	// ForgetInodeOp), as an aid to debugging file systems whose own counts
+	// drift from it, with Connection.LookupCount to query it. A forget of more
+	// than the tally, i.e. of an inode that the kernel was never given or has
+	// already forgotten, is logged to ErrorLogger when it is replied to. So is
+	// each inode that is still counted when the connection is closed, although
+	// that may be legitimate: the kernel need not forget every inode before it
+	// hangs up, leaving the file system to treat them as forgotten.
+	TrackLookupCounts bool
+
+	// Hand out runs of ForgetInodeOps from the kernel as a single
+	// BatchForgetOp, for file systems that take a lock per forget. A run is
+	// handed out at most a few milliseconds after its first forget, whether or
+	// not anything else arrives, or sooner once it reaches a thousand or so
+	// inodes or any other message arrives, so ops still reach the file system
+	// in the order the kernel sent them. Forgets of the same inode are merged
+	// into one entry with the sum of their counts, so the total dropped for
+	// each inode is exactly what the kernel dropped.
+	CoalesceForgets bool
+
 	// Linux only. OS X always behaves as if writeback caching is disabled.
 	//
 	// By default on Linux we allow the kernel to perform writeback caching
@@ -136,7 +214,9 @@ type MountConfig struct {
 	// This is not enabled by default because the old behavior masked a bug:
 	// file systems could return any size in the inode attributes of
 	// symlinks. After enabling caching, the specified size caps the symlink
-	// target.
+	// target, so the attributes of a symlink must carry the exact length of its
+	// target in Size. Targets longer than the size last reported are logged to
+	// ErrorLogger, since the kernel caches them truncated.
 	EnableSymlinkCaching bool
 
 	// Linux only.
@@ -151,9 +231,47 @@ type MountConfig struct {
 	// OpenDir calls at all (Linux >= 5.1):
 	EnableNoOpendirSupport bool
 
+	// If non-nil, the owner and group reported for every inode, in place of
+	// InodeAttributes.Uid and InodeAttributes.Gid as returned by the file
+	// system. This is applied wherever attributes are sent to the kernel, so
+	// that individual file systems need not fake ownership themselves.
+	OverrideUID *uint32
+	OverrideGID *uint32
+
+	// If set, OverrideUID and OverrideGID (whichever are non-nil) also replace
+	// the credentials of the calling process reported in each op's OpContext,
+	// so that the file system sees every request as coming from that user.
+	OverrideCallerIDs bool
+
+	// The error with which ops arriving during Connection.Drain are answered,
+	// typically EAGAIN or EBUSY. If zero, EAGAIN is used.
+	DrainRejectErrno syscall.Errno
+
+	// If set, called with the opcode of each request from the kernel that this
+	// package doesn't understand, such as those for features newer than it,
+	// and the request is answered with the error returned. Zero means ENOSYS,
+	// since there is no telling what a successful reply should contain. It is
+	// called on the goroutine reading ops, so it should be quick. By default,
+	// such requests go to the server, and servers created by package fuseutil
+	// answer them with ENOSYS.
+	OnUnknownOp func(opcode uint32) syscall.Errno
+
 	// Disable FUSE default permissions.
 	// This is useful for situations where the backing data store (e.g., S3) doesn't
 	// actually utilise any form of qualifiable UNIX permissions.
+	//
+	// By default the kernel checks every access against the Mode, Uid and Gid
+	// in InodeAttributes before sending an op, including search permission on
+	// each directory traversed. With this set it checks nothing, for files and
+	// directories alike: mode bits are only displayed, and any access control
+	// is up to the file system, using the caller's credentials in each op's
+	// OpContext (see also fuseutil.CheckSticky). The kernel still refuses to
+	// execute files without an execute bit. Because this is a single mount
+	// option, it cannot be applied to some inodes but not others.
+	//
+	// If ErrorLogger is set, a warning is logged the first time the file system
+	// reports permission bits that restrict access, since they then have no
+	// effect unless the file system enforces them.
 	DisableDefaultPermissions bool
 
 	// Use vectored reads.
@@ -163,6 +281,14 @@ type MountConfig struct {
 	// being read from the file as a list of slices in ReadFileOp.Data.
 	UseVectoredRead bool
 
+	// With UseVectoredRead, give each open file handle a read buffer that is
+	// reused across its reads and passed in ReadFileOp.Buffer, saving file
+	// systems that copy data into a fresh buffer for every read (e.g. when
+	// serving large sequential reads) an allocation each time. The buffer is
+	// freed when the handle is released. Like the reuse of request buffers,
+	// this is turned off by DisableRequestBufferReuse.
+	HandleReadBuffers bool
+
 	// OS X only.
 	//
 	// The name of the mounted volume, as displayed in the Finder. If empty, a
@@ -178,7 +304,8 @@ type MountConfig struct {
 	Options map[string]string
 
 	// Sets the filesystem type (third field in /etc/mtab). /etc/mtab and
-	// /proc/mounts will show the filesystem type as fuse.<Subtype>.
+	// /proc/mounts will show the filesystem type as fuse.<Subtype>, with FSName
+	// as the source, whether or not fusermount(1) is used to mount.
 	// If not set, /proc/mounts will show the filesystem type as fuse/fuseblk.
 	Subtype string
 
@@ -190,6 +317,299 @@ type MountConfig struct {
 	// kernel
 	// Ref: https://github.com/torvalds/linux/commit/5c672ab3f0ee0f78f7acad183f34db0f8781a200
 	EnableParallelDirOps bool
+
+	// Ask the kernel to list directories with ReadDirPlusOp, which returns the
+	// attributes of each entry along with its name, saving a lookup per entry
+	// for callers like `ls -l`. The kernel may still send ReadDirOp, so the file
+	// system must implement both. Linux only.
+	EnableReaddirplus bool
+
+	// Linux only, 6.6 and later. Allow shared writable mmap of files opened with
+	// OpenFileOp.UseDirectIO, which the kernel otherwise refuses. The capability
+	// is negotiated through the flags2 field of INIT, so it also needs a kernel
+	// speaking protocol 7.36 or later.
+	EnableDirectIOAllowMmap bool
+
+	// Linux only. Tell the kernel that the file system can be exported over
+	// NFS, by finding inodes without going through the kernel's dentry cache.
+	// The kernel then builds NFS file handles from inode IDs and generation
+	// numbers, and resolves them with LookUpInodeOp for the names "." and ".."
+	// (see its Name field), even after it has forgotten the inode. The file
+	// system must therefore be able to look up any inode ID it has handed out,
+	// and must change the generation number whenever it reuses an ID (see
+	// fuseops.GenerationNumber), or stale file handles could reach the wrong
+	// file.
+	EnableExport bool
+
+	// Have the kernel pass O_TRUNC on to OpenFileOp, for the file system to
+	// truncate the file as part of opening it, rather than following the open
+	// with a SetInodeAttributesOp setting the size to zero. Whether the kernel
+	// agreed is reported by Connection.Capabilities as CapAtomicTrunc, and it
+	// is what decides which of the two the file system will see.
+	EnableAtomicTrunc bool
+
+	// Send fcntl(2) record lock requests to the file system as GetFileLockOp
+	// and SetFileLockOp, so that it can implement locks that are shared with
+	// other machines. By default the kernel implements them itself.
+	EnablePosixLocks bool
+
+	// Like EnablePosixLocks, but for flock(2) locks, which are sent as
+	// SetFileLockOp with Flock set. Linux only.
+	EnableFlockLocks bool
+
+	// The resolution of the timestamps the file system can persist. If
+	// positive, the atime, mtime, ctime and crtime in every attribute reply are
+	// rounded down to a multiple of it since the Unix epoch, so that the kernel
+	// never sees a precision the file system can't reproduce later (which
+	// confuses tools like make that compare mtimes). Zero means nanoseconds.
+	//
+	// The resolution is also advertised to the kernel as the time granularity
+	// of the mount, capped at one second, so that timestamps the kernel sets
+	// itself (e.g. with writeback caching) are truncated the same way.
+	// Resolutions coarser than a second (like FAT's two seconds) can't be
+	// expressed there, so the kernel may hold finer timestamps than the file
+	// system returns until it next fetches attributes.
+	TimestampResolution time.Duration
+
+	// Linux 6.9 and later. Negotiate FUSE passthrough, which lets the file
+	// system hand the kernel a backing file for an open handle (see
+	// Connection.OpenBackingFd and OpenFileOp.BackingID) so that reads and
+	// writes go straight to it. Registering backing files requires
+	// CAP_SYS_ADMIN. The kernel doesn't support passthrough together with
+	// writeback caching, so DisableWritebackCaching must also be set.
+	EnablePassthrough bool
+
+	// Linux only. Negotiate FUSE_SPLICE_WRITE, and send the data for reads
+	// that set fuseops.ReadFileOp.SpliceFile by splicing it from the file to
+	// the kernel through a pipe. The data then goes by reference to the file's
+	// pages and is copied once, by the kernel into the request, rather than
+	// being read into a buffer here and copied again on its way to the kernel.
+	// That roughly halves the memory bandwidth used per byte read, which shows
+	// mostly as less CPU time at high throughput; disks slower than memory
+	// don't get faster. Whether the kernel agreed is reported by
+	// Connection.Capabilities as CapSpliceWrite.
+	//
+	// Requests are still read from the kernel by copying (FUSE_SPLICE_READ
+	// isn't used), so writes don't benefit. Replies whose data doesn't fit in
+	// a pipe, as limited by /proc/sys/fs/pipe-max-size for unprivileged users,
+	// are copied as usual.
+	EnableSplice bool
+
+	// Ask the kernel not to apply the umask of the calling process to the mode
+	// of new files, directories and nodes, leaving it to the file system. The
+	// Mode of CreateFileOp, MkDirOp and MkNodeOp is then the mode requested by
+	// the caller, and the file system should clear the bits in their Umask.
+	// Linux only.
+	DontMask bool
+
+	// How long the kernel may cache name lookups and inode attributes returned
+	// by ops that leave ChildInodeEntry.EntryExpiration or the various
+	// AttributesExpiration fields at the zero time. The default of zero means
+	// that such results are not cached at all. Ops can still turn caching off
+	// for a particular result by setting an expiration time that isn't in the
+	// future, such as time.Now().
+	DefaultEntryTimeout time.Duration
+	DefaultAttrTimeout  time.Duration
+
+	// If positive, how long the kernel may remember that a name doesn't exist
+	// when LookUpInodeOp fails with ENOENT, rather than asking again on every
+	// access to it. The failure is sent as a negative entry instead, as if the
+	// file system had returned one itself (see LookUpInodeOp.Entry). Zero means
+	// that ENOENT is passed on as is, so nothing is cached. Ignored on OS X.
+	NegativeEntryTimeout time.Duration
+
+	// Declare that the content of the file system never changes, as for a
+	// static dataset, so that the kernel may cache all of it indefinitely. This
+	// sets DefaultEntryTimeout, DefaultAttrTimeout and NegativeEntryTimeout to
+	// a year where they are zero and turns on EnableSymlinkCaching. It also has
+	// the kernel keep the page cache of files and the cached listings of
+	// directories across opens, as if every OpenFileOp set KeepPageCache and
+	// every OpenDirOp set CacheDir and KeepCache.
+	//
+	// This is unsafe for a file system whose content can change: processes
+	// would go on seeing stale names, attributes, data and listings, since the
+	// kernel has no reason to ask for them again.
+	ImmutableData bool
+
+	// Allocate a fresh buffer for every request read from the kernel, rather
+	// than reusing the buffers of requests that have been replied to. Slices
+	// of the request buffer, such as WriteFileOp.Data and SetXattrOp.Value,
+	// then stay intact after the reply, which protects file systems that
+	// mistakenly retain them, at the cost of more garbage. This also turns off
+	// HandleReadBuffers.
+	DisableRequestBufferReuse bool
+
+	// The most ops that Connection.ReadOp hands out before they are replied
+	// to. Once that many are outstanding, ReadOp waits for one to finish before
+	// returning another. Meanwhile it keeps reading, so that interrupts and
+	// forget ops get through, and holds back the other ops it reads; only once
+	// as many are held as the limit does it stop reading until a slot comes
+	// free, so that their buffers are bounded too. Forget ops are exempt, since
+	// the kernel doesn't wait for them, and interrupts are handled by ReadOp
+	// itself, with a held op being answered EINTR. Zero means no limit.
+	MaxConcurrentOps int
+
+	// If positive, the longest an op may go without a reply. Its context has
+	// this deadline, and once it passes the kernel is answered with ETIMEDOUT
+	// on the file system's behalf, so that the syscall waiting for the op
+	// returns even if the handler is stuck. The handler's reply, whenever it
+	// comes, is thrown away, and until then the op keeps its buffers and its
+	// slot under MaxConcurrentOps. Forget ops, which get no reply, have no
+	// deadline.
+	//
+	// The kernel doesn't learn of anything the handler did, so a handler that
+	// finishes a lookup or creates a file after the deadline must not count
+	// the inode as one the kernel has looked up (cf. ForgetInodeOp). Zero
+	// means no deadline.
+	OpDeadline time.Duration
+
+	// If positive, ops are handled by a fixed pool of this many goroutines
+	// rather than a goroutine each (see Connection.Go). The workers take ops in
+	// the order in which ReadOp returned them, but with more than one worker
+	// may finish them in any order. Forget ops still get a goroutine of their
+	// own, and interrupts are handled by ReadOp, which keeps reading while the
+	// workers are busy, so neither waits behind queued ops. A handler must not
+	// otherwise wait for another op to be handled, since that op may be queued
+	// behind it. Zero means a goroutine per op.
+	WorkerPoolSize int
+
+	// If positive, the longest Mount and MountContext wait for the mount helper
+	// and the INIT handshake with the kernel before giving up with an error
+	// wrapping context.DeadlineExceeded. The directory is then unmounted, once
+	// the helper has returned if it is stuck. Zero means no limit.
+	MountTimeout time.Duration
+
+	// Create the mount point with MountpointMode (0755 if zero, before the
+	// umask) if it doesn't exist; its parent must. A mount point created this
+	// way is removed again once the file system has been unmounted, or if
+	// mounting fails, but one that already existed is left alone. With this
+	// set, an existing mount point must be empty, rather than having its
+	// contents hidden by the file system.
+	CreateMountpoint bool
+	MountpointMode   os.FileMode
+
+	// The most the kernel may read ahead of a process reading a file
+	// sequentially, in bytes, as a cap on what it would otherwise choose. Zero
+	// means 1 MiB, and a negative value turns readahead off, so that reads are
+	// only sent for what processes ask for (rounded up to whole pages).
+	//
+	// Readahead can't be configured per file, but files opened with
+	// OpenFileOp.UseDirectIO bypass the page cache and so are never read ahead,
+	// at the cost of every read(2) being sent to the file system and mmap(2)
+	// not working (see EnableDirectIOAllowMmap). OpenFileOp.KeepPageCache has
+	// no effect on readahead: it only decides whether pages that were already
+	// read survive the file being opened again.
+	MaxReadahead int
+
+	// Linux only. The most pages of data that a single read or write may carry,
+	// which also bounds the buffers that requests are read into. Zero means 256
+	// pages with writes of at most 1 MiB. Linux allows at most 256 pages
+	// unless the fs.fuse.max_pages_limit sysctl (Linux 6.13 and later) says
+	// otherwise, and limits larger values to that.
+	//
+	// Before Linux 4.20 the number of pages can't be negotiated, and requests
+	// carry at most 32 pages (128 KiB on most machines) whatever this says, so
+	// request buffers are made no bigger than that either.
+	MaxPages int
+
+	// Linux only. Have the kernel enforce POSIX access control lists, which it
+	// stores as the system.posix_acl_access and system.posix_acl_default
+	// extended attributes through GetXattrOp and SetXattrOp. The kernel then
+	// checks permissions itself as with the default permissions (so this can't
+	// be combined with DisableDefaultPermissions), and when an access ACL that
+	// is equivalent to plain mode bits is set, it changes the mode with
+	// SetInodeAttributesOp and removes the attribute instead.
+	//
+	// Without this, the kernel refuses to get or set ACLs, rather than passing
+	// the attributes through.
+	EnablePosixACL bool
+
+	// Linux only, 5.11 and later. Leave clearing the setuid and setgid bits of
+	// files to the file system, as POSIX requires when someone without
+	// CAP_FSETID writes to or truncates them. The kernel then asks for it with
+	// WriteFileOp.KillSuidgid and SetInodeAttributesOp.KillSuidgid, and the
+	// file system is also expected to clear the bits when a file's owner or
+	// group is changed, and to drop any security.capability attribute along
+	// with them. Without this, the kernel clears the bits itself with a
+	// SetInodeAttributesOp before writing, which is racy for file systems that
+	// are shared with other machines.
+	HandleKillPriv bool
+
+	// If set, called once the server has stopped because the kernel aborted
+	// the connection while the file system was still mounted, just before Join
+	// returns ErrConnectionLost. Useful for remounting: see ErrConnectionLost.
+	OnConnectionLost func()
+
+	// If set, called with the protocol version and INIT flags offered by the
+	// kernel, before they are negotiated and before any other op is read. The
+	// flags are the bits that the Cap* constants name, including those the
+	// kernel supports but the package won't ask for. Returning an error
+	// refuses the INIT request and fails Mount with that error, e.g. to insist
+	// on a minimum kernel version.
+	OnInit func(kernelMajor, kernelMinor uint32, kernelFlags uint64) error
+}
+
+// Check for settings that can't be used together.
+func (c *MountConfig) validate() error {
+	if c.AllowOther && c.AllowRoot {
+		return errors.New("AllowOther and AllowRoot are mutually exclusive")
+	}
+
+	if c.EnablePassthrough && !c.DisableWritebackCaching {
+		return errors.New("EnablePassthrough requires DisableWritebackCaching")
+	}
+
+	if c.DefaultEntryTimeout < 0 || c.DefaultAttrTimeout < 0 ||
+		c.NegativeEntryTimeout < 0 {
+		return errors.New("Cache timeouts must not be negative")
+	}
+
+	if c.MaxConcurrentOps < 0 {
+		return errors.New("MaxConcurrentOps must not be negative")
+	}
+
+	if c.WorkerPoolSize < 0 {
+		return errors.New("WorkerPoolSize must not be negative")
+	}
+
+	if c.EnablePosixACL && c.DisableDefaultPermissions {
+		return errors.New("EnablePosixACL requires the default permissions")
+	}
+
+	if c.MountTimeout < 0 {
+		return errors.New("MountTimeout must not be negative")
+	}
+
+	if int64(c.MaxReadahead) > math.MaxUint32 {
+		return errors.New("MaxReadahead is too large")
+	}
+
+	return nil
+}
+
+// How long the kernel may cache everything with ImmutableData.
+const immutableDataTimeout = 365 * 24 * time.Hour
+
+// Fill in the settings that ImmutableData implies, leaving timeouts that were
+// set explicitly alone.
+func (c *MountConfig) applyImmutableData() {
+	if !c.ImmutableData {
+		return
+	}
+
+	if c.DefaultEntryTimeout == 0 {
+		c.DefaultEntryTimeout = immutableDataTimeout
+	}
+
+	if c.DefaultAttrTimeout == 0 {
+		c.DefaultAttrTimeout = immutableDataTimeout
+	}
+
+	if c.NegativeEntryTimeout == 0 {
+		c.NegativeEntryTimeout = immutableDataTimeout
+	}
+
+	c.EnableSymlinkCaching = true
 }
 
 // Create a map containing all of the key=value mount options to be given to
@@ -233,6 +653,23 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 		opts["ro"] = ""
 	}
 
+	// Access times?
+	if c.NoAtime {
+		opts["noatime"] = ""
+	}
+
+	// Access by other users?
+	switch {
+	case c.AllowOther:
+		opts["allow_other"] = ""
+
+	case c.AllowRoot && (runtime.GOOS == "linux" || runtime.GOOS == "freebsd"):
+		opts["allow_other"] = ""
+
+	case c.AllowRoot:
+		opts["allow_root"] = ""
+	}
+
 	// Handle OS X options.
 	if isDarwin {
 		if !c.EnableVnodeCaching {
@@ -269,9 +706,18 @@ func escapeOptionsKey(s string) (res string) {
 	return res
 }
 
+// Join the supplied options into a comma-separated string, sorted by key so
+// that the result is stable.
 func mapToOptionsString(opts map[string]string) string {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	var components []string
-	for k, v := range opts {
+	for _, k := range keys {
+		v := opts[k]
 		k = escapeOptionsKey(k)
 
 		component := k
@@ -289,3 +735,11 @@ func mapToOptionsString(opts map[string]string) string {
 func (c *MountConfig) toOptionsString() string {
 	return mapToOptionsString(c.toMap())
 }
+
+// OptionsString returns the comma-separated options that Mount would pass to
+// the mount helper for this config, including defaults such as
+// default_permissions that the package adds itself. It is intended for
+// debugging mounts that are rejected.
+func (c *MountConfig) OptionsString() string {
+	return c.toOptionsString()
+}
@@ -182,11 +182,7 @@ func callMount(
 	go func() {
 		err := cmd.Wait()
 		if err != nil {
-			if buf.Len() > 0 {
-				output := buf.Bytes()
-				output = bytes.TrimRight(output, "\n")
-				err = fmt.Errorf("%v: %s", err, output)
-			}
+			err = mountError(err, buf.String())
 		}
 
 		ready <- err
@@ -0,0 +1,86 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// The mount helper for fusefs(5).
+const mountFusefs = "/sbin/mount_fusefs"
+
+// Begin the process of mounting at the given directory, returning a connection
+// to the kernel. Mounting continues in the background, and is complete when an
+// error is written to the supplied channel. The file system may need to
+// service the connection in order for mounting to complete.
+func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
+	// As on Linux, /dev/fd/N is an already open FUSE channel.
+	if fd, err := parseFuseFd(dir); err == nil {
+		ready <- nil
+		return os.NewFile(uintptr(fd), "/dev/fuse"), nil
+	}
+
+	// The mount helper doesn't understand any escaping.
+	opts := cfg.toMap()
+	for k, v := range opts {
+		if strings.Contains(k, ",") || strings.Contains(v, ",") {
+			return nil, fmt.Errorf(
+				"mount options cannot contain commas on FreeBSD: %q=%q",
+				k,
+				v)
+		}
+	}
+
+	// Unlike Linux, FreeBSD doesn't limit direct I/O reads to the size of its
+	// buffers, so tell it how large ours are.
+	opts["max_read"] = strconv.Itoa(buffer.MaxReadSize)
+
+	if cfg.DebugLogger != nil {
+		cfg.DebugLogger.Println("Opening /dev/fuse")
+	}
+
+	// Open the device in blocking mode, for the same reason as on Linux.
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening /dev/fuse: %v", err)
+	}
+	dev := os.NewFile(uintptr(fd), "/dev/fuse")
+
+	// Call the mount helper, passing in the device as file descriptor 3 and
+	// saving output into a buffer.
+	cmd := exec.Command(
+		mountFusefs,
+		"-o", mapToOptionsString(opts),
+		"3",
+		dir,
+	)
+	cmd.ExtraFiles = []*os.File{dev}
+
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+
+	if err := cmd.Start(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("running %v: %v", mountFusefs, err)
+	}
+
+	// In the background, wait for the command to complete. The kernel may want
+	// INIT answered first.
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			err = mountError(err, buf.String())
+		}
+
+		ready <- err
+	}()
+
+	return dev, nil
+}
@@ -5,8 +5,6 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strconv"
-	"strings"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -54,6 +52,39 @@ var mountflagopts = map[string]func(uintptr) uintptr{
 
 var errFallback = errors.New("sentinel: fallback to fusermount(1)")
 
+// Split the supplied mount options into the arguments to mount(2), the way
+// fusermount(1) does: fsname becomes the source and subtype is appended to the
+// file system type, so that /proc/mounts shows "<fsname> <dir> fuse.<subtype>",
+// while flags such as ro become mount flags. The remaining options are returned
+// in the form expected by the kernel.
+func directmountArgs(
+	opts map[string]string) (source, fstype string, mountflag uintptr, data string) {
+	// As per libfuse/fusermount.c:749: https://bit.ly/2SgtWYM#L749
+	mountflag = uintptr(unix.MS_NODEV | unix.MS_NOSUID)
+
+	rest := make(map[string]string)
+	for k, v := range opts {
+		if fn, ok := mountflagopts[k]; ok {
+			mountflag = fn(mountflag)
+			continue
+		}
+
+		rest[k] = v
+	}
+
+	source = rest["fsname"]
+	delete(rest, "fsname")
+
+	fstype = "fuse"
+	if subtype := rest["subtype"]; subtype != "" {
+		fstype += "." + subtype
+	}
+	delete(rest, "subtype")
+
+	data = mapToOptionsString(rest)
+	return
+}
+
 func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	if cfg.DebugLogger != nil {
 		cfg.DebugLogger.Println("Preparing for direct mounting")
@@ -71,42 +102,28 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 		cfg.DebugLogger.Println("Successfully opened the /dev/fuse in blocking mode")
 	}
 	// As per libfuse/fusermount.c:847: https://bit.ly/2SgtWYM#L847
+	source, fstype, mountflag, opts := directmountArgs(cfg.toMap())
 	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d",
 		dev.Fd(), os.Getuid(), os.Getgid())
-	// As per libfuse/fusermount.c:749: https://bit.ly/2SgtWYM#L749
-	mountflag := uintptr(unix.MS_NODEV | unix.MS_NOSUID)
-	opts := cfg.toMap()
-	for k := range opts {
-		fn, ok := mountflagopts[k]
-		if !ok {
-			continue
-		}
-		mountflag = fn(mountflag)
-		delete(opts, k)
+	if opts != "" {
+		data += "," + opts
 	}
-	delete(opts, "fsname") // handled via fstype mount(2) parameter
-	fstype := "fuse"
-	if subtype, ok := opts["subtype"]; ok {
-		fstype += "." + subtype
-	}
-	delete(opts, "subtype")
-	data += "," + mapToOptionsString(opts)
 
 	if cfg.DebugLogger != nil {
 		cfg.DebugLogger.Println("Starting the unix mounting")
 	}
 	if err := unix.Mount(
-		cfg.FSName, // source
-		dir,        // target
-		fstype,     // fstype
-		mountflag,  // mountflag
-		data,       // data
+		source,    // source
+		dir,       // target
+		fstype,    // fstype
+		mountflag, // mountflag
+		data,      // data
 	); err != nil {
 		if err == syscall.EPERM {
 			return nil, errFallback
 
 		}
-		return nil, err
+		return nil, mountError(err, "")
 	}
 	if cfg.DebugLogger != nil {
 		cfg.DebugLogger.Println("Unix mounting completed successfully")
@@ -153,16 +170,3 @@ func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 	}
 	return dev, err
 }
-
-func parseFuseFd(dir string) (int, error) {
-	if !strings.HasPrefix(dir, "/dev/fd/") {
-		return -1, fmt.Errorf("not a /dev/fd path")
-	}
-
-	fd, err := strconv.ParseUint(strings.TrimPrefix(dir, "/dev/fd/"), 10, 32)
-	if err != nil {
-		return -1, fmt.Errorf("invalid /dev/fd/N path: N must be a positive integer")
-	}
-
-	return int(fd), nil
-}
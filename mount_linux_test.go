@@ -1,7 +1,15 @@
 package fuse
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func Test_parseFuseFd(t *testing.T) {
@@ -35,3 +43,225 @@ func Test_parseFuseFd(t *testing.T) {
 		}
 	})
 }
+
+// A server that does nothing.
+type nopServer struct{}
+
+func (nopServer) ServeOps(*Connection) {}
+
+func TestMountTimeout(t *testing.T) {
+	// A "kernel" that never sends INIT.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+	defer syscall.Close(fds[0])
+
+	const timeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err = Mount(
+		fmt.Sprintf("/dev/fd/%d", fds[1]),
+		nopServer{},
+		&MountConfig{MountTimeout: timeout})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Mount: got %v, want a deadline error", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*timeout {
+		t.Errorf("Mount took %v to time out", elapsed)
+	}
+}
+
+func TestMountContextCancelled(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+	defer syscall.Close(fds[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err = MountContext(
+		ctx,
+		fmt.Sprintf("/dev/fd/%d", fds[1]),
+		nopServer{},
+		&MountConfig{})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("MountContext: got %v, want a cancellation error", err)
+	}
+}
+
+func TestConnectionAborted(t *testing.T) {
+	// Without a FUSE mount we can't abort a connection, but we can check that
+	// hanging up on an ordinary directory or file descriptor doesn't count.
+	for _, dir := range []string{t.TempDir(), "/dev/fd/3"} {
+		if connectionAborted(dir) {
+			t.Errorf("connectionAborted(%q) returned true", dir)
+		}
+	}
+}
+
+func TestDirectmountArgs(t *testing.T) {
+	cfg := &MountConfig{
+		FSName:   "myfs",
+		Subtype:  "mytype",
+		ReadOnly: true,
+		Options:  map[string]string{"max_read": "4096"},
+	}
+
+	source, fstype, mountflag, data := directmountArgs(cfg.toMap())
+	if source != "myfs" {
+		t.Errorf("source = %q, want %q", source, "myfs")
+	}
+
+	if fstype != "fuse.mytype" {
+		t.Errorf("fstype = %q, want %q", fstype, "fuse.mytype")
+	}
+
+	if mountflag&syscall.MS_RDONLY == 0 {
+		t.Errorf("mountflag = %#x, want MS_RDONLY", mountflag)
+	}
+
+	// The data must contain only options the kernel understands, in any order.
+	got := make(map[string]bool)
+	for _, opt := range strings.Split(data, ",") {
+		got[opt] = true
+	}
+
+	want := map[string]bool{
+		"default_permissions": true,
+		"max_read=4096":       true,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("data = %q, want options %v", data, want)
+	}
+}
+
+func TestDirectmountArgsDefaultFSName(t *testing.T) {
+	source, fstype, _, _ := directmountArgs((&MountConfig{}).toMap())
+	if source != "some_fuse_file_system" {
+		t.Errorf("source = %q, want the default fsname", source)
+	}
+
+	if fstype != "fuse" {
+		t.Errorf("fstype = %q, want %q", fstype, "fuse")
+	}
+}
+
+func TestNoAtime(t *testing.T) {
+	cfg := &MountConfig{NoAtime: true}
+
+	_, _, mountflag, data := directmountArgs(cfg.toMap())
+	if mountflag&syscall.MS_NOATIME == 0 {
+		t.Errorf("mountflag = %#x, want MS_NOATIME", mountflag)
+	}
+
+	if strings.Contains(data, "atime") {
+		t.Errorf("data = %q, want no atime options", data)
+	}
+
+	// Either way of asking for it is reported by the connection.
+	for _, cfg := range []MountConfig{
+		{NoAtime: true},
+		{Options: map[string]string{"noatime": ""}},
+	} {
+		c := &Connection{cfg: cfg}
+		if !c.NoAtime() {
+			t.Errorf("NoAtime() with %+v returned false", cfg)
+		}
+	}
+
+	if c := (&Connection{}); c.NoAtime() {
+		t.Errorf("NoAtime() returned true by default")
+	}
+}
+
+func TestOptionsString(t *testing.T) {
+	cfg := &MountConfig{
+		FSName:     "myfs",
+		Subtype:    "mytype",
+		ReadOnly:   true,
+		AllowOther: true,
+		Options:    map[string]string{"max_read": "4096"},
+	}
+
+	const want = "allow_other,default_permissions,fsname=myfs,max_read=4096,ro,subtype=mytype"
+	if got := cfg.OptionsString(); got != want {
+		t.Errorf("OptionsString() = %q, want %q", got, want)
+	}
+}
+
+func TestFindConnectionID(t *testing.T) {
+	const mountinfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 0:41 / /tmp/foo rw,nosuid,nodev - fuse.foofs foofs rw,user_id=0
+41 22 0:42 / /tmp/with\040space rw,nosuid,nodev - fuse somefs rw,user_id=0
+42 22 0:43 / /tmp/bar rw - tmpfs tmpfs rw
+43 40 0:44 / /tmp/foo rw,nosuid,nodev - fuse.foofs foofs rw,user_id=0
+`
+
+	testCases := []struct {
+		dir     string
+		want    uint64
+		wantErr bool
+	}{
+		// The most recent of the stacked mounts wins.
+		{dir: "/tmp/foo", want: 44},
+		{dir: "/tmp/with space", want: 42},
+		{dir: "/tmp/bar", wantErr: true},
+		{dir: "/tmp/baz", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		got, err := findConnectionID(strings.NewReader(mountinfo), tc.dir)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("%s: got ID %d, want an error", tc.dir, got)
+
+		case !tc.wantErr && err != nil:
+			t.Errorf("%s: %v", tc.dir, err)
+
+		case got != tc.want:
+			t.Errorf("%s: got ID %d, want %d", tc.dir, got, tc.want)
+		}
+	}
+}
+
+func TestMountError(t *testing.T) {
+	exitErr := errors.New("exit status 1")
+	testCases := []struct {
+		err    error
+		output string
+		want   error
+	}{
+		{exitErr, "fusermount3: mount failed: Device or resource busy\n", ErrMountpointBusy},
+		{syscall.EBUSY, "", ErrMountpointBusy},
+		{exitErr, "fusermount3: failed to open /dev/fuse: Permission denied\n", os.ErrPermission},
+		{exitErr, "fusermount3: user has no write access to mountpoint /mnt\n", os.ErrPermission},
+		{syscall.EACCES, "", os.ErrPermission},
+		{exitErr, "fusermount3: failed to access mountpoint /mnt: No such file or directory\n", os.ErrNotExist},
+		{exitErr, "fusermount3: option allow_other only allowed if 'user_allow_other' is set in /etc/fuse.conf\n", ErrAllowOtherNotPermitted},
+	}
+
+	for _, tc := range testCases {
+		err := mountError(tc.err, tc.output)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%v, %q: got %v, which isn't %v", tc.err, tc.output, err, tc.want)
+		}
+
+		if !errors.Is(err, tc.err) || !strings.Contains(err.Error(), strings.TrimSpace(tc.output)) {
+			t.Errorf("%v, %q: got %v, which loses the original", tc.err, tc.output, err)
+		}
+	}
+
+	// Anything else is left as it was, apart from the output.
+	err := mountError(exitErr, "fusermount3: something else\n")
+	for _, kind := range []error{ErrMountpointBusy, os.ErrPermission, os.ErrNotExist} {
+		if errors.Is(err, kind) {
+			t.Errorf("Got %v, which is %v", err, kind)
+		}
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -29,6 +31,86 @@ func (fs *minimalFS) StatFS(
 	return nil
 }
 
+////////////////////////////////////////////////////////////////////////
+// createFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose root is empty until a file is created in it, which
+// counts the ops that would show the kernel asking about the file again.
+type createFS struct {
+	minimalFS
+
+	mu       sync.Mutex
+	created  bool // GUARDED_BY(mu)
+	lookUps  int  // GUARDED_BY(mu)
+	getAttrs int  // GUARDED_BY(mu)
+}
+
+func (fs *createFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	if id == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0777 | os.ModeDir}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0666}
+}
+
+func (fs *createFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.created {
+		return fuse.ENOENT
+	}
+
+	fs.lookUps++
+	op.Entry = fuseops.ChildInodeEntry{
+		Child:      2,
+		Attributes: fs.attributes(2),
+	}
+
+	return nil
+}
+
+func (fs *createFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Inode != fuseops.RootInodeID {
+		fs.getAttrs++
+	}
+
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *createFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.created = true
+	op.Entry = fuseops.ChildInodeEntry{
+		Child:                2,
+		Attributes:           fs.attributes(2),
+		AttributesExpiration: time.Now().Add(time.Hour),
+		EntryExpiration:      time.Now().Add(time.Hour),
+	}
+
+	op.Handle = 1
+	return nil
+}
+
+func (fs *createFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Tests
 ////////////////////////////////////////////////////////////////////////
@@ -64,6 +146,102 @@ func TestSuccessfulMount(t *testing.T) {
 	defer fuse.Unmount(mfs.Dir())
 }
 
+func TestPingMountPoint(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&minimalFS{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// The mount point's statfs(2) should reach the server.
+	pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := mfs.Ping(pingCtx); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+}
+
+func TestCreateNeedsNoLookup(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount. With writeback caching the kernel fetches the attributes of a
+	// file again once it has been closed, so turn that off.
+	fs := &createFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{DisableWritebackCaching: true})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// The reply to CreateFileOp carries both the entry and the handle, so the
+	// kernel has everything it needs to stat the new file.
+	f, err := os.OpenFile(path.Join(dir, "foo"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	if _, err := f.Stat(); err != nil {
+		t.Errorf("Stat via handle: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "foo")); err != nil {
+		t.Errorf("Stat via path: %v", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.lookUps != 0 || fs.getAttrs != 0 {
+		t.Errorf("Got %d lookups and %d getattrs after creating", fs.lookUps, fs.getAttrs)
+	}
+}
+
 func TestNonexistentMountPoint(t *testing.T) {
 	ctx := context.Background()
 
@@ -93,3 +271,149 @@ func TestNonexistentMountPoint(t *testing.T) {
 		t.Errorf("Unexpected error: %v", got)
 	}
 }
+
+func TestCreateMountpoint(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cfg := &fuse.MountConfig{CreateMountpoint: true}
+	mount := func(dir string) (*fuse.MountedFileSystem, error) {
+		return fuse.Mount(dir, fuseutil.NewFileSystemServer(&minimalFS{}), cfg)
+	}
+
+	unmount := func(mfs *fuse.MountedFileSystem) {
+		if err := fuse.Unmount(mfs.Dir()); err != nil {
+			t.Fatalf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(ctx); err != nil {
+			t.Fatalf("Join: %v", err)
+		}
+	}
+
+	// A mount point that doesn't exist is created, and removed again.
+	created := path.Join(dir, "created")
+	mfs, err := mount(created)
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Statting the mount point would reach minimalFS, so look in its parent.
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("ReadDir: got %v, %v", entries, err)
+	}
+
+	unmount(mfs)
+
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("Mount point not removed: %v", err)
+	}
+
+	// One that exists is left alone.
+	existing := path.Join(dir, "existing")
+	if err := os.Mkdir(existing, 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	mfs, err = mount(existing)
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	unmount(mfs)
+
+	if _, err := os.Stat(existing); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+
+	// But it must be empty.
+	if err := ioutil.WriteFile(path.Join(existing, "foo"), nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	mfs, err = mount(existing)
+	if err == nil {
+		unmount(mfs)
+		t.Fatal("fuse.Mount returned nil")
+	}
+
+	const want = "not empty"
+	if got := err.Error(); !strings.Contains(got, want) {
+		t.Errorf("Unexpected error: %v", got)
+	}
+
+	if _, err := os.Stat(path.Join(existing, "foo")); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+}
+
+func TestAllowOtherAndAllowRoot(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// The two options can't be combined.
+	fs := &minimalFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			AllowOther: true,
+			AllowRoot:  true,
+		})
+
+	if err == nil {
+		fuse.Unmount(mfs.Dir())
+		mfs.Join(ctx)
+		t.Fatal("fuse.Mount returned nil")
+	}
+
+	const want = "mutually exclusive"
+	if got := err.Error(); !strings.Contains(got, want) {
+		t.Errorf("Unexpected error: %v", got)
+	}
+}
+
+func TestPassthroughRequiresNoWritebackCaching(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fs := &minimalFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			EnablePassthrough: true,
+		})
+
+	if err == nil {
+		fuse.Unmount(mfs.Dir())
+		mfs.Join(ctx)
+		t.Fatal("fuse.Mount returned nil")
+	}
+
+	const want = "DisableWritebackCaching"
+	if got := err.Error(); !strings.Contains(got, want) {
+		t.Errorf("Unexpected error: %v", got)
+	}
+}
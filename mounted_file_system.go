@@ -16,13 +16,24 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"syscall"
 )
 
+// ErrConnectionLost is returned by MountedFileSystem.Join when the kernel
+// aborted the connection while the file system was still mounted, for
+// example through /sys/fs/fuse/connections/N/abort. The mount point then
+// fails every access with ENOTCONN until it is unmounted with Unmount, after
+// which it is safe to mount a file system there again.
+var ErrConnectionLost = errors.New("connection to the kernel lost")
+
 // MountedFileSystem represents the status of a mount operation, with a method
 // that waits for unmounting.
 type MountedFileSystem struct {
-	dir string
+	dir  string
+	conn *Connection
 
 	// The result to return from Join. Not valid until the channel is closed.
 	joinStatus          error
@@ -35,13 +46,56 @@ func (mfs *MountedFileSystem) Dir() string {
 	return mfs.dir
 }
 
-// Join blocks until a mounted file system has been unmounted. It does not
-// return successfully until all ops read from the connection have been
-// responded to (i.e. the file system server has finished processing all
-// in-flight ops).
+// ConnectionID returns the ID that the kernel assigned to the fuse connection
+// for the file system. On Linux this is the name of the connection's directory
+// under /sys/fs/fuse/connections, through which it can be inspected or
+// aborted, and is derived from the device number of the mount point.
+//
+// Connection IDs are not available on other platforms, nor for file systems
+// mounted by someone else and handed over as /dev/fd/N, since the mount point
+// isn't known then.
+func (mfs *MountedFileSystem) ConnectionID() (uint64, error) {
+	return connectionID(mfs.dir)
+}
+
+// SetReadOnly makes the file system read-only, or writable again, without
+// unmounting it. While it is read-only, ops that would modify it (including
+// opening files for writing, AccessOp asking about write access, and ioctls
+// that only pass data in, such as chattr(1)'s) fail with EROFS before reaching
+// the server, but ops already in flight, such as writes, are allowed to
+// finish. Open handles stay open, so readers are undisturbed.
 //
-// The return value will be non-nil if anything unexpected happened while
-// serving. May be called multiple times.
+// Unlike remounting with the ro option, this doesn't stop the kernel from
+// trying: in particular dirty pages in the kernel's cache that are written
+// back while the file system is read-only are lost, so callers should sync
+// before flipping the switch (or use MountConfig.DisableWritebackCaching).
+//
+// A file system mounted with MountConfig.ReadOnly is read-only in the kernel
+// and can't be made writable this way.
+func (mfs *MountedFileSystem) SetReadOnly(ro bool) error {
+	if !ro && mfs.conn.cfg.ReadOnly {
+		return errors.New("mounted read-only; can't be made writable without remounting")
+	}
+
+	mfs.conn.setReadOnly(ro)
+	return nil
+}
+
+// Join blocks until a mounted file system has been unmounted, or until ctx is
+// done. It does not return successfully until all ops read from the
+// connection have been responded to (i.e. the file system server has finished
+// processing all in-flight ops). It returns:
+//
+//   - nil if the file system was unmounted and served without trouble.
+//
+//   - ctx.Err() if ctx was done first. The file system is unaffected: it stays
+//     mounted, or finishes unmounting, in the background. This lets a caller
+//     shutting down give up on in-flight ops that hold up the unmount.
+//
+//   - Any other error if something unexpected happened while serving, such as
+//     ErrConnectionLost.
+//
+// May be called multiple times.
 func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	select {
 	case <-mfs.joinStatusAvailable:
@@ -51,6 +105,47 @@ func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	}
 }
 
+// Ping checks that the file system is still being served, returning an error
+// if not, or ctx.Err() if that can't be determined before ctx is done. Unless
+// the file system was mounted by someone else and handed over as /dev/fd/N,
+// this involves calling statfs(2) on the mount point, which the kernel always
+// sends to the server as a StatFSOp, so that a server that is wedged (for
+// example on a dead backend) fails the check too. Any reply to that op counts,
+// even an error.
+//
+// If ctx is done first, the statfs(2) call is left to finish in the
+// background.
+func (mfs *MountedFileSystem) Ping(ctx context.Context) error {
+	select {
+	case <-mfs.joinStatusAvailable:
+		return errors.New("the file system is no longer being served")
+
+	default:
+	}
+
+	if strings.HasPrefix(mfs.dir, "/dev/fd") {
+		return nil
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		var st syscall.Statfs_t
+		result <- syscall.Statfs(mfs.dir, &st)
+	}()
+
+	select {
+	case err := <-result:
+		if errors.Is(err, syscall.ENOTCONN) {
+			return ErrConnectionLost
+		}
+
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // GetFuseContext implements the equiv. of FUSE-C fuse_get_context() and thus
 // returns the UID / GID / PID associated with all FUSE requests send by the kernel.
 // ctx parameter must be one of the context from the fuseops handlers (e.g.: CreateFile)
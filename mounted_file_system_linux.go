@@ -0,0 +1,138 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func connectionID(dir string) (uint64, error) {
+	if strings.HasPrefix(dir, "/dev/fd/") {
+		return 0, fmt.Errorf("connection ID unknown for externally mounted %s", dir)
+	}
+
+	// Don't stat the mount point itself: that would send GETATTR to the file
+	// system that we're serving, which may not implement it, or be wedged. Only
+	// the parent directory is resolved, to match the path the kernel reports.
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if parent, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		abs = filepath.Join(parent, filepath.Base(abs))
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return findConnectionID(f, abs)
+}
+
+// Find the connection ID of the fuse file system mounted on dir in the
+// supplied contents of /proc/self/mountinfo (cf. proc(5)).
+//
+// The kernel names the connection after the device number of the file
+// system's superblock. fuse uses anonymous devices, whose major number is
+// zero, so that's just the minor number.
+func findConnectionID(r io.Reader, dir string) (uint64, error) {
+	var id uint64
+	var found bool
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// For example:
+		//
+		//     36 35 0:42 / /mnt/foo rw,nosuid - fuse.foofs foofs rw,user_id=0
+		//
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+
+		if sep < 5 || sep+1 >= len(fields) {
+			continue
+		}
+
+		fstype := fields[sep+1]
+		if fstype != "fuse" && !strings.HasPrefix(fstype, "fuse.") {
+			continue
+		}
+
+		if unescapeMountinfo(fields[4]) != dir {
+			continue
+		}
+
+		dev := strings.SplitN(fields[2], ":", 2)
+		if len(dev) != 2 {
+			continue
+		}
+
+		minor, err := strconv.ParseUint(dev[1], 10, 32)
+		if err != nil {
+			continue
+		}
+
+		// Later entries are mounted on top of earlier ones.
+		id = minor
+		found = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("reading mountinfo: %v", err)
+	}
+
+	if !found {
+		return 0, fmt.Errorf("no fuse file system mounted on %s", dir)
+	}
+
+	return id, nil
+}
+
+// Undo the octal escaping of spaces, tabs, newlines and backslashes in paths
+// in /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
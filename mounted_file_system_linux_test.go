@@ -0,0 +1,187 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const connectionsDir = "/sys/fs/fuse/connections"
+
+////////////////////////////////////////////////////////////////////////
+// stuckFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose StatFS announces itself and then hangs, ignoring its
+// context, until released.
+type stuckFS struct {
+	minimalFS
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs *stuckFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fs.started <- struct{}{}
+	<-fs.release
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestConnectionID(t *testing.T) {
+	if _, err := os.Stat(connectionsDir); err != nil {
+		t.Skipf("fusectl not available: %v", err)
+	}
+
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mounted_file_system_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount, if we're allowed to.
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&minimalFS{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Skipf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// The ID should name a connection.
+	id, err := mfs.ConnectionID()
+	if err != nil {
+		t.Fatalf("ConnectionID: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(connectionsDir, fmt.Sprint(id), "waiting")); err != nil {
+		t.Errorf("No connection with ID %d: %v", id, err)
+	}
+}
+
+func TestLazyUnmount(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&minimalFS{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	if err := fuse.UnmountWith(dir, fuse.UnmountOptions{Lazy: true}); err != nil {
+		t.Fatalf("UnmountWith: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Errorf("Joining: %v", err)
+	}
+}
+
+func TestForceUnmount(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &stuckFS{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Wedge a statfs(2) call in the file system.
+	statfsErr := make(chan error, 1)
+	go func() {
+		var st syscall.Statfs_t
+		statfsErr <- syscall.Statfs(dir, &st)
+	}()
+
+	<-fs.started
+
+	// Forcing the unmount unsticks it.
+	if err := fuse.UnmountWith(dir, fuse.UnmountOptions{Force: true, Lazy: true}); err != nil {
+		t.Fatalf("UnmountWith: %v", err)
+	}
+
+	select {
+	case err := <-statfsErr:
+		if err == nil {
+			t.Errorf("statfs(2) succeeded")
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("statfs(2) still stuck")
+	}
+
+	// The server can't finish until the handler does.
+	close(fs.release)
+	if err := mfs.Join(ctx); err != nil {
+		t.Errorf("Joining: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// NotifyInvalEntry tells the kernel to forget the directory entry for the
+// supplied name within the supplied parent, so that the next access to it
+// results in a fresh LookUpInodeOp. Use it when an entry has changed behind
+// the kernel's back, e.g. because another machine renamed or removed it.
+//
+// The kernel returns ENOENT if it doesn't have the parent or the entry cached,
+// in which case there is nothing to invalidate.
+//
+// It may be called concurrently with op processing, but must not be called
+// from within an op on the parent directory (e.g. while handling a
+// LookUpInodeOp in it), since the kernel holds the directory's lock while
+// waiting for the reply.
+func (c *Connection) NotifyInvalEntry(parent fuseops.InodeID, name string) error {
+	_, err := c.notifyInvalEntry(nil, parent, name)
+	return err
+}
+
+// NotifyInvalEntries is like calling NotifyInvalEntry for each of the supplied
+// names, e.g. to resynchronize a directory after a bulk remote change, except
+// that the notifications are built in a single reused buffer rather than one
+// allocation each. They are still written one at a time, since the kernel
+// accepts a single notification per write to the device.
+//
+// Names that the kernel doesn't have cached don't stop the batch. If there are
+// any, the returned error joins an error for each, wrapping ENOENT. Any other
+// failure aborts the batch, and is joined to the errors for names seen so far.
+func (c *Connection) NotifyInvalEntries(
+	parent fuseops.InodeID,
+	names []string) error {
+	var buf []byte
+	var errs []error
+	for _, name := range names {
+		var err error
+		buf, err = c.notifyInvalEntry(buf, parent, name)
+		if err == nil {
+			continue
+		}
+
+		errs = append(errs, fmt.Errorf("%q: %w", name, err))
+		if !errors.Is(err, syscall.ENOENT) {
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Build an entry invalidation in buf, growing it if necessary, and send it to
+// the kernel. Return the buffer for reuse.
+func (c *Connection) notifyInvalEntry(
+	buf []byte,
+	parent fuseops.InodeID,
+	name string) ([]byte, error) {
+	const outSize = int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))
+
+	// The name is followed by a NUL byte.
+	n := buffer.OutMessageHeaderSize + outSize + len(name) + 1
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+
+	buf = buf[:n]
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	*h = fusekernel.OutHeader{
+		Len:   uint32(n),
+		Error: fusekernel.NotifyCodeInvalEntry,
+	}
+
+	out := (*fusekernel.NotifyInvalEntryOut)(
+		unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+	*out = fusekernel.NotifyInvalEntryOut{
+		Parent:  uint64(parent),
+		Namelen: uint32(len(name)),
+	}
+
+	copy(buf[buffer.OutMessageHeaderSize+outSize:], name)
+	buf[n-1] = 0
+
+	return buf, c.writeMessage(buf)
+}
+
+// Have the kernel drop what it concluded about the file's size from the reply
+// to a read that the file system marked as short (see
+// fuseops.ReadFileOp.ShortRead), along with the data from the end of the read
+// on. The kernel must lock the pages that it drops, which other reads may
+// hold until they are replied to, so the notification is sent in the
+// background rather than holding up this op's goroutine, which those replies
+// may be waiting for (e.g. with MountConfig.WorkerPoolSize).
+func (c *Connection) invalidateShortRead(op *fuseops.ReadFileOp) {
+	inode, off := op.Inode, op.Offset+int64(op.BytesRead)
+
+	c.notifications.Add(1)
+	go func() {
+		defer c.notifications.Done()
+
+		// ENOENT means that the kernel doesn't have the inode cached, so that
+		// there is nothing to drop.
+		err := c.notifyInvalInode(inode, off, 0)
+		if err != nil && !errors.Is(err, syscall.ENOENT) && c.errorLogger != nil {
+			c.errorLogger.Printf("Invalidating after short read of inode %v: %v", inode, err)
+		}
+	}()
+}
+
+// Have the kernel drop the negative entry that led it to send a create that
+// made something other than a regular file, so that the next lookup finds
+// what was made (see fuseops.CreateFileOp.Entry). The kernel holds the
+// parent's lock until the create's syscall returns, so this is sent in the
+// background.
+func (c *Connection) invalidateCreated(op *fuseops.CreateFileOp) {
+	parent, name := op.Parent, op.Name
+
+	c.notifications.Add(1)
+	go func() {
+		defer c.notifications.Done()
+
+		err := c.NotifyInvalEntry(parent, name)
+		if err != nil && !errors.Is(err, syscall.ENOENT) && c.errorLogger != nil {
+			c.errorLogger.Printf("Invalidating %q in inode %v after create: %v", name, parent, err)
+		}
+	}()
+}
+
+// Report whether op is a successful create whose entry is for something other
+// than a regular file.
+func createdNonRegular(op interface{}, opErr error) bool {
+	o, ok := op.(*fuseops.CreateFileOp)
+	return ok && opErr == nil && !o.Entry.Attributes.Mode.IsRegular()
+}
+
+// Tell the kernel to drop its cached attributes for the supplied inode, and
+// its cached data for the supplied range, which runs to the end of the file if
+// length is zero. A negative offset leaves the data alone.
+func (c *Connection) notifyInvalInode(
+	inode fuseops.InodeID,
+	offset int64,
+	length int64) error {
+	const outSize = int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))
+
+	buf := make([]byte, buffer.OutMessageHeaderSize+outSize)
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	*h = fusekernel.OutHeader{
+		Len:   uint32(len(buf)),
+		Error: fusekernel.NotifyCodeInvalInode,
+	}
+
+	out := (*fusekernel.NotifyInvalInodeOut)(
+		unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+	*out = fusekernel.NotifyInvalInodeOut{
+		Ino: uint64(inode),
+		Off: offset,
+		Len: length,
+	}
+
+	return c.writeMessage(buf)
+}
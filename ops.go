@@ -45,4 +45,6 @@ type initOp struct {
 	MaxBackground uint16
 	MaxWrite      uint32
 	MaxPages      uint16
+	TimeGran      uint32
+	MaxStackDepth uint32
 }
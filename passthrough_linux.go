@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+var errNoPassthrough = errors.New("Passthrough is not enabled on this connection")
+
+// OpenBackingFd registers the open file fd with the kernel as a backing file
+// for passthrough, returning an ID to put in OpenFileOp.BackingID. The kernel
+// takes its own reference to the file, so fd may be closed as soon as this
+// returns; the ID stays valid until passed to CloseBackingID, and may be used
+// for any number of opens in the meantime.
+//
+// Passthrough must have been negotiated with MountConfig.EnablePassthrough,
+// and the caller needs CAP_SYS_ADMIN.
+func (c *Connection) OpenBackingFd(fd int) (uint32, error) {
+	if !c.passthrough {
+		return 0, errNoPassthrough
+	}
+
+	m := fusekernel.BackingMap{Fd: int32(fd)}
+	id, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		c.dev.Fd(),
+		fusekernel.DevIocBackingOpen,
+		uintptr(unsafe.Pointer(&m)))
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return uint32(id), nil
+}
+
+// CloseBackingID unregisters a backing file ID returned by OpenBackingFd.
+// Handles already opened with it keep using the backing file until released.
+func (c *Connection) CloseBackingID(id uint32) error {
+	if !c.passthrough {
+		return errNoPassthrough
+	}
+
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		c.dev.Fd(),
+		fusekernel.DevIocBackingClose,
+		uintptr(unsafe.Pointer(&id)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
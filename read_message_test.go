@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A reader that fails with each of errs in turn, then reads a message made of
+// just a header.
+type flakyReader struct {
+	errs  []error
+	reads int
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	r.reads++
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return 0, err
+	}
+
+	h := fusekernel.InHeader{
+		Len:    uint32(unsafe.Sizeof(fusekernel.InHeader{})),
+		Opcode: fusekernel.OpStatfs,
+		Unique: 17,
+	}
+
+	return copy(p, unsafe.Slice((*byte)(unsafe.Pointer(&h)), unsafe.Sizeof(h))), nil
+}
+
+func TestReadInMessageRetries(t *testing.T) {
+	r := &flakyReader{
+		errs: []error{
+			&os.PathError{Op: "read", Path: "/dev/fuse", Err: syscall.EINTR},
+			&os.PathError{Op: "read", Path: "/dev/fuse", Err: syscall.EAGAIN},
+			&os.PathError{Op: "read", Path: "/dev/fuse", Err: syscall.ENOENT},
+			syscall.EINTR,
+		},
+	}
+
+	m := buffer.NewInMessage()
+	if err := readInMessage(m, r); err != nil {
+		t.Fatalf("readInMessage: %v", err)
+	}
+
+	if r.reads != 5 {
+		t.Errorf("Got %d reads, want 5", r.reads)
+	}
+
+	if got := m.Header().Unique; got != 17 {
+		t.Errorf("Got message %d, want 17", got)
+	}
+}
+
+func TestReadInMessageErrors(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want error
+	}{
+		{&os.PathError{Op: "read", Path: "/dev/fuse", Err: syscall.ENODEV}, io.EOF},
+		{os.ErrClosed, io.EOF},
+		{syscall.EIO, syscall.EIO},
+	}
+
+	for _, tc := range testCases {
+		r := &flakyReader{errs: []error{tc.err}}
+		err := readInMessage(buffer.NewInMessage(), r)
+		if err != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.err, err, tc.want)
+		}
+
+		if r.reads != 1 {
+			t.Errorf("%v: got %d reads, want 1", tc.err, r.reads)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// A message read from the kernel by readMessages, or the error with which
+// reading failed.
+type readResult struct {
+	m   *buffer.InMessage
+	err error
+}
+
+// Returned by nextMessage when, rather than a message, a slot under
+// MaxConcurrentOps has been taken for the first held op, or when the pending
+// forgets are due to be handed out.
+var (
+	errSlotTaken  = errors.New("sentinel: op slot taken")
+	errForgetsDue = errors.New("sentinel: forgets due")
+)
+
+// Report whether messages are read from the kernel by a goroutine of their
+// own, so that ReadOp can wait for a slot under MountConfig.MaxConcurrentOps,
+// or for the window of MountConfig.CoalesceForgets to end, while still
+// reading. The INIT handshake is always read directly, since request buffers
+// are only sized once it is done.
+func (c *Connection) readsInBackground() bool {
+	return (c.opSlots != nil || c.cfg.CoalesceForgets) && c.maxWrite != 0
+}
+
+// Read messages from the kernel and pass them to ReadOp until reading fails or
+// the connection is closed.
+func (c *Connection) readMessages() {
+	for {
+		m, err := c.readMessage()
+		select {
+		case c.incoming <- readResult{m, err}:
+
+		case <-c.closed:
+			if m != nil {
+				c.putInMessage(m)
+			}
+
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Wait for the next thing that ReadOp must deal with: the message read while a
+// batch of forgets was pending, if any, otherwise a new message from the
+// kernel, a slot for the first held op (errSlotTaken), or the end of the
+// window for coalescing forgets (errForgetsDue).
+func (c *Connection) nextMessage() (*buffer.InMessage, error) {
+	b := &c.forgets
+	switch {
+	case b.next != nil:
+		m := b.next
+		b.next = nil
+		return m, nil
+
+	case b.nextErr != nil:
+		err := b.nextErr
+		b.nextErr = nil
+		return nil, err
+	}
+
+	if !c.readsInBackground() {
+		return c.readMessage()
+	}
+
+	if c.incoming == nil {
+		c.incoming = make(chan readResult)
+		go c.readMessages()
+	}
+
+	// Stop reading once as many ops are held as there are slots, so that
+	// their buffers stay bounded.
+	incoming := c.incoming
+	if len(c.held) >= cap(c.opSlots) && len(c.held) > 0 {
+		incoming = nil
+	}
+
+	// Held ops wait for a slot, unless the connection's OpContext ends first.
+	var slots chan struct{}
+	var done <-chan struct{}
+	if len(c.held) > 0 {
+		slots = c.opSlots
+		done = c.cfg.OpContext.Done()
+	}
+
+	var forgetsDue <-chan time.Time
+	if c.forgetsPending() {
+		t := time.NewTimer(forgetCoalesceWindow - time.Since(b.first))
+		defer t.Stop()
+		forgetsDue = t.C
+	}
+
+	select {
+	case r := <-incoming:
+		return r.m, r.err
+
+	case slots <- struct{}{}:
+		return nil, errSlotTaken
+
+	case <-forgetsDue:
+		return nil, errForgetsDue
+
+	case <-done:
+		c.rejectHeldOps()
+		return c.nextMessage()
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lockfs
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Create a file system whose sole contents are an empty file named "foo",
+// which implements byte range locks on the file itself rather than leaving
+// them to the kernel. Mount it with MountConfig.EnablePosixLocks (and
+// optionally EnableFlockLocks) set so that lock requests reach it.
+//
+// Locks are released when their owner flushes the file, which happens
+// whenever a process closes any of its descriptors for it, as POSIX requires.
+// Open handles are tracked separately and survive until released, so closing
+// one of two dup'd descriptors drops the process's locks but leaves the other
+// descriptor usable.
+func NewLockFS() (fuse.Server, error) {
+	fs := &lockFS{
+		handles: make(map[fuseops.HandleID]struct{}),
+		changed: make(chan struct{}),
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+const fooID = fuseops.RootInodeID + 1
+
+// A lock held by an owner.
+type heldLock struct {
+	owner uint64
+	fuseops.FileLock
+}
+
+type lockFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// The currently open handles, and the ID to use for the next one.
+	//
+	// GUARDED_BY(mu)
+	handles    map[fuseops.HandleID]struct{}
+	nextHandle fuseops.HandleID
+
+	// The locks currently held on foo. For each owner, the ranges don't
+	// overlap.
+	//
+	// GUARDED_BY(mu)
+	locks []heldLock
+
+	// Closed and replaced whenever a lock is released, waking up anyone waiting
+	// for one.
+	//
+	// GUARDED_BY(mu)
+	changed chan struct{}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func overlaps(a, b fuseops.FileLock) bool {
+	return a.Start <= b.End && b.Start <= a.End
+}
+
+// Return a lock held by someone other than owner that conflicts with l, if
+// any.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *lockFS) conflict(owner uint64, l fuseops.FileLock) (heldLock, bool) {
+	for _, h := range fs.locks {
+		if h.owner == owner || !overlaps(h.FileLock, l) {
+			continue
+		}
+
+		if h.Type == syscall.F_WRLCK || l.Type == syscall.F_WRLCK {
+			return h, true
+		}
+	}
+
+	return heldLock{}, false
+}
+
+// Remove the part of owner's locks that falls within the range of l, splitting
+// locks that straddle its ends, and wake up any waiters.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *lockFS) unlock(owner uint64, l fuseops.FileLock) {
+	var kept []heldLock
+	for _, h := range fs.locks {
+		if h.owner != owner || !overlaps(h.FileLock, l) {
+			kept = append(kept, h)
+			continue
+		}
+
+		if h.Start < l.Start {
+			before := h
+			before.End = l.Start - 1
+			kept = append(kept, before)
+		}
+
+		if h.End > l.End {
+			after := h
+			after.Start = l.End + 1
+			kept = append(kept, after)
+		}
+	}
+
+	fs.locks = kept
+	close(fs.changed)
+	fs.changed = make(chan struct{})
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *lockFS) checkHandle(h fuseops.HandleID) error {
+	if _, ok := fs.handles[h]; !ok {
+		return syscall.EBADF
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *lockFS) fooAttributes() fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0666,
+	}
+}
+
+func (fs *lockFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = fooID
+	op.Entry.Attributes = fs.fooAttributes()
+	return nil
+}
+
+func (fs *lockFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	switch op.Inode {
+	case fuseops.RootInodeID:
+		op.Attributes = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0777 | os.ModeDir,
+		}
+
+	case fooID:
+		op.Attributes = fs.fooAttributes()
+
+	default:
+		return fuse.ENOENT
+	}
+
+	return nil
+}
+
+func (fs *lockFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.nextHandle++
+	op.Handle = fs.nextHandle
+	fs.handles[op.Handle] = struct{}{}
+
+	return nil
+}
+
+func (fs *lockFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// The file is empty, but the handle must still be open.
+	return fs.checkHandle(op.Handle)
+}
+
+func (fs *lockFS) GetFileLock(
+	ctx context.Context,
+	op *fuseops.GetFileLockOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.checkHandle(op.Handle); err != nil {
+		return err
+	}
+
+	if h, ok := fs.conflict(op.Owner, op.Lock); ok {
+		op.Lock = h.FileLock
+	} else {
+		op.Lock.Type = syscall.F_UNLCK
+	}
+
+	return nil
+}
+
+func (fs *lockFS) SetFileLock(
+	ctx context.Context,
+	op *fuseops.SetFileLockOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.checkHandle(op.Handle); err != nil {
+		return err
+	}
+
+	if op.Lock.Type == syscall.F_UNLCK {
+		fs.unlock(op.Owner, op.Lock)
+		return nil
+	}
+
+	// Wait for conflicting locks to go away, if asked to.
+	for {
+		if _, ok := fs.conflict(op.Owner, op.Lock); !ok {
+			break
+		}
+
+		if !op.Wait {
+			return syscall.EAGAIN
+		}
+
+		changed := fs.changed
+		fs.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			fs.mu.Lock()
+			return syscall.EINTR
+		}
+		fs.mu.Lock()
+	}
+
+	// Replace whatever the owner held in the range.
+	fs.unlock(op.Owner, op.Lock)
+	fs.locks = append(fs.locks, heldLock{op.Owner, op.Lock})
+
+	return nil
+}
+
+// Closing any descriptor releases all of the process's record locks, whether
+// or not the handle itself is released.
+func (fs *lockFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.unlock(op.LockOwner, fuseops.FileLock{End: ^uint64(0)})
+	return nil
+}
+
+// The last close of an open file description also releases its flock(2)
+// locks, and its POSIX locks too if the kernel folded the flush into the
+// release.
+func (fs *lockFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.FlockUnlock || op.Flush {
+		fs.unlock(op.LockOwner, fuseops.FileLock{End: ^uint64(0)})
+	}
+
+	delete(fs.handles, op.Handle)
+	return nil
+}
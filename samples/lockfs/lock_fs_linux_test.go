@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lockfs_test
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/lockfs"
+)
+
+const (
+	fooID = 2
+
+	// Lock owners for two processes.
+	ownerA = 0xa
+	ownerB = 0xb
+)
+
+var wholeFile = fusekernel.FileLock{End: ^uint64(0), Type: syscall.F_WRLCK}
+
+func mount(t *testing.T) *fakekernel.Kernel {
+	server, err := lockfs.NewLockFS()
+	if err != nil {
+		t.Fatalf("NewLockFS: %v", err)
+	}
+
+	k, err := fakekernel.Mount(server, &fuse.MountConfig{EnablePosixLocks: true})
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	if fusekernel.InitFlags(k.Init.Flags)&fusekernel.InitPosixLocks == 0 {
+		t.Fatalf("POSIX locks not enabled: %v", fusekernel.InitFlags(k.Init.Flags))
+	}
+
+	return k
+}
+
+// Make a request that is expected to succeed, returning the reply.
+func do(
+	t *testing.T,
+	k *fakekernel.Kernel,
+	opcode uint32,
+	payload []byte) *fakekernel.Message {
+	m, err := k.Do(opcode, fooID, payload)
+	if err != nil {
+		t.Fatalf("Do(%d): %v", opcode, err)
+	}
+
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("Opcode %d: errno %v", opcode, errno)
+	}
+
+	return m
+}
+
+func open(t *testing.T, k *fakekernel.Kernel) uint64 {
+	m := do(t, k, fusekernel.OpOpen, fakekernel.Bytes(&fusekernel.OpenIn{
+		Flags: syscall.O_RDWR,
+	}))
+
+	var out fusekernel.OpenOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	return out.Fh
+}
+
+func lk(fh uint64, owner uint64, l fusekernel.FileLock) []byte {
+	return fakekernel.Bytes(&fusekernel.LkIn{Fh: fh, Owner: owner, Lk: l})
+}
+
+// Return the type of the lock that would block owner from taking a write lock
+// on the whole file, or F_UNLCK if there is none.
+func getlk(t *testing.T, k *fakekernel.Kernel, fh uint64, owner uint64) uint32 {
+	m := do(t, k, fusekernel.OpGetlk, lk(fh, owner, wholeFile))
+
+	var out fusekernel.LkOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	return out.Lk.Type
+}
+
+func flush(t *testing.T, k *fakekernel.Kernel, fh uint64, owner uint64) {
+	do(t, k, fusekernel.OpFlush, fakekernel.Bytes(&fusekernel.FlushIn{
+		Fh:        fh,
+		LockOwner: owner,
+	}))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestLockReleasedOnFlushOfDupedDescriptor(t *testing.T) {
+	k := mount(t)
+	defer k.Close()
+
+	// Process A opens the file, takes a lock, and dups the descriptor. Both
+	// descriptors share the one handle.
+	fh := open(t, k)
+	do(t, k, fusekernel.OpSetlk, lk(fh, ownerA, wholeFile))
+
+	// Process B (with its own handle) is locked out.
+	fhB := open(t, k)
+	if got := getlk(t, k, fhB, ownerB); got != syscall.F_WRLCK {
+		t.Errorf("GetLk before flush: got type %d, want F_WRLCK", got)
+	}
+
+	m, err := k.Do(fusekernel.OpSetlk, fooID, lk(fhB, ownerB, wholeFile))
+	if err != nil {
+		t.Fatalf("Do(OpSetlk): %v", err)
+	}
+
+	if got, want := m.Errno(), syscall.EAGAIN; got != want {
+		t.Errorf("SetLk while locked: got errno %v, want %v", got, want)
+	}
+
+	// Process A closes the dup'd descriptor, which flushes the handle but
+	// doesn't release it. The lock goes away.
+	flush(t, k, fh, ownerA)
+
+	if got := getlk(t, k, fhB, ownerB); got != syscall.F_UNLCK {
+		t.Errorf("GetLk after flush: got type %d, want F_UNLCK", got)
+	}
+
+	// But the handle survives, for the other descriptor.
+	do(t, k, fusekernel.OpRead, fakekernel.Bytes(&fusekernel.ReadIn{
+		Fh:   fh,
+		Size: 1,
+	}))
+
+	do(t, k, fusekernel.OpSetlk, lk(fhB, ownerB, wholeFile))
+}
+
+func TestWaitingLockAcquiredOnFlush(t *testing.T) {
+	k := mount(t)
+	defer k.Close()
+
+	fh := open(t, k)
+	do(t, k, fusekernel.OpSetlk, lk(fh, ownerA, wholeFile))
+
+	// Process B waits for the lock.
+	h := k.Header(fusekernel.OpSetlkw, fooID)
+	if err := k.Send(h, lk(fh, ownerB, wholeFile)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	// Process A closes its descriptor. We get the reply to the flush and to
+	// the waiting lock request, in either order.
+	flushHeader := k.Header(fusekernel.OpFlush, fooID)
+	err := k.Send(flushHeader, fakekernel.Bytes(&fusekernel.FlushIn{
+		Fh:        fh,
+		LockOwner: ownerA,
+	}))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		m, err := k.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Errorf("Reply to request %d: errno %v", m.Header.Unique, errno)
+		}
+	}
+
+	// Now A is locked out.
+	if got := getlk(t, k, fh, ownerA); got != syscall.F_WRLCK {
+		t.Errorf("GetLk: got type %d, want F_WRLCK", got)
+	}
+}
+
+func TestLockReleasedOnReleaseWithFlush(t *testing.T) {
+	k := mount(t)
+	defer k.Close()
+
+	fh := open(t, k)
+	do(t, k, fusekernel.OpSetlk, lk(fh, ownerA, wholeFile))
+
+	// A kernel that folds the final flush into the release drops A's POSIX
+	// locks with it.
+	do(t, k, fusekernel.OpRelease, fakekernel.Bytes(&fusekernel.ReleaseIn{
+		Fh:           fh,
+		ReleaseFlags: uint32(fusekernel.ReleaseFlush),
+		LockOwner:    ownerA,
+	}))
+
+	fhB := open(t, k)
+	if got := getlk(t, k, fhB, ownerB); got != syscall.F_UNLCK {
+		t.Errorf("GetLk after release: got type %d, want F_UNLCK", got)
+	}
+}
@@ -389,14 +389,27 @@ func (in *inode) SetAttributes(
 }
 
 func (in *inode) Fallocate(mode uint32, offset uint64, length uint64) error {
-	if mode != 0 {
-		return fuse.ENOSYS
+	keepSize := mode&fuseops.FallocKeepSize != 0
+	switch mode &^ fuseops.FallocKeepSize {
+	case 0, fuseops.FallocPunchHole, fuseops.FallocZeroRange:
+	default:
+		return fuse.EOPNOTSUPP
 	}
+
 	newSize := int(offset + length)
-	if newSize > len(in.contents) {
+	if !keepSize && newSize > len(in.contents) {
 		padding := make([]byte, newSize-len(in.contents))
 		in.contents = append(in.contents, padding...)
 		in.attrs.Size = offset + length
 	}
+
+	// We don't keep track of allocation, so punching a hole is the same as
+	// zeroing the range.
+	if mode&(fuseops.FallocPunchHole|fuseops.FallocZeroRange) != 0 {
+		for i := int(offset); i < newSize && i < len(in.contents); i++ {
+			in.contents[i] = 0
+		}
+	}
+
 	return nil
 }
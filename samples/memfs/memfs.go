@@ -27,7 +27,6 @@ import (
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/syncutil"
-	"golang.org/x/sys/unix"
 )
 
 const (
@@ -337,15 +336,38 @@ func (fs *memFS) MkNode(
 	defer fs.mu.Unlock()
 
 	var err error
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, op.Rdev)
 	return err
 }
 
+// Return the directory entry type for a file with the given mode.
+func direntType(mode os.FileMode) fuseutil.DirentType {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return fuseutil.DT_Link
+
+	case mode&os.ModeNamedPipe != 0:
+		return fuseutil.DT_FIFO
+
+	case mode&os.ModeSocket != 0:
+		return fuseutil.DT_Socket
+
+	case mode&os.ModeCharDevice != 0:
+		return fuseutil.DT_Char
+
+	case mode&os.ModeDevice != 0:
+		return fuseutil.DT_Block
+	}
+
+	return fuseutil.DT_File
+}
+
 // LOCKS_REQUIRED(fs.mu)
 func (fs *memFS) createFile(
 	parentID fuseops.InodeID,
 	name string,
-	mode os.FileMode) (fuseops.ChildInodeEntry, error) {
+	mode os.FileMode,
+	rdev uint32) (fuseops.ChildInodeEntry, error) {
 	// Grab the parent, which we will update shortly.
 	parent := fs.getInodeOrDie(parentID)
 
@@ -361,6 +383,7 @@ func (fs *memFS) createFile(
 	childAttrs := fuseops.InodeAttributes{
 		Nlink:  1,
 		Mode:   mode,
+		Rdev:   rdev,
 		Atime:  now,
 		Mtime:  now,
 		Ctime:  now,
@@ -373,7 +396,7 @@ func (fs *memFS) createFile(
 	childID, child := fs.allocateInode(childAttrs, name)
 
 	// Add an entry in the parent.
-	parent.AddChild(childID, name, fuseutil.DT_File)
+	parent.AddChild(childID, name, direntType(mode))
 
 	// Fill in the response entry.
 	var entry fuseops.ChildInodeEntry
@@ -394,7 +417,7 @@ func (fs *memFS) CreateFile(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, 0)
 	return err
 }
 
@@ -472,8 +495,9 @@ func (fs *memFS) CreateLink(
 	target.attrs.Nlink++
 	target.attrs.Ctime = now
 
-	// Add an entry in the parent.
-	parent.AddChild(op.Target, op.Name, fuseutil.DT_File)
+	// Add an entry in the parent, of the same type as the target's existing
+	// ones: links may be made to symlinks and special files too.
+	parent.AddChild(op.Target, op.Name, direntType(target.attrs.Mode))
 
 	// Return the response.
 	op.Entry.Child = op.Target
@@ -785,11 +809,11 @@ func (fs *memFS) setXattrHelper(inode *inode, op *fuseops.SetXattrOp) error {
 	_, ok := inode.xattrs[op.Name]
 
 	switch op.Flags {
-	case unix.XATTR_CREATE:
+	case fuseops.SetXattrCreate:
 		if ok {
 			return fuse.EEXIST
 		}
-	case unix.XATTR_REPLACE:
+	case fuseops.SetXattrReplace:
 		if !ok {
 			return fuse.ENOATTR
 		}
@@ -806,6 +830,5 @@ func (fs *memFS) Fallocate(ctx context.Context,
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	inode := fs.getInodeOrDie(op.Inode)
-	inode.Fallocate(op.Mode, op.Offset, op.Length)
-	return nil
+	return inode.Fallocate(op.Mode, op.Offset, op.Length)
 }
@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/sys/unix"
+)
+
+func (t *MknodTest) Fallocate_PunchHole() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Punch a hole that extends past the end of the file.
+	err = unix.Fallocate(
+		int(f.Fd()),
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		4,
+		10)
+	AssertEq(nil, err)
+
+	// The size is unchanged, and the hole reads as zeroes.
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("burr\x00\x00\x00", string(contents))
+}
+
+func (t *MknodTest) Fallocate_ZeroRange() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Zero a range that extends past the end of the file, which grows it.
+	err = unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_ZERO_RANGE, 1, 8)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("b\x00\x00\x00\x00\x00\x00\x00\x00", string(contents))
+}
+
+func (t *MknodTest) Fallocate_UnsupportedMode() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Unsupported modes fail with EOPNOTSUPP, without disabling fallocate for
+	// good.
+	err = unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_INSERT_RANGE, 0, 4096)
+	ExpectEq(unix.EOPNOTSUPP, err)
+
+	err = unix.Fallocate(int(f.Fd()), 0, 0, 10)
+	ExpectEq(nil, err)
+}
+
+func (t *MknodTest) FIFO() {
+	var err error
+	p := path.Join(t.Dir, "foo")
+
+	err = syscall.Mknod(p, syscall.S_IFIFO|0600, 0)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeNamedPipe|0600, fi.Mode())
+
+	// The directory listing agrees.
+	entries, err := ioutil.ReadDir(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq(os.ModeNamedPipe|0600, entries[0].Mode())
+}
+
+func (t *MknodTest) Socket() {
+	var err error
+	p := path.Join(t.Dir, "foo")
+
+	err = syscall.Mknod(p, syscall.S_IFSOCK|0700, 0)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeSocket|0700, fi.Mode())
+}
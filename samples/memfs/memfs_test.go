@@ -1835,74 +1835,6 @@ func (t *MemFSTest) NoXattrs() {
 	ExpectEq(0, sz)
 }
 
-func (t *MemFSTest) SetXAttr() {
-	var err error
-	var sz int
-	var buf [1024]byte
-
-	// Create a file.
-	filePath := path.Join(t.Dir, "foo")
-	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
-	AssertEq(nil, err)
-
-	err = unix.Setxattr(filePath, "foo", []byte("bar"), unix.XATTR_REPLACE)
-	AssertEq(fuse.ENOATTR, err)
-
-	err = unix.Setxattr(filePath, "foo", []byte("bar"), unix.XATTR_CREATE)
-	AssertEq(nil, err)
-
-	// List xattr with a buf that is too small.
-	_, err = unix.Listxattr(filePath, buf[:1])
-	ExpectEq(unix.ERANGE, err)
-
-	// List xattr to ask for name size.
-	sz, err = unix.Listxattr(filePath, nil)
-	AssertEq(nil, err)
-	AssertEq(4, sz)
-
-	// List xattr names.
-	sz, err = unix.Listxattr(filePath, buf[:sz])
-	AssertEq(nil, err)
-	AssertEq(4, sz)
-	AssertEq("foo\000", string(buf[:sz]))
-
-	// Read xattr with a buf that is too small.
-	_, err = unix.Getxattr(filePath, "foo", buf[:1])
-	ExpectEq(unix.ERANGE, err)
-
-	// Read xattr to ask for value size.
-	sz, err = unix.Getxattr(filePath, "foo", nil)
-	AssertEq(nil, err)
-	AssertEq(3, sz)
-
-	// Read xattr value.
-	sz, err = unix.Getxattr(filePath, "foo", buf[:sz])
-	AssertEq(nil, err)
-	AssertEq(3, sz)
-	AssertEq("bar", string(buf[:sz]))
-}
-
-func (t *MemFSTest) RemoveXAttr() {
-	var err error
-
-	// Create a file
-	filePath := path.Join(t.Dir, "foo")
-	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
-	AssertEq(nil, err)
-
-	err = unix.Removexattr(filePath, "foo")
-	AssertEq(fuse.ENOATTR, err)
-
-	err = unix.Setxattr(filePath, "foo", []byte("bar"), unix.XATTR_CREATE)
-	AssertEq(nil, err)
-
-	err = unix.Removexattr(filePath, "foo")
-	AssertEq(nil, err)
-
-	_, err = unix.Getxattr(filePath, "foo", nil)
-	AssertEq(fuse.ENOATTR, err)
-}
-
 ////////////////////////////////////////////////////////////////////////
 // Mknod
 ////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,98 @@
+//go:build !freebsd
+// +build !freebsd
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"io/ioutil"
+	"path"
+
+	"github.com/jacobsa/fuse"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/sys/unix"
+)
+
+// These tests use XATTR_CREATE and XATTR_REPLACE, which FreeBSD's extended
+// attributes have no equivalent of.
+
+func (t *MemFSTest) SetXAttr() {
+	var err error
+	var sz int
+	var buf [1024]byte
+
+	// Create a file.
+	filePath := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = unix.Setxattr(filePath, "foo", []byte("bar"), unix.XATTR_REPLACE)
+	AssertEq(fuse.ENOATTR, err)
+
+	err = unix.Setxattr(filePath, "foo", []byte("bar"), unix.XATTR_CREATE)
+	AssertEq(nil, err)
+
+	// List xattr with a buf that is too small.
+	_, err = unix.Listxattr(filePath, buf[:1])
+	ExpectEq(unix.ERANGE, err)
+
+	// List xattr to ask for name size.
+	sz, err = unix.Listxattr(filePath, nil)
+	AssertEq(nil, err)
+	AssertEq(4, sz)
+
+	// List xattr names.
+	sz, err = unix.Listxattr(filePath, buf[:sz])
+	AssertEq(nil, err)
+	AssertEq(4, sz)
+	AssertEq("foo\000", string(buf[:sz]))
+
+	// Read xattr with a buf that is too small.
+	_, err = unix.Getxattr(filePath, "foo", buf[:1])
+	ExpectEq(unix.ERANGE, err)
+
+	// Read xattr to ask for value size.
+	sz, err = unix.Getxattr(filePath, "foo", nil)
+	AssertEq(nil, err)
+	AssertEq(3, sz)
+
+	// Read xattr value.
+	sz, err = unix.Getxattr(filePath, "foo", buf[:sz])
+	AssertEq(nil, err)
+	AssertEq(3, sz)
+	AssertEq("bar", string(buf[:sz]))
+}
+
+func (t *MemFSTest) RemoveXAttr() {
+	var err error
+
+	// Create a file
+	filePath := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = unix.Removexattr(filePath, "foo")
+	AssertEq(fuse.ENOATTR, err)
+
+	err = unix.Setxattr(filePath, "foo", []byte("bar"), unix.XATTR_CREATE)
+	AssertEq(nil, err)
+
+	err = unix.Removexattr(filePath, "foo")
+	AssertEq(nil, err)
+
+	_, err = unix.Getxattr(filePath, "foo", nil)
+	AssertEq(fuse.ENOATTR, err)
+}
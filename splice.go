@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"io"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// Replies to reads that set fuseops.ReadFileOp.SpliceFile are written by
+// writeSpliced rather than from the message built by kernelResponse, which has
+// just the header. With MountConfig.EnableSplice on Linux, the data goes from
+// the file to the device through a pipe with splice(2) (see splice_linux.go);
+// otherwise, or if that isn't possible, it is read from the file and written
+// as usual.
+
+// Returned by spliceReply when the reply can be sent by copying instead.
+var errCantSplice = errors.New("can't splice")
+
+// A pipe through which to splice replies, with the capacity it was given.
+type splicePipe struct {
+	r, w int
+	size int
+}
+
+func (p *splicePipe) close() {
+	syscall.Close(p.r)
+	syscall.Close(p.w)
+}
+
+// Write the reply to a successful read whose data comes from op.SpliceFile,
+// the header for which is in m.
+func (c *Connection) writeSpliced(m *buffer.OutMessage, op *fuseops.ReadFileOp) error {
+	if c.splice {
+		err := c.spliceReply(m, op)
+		if err != errCantSplice {
+			return err
+		}
+	}
+
+	buf := make([]byte, op.BytesRead)
+	n, err := op.SpliceFile.ReadAt(buf, op.SpliceOffset)
+	if err != nil && err != io.EOF {
+		if c.errorLogger != nil {
+			c.errorLogger.Printf("ReadFileOp: reading SpliceFile: %v", err)
+		}
+
+		h := m.OutHeader()
+		h.Error = -int32(syscall.EIO)
+		h.Len = uint32(buffer.OutMessageHeaderSize)
+		return c.writeMessage(m.OutHeaderBytes())
+	}
+
+	op.BytesRead = n
+	m.OutHeader().Len = uint32(buffer.OutMessageHeaderSize + n)
+	_, err = writev(int(c.dev.Fd()), [][]byte{m.OutHeaderBytes(), buf[:n]})
+	return err
+}
+
+// Take one of the pipes kept by the connection, or nil if there are none.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) getSplicePipe() *splicePipe {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.splicePipes)
+	if n == 0 {
+		return nil
+	}
+
+	p := c.splicePipes[n-1]
+	c.splicePipes = c.splicePipes[:n-1]
+	return p
+}
+
+// Keep an empty pipe for later replies.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) putSplicePipe(p *splicePipe) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.splicePipes = append(c.splicePipes, p)
+}
+
+// Close the pipes kept by the connection.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) closeSplicePipes() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.splicePipes {
+		p.close()
+	}
+
+	c.splicePipes = nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"golang.org/x/sys/unix"
+)
+
+// Report whether replies can be spliced to dev, which they can't unless it
+// is the FUSE device, e.g. for a socket standing in for it.
+func canSplice(dev *os.File) bool {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(dev.Fd()), &st); err != nil {
+		return false
+	}
+
+	return st.Mode&unix.S_IFMT == unix.S_IFCHR
+}
+
+// Splice the reply to a read whose data comes from op.SpliceFile to the
+// device, returning errCantSplice if it must be copied instead.
+func (c *Connection) spliceReply(m *buffer.OutMessage, op *fuseops.ReadFileOp) error {
+	return c.spliceReplyTo(int(c.dev.Fd()), m, op)
+}
+
+func (c *Connection) spliceReplyTo(
+	dev int,
+	m *buffer.OutMessage,
+	op *fuseops.ReadFileOp) error {
+	total := buffer.OutMessageHeaderSize + op.BytesRead
+	m.OutHeader().Len = uint32(total)
+
+	p, err := c.splicePipeFor(total)
+	if err != nil {
+		return errCantSplice
+	}
+
+	// The header and the data go into the pipe first, and from there to the
+	// device in one go, since the kernel takes a message per write.
+	if _, err := unix.Write(p.w, m.OutHeaderBytes()); err != nil {
+		p.close()
+		return errCantSplice
+	}
+
+	// If the file has less data than promised in the header, start again by
+	// copying.
+	n, err := spliceFromFile(p.w, op.SpliceFile, op.SpliceOffset, op.BytesRead)
+	if err != nil || n < op.BytesRead {
+		p.close()
+		return errCantSplice
+	}
+
+	written, err := unix.Splice(p.r, nil, dev, nil, total, unix.SPLICE_F_MOVE)
+	if err == nil && int(written) != total {
+		err = fmt.Errorf("Spliced %d bytes; expected %d", written, total)
+	}
+
+	if err != nil {
+		p.close()
+		return err
+	}
+
+	c.putSplicePipe(p)
+	return nil
+}
+
+// Return an empty pipe that can hold a reply of the supplied size, with room
+// for the data not to start or end on a page boundary.
+func (c *Connection) splicePipeFor(size int) (*splicePipe, error) {
+	p := c.getSplicePipe()
+	if p == nil {
+		// Both ends are non-blocking, so that a pipe that turns out to be too
+		// small fails rather than blocking forever.
+		var fds [2]int
+		if err := unix.Pipe2(fds[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+			return nil, err
+		}
+
+		p = &splicePipe{r: fds[0], w: fds[1]}
+	}
+
+	need := size + 3*os.Getpagesize()
+	if p.size < need {
+		// This fails beyond /proc/sys/fs/pipe-max-size for unprivileged users.
+		n, err := unix.FcntlInt(uintptr(p.w), unix.F_SETPIPE_SZ, need)
+		if err != nil {
+			c.putSplicePipe(p)
+			return nil, err
+		}
+
+		p.size = n
+	}
+
+	return p, nil
+}
+
+// Splice up to n bytes at off in f to the pipe whose write end is w,
+// returning the number spliced, which is less than n only at the end of the
+// file.
+func spliceFromFile(w int, f *os.File, off int64, n int) (int, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var done int
+	var spliceErr error
+	err = rc.Control(func(fd uintptr) {
+		for done < n {
+			k, err := unix.Splice(int(fd), &off, w, nil, n-done, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			if err == unix.EINTR {
+				continue
+			}
+
+			if err != nil {
+				spliceErr = err
+				return
+			}
+
+			if k == 0 {
+				return
+			}
+
+			done += int(k)
+		}
+	})
+
+	if err != nil {
+		return done, err
+	}
+
+	return done, spliceErr
+}
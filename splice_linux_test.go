@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+func TestSpliceReply(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<12)
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	// A pipe stands in for the device.
+	dev, devW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer dev.Close()
+	defer devW.Close()
+
+	// Unlike the device, a pipe takes only as much as it has room for.
+	if _, err := unix.FcntlInt(devW.Fd(), unix.F_SETPIPE_SZ, 4*len(data)); err != nil {
+		t.Fatalf("F_SETPIPE_SZ: %v", err)
+	}
+
+	c := &Connection{}
+	defer c.closeSplicePipes()
+
+	buf := make([]byte, 2*len(data))
+	reply := func(offset int64, n int) error {
+		var m buffer.OutMessage
+		m.Reset()
+		m.OutHeader().Unique = 17
+
+		return c.spliceReplyTo(int(devW.Fd()), &m, &fuseops.ReadFileOp{
+			SpliceFile:   f,
+			SpliceOffset: offset,
+			BytesRead:    n,
+		})
+	}
+
+	// Unaligned reads of various sizes reuse the same pipe.
+	for _, tc := range []struct{ offset, n int }{{0, 100}, {4095, 8192}, {1, 1 << 15}, {0, len(data)}} {
+		if err := reply(int64(tc.offset), tc.n); err != nil {
+			t.Fatalf("spliceReplyTo(%d, %d): %v", tc.offset, tc.n, err)
+		}
+
+		n, err := dev.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		const headerSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+		if n != headerSize+tc.n || int(h.Len) != n || h.Unique != 17 {
+			t.Fatalf("Got %d bytes with header %+v, want %d", n, *h, headerSize+tc.n)
+		}
+
+		if !bytes.Equal(buf[headerSize:n], data[tc.offset:tc.offset+tc.n]) {
+			t.Errorf("Wrong data for %d bytes at %d", tc.n, tc.offset)
+		}
+
+		if len(c.splicePipes) != 1 {
+			t.Errorf("Have %d pipes", len(c.splicePipes))
+		}
+	}
+
+	// A read beyond the end of the file must be copied instead, so that the
+	// header can be right.
+	if err := reply(int64(len(data)-10), 20); err != errCantSplice {
+		t.Errorf("Short read: got %v, want errCantSplice", err)
+	}
+
+	// Nothing reached the device.
+	fd := int(dev.Fd())
+	syscall.SetNonblock(fd, true)
+	if n, err := syscall.Read(fd, buf); err != syscall.EAGAIN {
+		t.Errorf("Read after short read: got %d bytes, error %v", n, err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ConnectionStats is a snapshot of the counters kept by a connection, as
+// returned by Connection.Stats.
+type ConnectionStats struct {
+	// The number of ops that have been replied to, whether by the file system
+	// or by the connection itself (e.g. while draining).
+	Ops uint64
+
+	// Ops broken down by type, keyed by the name of the op type without the
+	// package, e.g. "ReadFileOp". Ops that the package doesn't know are counted
+	// under "UnknownOp".
+	OpsByType map[string]uint64
+
+	// The number of bytes returned by successful reads and accepted by
+	// successful writes.
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// The number of ops that have been handed out by ReadOp but not yet replied
+	// to.
+	InFlight int64
+
+	// The number of those that the kernel sent in the background, as returned
+	// by Connection.BackgroundOps.
+	BackgroundOps int64
+}
+
+// The counters behind ConnectionStats, which are updated with atomic
+// operations only so as not to slow down op processing.
+type connStats struct {
+	ops          atomic.Uint64
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	inFlight     atomic.Int64
+	background   atomic.Int64
+
+	// A map from op type to *atomic.Uint64, which after the first op of each
+	// type is only ever read from.
+	byType sync.Map
+}
+
+// Stats returns the current values of the connection's counters. They are
+// read one at a time while ops are being processed, so they may be slightly
+// out of step with each other.
+func (c *Connection) Stats() ConnectionStats {
+	s := ConnectionStats{
+		Ops:           c.stats.ops.Load(),
+		OpsByType:     make(map[string]uint64),
+		BytesRead:     c.stats.bytesRead.Load(),
+		BytesWritten:  c.stats.bytesWritten.Load(),
+		InFlight:      c.stats.inFlight.Load(),
+		BackgroundOps: c.stats.background.Load(),
+	}
+
+	c.stats.byType.Range(func(k, v interface{}) bool {
+		s.OpsByType[opTypeName(k.(reflect.Type))] = v.(*atomic.Uint64).Load()
+		return true
+	})
+
+	return s
+}
+
+// BackgroundOps returns the number of ops in flight that the kernel sent in
+// the background, i.e. with no process waiting for them: writes of data from
+// the page cache (cf. WriteFileOp.Writeback), reads with
+// MountConfig.EnableAsyncReads, which is how the kernel reads ahead and fills
+// the page cache, and the release of file handles. The kernel allows at most
+// 12 of these (max_background) before it holds further ones back, so a count
+// that stays at that limit means that the file system is the bottleneck.
+//
+// Reads from files opened with OpenFileOp.UseDirectIO aren't sent in the
+// background even with async reads, but can't be told apart here and are
+// counted anyway.
+func (c *Connection) BackgroundOps() int {
+	return int(c.stats.background.Load())
+}
+
+// Count an op handed out by ReadOp.
+func (c *Connection) countOpStarted(op interface{}) {
+	c.stats.inFlight.Add(1)
+	if c.isBackground(op) {
+		c.stats.background.Add(1)
+	}
+}
+
+// Count an op being replied to, successfully or not.
+func (c *Connection) countOpFinished(op interface{}, succeeded bool) {
+	c.stats.inFlight.Add(-1)
+	if c.isBackground(op) {
+		c.stats.background.Add(-1)
+	}
+
+	// The INIT handshake is part of mounting, not an op that users see.
+	if _, ok := op.(*initOp); ok {
+		return
+	}
+
+	c.stats.ops.Add(1)
+
+	t := reflect.TypeOf(op)
+	n, ok := c.stats.byType.Load(t)
+	if !ok {
+		n, _ = c.stats.byType.LoadOrStore(t, new(atomic.Uint64))
+	}
+
+	n.(*atomic.Uint64).Add(1)
+
+	if !succeeded {
+		return
+	}
+
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		c.stats.bytesRead.Add(uint64(o.BytesRead))
+	case *fuseops.WriteFileOp:
+		c.stats.bytesWritten.Add(uint64(o.BytesWritten))
+	}
+}
+
+// Return the name of the supplied op type, e.g. "ReadFileOp" for
+// *fuseops.ReadFileOp, under which Stats counts its ops and Dispatch labels
+// them.
+func opTypeName(t reflect.Type) string {
+	if t == reflect.TypeOf(&unknownOp{}) {
+		return "UnknownOp"
+	}
+
+	return t.Elem().Name()
+}
+
+// Report whether op is one that the kernel sends in the background, for
+// BackgroundOps.
+func (c *Connection) isBackground(op interface{}) bool {
+	switch o := op.(type) {
+	case *fuseops.WriteFileOp:
+		return o.Writeback
+
+	case *fuseops.ReadFileOp:
+		return c.capabilities&CapAsyncRead != 0
+
+	case *fuseops.ReleaseFileHandleOp, *fuseops.ReleaseDirHandleOp:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// When symlink targets are cached by the kernel (cf.
+// MountConfig.EnableSymlinkCaching), it cuts a cached target off at the size
+// last reported for the symlink, silently producing a broken link if the file
+// system reported too small a size. To catch that, we remember the sizes that
+// we've reported for symlinks and check ReadSymlinkOp replies against them.
+
+// Report whether the kernel caches symlink targets.
+func (c *Connection) symlinkCaching() bool {
+	return c.capabilities&CapCacheSymlinks != 0
+}
+
+// Remember the size reported in the supplied attributes, if they belong to a
+// symlink whose target the kernel may cache.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) recordSymlinkSize(
+	inode fuseops.InodeID,
+	attr *fuseops.InodeAttributes) {
+	if attr.Mode&os.ModeSymlink == 0 || !c.symlinkCaching() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.symlinkSizes == nil {
+		c.symlinkSizes = make(map[fuseops.InodeID]uint64)
+	}
+
+	c.symlinkSizes[inode] = attr.Size
+}
+
+// Log an error if the target in a ReadSymlinkOp reply is longer than the size
+// last reported for the symlink, since the kernel would truncate it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) checkSymlinkTarget(op *fuseops.ReadSymlinkOp) {
+	if !c.symlinkCaching() || c.errorLogger == nil {
+		return
+	}
+
+	c.mu.Lock()
+	size, ok := c.symlinkSizes[op.Inode]
+	c.mu.Unlock()
+
+	if ok && uint64(len(op.Target)) > size {
+		c.errorLogger.Printf(
+			"ReadSymlinkOp: target of inode %v has length %d, but its size was "+
+				"reported as %d; the kernel will cache it truncated",
+			op.Inode,
+			len(op.Target),
+			size)
+	}
+}
+
+// Forget the sizes of symlinks that the kernel has forgotten. It sends forget
+// ops only once it has dropped an inode altogether, so there is no need to
+// count lookups here.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) forgetSymlinkSizes(op interface{}) {
+	var inodes []fuseops.InodeID
+	switch o := op.(type) {
+	case *fuseops.ForgetInodeOp:
+		inodes = append(inodes, o.Inode)
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range o.Entries {
+			inodes = append(inodes, e.Inode)
+		}
+
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, inode := range inodes {
+		delete(c.symlinkSizes, inode)
+	}
+}
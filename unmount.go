@@ -17,5 +17,27 @@ package fuse
 // Unmount attempts to unmount the file system whose mount point is the
 // supplied directory.
 func Unmount(dir string) error {
-	return unmount(dir)
+	return unmount(dir, UnmountOptions{})
+}
+
+// Options for UnmountWith.
+type UnmountOptions struct {
+	// Detach the file system from the directory straight away, even if it is
+	// busy, like umount -l; it is unmounted for good once it is no longer in
+	// use. Linux only: elsewhere UnmountWith fails if this is set.
+	Lazy bool
+
+	// Unmount even if the server is stuck, like umount -f: the connection is
+	// aborted, so that ops waiting for replies fail with ENOTCONN, and the
+	// server sees it end as it would on a normal unmount. On Linux, when
+	// unprivileged, this is done by aborting the connection through
+	// /sys/fs/fuse/connections before unmounting with fusermount(1), which
+	// can't force an unmount itself; combine it with Lazy if the file system
+	// may still be in use.
+	Force bool
+}
+
+// UnmountWith is like Unmount, but with the supplied options.
+func UnmountWith(dir string, opts UnmountOptions) error {
+	return unmount(dir, opts)
 }
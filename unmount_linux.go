@@ -3,15 +3,47 @@ package fuse
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"os/exec"
+
+	"golang.org/x/sys/unix"
 )
 
-func unmount(dir string) error {
+func unmount(dir string, opts UnmountOptions) error {
+	var flags int
+	if opts.Lazy {
+		flags |= unix.MNT_DETACH
+	}
+
+	if opts.Force {
+		flags |= unix.MNT_FORCE
+	}
+
+	// As with mounting, try without fusermount(1) first, in case we're
+	// privileged.
+	if err := unix.Unmount(dir, flags); err != unix.EPERM {
+		return err
+	}
+
+	// fusermount(1) has no way to force an unmount, but the owner of the mount
+	// may abort the connection, which is what forcing it does for fuse.
+	if opts.Force {
+		if err := abortConnection(dir); err != nil {
+			return fmt.Errorf("aborting connection: %w", err)
+		}
+	}
+
 	fusermount, err := findFusermount()
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command(fusermount, "-u", dir)
+
+	args := []string{"-u"}
+	if opts.Lazy {
+		args = append(args, "-z")
+	}
+
+	cmd := exec.Command(fusermount, append(args, dir)...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		if len(output) > 0 {
@@ -23,3 +55,15 @@ func unmount(dir string) error {
 	}
 	return nil
 }
+
+// Abort the connection of the fuse file system mounted on dir, through its
+// directory in the fusectl file system.
+func abortConnection(dir string) error {
+	id, err := connectionID(dir)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("/sys/fs/fuse/connections/%d/abort", id)
+	return os.WriteFile(path, []byte("1"), 0)
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import "sync"
+
+// Go arranges for handle, which handles op as returned by ReadOp, to be called
+// without waiting for it. By default that's on a goroutine of its own. When
+// MountConfig.WorkerPoolSize is set, it is instead queued for the connection's
+// pool of workers, except that forget ops still get a goroutine of their own so
+// that they are never held up behind other ops.
+//
+// Go doesn't block even when all of the workers are busy, so the goroutine
+// calling ReadOp keeps reading, and interrupts for the ops being handled are
+// delivered promptly. Servers created by package fuseutil call Go for every op
+// other than ForgetInodeOp, which they handle themselves.
+func (c *Connection) Go(op interface{}, handle func()) {
+	if c.workers == nil || isForget(op) {
+		go handle()
+		return
+	}
+
+	c.workers.push(handle)
+}
+
+// A fixed number of goroutines calling queued functions in the order in which
+// they were queued.
+type workerPool struct {
+	mu sync.Mutex
+
+	// Signalled when queue becomes non-empty or closed becomes true.
+	cond sync.Cond
+
+	// GUARDED_BY(mu)
+	queue  []func()
+	closed bool
+}
+
+// Start n workers, which run until close is called and the queue is empty.
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{}
+	p.cond.L = &p.mu
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *workerPool) push(f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queue = append(p.queue, f)
+	p.cond.Signal()
+}
+
+// Stop the workers once they have emptied the queue.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *workerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *workerPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+
+		f := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		f()
+	}
+}
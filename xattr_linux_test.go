@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fakekernel"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// xattrFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose inodes all have a single extended attribute, user.foo,
+// which it copies out without checking whether it fits.
+// It remembers the flags of the last SetXattrOp.
+type xattrFS struct {
+	fuseutil.NotImplementedFileSystem
+	value string
+
+	mu       sync.Mutex
+	setFlags uint32 // GUARDED_BY(mu)
+}
+
+func (fs *xattrFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.setFlags = op.Flags
+	return nil
+}
+
+func (fs *xattrFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	const names = "user.foo\x00"
+	copy(op.Dst, names)
+	op.BytesRead = len(names)
+	return nil
+}
+
+func (fs *xattrFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	copy(op.Dst, fs.value)
+	op.BytesRead = len(fs.value)
+	return nil
+}
+
+func getxattr(t *testing.T, k *fakekernel.Kernel, size uint32) *fakekernel.Message {
+	t.Helper()
+
+	var in fusekernel.GetxattrIn
+	in.Size = size
+	m, err := k.Do(fusekernel.OpGetxattr, 1, fakekernel.Bytes(&in), fakekernel.String("user.foo"))
+	if err != nil {
+		t.Fatalf("Do(OpGetxattr): %v", err)
+	}
+
+	return m
+}
+
+func listxattr(t *testing.T, k *fakekernel.Kernel, size uint32) *fakekernel.Message {
+	t.Helper()
+
+	in := fusekernel.ListxattrIn{Size: size}
+	m, err := k.Do(fusekernel.OpListxattr, 1, fakekernel.Bytes(&in))
+	if err != nil {
+		t.Fatalf("Do(OpListxattr): %v", err)
+	}
+
+	return m
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestGetXattrSizes(t *testing.T) {
+	const value = "taco"
+	k := mountFS(t, &xattrFS{value: value}, nil)
+	defer k.Close()
+
+	// A size probe gets only the size.
+	m := getxattr(t, k, 0)
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("Probe: errno %v", errno)
+	}
+
+	var out fusekernel.GetxattrOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if out.Size != uint32(len(value)) || len(m.Data) != int(unsafe.Sizeof(out)) {
+		t.Errorf("Probe: got size %v in %d bytes", out.Size, len(m.Data))
+	}
+
+	// A buffer that is too small gets ERANGE, not a truncated value.
+	m = getxattr(t, k, uint32(len(value)-1))
+	if errno := m.Errno(); errno != syscall.ERANGE {
+		t.Errorf("Too small: got errno %v, data %q", errno, m.Data)
+	}
+
+	// One that is just big enough gets the value.
+	m = getxattr(t, k, uint32(len(value)))
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("Exact: errno %v", errno)
+	}
+
+	if string(m.Data) != value {
+		t.Errorf("Exact: got %q, want %q", m.Data, value)
+	}
+}
+
+func TestListXattrSizes(t *testing.T) {
+	const names = "user.foo\x00"
+	k := mountFS(t, &xattrFS{}, nil)
+	defer k.Close()
+
+	// A size probe gets only the length of the list.
+	m := listxattr(t, k, 0)
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("Probe: errno %v", errno)
+	}
+
+	var out fusekernel.GetxattrOut
+	if err := fakekernel.Decode(m.Data, &out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if out.Size != uint32(len(names)) || len(m.Data) != int(unsafe.Sizeof(out)) {
+		t.Errorf("Probe: got size %v in %d bytes", out.Size, len(m.Data))
+	}
+
+	// A buffer that is too small gets ERANGE, not a truncated list.
+	m = listxattr(t, k, uint32(len(names)-1))
+	if errno := m.Errno(); errno != syscall.ERANGE {
+		t.Errorf("Too small: got errno %v, data %q", errno, m.Data)
+	}
+
+	// One that is just big enough gets the list.
+	m = listxattr(t, k, uint32(len(names)))
+	if errno := m.Errno(); errno != 0 {
+		t.Fatalf("Exact: errno %v", errno)
+	}
+
+	if string(m.Data) != names {
+		t.Errorf("Exact: got %q, want %q", m.Data, names)
+	}
+}
+
+func TestSetXattrFlags(t *testing.T) {
+	fs := &xattrFS{}
+	k := mountFS(t, fs, nil)
+	defer k.Close()
+
+	for _, flags := range []uint32{0, fuseops.SetXattrCreate, fuseops.SetXattrReplace} {
+		var in fusekernel.SetxattrIn
+		in.Size = 4
+		in.Flags = flags
+		m, err := k.Do(
+			fusekernel.OpSetxattr,
+			1,
+			fakekernel.Bytes(&in),
+			fakekernel.String("user.foo"),
+			[]byte("taco"))
+		if err != nil {
+			t.Fatalf("Do(OpSetxattr): %v", err)
+		}
+
+		if errno := m.Errno(); errno != 0 {
+			t.Fatalf("SetXattr: errno %v", errno)
+		}
+
+		fs.mu.Lock()
+		got := fs.setFlags
+		fs.mu.Unlock()
+
+		if got != flags {
+			t.Errorf("Sent flags %#x, file system got %#x", flags, got)
+		}
+	}
+}